@@ -2,52 +2,149 @@ package application
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"sync"
 	"time"
 
+	"github.com/redis/go-redis/extra/redisotel/v9"
 	"github.com/redis/go-redis/v9"
+	"github.com/umuttopalak/orders-api/events"
+	"github.com/umuttopalak/orders-api/handler"
+	"github.com/umuttopalak/orders-api/idempotency"
+	"github.com/umuttopalak/orders-api/inventory"
+	"github.com/umuttopalak/orders-api/logging"
+	"github.com/umuttopalak/orders-api/metrics"
+	"github.com/umuttopalak/orders-api/payments"
+	"github.com/umuttopalak/orders-api/ratelimit"
+	"github.com/umuttopalak/orders-api/repository/category"
+	"github.com/umuttopalak/orders-api/repository/customer"
+	"github.com/umuttopalak/orders-api/repository/order"
+	"github.com/umuttopalak/orders-api/repository/product"
+	webhookrepo "github.com/umuttopalak/orders-api/repository/webhook"
+	"github.com/umuttopalak/orders-api/tax"
+	"github.com/umuttopalak/orders-api/tracing"
+	"github.com/umuttopalak/orders-api/webhook"
+	"github.com/umuttopalak/orders-api/worker"
 )
 
 type App struct {
 	router http.Handler
 	rdb    *redis.Client
 	config Config
+	logger *slog.Logger
+	health *handler.Health
+
+	idempotency *idempotency.Store
+	limiter     *ratelimit.Limiter
+	payments    payments.Provider
+	taxes       *tax.Table
+
+	// shutdown is closed when Start begins shutting down the server.
+	shutdown chan struct{}
 }
 
-func New(config Config) *App {
+func New(config Config, logger *slog.Logger) (*App, error) {
+	options := &redis.Options{
+		Addr:     config.RedisAdress,
+		Password: config.RedisPassword,
+		DB:       config.RedisDB,
+		PoolSize: config.RedisPoolSize,
+	}
+	if config.RedisTLS {
+		host, _, _ := net.SplitHostPort(config.RedisAdress)
+		options.TLSConfig = &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			ServerName: host,
+		}
+	}
+
+	taxes, err := tax.Load(config.TaxRatesFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load tax rates: %w", err)
+	}
+
+	rdb := redis.NewClient(options)
+	rdb.AddHook(metrics.RedisHook{})
+	if err := redisotel.InstrumentTracing(rdb); err != nil {
+		logger.Error("failed to instrument redis tracing", slog.Any("error", err))
+	}
+
 	app := &App{
-		rdb: redis.NewClient(&redis.Options{
-			Addr: config.RedisAdress,
-		}),
-		config: config,
+		rdb:      rdb,
+		config:   config,
+		logger:   logger,
+		shutdown: make(chan struct{}),
+		// Validation only accepts the fake provider until a real one is
+		// added here.
+		payments: &payments.Fake{},
+		taxes:    taxes,
+	}
+	if err := app.loadRoutes(); err != nil {
+		return nil, fmt.Errorf("failed to load routes: %w", err)
 	}
-	app.loadRoutes()
 
-	return app
+	return app, nil
 }
 
 func (a *App) Start(ctx context.Context) error {
 	server := &http.Server{
-		Addr:    fmt.Sprintf(":%d", a.config.ServerPort),
-		Handler: a.router,
+		Addr:              fmt.Sprintf(":%d", a.config.ServerPort),
+		Handler:           a.router,
+		ReadTimeout:       a.config.ReadTimeout,
+		ReadHeaderTimeout: a.config.ReadHeaderTimeout,
+		WriteTimeout:      a.config.WriteTimeout,
+		IdleTimeout:       a.config.IdleTimeout,
 	}
 
-	err := a.rdb.Ping(ctx).Err()
+	shutdownTracing, err := tracing.Setup(ctx, tracing.Options{
+		Endpoint: a.config.OTLPEndpoint,
+		Insecure: a.config.OTLPInsecure,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set up tracing: %w", err)
+	}
+
+	defer func() {
+		timeout, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+
+		if err := shutdownTracing(timeout); err != nil {
+			a.logger.Error("failed to flush traces", slog.Any("error", err))
+		}
+	}()
+
+	err = a.rdb.Ping(ctx).Err()
 	if err != nil {
 		return fmt.Errorf("Failed to connect redis server: %w", err)
 	}
 
-	fmt.Println("Server starting..")
+	if err := a.migrateIndexes(ctx); err != nil {
+		return err
+	}
+
+	a.logger.Info("server starting", slog.String("addr", server.Addr))
 
 	ch := make(chan error, 1)
 
 	defer func() {
 		if err := a.rdb.Close(); err != nil {
-			fmt.Println("Failed to close redis: ", err)
+			a.logger.Error("failed to close redis", slog.Any("error", err))
 		}
 	}()
 
+	// Background work starts draining together with the server and is
+	// waited for before Redis is closed.
+	var background sync.WaitGroup
+	defer background.Wait()
+	backgroundCtx, stopBackground := context.WithCancel(ctx)
+	defer stopBackground()
+	a.startWorkers(backgroundCtx, &background)
+
 	go func() {
 		err = server.ListenAndServe()
 		if err != nil {
@@ -60,9 +157,142 @@ func (a *App) Start(ctx context.Context) error {
 	case err = <-ch:
 		return err
 	case <-ctx.Done():
-		timeout, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		a.logger.Info("server draining", slog.Duration("delay", a.config.DrainDelay))
+		a.health.SetDraining()
+
+		// Keep serving while probes see readiness fail and load balancers
+		// take the instance out of rotation.
+		select {
+		case err = <-ch:
+			return err
+		case <-time.After(a.config.DrainDelay):
+		}
+
+		a.logger.Info("server shutting down")
+		close(a.shutdown)
+
+		timeout, cancel := context.WithTimeout(context.Background(), a.config.ShutdownTimeout)
 		defer cancel()
 
 		return server.Shutdown(timeout)
 	}
 }
+
+func (a *App) migrateIndexes(ctx context.Context) error {
+	repos := map[string]interface {
+		MigrateIndex(ctx context.Context) error
+	}{
+		"order":    &order.RedisRepo{Client: a.rdb},
+		"customer": &customer.RedisRepo{Client: a.rdb},
+		"product":  &product.RedisRepo{Client: a.rdb},
+		"category": &category.RedisRepo{Client: a.rdb},
+	}
+
+	for name, repo := range repos {
+		if err := repo.MigrateIndex(ctx); err != nil {
+			return fmt.Errorf("failed to migrate %s index: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// startWorkers runs the background job queue shared by every instance.
+// Running jobs get the same ShutdownTimeout as in-flight requests.
+func (a *App) startWorkers(ctx context.Context, wg *sync.WaitGroup) {
+	queue := &worker.Queue{
+		Client:            a.rdb,
+		Name:              "jobs",
+		VisibilityTimeout: a.config.WorkerVisibilityTimeout,
+	}
+
+	runner := &worker.Runner{
+		Queue:        queue,
+		Concurrency:  a.config.WorkerConcurrency,
+		PollInterval: a.config.WorkerPollInterval,
+		DrainTimeout: a.config.ShutdownTimeout,
+	}
+
+	a.startWebhooks(ctx, wg, queue, runner)
+	a.startRestocks(ctx, wg, queue, runner)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		runner.Run(logging.WithLogger(ctx, a.logger.With(slog.String("component", "worker"))))
+	}()
+}
+
+// startWebhooks queues order events for webhook subscribers. Every
+// instance joins the same consumer group, so each event is queued once.
+func (a *App) startWebhooks(ctx context.Context, wg *sync.WaitGroup, queue *worker.Queue, runner *worker.Runner) {
+	ctx = logging.WithLogger(ctx, a.logger.With(slog.String("component", "webhooks")))
+
+	dispatcher := &webhook.Dispatcher{
+		Repo:        &webhookrepo.RedisRepo{Client: a.rdb},
+		Queue:       queue,
+		Client:      &http.Client{Timeout: a.config.WebhookTimeout},
+		MaxAttempts: a.config.WebhookMaxAttempts,
+		Backoff:     a.config.WebhookBackoff,
+	}
+	runner.Handle(webhook.DeliverJob, worker.HandlerFunc(dispatcher.Deliver))
+
+	consumer := &events.Consumer{
+		Client:    a.rdb,
+		Aggregate: events.AggregateOrder,
+		Group:     "webhooks",
+		Name:      consumerName(),
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := consumer.Run(ctx, dispatcher.HandleEvent); err != nil {
+			a.logger.Error("webhook event consumer stopped", slog.Any("error", err))
+		}
+	}()
+}
+
+// startRestocks posts the goods of received returns to the inventory
+// system, if one is configured. Like webhooks, every instance joins the
+// same consumer group.
+func (a *App) startRestocks(ctx context.Context, wg *sync.WaitGroup, queue *worker.Queue, runner *worker.Runner) {
+	if a.config.InventoryRestockURL == "" {
+		return
+	}
+
+	ctx = logging.WithLogger(ctx, a.logger.With(slog.String("component", "inventory")))
+
+	hook := &inventory.Hook{
+		Queue:  queue,
+		Client: &http.Client{Timeout: a.config.InventoryTimeout},
+		URL:    a.config.InventoryRestockURL,
+	}
+	runner.Handle(inventory.RestockJob, worker.HandlerFunc(hook.Restock))
+
+	consumer := &events.Consumer{
+		Client:    a.rdb,
+		Aggregate: events.AggregateReturn,
+		Group:     "inventory",
+		Name:      consumerName(),
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := consumer.Run(ctx, hook.HandleEvent); err != nil {
+			a.logger.Error("restock event consumer stopped", slog.Any("error", err))
+		}
+	}()
+}
+
+// consumerName names this instance in the consumer groups. It must stay
+// the same across restarts, so events delivered before one are picked up
+// again.
+func consumerName() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "orders-api"
+	}
+	return name
+}
@@ -1,30 +1,541 @@
 package application
 
 import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/url"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
+
+	"github.com/umuttopalak/orders-api/ratelimit"
+	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
-	RedisAdress string
-	ServerPort  uint16
+	ServerPort         uint16
+	ReadTimeout        time.Duration
+	ReadHeaderTimeout  time.Duration
+	WriteTimeout       time.Duration
+	IdleTimeout        time.Duration
+	RequestTimeout     time.Duration
+	ShutdownTimeout    time.Duration
+	DrainDelay         time.Duration
+	MaxBodyBytes       int64
+	BatchMaxBodyBytes  int64
+	ImportMaxBodyBytes int64
+	RequireIfMatch     bool
+
+	RedisAdress   string
+	RedisPassword string
+	RedisDB       int
+	RedisTLS      bool
+	RedisPoolSize int
+
+	LogLevel slog.Level
+
+	OTLPEndpoint string
+	OTLPInsecure bool
+
+	RateLimits map[string]ratelimit.Limit
+	// RateLimitAPIKeys get a rate limit bucket of their own.
+	RateLimitAPIKeys []string
+
+	IdempotencyTTL time.Duration
+
+	CatalogCacheMaxAge time.Duration
+
+	WebhookMaxAttempts int
+	WebhookBackoff     time.Duration
+	WebhookTimeout     time.Duration
+
+	PaymentProvider string
+	PaymentCurrency string
+
+	CartTTL time.Duration
+
+	// InventoryRestockURL receives the goods of received returns, empty
+	// disables restocking.
+	InventoryRestockURL string
+	InventoryTimeout    time.Duration
+
+	TaxRatesFile string
+
+	WorkerConcurrency       int
+	WorkerVisibilityTimeout time.Duration
+	WorkerPollInterval      time.Duration
+
+	LegacyDeprecatedAt time.Time
+	LegacySunset       time.Time
+}
+
+// setting describes one configuration value and the names it is known by in
+// the config file, the environment and on the command line. Values from all
+// three sources go through the same parse function, so they are validated
+// identically.
+type setting struct {
+	key   string
+	env   string
+	flag  string
+	usage string
+	parse func(cfg *Config, value string) error
 }
 
-func LoadConfig() Config {
-	cfg := Config{
+var settings = []setting{
+	{"server.port", "SERVER_PORT", "port", "HTTP listen port", func(cfg *Config, v string) error {
+		port, err := strconv.ParseUint(v, 10, 16)
+		if err != nil {
+			return fmt.Errorf("invalid port %q", v)
+		}
+		cfg.ServerPort = uint16(port)
+		return nil
+	}},
+	{"server.read_timeout", "SERVER_READ_TIMEOUT", "read-timeout", "maximum duration for reading a request", durationSetting(func(cfg *Config) *time.Duration { return &cfg.ReadTimeout })},
+	{"server.read_header_timeout", "SERVER_READ_HEADER_TIMEOUT", "read-header-timeout", "maximum duration for reading request headers", durationSetting(func(cfg *Config) *time.Duration { return &cfg.ReadHeaderTimeout })},
+	{"server.write_timeout", "SERVER_WRITE_TIMEOUT", "write-timeout", "maximum duration before timing out writes of a response", durationSetting(func(cfg *Config) *time.Duration { return &cfg.WriteTimeout })},
+	{"server.idle_timeout", "SERVER_IDLE_TIMEOUT", "idle-timeout", "maximum time to wait for the next request on a keep-alive connection", durationSetting(func(cfg *Config) *time.Duration { return &cfg.IdleTimeout })},
+	{"server.request_timeout", "SERVER_REQUEST_TIMEOUT", "request-timeout", "deadline for handling a request, 0 disables it", durationSetting(func(cfg *Config) *time.Duration { return &cfg.RequestTimeout })},
+	{"server.max_body_bytes", "SERVER_MAX_BODY_BYTES", "max-body-bytes", "maximum order request body size in bytes", func(cfg *Config, v string) error {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", v)
+		}
+		cfg.MaxBodyBytes = n
+		return nil
+	}},
+	{"server.batch_max_body_bytes", "SERVER_BATCH_MAX_BODY_BYTES", "batch-max-body-bytes", "maximum batch request body size in bytes", func(cfg *Config, v string) error {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", v)
+		}
+		cfg.BatchMaxBodyBytes = n
+		return nil
+	}},
+	{"server.import_max_body_bytes", "SERVER_IMPORT_MAX_BODY_BYTES", "import-max-body-bytes", "maximum import file size in bytes", func(cfg *Config, v string) error {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", v)
+		}
+		cfg.ImportMaxBodyBytes = n
+		return nil
+	}},
+	{"server.require_if_match", "REQUIRE_IF_MATCH", "require-if-match", "reject PUT and DELETE requests without an If-Match header", boolSetting(func(cfg *Config) *bool { return &cfg.RequireIfMatch })},
+	{"server.shutdown_timeout", "SHUTDOWN_TIMEOUT", "shutdown-timeout", "time allowed for in-flight requests to finish on shutdown", durationSetting(func(cfg *Config) *time.Duration { return &cfg.ShutdownTimeout })},
+	{"server.drain_delay", "SHUTDOWN_DRAIN_DELAY", "drain-delay", "time readiness reports draining while new requests are still served, before shutdown starts", durationSetting(func(cfg *Config) *time.Duration { return &cfg.DrainDelay })},
+
+	{"redis.address", "REDIS_ADDRESS", "redis-address", "Redis host:port", func(cfg *Config, v string) error {
+		cfg.RedisAdress = v
+		return nil
+	}},
+	{"redis.password", "REDIS_PASSWORD", "redis-password", "Redis password", func(cfg *Config, v string) error {
+		cfg.RedisPassword = v
+		return nil
+	}},
+	{"redis.db", "REDIS_DB", "redis-db", "Redis logical database", intSetting(func(cfg *Config) *int { return &cfg.RedisDB })},
+	{"redis.tls", "REDIS_TLS", "redis-tls", "connect to Redis over TLS", boolSetting(func(cfg *Config) *bool { return &cfg.RedisTLS })},
+	{"redis.pool_size", "REDIS_POOL_SIZE", "redis-pool-size", "Redis connection pool size, 0 uses the client default", intSetting(func(cfg *Config) *int { return &cfg.RedisPoolSize })},
+
+	{"log.level", "LOG_LEVEL", "log-level", "log level: debug, info, warn or error", func(cfg *Config, v string) error {
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(v)); err != nil {
+			return fmt.Errorf("invalid log level %q", v)
+		}
+		cfg.LogLevel = level
+		return nil
+	}},
+
+	{"tracing.otlp_endpoint", "OTLP_ENDPOINT", "otlp-endpoint", "OTLP/HTTP collector host:port, empty disables export", func(cfg *Config, v string) error {
+		cfg.OTLPEndpoint = v
+		return nil
+	}},
+	{"tracing.otlp_insecure", "OTLP_INSECURE", "otlp-insecure", "send traces without TLS", boolSetting(func(cfg *Config) *bool { return &cfg.OTLPInsecure })},
+
+	{"idempotency.ttl", "IDEMPOTENCY_TTL", "idempotency-ttl", "how long responses to requests with an Idempotency-Key are kept", durationSetting(func(cfg *Config) *time.Duration { return &cfg.IdempotencyTTL })},
+
+	{"cache.catalog_max_age", "CATALOG_CACHE_MAX_AGE", "catalog-cache-max-age", "Cache-Control max-age for product and category reads, 0 forces revalidation", durationSetting(func(cfg *Config) *time.Duration { return &cfg.CatalogCacheMaxAge })},
+
+	{"api.legacy_deprecated_at", "API_LEGACY_DEPRECATED_AT", "api-legacy-deprecated-at", "date (YYYY-MM-DD) the unversioned API was deprecated", dateSetting(func(cfg *Config) *time.Time { return &cfg.LegacyDeprecatedAt })},
+	{"api.legacy_sunset", "API_LEGACY_SUNSET", "api-legacy-sunset", "date (YYYY-MM-DD) the unversioned API will be removed, empty for none", dateSetting(func(cfg *Config) *time.Time { return &cfg.LegacySunset })},
+
+	{"webhook.max_attempts", "WEBHOOK_MAX_ATTEMPTS", "webhook-max-attempts", "delivery attempts before a webhook event is dead-lettered", intSetting(func(cfg *Config) *int { return &cfg.WebhookMaxAttempts })},
+	{"webhook.backoff", "WEBHOOK_BACKOFF", "webhook-backoff", "delay before the first webhook retry, doubled on every further one", durationSetting(func(cfg *Config) *time.Duration { return &cfg.WebhookBackoff })},
+	{"webhook.timeout", "WEBHOOK_TIMEOUT", "webhook-timeout", "time a webhook receiver has to answer", durationSetting(func(cfg *Config) *time.Duration { return &cfg.WebhookTimeout })},
+
+	{"payments.provider", "PAYMENTS_PROVIDER", "payments-provider", "payment provider: fake", func(cfg *Config, v string) error {
+		cfg.PaymentProvider = v
+		return nil
+	}},
+	{"payments.currency", "PAYMENTS_CURRENCY", "payments-currency", "ISO 4217 currency orders are charged in", func(cfg *Config, v string) error {
+		cfg.PaymentCurrency = v
+		return nil
+	}},
+
+	{"cart.ttl", "CART_TTL", "cart-ttl", "how long an untouched cart is kept", durationSetting(func(cfg *Config) *time.Duration { return &cfg.CartTTL })},
+
+	{"inventory.restock_url", "INVENTORY_RESTOCK_URL", "inventory-restock-url", "URL the products of received returns are posted to for restocking, empty disables it", func(cfg *Config, v string) error {
+		cfg.InventoryRestockURL = v
+		return nil
+	}},
+	{"inventory.timeout", "INVENTORY_TIMEOUT", "inventory-timeout", "time the inventory system has to answer a restock", durationSetting(func(cfg *Config) *time.Duration { return &cfg.InventoryTimeout })},
+
+	{"tax.rates_file", "TAX_RATES_FILE", "tax-rates-file", "YAML file with the tax rates by shipping region and product category, empty for none", func(cfg *Config, v string) error {
+		cfg.TaxRatesFile = v
+		return nil
+	}},
+
+	{"worker.concurrency", "WORKER_CONCURRENCY", "worker-concurrency", "number of background jobs run at once", intSetting(func(cfg *Config) *int { return &cfg.WorkerConcurrency })},
+	{"worker.visibility_timeout", "WORKER_VISIBILITY_TIMEOUT", "worker-visibility-timeout", "time after which a job held by an unresponsive worker is handed out again", durationSetting(func(cfg *Config) *time.Duration { return &cfg.WorkerVisibilityTimeout })},
+	{"worker.poll_interval", "WORKER_POLL_INTERVAL", "worker-poll-interval", "how often an idle worker checks the job queue", durationSetting(func(cfg *Config) *time.Duration { return &cfg.WorkerPollInterval })},
+
+	{"ratelimit.api_keys", "RATE_LIMIT_API_KEYS", "rate-limit-api-keys", "comma-separated API keys limited per key, other clients are limited per IP", func(cfg *Config, v string) error {
+		cfg.RateLimitAPIKeys = nil
+		for _, key := range strings.Split(v, ",") {
+			if key = strings.TrimSpace(key); key != "" {
+				cfg.RateLimitAPIKeys = append(cfg.RateLimitAPIKeys, key)
+			}
+		}
+		return nil
+	}},
+	rateLimitSetting("order"),
+	rateLimitSetting("customer"),
+	rateLimitSetting("product"),
+	rateLimitSetting("category"),
+	rateLimitSetting("webhook"),
+	rateLimitSetting("cart"),
+	rateLimitSetting("promotion"),
+}
+
+func rateLimitSetting(group string) setting {
+	return setting{
+		key:   "ratelimit." + group,
+		env:   "RATE_LIMIT_" + strings.ToUpper(group),
+		flag:  "rate-limit-" + group,
+		usage: "requests allowed per client on /" + group + " as <requests>/<period>, 0 disables it",
+		parse: func(cfg *Config, v string) error {
+			limit, err := ratelimit.ParseLimit(v)
+			if err != nil {
+				return err
+			}
+			cfg.RateLimits[group] = limit
+			return nil
+		},
+	}
+}
+
+func durationSetting(field func(cfg *Config) *time.Duration) func(*Config, string) error {
+	return func(cfg *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", v)
+		}
+		*field(cfg) = d
+		return nil
+	}
+}
+
+func dateSetting(field func(cfg *Config) *time.Time) func(*Config, string) error {
+	return func(cfg *Config, v string) error {
+		if v == "" {
+			*field(cfg) = time.Time{}
+			return nil
+		}
+
+		t, err := time.Parse(time.DateOnly, v)
+		if err != nil {
+			return fmt.Errorf("invalid date %q, expected YYYY-MM-DD", v)
+		}
+		*field(cfg) = t
+		return nil
+	}
+}
+
+func intSetting(field func(cfg *Config) *int) func(*Config, string) error {
+	return func(cfg *Config, v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", v)
+		}
+		*field(cfg) = n
+		return nil
+	}
+}
+
+func boolSetting(field func(cfg *Config) *bool) func(*Config, string) error {
+	return func(cfg *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", v)
+		}
+		*field(cfg) = b
+		return nil
+	}
+}
+
+func defaultConfig() Config {
+	return Config{
+		ServerPort:         3000,
+		ReadTimeout:        10 * time.Second,
+		ReadHeaderTimeout:  5 * time.Second,
+		WriteTimeout:       30 * time.Second,
+		IdleTimeout:        120 * time.Second,
+		RequestTimeout:     15 * time.Second,
+		ShutdownTimeout:    10 * time.Second,
+		DrainDelay:         5 * time.Second,
+		MaxBodyBytes:       1 << 20,
+		BatchMaxBodyBytes:  8 << 20,
+		ImportMaxBodyBytes: 64 << 20,
+
 		RedisAdress: "localhost:6379",
-		ServerPort:  3000,
+
+		LogLevel: slog.LevelInfo,
+
+		RateLimits: map[string]ratelimit.Limit{
+			"order":     {Rate: 2, Burst: 120},
+			"customer":  {Rate: 5, Burst: 300},
+			"product":   {Rate: 10, Burst: 600},
+			"category":  {Rate: 10, Burst: 600},
+			"webhook":   {Rate: 1, Burst: 60},
+			"cart":      {Rate: 5, Burst: 300},
+			"promotion": {Rate: 1, Burst: 60},
+		},
+
+		IdempotencyTTL: 24 * time.Hour,
+
+		CatalogCacheMaxAge: time.Minute,
+
+		WebhookMaxAttempts: 8,
+		WebhookBackoff:     5 * time.Second,
+		WebhookTimeout:     10 * time.Second,
+
+		PaymentProvider: "fake",
+		PaymentCurrency: "USD",
+
+		CartTTL: 72 * time.Hour,
+
+		InventoryTimeout: 10 * time.Second,
+
+		WorkerConcurrency:       8,
+		WorkerVisibilityTimeout: time.Minute,
+		WorkerPollInterval:      time.Second,
+
+		LegacyDeprecatedAt: time.Date(2026, time.October, 19, 0, 0, 0, 0, time.UTC),
+		LegacySunset:       time.Date(2027, time.April, 30, 0, 0, 0, 0, time.UTC),
 	}
+}
+
+// LoadConfig builds the configuration by layering, from lowest to highest
+// precedence, the defaults, a YAML file named by -config or CONFIG_FILE,
+// environment variables and command line flags. Every malformed or invalid
+// value is collected so the returned error lists all of them at once.
+func LoadConfig(args []string) (Config, error) {
+	cfg := defaultConfig()
+
+	fs := flag.NewFlagSet("orders-api", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML config file")
+	flagValues := make(map[string]*string, len(settings))
+	for _, s := range settings {
+		flagValues[s.flag] = fs.String(s.flag, "", s.usage+" (env "+s.env+")")
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	var problems []string
 
-	if redisAddres, exist := os.LookupEnv("REDIS_ADDRESS"); exist {
-		cfg.RedisAdress = redisAddres
+	if *configFile != "" {
+		values, err := readConfigFile(*configFile)
+		if err != nil {
+			return Config{}, err
+		}
+
+		known := make(map[string]bool, len(settings))
+		for _, s := range settings {
+			known[s.key] = true
+			if v, exist := values[s.key]; exist {
+				if err := s.parse(&cfg, v); err != nil {
+					problems = append(problems, fmt.Sprintf("%s (file %s): %v", s.key, *configFile, err))
+				}
+			}
+		}
+
+		for key := range values {
+			if !known[key] {
+				problems = append(problems, fmt.Sprintf("%s (file %s): unknown setting", key, *configFile))
+			}
+		}
+	}
+
+	for _, s := range settings {
+		if v, exist := os.LookupEnv(s.env); exist {
+			if err := s.parse(&cfg, v); err != nil {
+				problems = append(problems, fmt.Sprintf("%s (env %s): %v", s.key, s.env, err))
+			}
+		}
 	}
 
-	if serverPort, exist := os.LookupEnv("SERVER_PORT"); exist {
-		if port, err := strconv.ParseUint(serverPort, 10, 16); err == nil {
-			cfg.ServerPort = uint16(port)
+	fs.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if s.flag == f.Name {
+				if err := s.parse(&cfg, *flagValues[s.flag]); err != nil {
+					problems = append(problems, fmt.Sprintf("%s (flag -%s): %v", s.key, s.flag, err))
+				}
+			}
 		}
+	})
+
+	problems = append(problems, cfg.validate()...)
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return Config{}, errors.New("invalid configuration:\n  " + strings.Join(problems, "\n  "))
 	}
 
-	return cfg
+	return cfg, nil
+}
+
+func (c Config) validate() []string {
+	var problems []string
+
+	if c.ServerPort == 0 {
+		problems = append(problems, "server.port: must be between 1 and 65535")
+	}
+	if c.ReadTimeout < 0 {
+		problems = append(problems, "server.read_timeout: must not be negative")
+	}
+	if c.ReadHeaderTimeout < 0 {
+		problems = append(problems, "server.read_header_timeout: must not be negative")
+	}
+	if c.WriteTimeout < 0 {
+		problems = append(problems, "server.write_timeout: must not be negative")
+	}
+	if c.IdleTimeout < 0 {
+		problems = append(problems, "server.idle_timeout: must not be negative")
+	}
+	if c.RequestTimeout < 0 {
+		problems = append(problems, "server.request_timeout: must not be negative")
+	}
+	if c.WriteTimeout > 0 && c.RequestTimeout >= c.WriteTimeout {
+		problems = append(problems, "server.request_timeout: must be shorter than server.write_timeout so timeouts can be reported")
+	}
+	if c.MaxBodyBytes <= 0 {
+		problems = append(problems, "server.max_body_bytes: must be positive")
+	}
+	if c.BatchMaxBodyBytes <= 0 {
+		problems = append(problems, "server.batch_max_body_bytes: must be positive")
+	}
+	if c.ImportMaxBodyBytes <= 0 {
+		problems = append(problems, "server.import_max_body_bytes: must be positive")
+	}
+	if c.ShutdownTimeout <= 0 {
+		problems = append(problems, "server.shutdown_timeout: must be positive")
+	}
+	if c.DrainDelay < 0 {
+		problems = append(problems, "server.drain_delay: must not be negative")
+	}
+	if c.WebhookMaxAttempts < 1 {
+		problems = append(problems, "webhook.max_attempts: must be at least 1")
+	}
+	if c.WebhookBackoff <= 0 {
+		problems = append(problems, "webhook.backoff: must be positive")
+	}
+	if c.WebhookTimeout <= 0 {
+		problems = append(problems, "webhook.timeout: must be positive")
+	}
+	if c.PaymentProvider != "fake" {
+		problems = append(problems, fmt.Sprintf("payments.provider: unknown provider %q", c.PaymentProvider))
+	}
+	if len(c.PaymentCurrency) != 3 || strings.ToUpper(c.PaymentCurrency) != c.PaymentCurrency {
+		problems = append(problems, "payments.currency: must be a three letter ISO 4217 code")
+	}
+	if c.CartTTL < time.Minute {
+		problems = append(problems, "cart.ttl: must be at least 1m")
+	}
+	if c.InventoryRestockURL != "" {
+		if u, err := url.Parse(c.InventoryRestockURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, "inventory.restock_url: must be an absolute http or https URL")
+		}
+	}
+	if c.InventoryTimeout <= 0 {
+		problems = append(problems, "inventory.timeout: must be positive")
+	}
+	if c.WorkerConcurrency < 1 {
+		problems = append(problems, "worker.concurrency: must be at least 1")
+	}
+	if c.WorkerVisibilityTimeout < time.Second {
+		problems = append(problems, "worker.visibility_timeout: must be at least 1s")
+	}
+	if c.WorkerPollInterval <= 0 {
+		problems = append(problems, "worker.poll_interval: must be positive")
+	}
+	if c.IdempotencyTTL <= 0 {
+		problems = append(problems, "idempotency.ttl: must be positive")
+	}
+	if c.CatalogCacheMaxAge < 0 {
+		problems = append(problems, "cache.catalog_max_age: must not be negative")
+	}
+	if c.LegacyDeprecatedAt.IsZero() {
+		problems = append(problems, "api.legacy_deprecated_at: must be set")
+	}
+	if !c.LegacySunset.IsZero() && c.LegacySunset.Before(c.LegacyDeprecatedAt) {
+		problems = append(problems, "api.legacy_sunset: must not be before api.legacy_deprecated_at")
+	}
+	if c.RedisAdress == "" {
+		problems = append(problems, "redis.address: must not be empty")
+	}
+	if c.RedisDB < 0 {
+		problems = append(problems, "redis.db: must not be negative")
+	}
+	if c.RedisPoolSize < 0 {
+		problems = append(problems, "redis.pool_size: must not be negative")
+	}
+
+	return problems
+}
+
+// readConfigFile flattens the YAML document into dotted keys, so
+//
+//	redis:
+//	  address: redis:6379
+//
+// is returned as {"redis.address": "redis:6379"}.
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var doc map[string]any
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	values := make(map[string]string)
+	flatten("", doc, values)
+
+	return values, nil
+}
+
+func flatten(prefix string, doc map[string]any, values map[string]string) {
+	for key, value := range doc {
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+
+		switch v := value.(type) {
+		case map[string]any:
+			flatten(key, v, values)
+		case nil:
+			values[key] = ""
+		case time.Time:
+			// YAML resolves unquoted dates to timestamps.
+			values[key] = v.Format(time.DateOnly)
+		default:
+			values[key] = fmt.Sprint(v)
+		}
+	}
 }
@@ -0,0 +1,150 @@
+package application
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/google/uuid"
+	"github.com/umuttopalak/orders-api/logging"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+const maxRequestIDLength = 128
+
+func requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if id == "" || len(id) > maxRequestIDLength {
+			id = uuid.NewString()
+		}
+
+		w.Header().Set(requestIDHeader, id)
+
+		ctx := logging.WithRequestID(r.Context(), id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func (a *App) requestLogger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := a.logger.With(
+			slog.String("request_id", logging.RequestID(r.Context())),
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+		)
+		if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+			logger = logger.With(slog.String("trace_id", sc.TraceID().String()))
+		}
+		ctx := logging.WithLogger(r.Context(), logger)
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		start := time.Now()
+
+		next.ServeHTTP(ww, r.WithContext(ctx))
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		logger.Info("request completed",
+			slog.Int("status", status),
+			slog.Int("bytes", ww.BytesWritten()),
+			slog.Duration("duration", time.Since(start)),
+		)
+	})
+}
+
+// recoverer turns a handler panic into a JSON 500 and logs the stack with
+// the request scoped logger. http.ErrAbortHandler is re-raised so net/http
+// can abort the connection as intended.
+func recoverer(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+			if rec == http.ErrAbortHandler {
+				panic(rec)
+			}
+
+			logging.FromContext(r.Context()).Error("panic recovered",
+				slog.Any("panic", rec),
+				slog.String("stack", string(debug.Stack())),
+			)
+
+			writeJSONError(w, http.StatusInternalServerError, "internal server error")
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestTimeout cancels the request context after timeout. Handlers that
+// give up because of the cancellation without writing a response get a 504.
+func requestTimeout(timeout time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if timeout <= 0 {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			next.ServeHTTP(ww, r.WithContext(ctx))
+
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) && ww.Status() == 0 {
+				writeJSONError(w, http.StatusGatewayTimeout, "request timed out")
+			}
+		})
+	}
+}
+
+func maxBodySize(limit int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Body != nil {
+				r.Body = http.MaxBytesReader(w, r.Body, limit)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	_ = json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+	}{message})
+}
+
+// deprecated marks responses of a route group as deprecated (RFC 9745) with
+// an optional sunset date (RFC 8594), pointing clients at the same path
+// under successor.
+func deprecated(deprecatedAt, sunset time.Time, successor string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Deprecation", fmt.Sprintf("@%d", deprecatedAt.Unix()))
+			if !sunset.IsZero() {
+				w.Header().Set("Sunset", sunset.UTC().Format(http.TimeFormat))
+			}
+			w.Header().Add("Link", fmt.Sprintf(`<%s%s>; rel="successor-version"`, successor, r.URL.Path))
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
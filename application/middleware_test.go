@@ -0,0 +1,201 @@
+package application
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecoverer(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		status  int
+		body    string
+	}{
+		{"no panic", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) }, http.StatusNoContent, ""},
+		{"panic", func(w http.ResponseWriter, r *http.Request) { panic("boom") }, http.StatusInternalServerError, `{"error":"internal server error"}`},
+		{"panic with error", func(w http.ResponseWriter, r *http.Request) { panic(errors.New("boom")) }, http.StatusInternalServerError, `{"error":"internal server error"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			recoverer(tt.handler).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if w.Code != tt.status || strings.TrimSpace(w.Body.String()) != tt.body {
+				t.Errorf("response = %d %s, want %d %s", w.Code, w.Body, tt.status, tt.body)
+			}
+		})
+	}
+}
+
+func TestRecovererAbortHandler(t *testing.T) {
+	defer func() {
+		if rec := recover(); rec != http.ErrAbortHandler {
+			t.Errorf("recovered %v, want http.ErrAbortHandler re-raised", rec)
+		}
+	}()
+
+	h := recoverer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+}
+
+func TestRequestTimeout(t *testing.T) {
+	// wait blocks until the request is cancelled, then writes status if
+	// it is set.
+	wait := func(status int) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+			if status != 0 {
+				w.WriteHeader(status)
+			}
+		}
+	}
+
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		handler http.HandlerFunc
+		status  int
+	}{
+		{"in time", time.Second, func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusCreated) }, http.StatusCreated},
+		{"timed out", 10 * time.Millisecond, wait(0), http.StatusGatewayTimeout},
+		{"handler answered", 10 * time.Millisecond, wait(http.StatusServiceUnavailable), http.StatusServiceUnavailable},
+		{"disabled", 0, func(w http.ResponseWriter, r *http.Request) {
+			if _, ok := r.Context().Deadline(); ok {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		}, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			requestTimeout(tt.timeout)(tt.handler).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			if tt.status == http.StatusGatewayTimeout {
+				var body struct {
+					Error string `json:"error"`
+				}
+				if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.Error != "request timed out" {
+					t.Errorf("body = %s, want the timeout error", w.Body)
+				}
+			}
+		})
+	}
+}
+
+func TestRequestTimeoutCancelsContext(t *testing.T) {
+	var err error
+	h := requestTimeout(10 * time.Millisecond)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		err = r.Context().Err()
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("context error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestMaxBodySize(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"under the limit", strings.Repeat("x", 15), http.StatusOK},
+		{"at the limit", strings.Repeat("x", 16), http.StatusOK},
+		{"over the limit", strings.Repeat("x", 17), http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := maxBodySize(16)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var maxBytesErr *http.MaxBytesError
+				if _, err := io.ReadAll(r.Body); errors.As(err, &maxBytesErr) {
+					w.WriteHeader(http.StatusRequestEntityTooLarge)
+				}
+			}))
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body)))
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestDeprecated(t *testing.T) {
+	deprecatedAt := time.Date(2026, time.October, 19, 0, 0, 0, 0, time.UTC)
+	sunset := time.Date(2027, time.April, 30, 0, 0, 0, 0, time.FixedZone("CEST", 2*60*60))
+
+	tests := []struct {
+		name   string
+		sunset time.Time
+		path   string
+		links  []string
+		want   http.Header
+	}{
+		{
+			name:   "with sunset",
+			sunset: sunset,
+			path:   "/order/7",
+			want: http.Header{
+				"Deprecation": {"@1792368000"},
+				"Sunset":      {"Thu, 29 Apr 2027 22:00:00 GMT"},
+				"Link":        {`</v1/order/7>; rel="successor-version"`},
+			},
+		},
+		{
+			name: "without sunset",
+			path: "/product",
+			want: http.Header{
+				"Deprecation": {"@1792368000"},
+				"Link":        {`</v1/product>; rel="successor-version"`},
+			},
+		},
+		{
+			name:  "next to page links",
+			path:  "/customer",
+			links: []string{`</customer?cursor=abc>; rel="next"`},
+			want: http.Header{
+				"Deprecation": {"@1792368000"},
+				"Link":        {`</v1/customer>; rel="successor-version"`, `</customer?cursor=abc>; rel="next"`},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := deprecated(deprecatedAt, tt.sunset, "/v1")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for _, link := range tt.links {
+					w.Header().Add("Link", link)
+				}
+			}))
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			for _, name := range []string{"Deprecation", "Sunset", "Link"} {
+				got, want := w.Header().Values(name), tt.want.Values(name)
+				if strings.Join(got, ", ") != strings.Join(want, ", ") {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
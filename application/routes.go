@@ -1,30 +1,135 @@
 package application
 
 import (
+	"context"
 	"net/http"
+	"time"
 
 	"github.com/go-chi/chi/v5"
-	"github.com/go-chi/chi/v5/middleware"
 	"github.com/umuttopalak/orders-api/handler"
+	"github.com/umuttopalak/orders-api/idempotency"
+	"github.com/umuttopalak/orders-api/metrics"
+	"github.com/umuttopalak/orders-api/openapi"
+	"github.com/umuttopalak/orders-api/ratelimit"
+	"github.com/umuttopalak/orders-api/repository/cart"
 	"github.com/umuttopalak/orders-api/repository/category"
 	"github.com/umuttopalak/orders-api/repository/customer"
 	"github.com/umuttopalak/orders-api/repository/order"
+	"github.com/umuttopalak/orders-api/repository/payment"
 	"github.com/umuttopalak/orders-api/repository/product"
+	"github.com/umuttopalak/orders-api/repository/promotion"
+	"github.com/umuttopalak/orders-api/repository/returns"
+	"github.com/umuttopalak/orders-api/repository/shipment"
+	webhookrepo "github.com/umuttopalak/orders-api/repository/webhook"
+	"github.com/umuttopalak/orders-api/tracing"
 )
 
-func (a *App) loadRoutes() {
+// smallBodyBytes caps bodies for resources whose payloads are a handful of
+// scalar fields. Orders carry line items and use the configurable limit, as
+// do the batch and import endpoints.
+const smallBodyBytes = 64 << 10
+
+// idempotencyLeaseMargin is added to the request timeout for the claim on
+// an idempotency key, covering the handler's work after its context ends.
+const idempotencyLeaseMargin = 10 * time.Second
+
+func (a *App) loadRoutes() error {
 	router := chi.NewRouter()
-	router.Use(middleware.Logger)
+	router.Use(requestID)
+	router.Use(tracing.Middleware)
+	router.Use(a.requestLogger)
+	router.Use(metrics.Middleware)
+	router.Use(recoverer)
+
+	a.health = &handler.Health{
+		Checks: map[string]handler.HealthCheck{
+			"redis": func(ctx context.Context) error {
+				return a.rdb.Ping(ctx).Err()
+			},
+		},
+		Timeout: 2 * time.Second,
+	}
 
-	router.Get("/", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
+	router.Group(func(router chi.Router) {
+		router.Use(a.timeout)
+		router.Get("/", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
+		router.Get("/metrics", metrics.Handler().ServeHTTP)
+		router.Get("/openapi.json", openapi.Spec)
+		router.Get("/docs", openapi.Docs)
+		router.Get("/healthz", a.health.Live)
+		router.Get("/readyz", a.health.Ready)
 	})
 
-	router.Route("/customer", a.loadCustomerRoutes)
-	router.Route("/order", a.loadOrderRoutes)
-	router.Route("/product", a.loadProductRoutes)
-	router.Route("/category", a.loadCategoryRoutes)
+	a.limiter = &ratelimit.Limiter{
+		Client:  a.rdb,
+		APIKeys: make(map[string]bool, len(a.config.RateLimitAPIKeys)),
+	}
+	for _, key := range a.config.RateLimitAPIKeys {
+		a.limiter.APIKeys[key] = true
+	}
+	a.idempotency = &idempotency.Store{
+		Client: a.rdb,
+		TTL:    a.config.IdempotencyTTL,
+	}
+	if a.config.RequestTimeout > 0 {
+		a.idempotency.Lease = a.config.RequestTimeout + idempotencyLeaseMargin
+	}
+
+	// Every API version is mounted under its own prefix with its own loader,
+	// so a /v2 router can sit next to /v1 and share the middleware above.
+	router.Route("/v1", a.loadV1Routes)
+
+	// The unversioned paths predate /v1. They serve the v1 API as deprecated
+	// aliases until the sunset date.
+	router.Group(func(router chi.Router) {
+		router.Use(deprecated(a.config.LegacyDeprecatedAt, a.config.LegacySunset, "/v1"))
+		a.loadV1Routes(router)
+	})
+
+	if err := openapi.Verify(router); err != nil {
+		return err
+	}
+
 	a.router = router
+	return nil
+}
+
+// timeout applies the request timeout. Every route uses it except event
+// streams, which stay open for as long as the client listens, and exports
+// and imports, which take as long as the data set needs. The loaders mount
+// those outside of it.
+func (a *App) timeout(next http.Handler) http.Handler {
+	return requestTimeout(a.config.RequestTimeout)(next)
+}
+
+func (a *App) loadV1Routes(router chi.Router) {
+	router.With(
+		a.limiter.Middleware("customer", a.config.RateLimits["customer"]),
+	).Route("/customer", a.loadCustomerRoutes)
+	router.With(
+		maxBodySize(a.config.MaxBodyBytes),
+		a.limiter.Middleware("order", a.config.RateLimits["order"]),
+	).Route("/order", a.loadOrderRoutes)
+	router.With(
+		a.limiter.Middleware("product", a.config.RateLimits["product"]),
+	).Route("/product", a.loadProductRoutes)
+	router.With(
+		a.limiter.Middleware("category", a.config.RateLimits["category"]),
+	).Route("/category", a.loadCategoryRoutes)
+	router.With(
+		maxBodySize(smallBodyBytes),
+		a.limiter.Middleware("webhook", a.config.RateLimits["webhook"]),
+	).Route("/webhook", a.loadWebhookRoutes)
+	router.With(
+		maxBodySize(smallBodyBytes),
+		a.limiter.Middleware("cart", a.config.RateLimits["cart"]),
+	).Route("/cart", a.loadCartRoutes)
+	router.With(
+		maxBodySize(smallBodyBytes),
+		a.limiter.Middleware("promotion", a.config.RateLimits["promotion"]),
+	).Route("/promotion", a.loadPromotionRoutes)
 }
 
 func (a *App) loadOrderRoutes(router chi.Router) {
@@ -32,13 +137,60 @@ func (a *App) loadOrderRoutes(router chi.Router) {
 		Repo: &order.RedisRepo{
 			Client: a.rdb,
 		},
+		Promotions:     &promotion.RedisRepo{Client: a.rdb},
+		Products:       &product.RedisRepo{Client: a.rdb},
+		Taxes:          a.taxes,
+		RequireIfMatch: a.config.RequireIfMatch,
+		Shutdown:       a.shutdown,
 	}
 
-	router.Post("/", orderHandler.Create)
-	router.Get("/", orderHandler.List)
-	router.Get("/{id}", orderHandler.GetByID)
-	router.Put("/{id}", orderHandler.UpdateByID)
-	router.Delete("/{id}", orderHandler.DeleteByID)
+	router.Get("/export", orderHandler.Export)
+	router.Get("/stream", orderHandler.Stream)
+	router.Get("/{id}/stream", orderHandler.StreamByID)
+
+	router.Group(func(router chi.Router) {
+		router.Use(a.timeout)
+
+		router.With(a.idempotency.Middleware).Post("/", orderHandler.Create)
+		router.Get("/", orderHandler.List)
+
+		paymentHandler := &handler.Payment{
+			Orders:   orderHandler.Repo,
+			Repo:     &payment.RedisRepo{Client: a.rdb},
+			Provider: a.payments,
+			Currency: a.config.PaymentCurrency,
+		}
+
+		router.With(a.idempotency.Middleware).Post("/{id}/pay", paymentHandler.Pay)
+		router.With(a.idempotency.Middleware).Post("/{id}/refund", paymentHandler.Refund)
+		router.Get("/{id}/payments", paymentHandler.List)
+
+		shipmentHandler := &handler.Shipment{
+			Orders: orderHandler.Repo,
+			Repo:   &shipment.RedisRepo{Client: a.rdb},
+		}
+
+		router.With(a.idempotency.Middleware).Post("/{id}/shipments", shipmentHandler.Create)
+		router.Get("/{id}/shipments", shipmentHandler.List)
+		router.Get("/{id}/shipments/{shipment_id}", shipmentHandler.GetByID)
+
+		returnHandler := &handler.Return{
+			Orders:         orderHandler.Repo,
+			Shipments:      shipmentHandler.Repo,
+			Repo:           &returns.RedisRepo{Client: a.rdb},
+			Payments:       paymentHandler,
+			RequireIfMatch: a.config.RequireIfMatch,
+		}
+
+		router.With(a.idempotency.Middleware).Post("/{id}/returns", returnHandler.Create)
+		router.Get("/{id}/returns", returnHandler.List)
+		router.Get("/{id}/returns/{return_id}", returnHandler.GetByID)
+		router.Put("/{id}/returns/{return_id}", returnHandler.UpdateByID)
+
+		router.Get("/{id}", orderHandler.GetByID)
+		router.Put("/{id}", orderHandler.UpdateByID)
+		router.Delete("/{id}", orderHandler.DeleteByID)
+	})
 }
 
 func (a *App) loadCustomerRoutes(router chi.Router) {
@@ -46,13 +198,29 @@ func (a *App) loadCustomerRoutes(router chi.Router) {
 		Repo: &customer.RedisRepo{
 			Client: a.rdb,
 		},
+		RequireIfMatch: a.config.RequireIfMatch,
 	}
 
-	router.Post("/", customerHandler.Create)
-	router.Get("/", customerHandler.List)
-	router.Get("/{id}", customerHandler.GetByID)
-	//router.Put("/{id}", customerHandler.UpdateByID)
-	router.Delete("/{id}", customerHandler.DeleteByID)
+	router.Group(func(router chi.Router) {
+		router.Use(a.timeout)
+		router.Use(maxBodySize(smallBodyBytes))
+		router.With(a.idempotency.Middleware).Post("/", customerHandler.Create)
+		router.Get("/", customerHandler.List)
+		router.Get("/{id}", customerHandler.GetByID)
+		//router.Put("/{id}", customerHandler.UpdateByID)
+		router.Delete("/{id}", customerHandler.DeleteByID)
+	})
+
+	router.Group(func(router chi.Router) {
+		router.Use(a.timeout)
+		router.Use(maxBodySize(a.config.BatchMaxBodyBytes))
+		router.With(a.idempotency.Middleware).Post("/batch", customerHandler.BatchCreate)
+		router.Put("/batch", customerHandler.BatchUpdate)
+		router.Delete("/batch", customerHandler.BatchDelete)
+	})
+
+	router.Get("/export", customerHandler.Export)
+	router.With(maxBodySize(a.config.ImportMaxBodyBytes)).Post("/import", customerHandler.Import)
 }
 
 func (a *App) loadProductRoutes(router chi.Router) {
@@ -60,13 +228,29 @@ func (a *App) loadProductRoutes(router chi.Router) {
 		Repo: &product.RedisRepo{
 			Client: a.rdb,
 		},
+		RequireIfMatch: a.config.RequireIfMatch,
+		CacheMaxAge:    a.config.CatalogCacheMaxAge,
 	}
-	router.Post("/", productHandler.Create)
-	router.Get("/", productHandler.List)
-	router.Get("/{id}", productHandler.GetByID)
-	router.Put("/{id}", productHandler.UpdateByID)
-	router.Delete("/{id}", productHandler.DeleteByID)
+	router.Group(func(router chi.Router) {
+		router.Use(a.timeout)
+		router.Use(maxBodySize(smallBodyBytes))
+		router.With(a.idempotency.Middleware).Post("/", productHandler.Create)
+		router.Get("/", productHandler.List)
+		router.Get("/{id}", productHandler.GetByID)
+		router.Put("/{id}", productHandler.UpdateByID)
+		router.Delete("/{id}", productHandler.DeleteByID)
+	})
 
+	router.Group(func(router chi.Router) {
+		router.Use(a.timeout)
+		router.Use(maxBodySize(a.config.BatchMaxBodyBytes))
+		router.With(a.idempotency.Middleware).Post("/batch", productHandler.BatchCreate)
+		router.Put("/batch", productHandler.BatchUpdate)
+		router.Delete("/batch", productHandler.BatchDelete)
+	})
+
+	router.Get("/export", productHandler.Export)
+	router.With(maxBodySize(a.config.ImportMaxBodyBytes)).Post("/import", productHandler.Import)
 }
 
 func (a *App) loadCategoryRoutes(router chi.Router) {
@@ -74,11 +258,86 @@ func (a *App) loadCategoryRoutes(router chi.Router) {
 		Repo: &category.RedisRepo{
 			Client: a.rdb,
 		},
+		RequireIfMatch: a.config.RequireIfMatch,
+		CacheMaxAge:    a.config.CatalogCacheMaxAge,
+	}
+	router.Group(func(router chi.Router) {
+		router.Use(a.timeout)
+		router.Use(maxBodySize(smallBodyBytes))
+		router.With(a.idempotency.Middleware).Post("/", categoryHandler.Create)
+		router.Get("/", categoryHandler.List)
+		router.Get("/{id}", categoryHandler.GetByID)
+		router.Put("/{id}", categoryHandler.UpdateByID)
+		router.Delete("/{id}", categoryHandler.DeleteByID)
+	})
+
+	router.Group(func(router chi.Router) {
+		router.Use(a.timeout)
+		router.Use(maxBodySize(a.config.BatchMaxBodyBytes))
+		router.With(a.idempotency.Middleware).Post("/batch", categoryHandler.BatchCreate)
+		router.Put("/batch", categoryHandler.BatchUpdate)
+		router.Delete("/batch", categoryHandler.BatchDelete)
+	})
+
+	router.Get("/export", categoryHandler.Export)
+	router.With(maxBodySize(a.config.ImportMaxBodyBytes)).Post("/import", categoryHandler.Import)
+}
+
+func (a *App) loadWebhookRoutes(router chi.Router) {
+	webhookHandler := &handler.Webhook{
+		Repo: &webhookrepo.RedisRepo{
+			Client: a.rdb,
+		},
+		RequireIfMatch: a.config.RequireIfMatch,
 	}
-	router.Post("/", categoryHandler.Create)
-	router.Get("/", categoryHandler.List)
-	router.Get("/{id}", categoryHandler.GetByID)
-	router.Put("/{id}", categoryHandler.UpdateByID)
-	router.Delete("/{id}", categoryHandler.DeleteByID)
 
+	router.Use(a.timeout)
+
+	router.With(a.idempotency.Middleware).Post("/", webhookHandler.Create)
+	router.Get("/", webhookHandler.List)
+	router.Get("/{id}", webhookHandler.GetByID)
+	router.Put("/{id}", webhookHandler.UpdateByID)
+	router.Delete("/{id}", webhookHandler.DeleteByID)
+	router.Get("/{id}/deliveries", webhookHandler.Deliveries)
+	router.Get("/{id}/dead-letters", webhookHandler.DeadLetters)
+}
+
+func (a *App) loadPromotionRoutes(router chi.Router) {
+	promotionHandler := &handler.Promotion{
+		Repo: &promotion.RedisRepo{
+			Client: a.rdb,
+		},
+		RequireIfMatch: a.config.RequireIfMatch,
+	}
+
+	router.Use(a.timeout)
+
+	router.With(a.idempotency.Middleware).Post("/", promotionHandler.Create)
+	router.Get("/", promotionHandler.List)
+	router.Get("/{code}", promotionHandler.GetByCode)
+	router.Put("/{code}", promotionHandler.UpdateByCode)
+	router.Delete("/{code}", promotionHandler.DeleteByCode)
+}
+
+func (a *App) loadCartRoutes(router chi.Router) {
+	cartHandler := &handler.Cart{
+		Repo: &cart.RedisRepo{
+			Client: a.rdb,
+			TTL:    a.config.CartTTL,
+		},
+		Products:   &product.RedisRepo{Client: a.rdb},
+		Orders:     &order.RedisRepo{Client: a.rdb},
+		Promotions: &promotion.RedisRepo{Client: a.rdb},
+		Taxes:      a.taxes,
+	}
+
+	router.Use(a.timeout)
+
+	router.With(a.idempotency.Middleware).Post("/", cartHandler.Create)
+	router.Get("/{id}", cartHandler.GetByID)
+	router.Delete("/{id}", cartHandler.DeleteByID)
+	router.With(a.idempotency.Middleware).Post("/{id}/items", cartHandler.AddItem)
+	router.Put("/{id}/items/{product_id}", cartHandler.UpdateItem)
+	router.Delete("/{id}/items/{product_id}", cartHandler.RemoveItem)
+	router.With(a.idempotency.Middleware).Post("/{id}/checkout", cartHandler.Checkout)
 }
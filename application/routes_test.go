@@ -0,0 +1,68 @@
+package application
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/umuttopalak/orders-api/events"
+)
+
+// TestRoutesMatchSpec builds the router the server runs, which verifies
+// every route against openapi.json, so drift fails CI instead of startup.
+func TestRoutesMatchSpec(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	if _, err := New(defaultConfig(), logger); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestStreamOutlivesRequestTimeout checks that event streams are mounted
+// outside the request timeout.
+func TestStreamOutlivesRequestTimeout(t *testing.T) {
+	config := defaultConfig()
+	config.RedisAdress = miniredis.RunT(t).Addr()
+	config.RequestTimeout = 50 * time.Millisecond
+
+	app, err := New(config, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(app.router)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/v1/order/stream", nil)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET /v1/order/stream: %v", err)
+	}
+	defer res.Body.Close()
+
+	lines := bufio.NewScanner(res.Body)
+	for lines.Scan() && lines.Text() != ": connected" {
+	}
+
+	time.Sleep(3 * config.RequestTimeout)
+
+	e := events.Event{ID: "1-1", Type: events.OrderCreated, Aggregate: events.AggregateOrder, AggregateID: 1}
+	if err := events.Publish(ctx, app.rdb, e); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+
+	for lines.Scan() {
+		if lines.Text() == "id: 1-1" {
+			return
+		}
+	}
+	t.Fatalf("stream ended before the event was sent: %v", lines.Err())
+}
@@ -0,0 +1,136 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/umuttopalak/orders-api/logging"
+)
+
+type Handler func(ctx context.Context, e Event) error
+
+// Consumer reads the stream of one aggregate as a member of a consumer
+// group. Events are acknowledged once the handler returns nil. Failed
+// events stay pending and are retried after ClaimIdle, by this or by any
+// other consumer of the group, so handlers must be idempotent.
+type Consumer struct {
+	Client    *redis.Client
+	Aggregate string
+	Group     string
+	// Name identifies the consumer within the group and should be stable
+	// across restarts, so pending events are picked up again.
+	Name string
+
+	// Zero values use the defaults below.
+	Count     int64
+	Block     time.Duration
+	ClaimIdle time.Duration
+}
+
+const (
+	defaultCount     = 10
+	defaultBlock     = 5 * time.Second
+	defaultClaimIdle = time.Minute
+)
+
+// Run creates the group if needed, starting at the beginning of the stream,
+// and delivers events to handle until ctx is cancelled.
+func (c *Consumer) Run(ctx context.Context, handle Handler) error {
+	stream := StreamKey(c.Aggregate)
+
+	count := c.Count
+	if count <= 0 {
+		count = defaultCount
+	}
+	block := c.Block
+	if block <= 0 {
+		block = defaultBlock
+	}
+	claimIdle := c.ClaimIdle
+	if claimIdle <= 0 {
+		claimIdle = defaultClaimIdle
+	}
+
+	err := c.Client.XGroupCreateMkStream(ctx, stream, c.Group, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return fmt.Errorf("failed to create consumer group: %w", err)
+	}
+
+	// Entries delivered to this consumer before a restart come first, then
+	// new ones.
+	next := "0"
+	claimFrom := "0-0"
+
+	for ctx.Err() == nil {
+		claimed, start, err := c.Client.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+			Stream:   stream,
+			Group:    c.Group,
+			Consumer: c.Name,
+			MinIdle:  claimIdle,
+			Start:    claimFrom,
+			Count:    count,
+		}).Result()
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			return fmt.Errorf("failed to claim idle events: %w", err)
+		}
+		claimFrom = start
+		c.deliver(ctx, stream, claimed, handle)
+
+		streams, err := c.Client.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    c.Group,
+			Consumer: c.Name,
+			Streams:  []string{stream, next},
+			Count:    count,
+			Block:    block,
+		}).Result()
+		if errors.Is(err, redis.Nil) {
+			continue
+		} else if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			return fmt.Errorf("failed to read events: %w", err)
+		}
+
+		msgs := streams[0].Messages
+		if next != ">" {
+			if len(msgs) == 0 {
+				next = ">"
+				continue
+			}
+			next = msgs[len(msgs)-1].ID
+		}
+		c.deliver(ctx, stream, msgs, handle)
+	}
+
+	return nil
+}
+
+func (c *Consumer) deliver(ctx context.Context, stream string, msgs []redis.XMessage, handle Handler) {
+	logger := logging.FromContext(ctx)
+
+	for _, msg := range msgs {
+		e, err := parse(c.Aggregate, msg)
+		if err != nil {
+			// A malformed entry would fail again on every retry.
+			logger.Error("dropping malformed event", slog.String("stream", stream), slog.Any("error", err))
+		} else if err := handle(ctx, e); err != nil {
+			logger.Warn("event handler failed", slog.String("stream", stream), slog.String("id", msg.ID), slog.String("type", e.Type), slog.Any("error", err))
+			continue
+		}
+
+		// A handled event is acked even if shutdown started meanwhile, so it
+		// is not handled again after the restart.
+		if err := c.Client.XAck(context.WithoutCancel(ctx), stream, c.Group, msg.ID).Err(); err != nil {
+			logger.Error("failed to ack event", slog.String("stream", stream), slog.String("id", msg.ID), slog.Any("error", err))
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestClient(t *testing.T) *redis.Client {
+	t.Helper()
+
+	client := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func publish(t *testing.T, client *redis.Client, ids ...uint64) {
+	t.Helper()
+
+	for _, id := range ids {
+		e, err := New(OrderCreated, AggregateOrder, id, 1, map[string]uint64{"order_id": id})
+		if err != nil {
+			t.Fatalf("new event: %v", err)
+		}
+		_, err = client.TxPipelined(context.Background(), func(pipe redis.Pipeliner) error {
+			Append(context.Background(), pipe, e)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("append event: %v", err)
+		}
+	}
+}
+
+// run runs c until handle has been called calls times or a second has
+// passed, and returns the aggregate IDs it was called with.
+func run(t *testing.T, c *Consumer, calls int, handle Handler) []uint64 {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	var mu sync.Mutex
+	var got []uint64
+	err := c.Run(ctx, func(ctx context.Context, e Event) error {
+		mu.Lock()
+		got = append(got, e.AggregateID)
+		if len(got) == calls {
+			cancel()
+		}
+		mu.Unlock()
+		return handle(ctx, e)
+	})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	return got
+}
+
+func pending(t *testing.T, client *redis.Client, group string) int64 {
+	t.Helper()
+
+	res, err := client.XPending(context.Background(), StreamKey(AggregateOrder), group).Result()
+	if err != nil {
+		t.Fatalf("XPENDING: %v", err)
+	}
+	return res.Count
+}
+
+func consumer(client *redis.Client, name string) *Consumer {
+	return &Consumer{
+		Client:    client,
+		Aggregate: AggregateOrder,
+		Group:     "test",
+		Name:      name,
+		Block:     10 * time.Millisecond,
+		ClaimIdle: 50 * time.Millisecond,
+	}
+}
+
+func TestConsumerRun(t *testing.T) {
+	errFailed := errors.New("failed")
+
+	tests := []struct {
+		name    string
+		fail    map[uint64]bool
+		calls   int
+		want    string
+		pending int64
+	}{
+		{"acknowledged", nil, 3, "[1 2 3]", 0},
+		{"failed stay pending", map[uint64]bool{2: true}, 3, "[1 2 3]", 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newTestClient(t)
+			publish(t, client, 1, 2, 3)
+
+			got := run(t, consumer(client, "a"), tt.calls, func(ctx context.Context, e Event) error {
+				if tt.fail[e.AggregateID] {
+					return errFailed
+				}
+				return nil
+			})
+			if fmt.Sprint(got) != tt.want {
+				t.Errorf("delivered %v, want %s", got, tt.want)
+			}
+			if n := pending(t, client, "test"); n != tt.pending {
+				t.Errorf("pending = %d, want %d", n, tt.pending)
+			}
+		})
+	}
+}
+
+func TestConsumerRestartRedeliversPending(t *testing.T) {
+	client := newTestClient(t)
+	publish(t, client, 1, 2)
+
+	// The first run fails the second event and stops.
+	run(t, consumer(client, "a"), 2, func(ctx context.Context, e Event) error {
+		if e.AggregateID == 2 {
+			return errors.New("failed")
+		}
+		return nil
+	})
+	publish(t, client, 3)
+
+	// After a restart under the same name its pending event comes first,
+	// then the new one.
+	got := run(t, consumer(client, "a"), 2, func(context.Context, Event) error { return nil })
+	if fmt.Sprint(got) != "[2 3]" {
+		t.Errorf("delivered %v after restart, want [2 3]", got)
+	}
+	if n := pending(t, client, "test"); n != 0 {
+		t.Errorf("pending = %d, want 0", n)
+	}
+}
+
+func TestConsumerClaimsIdleEvents(t *testing.T) {
+	client := newTestClient(t)
+	publish(t, client, 1, 2)
+
+	// Consumer a fails the second event and goes away for good.
+	run(t, consumer(client, "a"), 2, func(ctx context.Context, e Event) error {
+		if e.AggregateID == 2 {
+			return errors.New("failed")
+		}
+		return nil
+	})
+
+	// Consumer b gets it once it has been idle for ClaimIdle.
+	got := run(t, consumer(client, "b"), 1, func(context.Context, Event) error { return nil })
+	if fmt.Sprint(got) != "[2]" {
+		t.Fatalf("b delivered %v, want [2]", got)
+	}
+	if n := pending(t, client, "test"); n != 0 {
+		t.Errorf("pending = %d, want 0", n)
+	}
+}
+
+func TestConsumerDropsMalformedEvents(t *testing.T) {
+	client := newTestClient(t)
+	client.XAdd(context.Background(), &redis.XAddArgs{
+		Stream: StreamKey(AggregateOrder),
+		Values: []any{"type", OrderCreated, "aggregate_id", "not a number"},
+	})
+	publish(t, client, 2)
+
+	got := run(t, consumer(client, "a"), 1, func(context.Context, Event) error { return nil })
+	if fmt.Sprint(got) != "[2]" {
+		t.Errorf("delivered %v, want [2]", got)
+	}
+	if n := pending(t, client, "test"); n != 0 {
+		t.Errorf("pending = %d, want the malformed event acknowledged", n)
+	}
+}
@@ -0,0 +1,45 @@
+// Package events publishes domain events to Redis Streams and reads them
+// back through consumer groups.
+//
+// Repositories append events in the same MULTI/EXEC as the write that
+// caused them, so an event is on the stream if and only if the change was
+// stored. Each aggregate has its own stream, named events:<aggregate>:
+//
+//	events:order     OrderCreated, OrderUpdated, OrderShipped, OrderCompleted, OrderDeleted,
+//	                 OrderPaid, OrderPaymentFailed, OrderRefunded
+//	events:customer  CustomerCreated, CustomerUpdated, CustomerDeleted
+//	events:product   ProductCreated, ProductUpdated, ProductPriceChanged, ProductDeleted
+//	events:return    ReturnRequested, ReturnApproved, ReturnRejected, ReturnReceived,
+//	                 ReturnRefunded
+//
+// Every stream entry has the fields
+//
+//	type          event type, one of the names above
+//	aggregate_id  ID of the order, customer, product or return, in decimal
+//	version       version of the aggregate after the change, 0 for deletes
+//	occurred_at   RFC 3339 timestamp with nanoseconds, UTC
+//	data          JSON payload
+//
+// The payload of the Created, Updated, Shipped and Completed events is the
+// aggregate as returned by the API after the change. Deleted events carry
+// the aggregate as it was before the delete. ProductPriceChanged carries
+//
+//	{"product_id": 1, "old_price": 100, "new_price": 120}
+//
+// and is appended next to the ProductUpdated event of the same write. A
+// shipped or completed order gets OrderShipped or OrderCompleted instead
+// of OrderUpdated. Likewise, a change of the order's payment_status to
+// paid, failed or (partially) refunded is reported as OrderPaid,
+// OrderPaymentFailed or OrderRefunded.
+//
+// Return events carry the return after it moved to the named status. The
+// inventory consumer group restocks the items of every ReturnReceived
+// event whose restock flag is set, see package inventory.
+//
+// After the transaction commits, the order repository also publishes each
+// event, with its entry ID, as JSON on the pub/sub channel
+// events:order:live for listeners that want changes as they happen.
+//
+// Streams are trimmed to roughly MaxLen entries. Consumers that fall
+// further behind lose the oldest events.
+package events
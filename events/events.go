@@ -0,0 +1,128 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	OrderCreated   = "OrderCreated"
+	OrderUpdated   = "OrderUpdated"
+	OrderShipped   = "OrderShipped"
+	OrderCompleted = "OrderCompleted"
+	OrderDeleted   = "OrderDeleted"
+
+	OrderPaid          = "OrderPaid"
+	OrderPaymentFailed = "OrderPaymentFailed"
+	OrderRefunded      = "OrderRefunded"
+
+	CustomerCreated = "CustomerCreated"
+	CustomerUpdated = "CustomerUpdated"
+	CustomerDeleted = "CustomerDeleted"
+
+	ProductCreated      = "ProductCreated"
+	ProductUpdated      = "ProductUpdated"
+	ProductPriceChanged = "ProductPriceChanged"
+	ProductDeleted      = "ProductDeleted"
+
+	ReturnRequested = "ReturnRequested"
+	ReturnApproved  = "ReturnApproved"
+	ReturnRejected  = "ReturnRejected"
+	ReturnReceived  = "ReturnReceived"
+	ReturnRefunded  = "ReturnRefunded"
+)
+
+const (
+	AggregateOrder    = "order"
+	AggregateCustomer = "customer"
+	AggregateProduct  = "product"
+	AggregateReturn   = "return"
+)
+
+// MaxLen is the approximate number of entries kept per stream.
+const MaxLen = 1_000_000
+
+type Event struct {
+	// ID is the stream entry ID. It is assigned by Redis and only set on
+	// events that were read back.
+	ID          string          `json:"id,omitempty"`
+	Type        string          `json:"type"`
+	Aggregate   string          `json:"aggregate"`
+	AggregateID uint64          `json:"aggregate_id"`
+	Version     uint64          `json:"version"`
+	OccurredAt  time.Time       `json:"occurred_at"`
+	Data        json.RawMessage `json:"data"`
+}
+
+type PriceChange struct {
+	ProductID uint64 `json:"product_id"`
+	OldPrice  int64  `json:"old_price"`
+	NewPrice  int64  `json:"new_price"`
+}
+
+func StreamKey(aggregate string) string {
+	return "events:" + aggregate
+}
+
+func New(typ, aggregate string, id, version uint64, data any) (Event, error) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return Event{}, fmt.Errorf("failed to encode %s event: %w", typ, err)
+	}
+
+	return Event{
+		Type:        typ,
+		Aggregate:   aggregate,
+		AggregateID: id,
+		Version:     version,
+		OccurredAt:  time.Now().UTC(),
+		Data:        payload,
+	}, nil
+}
+
+// Append queues an XADD of e on pipe. Pass the pipeline of the transaction
+// that stores the change so both are applied together. The returned command
+// holds the entry ID once the transaction has run.
+func Append(ctx context.Context, pipe redis.Pipeliner, e Event) *redis.StringCmd {
+	return pipe.XAdd(ctx, &redis.XAddArgs{
+		Stream: StreamKey(e.Aggregate),
+		MaxLen: MaxLen,
+		Approx: true,
+		Values: []any{
+			"type", e.Type,
+			"aggregate_id", strconv.FormatUint(e.AggregateID, 10),
+			"version", strconv.FormatUint(e.Version, 10),
+			"occurred_at", e.OccurredAt.Format(time.RFC3339Nano),
+			"data", string(e.Data),
+		},
+	})
+}
+
+func parse(aggregate string, msg redis.XMessage) (Event, error) {
+	e := Event{ID: msg.ID, Aggregate: aggregate}
+
+	field := func(name string) string {
+		v, _ := msg.Values[name].(string)
+		return v
+	}
+
+	var err error
+	e.Type = field("type")
+	if e.AggregateID, err = strconv.ParseUint(field("aggregate_id"), 10, 64); err != nil {
+		return Event{}, fmt.Errorf("event %s: invalid aggregate_id: %w", msg.ID, err)
+	}
+	if e.Version, err = strconv.ParseUint(field("version"), 10, 64); err != nil {
+		return Event{}, fmt.Errorf("event %s: invalid version: %w", msg.ID, err)
+	}
+	if e.OccurredAt, err = time.Parse(time.RFC3339Nano, field("occurred_at")); err != nil {
+		return Event{}, fmt.Errorf("event %s: invalid occurred_at: %w", msg.ID, err)
+	}
+	e.Data = json.RawMessage(field("data"))
+
+	return e, nil
+}
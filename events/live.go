@@ -0,0 +1,85 @@
+package events
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// LiveChannel is the pub/sub channel on which an aggregate's events are
+// published once their write has been committed.
+func LiveChannel(aggregate string) string {
+	return StreamKey(aggregate) + ":live"
+}
+
+// Publish sends e, which must carry its stream entry ID, to the live
+// channel of its aggregate. Pub/sub has no delivery guarantee, so listeners
+// that miss a message catch up from the stream with After.
+func Publish(ctx context.Context, client redis.Cmdable, e Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s event: %w", e.Type, err)
+	}
+
+	if err := client.Publish(ctx, LiveChannel(e.Aggregate), data).Err(); err != nil {
+		return fmt.Errorf("failed to publish %s event: %w", e.Type, err)
+	}
+	return nil
+}
+
+// After returns up to count events of aggregate that were appended after
+// the entry with ID id, oldest first.
+func After(ctx context.Context, client redis.Cmdable, aggregate, id string, count int64) ([]Event, error) {
+	msgs, err := client.XRangeN(ctx, StreamKey(aggregate), "("+id, "+", count).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s events: %w", aggregate, err)
+	}
+
+	evs := make([]Event, 0, len(msgs))
+	for _, msg := range msgs {
+		e, err := parse(aggregate, msg)
+		if err != nil {
+			return nil, err
+		}
+		evs = append(evs, e)
+	}
+	return evs, nil
+}
+
+// ValidID reports whether id has the <ms>-<seq> form of a stream entry ID.
+func ValidID(id string) bool {
+	_, _, ok := splitID(id)
+	return ok
+}
+
+// CompareIDs orders two valid stream entry IDs like strings.Compare.
+func CompareIDs(a, b string) int {
+	ams, aseq, _ := splitID(a)
+	bms, bseq, _ := splitID(b)
+
+	if c := cmp.Compare(ams, bms); c != 0 {
+		return c
+	}
+	return cmp.Compare(aseq, bseq)
+}
+
+func splitID(id string) (ms, seq uint64, ok bool) {
+	msPart, seqPart, found := strings.Cut(id, "-")
+	if !found {
+		return 0, 0, false
+	}
+
+	var err error
+	if ms, err = strconv.ParseUint(msPart, 10, 64); err != nil {
+		return 0, 0, false
+	}
+	if seq, err = strconv.ParseUint(seqPart, 10, 64); err != nil {
+		return 0, 0, false
+	}
+	return ms, seq, true
+}
@@ -0,0 +1,162 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"strconv"
+
+	"github.com/umuttopalak/orders-api/logging"
+	"github.com/umuttopalak/orders-api/model"
+	"github.com/umuttopalak/orders-api/repository/batch"
+)
+
+const maxBatchSize = 1000
+
+// batchResult reports the outcome of one element of a batch request, using
+// the status code the single item endpoint would have answered with.
+type batchResult struct {
+	Index   int    `json:"index"`
+	Status  int    `json:"status"`
+	ID      uint64 `json:"id,omitempty"`
+	Version uint64 `json:"version,omitempty"`
+	Error   string `json:"error,omitempty"`
+	Item    any    `json:"item,omitempty"`
+}
+
+type batchTarget struct {
+	ID      uint64 `json:"id"`
+	Version uint64 `json:"version"`
+}
+
+// decodeBatch reads the ?atomic= mode and a JSON array body into items.
+// It writes the error response itself and reports whether to continue.
+func decodeBatch[T any](w http.ResponseWriter, r *http.Request, items *[]T) (atomic, ok bool) {
+	if mode := r.URL.Query().Get("atomic"); mode != "" {
+		var err error
+		atomic, err = strconv.ParseBool(mode)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return false, false
+		}
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(items); err != nil {
+		w.WriteHeader(decodeErrorStatus(err))
+		return false, false
+	}
+
+	if len(*items) == 0 || len(*items) > maxBatchSize {
+		w.WriteHeader(http.StatusBadRequest)
+		return false, false
+	}
+
+	return atomic, true
+}
+
+// abortAtomic reports whether an atomic batch has to be rejected because
+// an element failed validation, marking the other elements as not applied.
+func abortAtomic(results []batchResult, atomic bool) bool {
+	if !atomic {
+		return false
+	}
+
+	failed := false
+	for _, res := range results {
+		if res.Status != 0 {
+			failed = true
+		}
+	}
+	if !failed {
+		return false
+	}
+
+	for i := range results {
+		if results[i].Status == 0 {
+			results[i] = batchResult{Index: i, Status: http.StatusFailedDependency, Error: batch.ErrAborted.Error()}
+		}
+	}
+
+	return true
+}
+
+func batchErrorResult(index int, err error) batchResult {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, batch.ErrNotExist):
+		status = http.StatusNotFound
+	case errors.Is(err, batch.ErrVersionMismatch):
+		status = http.StatusPreconditionFailed
+	case errors.Is(err, batch.ErrExists), errors.Is(err, batch.ErrDuplicate):
+		status = http.StatusConflict
+	case errors.Is(err, batch.ErrAborted):
+		status = http.StatusFailedDependency
+	}
+
+	return batchResult{Index: index, Status: status, Error: err.Error()}
+}
+
+// writeBatchResults answers 200 when every element was applied, 207 when
+// only some were and 422 when an atomic batch was rejected as a whole.
+func writeBatchResults(w http.ResponseWriter, r *http.Request, results []batchResult, atomic bool) {
+	status := http.StatusOK
+	for _, res := range results {
+		if res.Status >= http.StatusBadRequest {
+			status = http.StatusMultiStatus
+			if atomic {
+				status = http.StatusUnprocessableEntity
+			}
+			break
+		}
+	}
+
+	var response struct {
+		Atomic  bool          `json:"atomic"`
+		Results []batchResult `json:"results"`
+	}
+	response.Atomic = atomic
+	response.Results = results
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to marshal", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if _, err := w.Write(data); err != nil {
+		logging.FromContext(r.Context()).Error("failed to write response", slog.Any("error", err))
+	}
+}
+
+func validateProduct(p model.Product) error {
+	if p.ProductName == "" {
+		return errors.New("product_name is required")
+	}
+	if p.ProductPrice < 0 {
+		return errors.New("price must not be negative")
+	}
+	return nil
+}
+
+func validateCategory(c model.Category) error {
+	if c.CategoryName == "" {
+		return errors.New("category_name is required")
+	}
+	return nil
+}
+
+func validateCustomer(c model.Customer) error {
+	if c.Name == "" {
+		return errors.New("name is required")
+	}
+	if _, err := mail.ParseAddress(c.Email.Address); err != nil {
+		return fmt.Errorf("invalid email: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/umuttopalak/orders-api/model"
+	"github.com/umuttopalak/orders-api/repository/product"
+)
+
+func TestProductBatchUpdateVersion(t *testing.T) {
+	tests := []struct {
+		name           string
+		stored         uint64
+		version        string
+		requireIfMatch bool
+		status         int
+		want           uint64
+	}{
+		{"current version", 3, `"version":3,`, false, http.StatusOK, 4},
+		{"stale version", 3, `"version":2,`, false, http.StatusPreconditionFailed, 3},
+		{"unversioned", 3, ``, false, http.StatusOK, 4},
+		{"zero", 3, `"version":0,`, false, http.StatusOK, 4},
+		{"stored before versions", 0, ``, false, http.StatusOK, 1},
+		{"unversioned with If-Match required", 3, ``, true, http.StatusBadRequest, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Product{Repo: &product.RedisRepo{Client: newTestRedis(t)}, RequireIfMatch: tt.requireIfMatch}
+			if err := h.Repo.Insert(context.Background(), model.Product{ProductID: 7, ProductName: "Kettle", ProductPrice: 1250, Version: tt.stored}); err != nil {
+				t.Fatalf("insert product: %v", err)
+			}
+
+			body := `[{"product_id":7,` + tt.version + `"product_name":"Kettle","price":999}]`
+			w := serve(h.BatchUpdate, http.MethodPut, "/product/batch", "/product/batch", body)
+
+			var res struct {
+				Results []batchResult `json:"results"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || len(res.Results) != 1 {
+				t.Fatalf("batch update = %d %s", w.Code, w.Body)
+			}
+			if res.Results[0].Status != tt.status {
+				t.Errorf("status = %d %s, want %d", res.Results[0].Status, res.Results[0].Error, tt.status)
+			}
+
+			stored, err := h.Repo.FindByID(context.Background(), 7)
+			if err != nil {
+				t.Fatalf("find product: %v", err)
+			}
+			if stored.Version != tt.want {
+				t.Errorf("stored version = %d, want %d", stored.Version, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func cacheControl(maxAge time.Duration) string {
+	if maxAge <= 0 {
+		return "no-cache"
+	}
+
+	return "public, max-age=" + strconv.Itoa(int(maxAge.Seconds()))
+}
+
+// contentETag is a weak validator derived from the response body, for
+// representations such as list pages that have no single version.
+func contentETag(data []byte) string {
+	sum := sha256.Sum256(data)
+	return `W/"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// checkNotModified sets the validators for a GET response and writes 304
+// when the client's cached copy is still current. If-None-Match takes
+// precedence over If-Modified-Since as RFC 9110 requires.
+func checkNotModified(w http.ResponseWriter, r *http.Request, tag string, modified *time.Time) bool {
+	w.Header().Set("ETag", tag)
+	if modified != nil {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+
+	if header := r.Header.Get("If-None-Match"); header != "" {
+		if matchesIfNoneMatch(header, tag) {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+		return false
+	}
+
+	if header := r.Header.Get("If-Modified-Since"); header != "" && modified != nil {
+		since, err := http.ParseTime(header)
+		if err == nil && !modified.Truncate(time.Second).After(since) {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchesIfNoneMatch uses weak comparison, so W/"1" matches "1".
+func matchesIfNoneMatch(header, tag string) bool {
+	tag = strings.TrimPrefix(tag, "W/")
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == tag {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,82 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCheckNotModified(t *testing.T) {
+	modified := time.Date(2026, time.October, 19, 12, 30, 15, 500_000_000, time.UTC)
+	format := func(t time.Time) string { return t.Format(http.TimeFormat) }
+
+	tests := []struct {
+		name            string
+		ifNoneMatch     string
+		ifModifiedSince string
+		modified        *time.Time
+		notModified     bool
+	}{
+		{"no validators", "", "", &modified, false},
+		{"same second", "", format(modified), &modified, true},
+		{"later", "", format(modified.Add(time.Hour)), &modified, true},
+		{"earlier", "", format(modified.Add(-time.Second)), &modified, false},
+		{"malformed date", "", "yesterday", &modified, false},
+		{"never modified", "", format(modified), nil, false},
+		{"matching tag", `"3"`, "", &modified, true},
+		{"weak matching tag", `W/"3"`, "", &modified, true},
+		{"stale tag", `"2"`, "", &modified, false},
+		{"stale tag wins over date", `"2"`, format(modified), &modified, false},
+		{"matching tag wins over date", `"3"`, format(modified.Add(-time.Hour)), &modified, true},
+		{"wildcard", "*", "", &modified, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/product/1", nil)
+			if tt.ifNoneMatch != "" {
+				r.Header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+			if tt.ifModifiedSince != "" {
+				r.Header.Set("If-Modified-Since", tt.ifModifiedSince)
+			}
+			w := httptest.NewRecorder()
+
+			if got := checkNotModified(w, r, `"3"`, tt.modified); got != tt.notModified {
+				t.Errorf("checkNotModified = %v, want %v", got, tt.notModified)
+			}
+			if tt.notModified && w.Code != http.StatusNotModified {
+				t.Errorf("status = %d, want %d", w.Code, http.StatusNotModified)
+			}
+			if got := w.Header().Get("ETag"); got != `"3"` {
+				t.Errorf("ETag = %q, want %q", got, `"3"`)
+			}
+			wantModified := ""
+			if tt.modified != nil {
+				wantModified = format(modified)
+			}
+			if got := w.Header().Get("Last-Modified"); got != wantModified {
+				t.Errorf("Last-Modified = %q, want %q", got, wantModified)
+			}
+		})
+	}
+}
+
+func TestCacheControl(t *testing.T) {
+	tests := []struct {
+		maxAge time.Duration
+		want   string
+	}{
+		{0, "no-cache"},
+		{-time.Second, "no-cache"},
+		{time.Minute, "public, max-age=60"},
+		{1500 * time.Millisecond, "public, max-age=1"},
+	}
+
+	for _, tt := range tests {
+		if got := cacheControl(tt.maxAge); got != tt.want {
+			t.Errorf("cacheControl(%v) = %q, want %q", tt.maxAge, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,492 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/umuttopalak/orders-api/logging"
+	"github.com/umuttopalak/orders-api/metrics"
+	"github.com/umuttopalak/orders-api/model"
+	"github.com/umuttopalak/orders-api/repository/cart"
+	"github.com/umuttopalak/orders-api/repository/order"
+	"github.com/umuttopalak/orders-api/repository/product"
+	"github.com/umuttopalak/orders-api/repository/promotion"
+	"github.com/umuttopalak/orders-api/tax"
+)
+
+// maxCartItems bounds the number of distinct products in a cart.
+const maxCartItems = 100
+
+type Cart struct {
+	Repo     *cart.RedisRepo
+	Products *product.RedisRepo
+	Orders   *order.RedisRepo
+	// Promotions applies discount codes given at checkout.
+	Promotions *promotion.RedisRepo
+	Taxes      *tax.Table
+}
+
+// cartLine is a cart item priced from the current product. Items whose
+// product has been deleted stay in the cart as unavailable until removed,
+// and block checkout.
+type cartLine struct {
+	ProductID   uint64 `json:"product_id"`
+	ProductName string `json:"product_name,omitempty"`
+	Quantity    uint   `json:"quantity"`
+	Price       int64  `json:"price"`
+	Subtotal    int64  `json:"subtotal"`
+	Available   bool   `json:"available"`
+}
+
+type cartView struct {
+	CartID     uuid.UUID  `json:"cart_id"`
+	CustomerID uuid.UUID  `json:"customer_id"`
+	Items      []cartLine `json:"items"`
+	Total      int64      `json:"total"`
+	CreatedAt  *time.Time `json:"created_at"`
+	UpdatedAt  *time.Time `json:"updated_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	Version    uint64     `json:"version"`
+}
+
+type cartItemBody struct {
+	ProductID uint64 `json:"product_id"`
+	Quantity  uint   `json:"quantity"`
+}
+
+func (h *Cart) Create(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		CustomerID uuid.UUID      `json:"customer_id"`
+		Items      []cartItemBody `json:"items"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(decodeErrorStatus(err))
+		return
+	}
+
+	if body.CustomerID == uuid.Nil {
+		writeError(w, http.StatusBadRequest, "customer_id is required")
+		return
+	}
+
+	now := time.Now().UTC()
+	c := model.Cart{
+		CartID:     uuid.New(),
+		CustomerID: body.CustomerID,
+		Items:      []model.CartItem{},
+		CreatedAt:  &now,
+		UpdatedAt:  &now,
+		Version:    1,
+	}
+	for _, item := range body.Items {
+		if err := addCartItem(&c, item); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	if !h.checkProducts(w, r, c.Items) {
+		return
+	}
+
+	if err := h.Repo.Insert(r.Context(), c); err != nil {
+		logging.FromContext(r.Context()).Error("failed to insert", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	h.writeCart(w, r, http.StatusCreated, c)
+}
+
+func (h *Cart) GetByID(w http.ResponseWriter, r *http.Request) {
+	c, ok := h.find(w, r)
+	if !ok {
+		return
+	}
+
+	h.writeCart(w, r, http.StatusOK, c)
+}
+
+func (h *Cart) DeleteByID(w http.ResponseWriter, r *http.Request) {
+	c, ok := h.find(w, r)
+	if !ok {
+		return
+	}
+
+	if !checkIfMatch(w, r, c.Version, false) {
+		return
+	}
+
+	err := h.Repo.DeleteByID(r.Context(), c.CartID, c.Version)
+	if errors.Is(err, cart.ErrNotExist) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if errors.Is(err, cart.ErrVersionMismatch) {
+		w.WriteHeader(versionConflictStatus(r))
+		return
+	} else if err != nil {
+		logging.FromContext(r.Context()).Error("failed to delete", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// AddItem adds a product to the cart, or raises its quantity if it is
+// already in the cart.
+func (h *Cart) AddItem(w http.ResponseWriter, r *http.Request) {
+	var body cartItemBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(decodeErrorStatus(err))
+		return
+	}
+
+	if !h.checkProducts(w, r, []model.CartItem{{ProductID: body.ProductID}}) {
+		return
+	}
+
+	h.modify(w, r, func(c *model.Cart) (int, error) {
+		if err := addCartItem(c, body); err != nil {
+			return http.StatusBadRequest, err
+		}
+		return 0, nil
+	})
+}
+
+// UpdateItem sets the quantity of a product in the cart. A quantity of 0
+// removes it.
+func (h *Cart) UpdateItem(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Quantity uint `json:"quantity"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(decodeErrorStatus(err))
+		return
+	}
+
+	productID, err := strconv.ParseUint(chi.URLParam(r, "product_id"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	h.modify(w, r, func(c *model.Cart) (int, error) {
+		return setCartItem(c, productID, body.Quantity)
+	})
+}
+
+func (h *Cart) RemoveItem(w http.ResponseWriter, r *http.Request) {
+	productID, err := strconv.ParseUint(chi.URLParam(r, "product_id"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	h.modify(w, r, func(c *model.Cart) (int, error) {
+		return setCartItem(c, productID, 0)
+	})
+}
+
+// Checkout turns the cart into an order at the current product prices,
+// through the same validation as POST /order, with an optional discount
+// code and shipping region. The cart is removed first, so a cart can only
+// be checked out once, and restored if the order cannot be stored.
+func (h *Cart) Checkout(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		DiscountCode   string `json:"discount_code"`
+		ShippingRegion string `json:"shipping_region"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		w.WriteHeader(decodeErrorStatus(err))
+		return
+	}
+
+	c, ok := h.find(w, r)
+	if !ok {
+		return
+	}
+
+	if !checkIfMatch(w, r, c.Version, false) {
+		return
+	}
+
+	if len(c.Items) == 0 {
+		writeError(w, http.StatusBadRequest, "cart is empty")
+		return
+	}
+
+	products, err := h.products(r.Context(), c.Items)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to find products", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	items := make([]model.LineItem, 0, len(c.Items))
+	for _, item := range c.Items {
+		p, ok := products[item.ProductID]
+		if !ok {
+			writeError(w, http.StatusConflict, fmt.Sprintf("product %d is no longer available", item.ProductID))
+			return
+		}
+
+		items = append(items, model.LineItem{
+			ItemID:    uuid.New(),
+			ProductID: p.ProductID,
+			Quantity:  item.Quantity,
+			Price:     uint(p.ProductPrice),
+		})
+	}
+
+	o, err := newOrder(c.CustomerID, items)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if !setShippingRegion(w, h.Taxes, &o, body.ShippingRegion) {
+		return
+	}
+
+	release := func() {}
+	if body.DiscountCode != "" {
+		var serr *statusError
+		release, err = redeemPromotion(r.Context(), h.Promotions, h.Products, &o, body.DiscountCode)
+		if errors.As(err, &serr) {
+			writeError(w, serr.status, serr.msg)
+			return
+		} else if err != nil {
+			logging.FromContext(r.Context()).Error("failed to apply discount code", slog.Any("error", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := applyTax(r.Context(), h.Taxes, h.Products, &o); err != nil {
+		release()
+		logging.FromContext(r.Context()).Error("failed to apply tax", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	err = h.Repo.DeleteByID(r.Context(), c.CartID, c.Version)
+	if errors.Is(err, cart.ErrNotExist) {
+		release()
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if errors.Is(err, cart.ErrVersionMismatch) {
+		release()
+		w.WriteHeader(versionConflictStatus(r))
+		return
+	} else if err != nil {
+		release()
+		logging.FromContext(r.Context()).Error("failed to delete cart", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.Orders.Insert(r.Context(), o); err != nil {
+		release()
+		logging.FromContext(r.Context()).Error("failed to insert", slog.Any("error", err))
+		if err := h.Repo.Insert(context.WithoutCancel(r.Context()), c); err != nil {
+			logging.FromContext(r.Context()).Error("failed to restore cart", slog.Any("error", err), slog.String("cart_id", c.CartID.String()))
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	metrics.OrdersCreated.Inc()
+
+	res, err := json.Marshal(o)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to marshal", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", etag(o.Version))
+	w.WriteHeader(http.StatusCreated)
+	if _, err := w.Write(res); err != nil {
+		logging.FromContext(r.Context()).Error("failed to write response", slog.Any("error", err))
+	}
+}
+
+func (h *Cart) find(w http.ResponseWriter, r *http.Request) (model.Cart, bool) {
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return model.Cart{}, false
+	}
+
+	c, err := h.Repo.FindByID(r.Context(), id)
+	if errors.Is(err, cart.ErrNotExist) {
+		w.WriteHeader(http.StatusNotFound)
+		return model.Cart{}, false
+	} else if err != nil {
+		logging.FromContext(r.Context()).Error("failed to find by id", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return model.Cart{}, false
+	}
+
+	return c, true
+}
+
+// modify applies change to the cart and stores it. Without If-Match, a
+// concurrent change of the cart is retried on the fresh cart, since item
+// edits do not depend on each other. change reports client errors with a
+// status.
+func (h *Cart) modify(w http.ResponseWriter, r *http.Request, change func(*model.Cart) (int, error)) {
+	for attempt := 1; ; attempt++ {
+		c, ok := h.find(w, r)
+		if !ok {
+			return
+		}
+
+		if !checkIfMatch(w, r, c.Version, false) {
+			return
+		}
+
+		if status, err := change(&c); err != nil {
+			writeError(w, status, err.Error())
+			return
+		}
+
+		now := time.Now().UTC()
+		c.UpdatedAt = &now
+
+		c, err := h.Repo.Update(r.Context(), c)
+		if errors.Is(err, cart.ErrVersionMismatch) {
+			if r.Header.Get("If-Match") == "" && attempt < orderUpdateRetries {
+				continue
+			}
+			w.WriteHeader(versionConflictStatus(r))
+			return
+		} else if errors.Is(err, cart.ErrNotExist) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		} else if err != nil {
+			logging.FromContext(r.Context()).Error("failed to update", slog.Any("error", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		h.writeCart(w, r, http.StatusOK, c)
+		return
+	}
+}
+
+// checkProducts answers 422 if any of the items' products does not exist.
+func (h *Cart) checkProducts(w http.ResponseWriter, r *http.Request, items []model.CartItem) bool {
+	products, err := h.products(r.Context(), items)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to find products", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return false
+	}
+
+	for _, item := range items {
+		if _, ok := products[item.ProductID]; !ok {
+			writeError(w, http.StatusUnprocessableEntity, fmt.Sprintf("product %d does not exist", item.ProductID))
+			return false
+		}
+	}
+	return true
+}
+
+func (h *Cart) products(ctx context.Context, items []model.CartItem) (map[uint64]model.Product, error) {
+	ids := make([]uint64, len(items))
+	for i, item := range items {
+		ids[i] = item.ProductID
+	}
+	return h.Products.FindByIDs(ctx, ids)
+}
+
+func (h *Cart) writeCart(w http.ResponseWriter, r *http.Request, status int, c model.Cart) {
+	products, err := h.products(r.Context(), c.Items)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to find products", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	view := cartView{
+		CartID:     c.CartID,
+		CustomerID: c.CustomerID,
+		Items:      make([]cartLine, 0, len(c.Items)),
+		CreatedAt:  c.CreatedAt,
+		UpdatedAt:  c.UpdatedAt,
+		ExpiresAt:  time.Now().UTC().Add(h.Repo.TTL).Truncate(time.Second),
+		Version:    c.Version,
+	}
+	for _, item := range c.Items {
+		line := cartLine{ProductID: item.ProductID, Quantity: item.Quantity}
+		if p, ok := products[item.ProductID]; ok {
+			line.ProductName = p.ProductName
+			line.Price = p.ProductPrice
+			line.Subtotal = p.ProductPrice * int64(item.Quantity)
+			line.Available = true
+		}
+		view.Items = append(view.Items, line)
+		view.Total += line.Subtotal
+	}
+
+	res, err := json.Marshal(view)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to marshal", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", etag(c.Version))
+	w.WriteHeader(status)
+	if _, err := w.Write(res); err != nil {
+		logging.FromContext(r.Context()).Error("failed to write response", slog.Any("error", err))
+	}
+}
+
+func addCartItem(c *model.Cart, item cartItemBody) error {
+	if item.Quantity == 0 {
+		return errors.New("quantity must be at least 1")
+	}
+
+	for i := range c.Items {
+		if c.Items[i].ProductID == item.ProductID {
+			c.Items[i].Quantity += item.Quantity
+			return nil
+		}
+	}
+
+	if len(c.Items) == maxCartItems {
+		return fmt.Errorf("a cart holds at most %d products", maxCartItems)
+	}
+	c.Items = append(c.Items, model.CartItem{ProductID: item.ProductID, Quantity: item.Quantity})
+	return nil
+}
+
+func setCartItem(c *model.Cart, productID uint64, quantity uint) (int, error) {
+	for i := range c.Items {
+		if c.Items[i].ProductID != productID {
+			continue
+		}
+
+		if quantity == 0 {
+			c.Items = append(c.Items[:i], c.Items[i+1:]...)
+		} else {
+			c.Items[i].Quantity = quantity
+		}
+		return 0, nil
+	}
+
+	return http.StatusNotFound, fmt.Errorf("product %d is not in the cart", productID)
+}
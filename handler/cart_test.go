@@ -0,0 +1,255 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"github.com/umuttopalak/orders-api/model"
+	"github.com/umuttopalak/orders-api/repository/cart"
+	"github.com/umuttopalak/orders-api/repository/order"
+	"github.com/umuttopalak/orders-api/repository/product"
+)
+
+func TestAddCartItem(t *testing.T) {
+	full := make([]model.CartItem, maxCartItems)
+	for i := range full {
+		full[i] = model.CartItem{ProductID: uint64(i + 1), Quantity: 1}
+	}
+
+	tests := []struct {
+		name  string
+		items []model.CartItem
+		add   cartItemBody
+		want  []model.CartItem
+		err   string
+	}{
+		{"new product", []model.CartItem{{ProductID: 1, Quantity: 1}}, cartItemBody{2, 3}, []model.CartItem{{ProductID: 1, Quantity: 1}, {ProductID: 2, Quantity: 3}}, ""},
+		{"merged", []model.CartItem{{ProductID: 1, Quantity: 1}, {ProductID: 2, Quantity: 3}}, cartItemBody{2, 2}, []model.CartItem{{ProductID: 1, Quantity: 1}, {ProductID: 2, Quantity: 5}}, ""},
+		{"zero quantity", []model.CartItem{{ProductID: 1, Quantity: 1}}, cartItemBody{1, 0}, nil, "quantity must be at least 1"},
+		{"full cart merges", full, cartItemBody{1, 1}, nil, ""},
+		{"full cart", full, cartItemBody{maxCartItems + 1, 1}, nil, fmt.Sprintf("a cart holds at most %d products", maxCartItems)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := model.Cart{Items: append([]model.CartItem(nil), tt.items...)}
+
+			err := addCartItem(&c, tt.add)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Errorf("addCartItem error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("addCartItem: %v", err)
+			}
+			if tt.want != nil && fmt.Sprint(c.Items) != fmt.Sprint(tt.want) {
+				t.Errorf("items = %v, want %v", c.Items, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetCartItem(t *testing.T) {
+	tests := []struct {
+		name     string
+		product  uint64
+		quantity uint
+		want     []model.CartItem
+		status   int
+	}{
+		{"set", 2, 7, []model.CartItem{{ProductID: 1, Quantity: 1}, {ProductID: 2, Quantity: 7}}, 0},
+		{"removed", 1, 0, []model.CartItem{{ProductID: 2, Quantity: 3}}, 0},
+		{"not in cart", 3, 1, nil, http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := model.Cart{Items: []model.CartItem{{ProductID: 1, Quantity: 1}, {ProductID: 2, Quantity: 3}}}
+
+			status, err := setCartItem(&c, tt.product, tt.quantity)
+			if status != tt.status || (err != nil) != (tt.status != 0) {
+				t.Fatalf("setCartItem = %d, %v, want %d", status, err, tt.status)
+			}
+			if tt.want != nil && fmt.Sprint(c.Items) != fmt.Sprint(tt.want) {
+				t.Errorf("items = %v, want %v", c.Items, tt.want)
+			}
+		})
+	}
+}
+
+const cartTTL = time.Hour
+
+func newTestCart(t *testing.T) (*Cart, *miniredis.Miniredis) {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	h := &Cart{
+		Repo:     &cart.RedisRepo{Client: client, TTL: cartTTL},
+		Products: &product.RedisRepo{Client: client},
+		Orders:   &order.RedisRepo{Client: client},
+	}
+	for _, p := range []model.Product{
+		{ProductID: 7, ProductName: "Kettle", ProductPrice: 1250, Version: 1},
+		{ProductID: 8, ProductName: "Filter", ProductPrice: 99, Version: 1},
+	} {
+		if err := h.Products.Insert(context.Background(), p); err != nil {
+			t.Fatalf("insert product: %v", err)
+		}
+	}
+	return h, mr
+}
+
+func createCart(t *testing.T, h *Cart, items string) cartView {
+	t.Helper()
+
+	w := serve(h.Create, http.MethodPost, "/cart", "/cart", `{"customer_id":"`+uuid.NewString()+`","items":`+items+`}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create cart = %d %s", w.Code, w.Body)
+	}
+
+	var view cartView
+	if err := json.Unmarshal(w.Body.Bytes(), &view); err != nil {
+		t.Fatalf("decode cart: %v", err)
+	}
+	return view
+}
+
+func TestCartAddItem(t *testing.T) {
+	tests := []struct {
+		name   string
+		items  string
+		add    string
+		status int
+		want   string
+		total  int64
+	}{
+		{"merged on create", `[{"product_id":7,"quantity":1},{"product_id":7,"quantity":2}]`, "", 0, "7x3", 3750},
+		{"merged on add", `[{"product_id":7,"quantity":1}]`, `{"product_id":7,"quantity":2}`, http.StatusOK, "7x3", 3750},
+		{"added", `[{"product_id":7,"quantity":1}]`, `{"product_id":8,"quantity":2}`, http.StatusOK, "7x1 8x2", 1448},
+		{"unknown product", `[{"product_id":7,"quantity":1}]`, `{"product_id":9,"quantity":1}`, http.StatusUnprocessableEntity, "7x1", 1250},
+		{"zero quantity", `[{"product_id":7,"quantity":1}]`, `{"product_id":7,"quantity":0}`, http.StatusBadRequest, "7x1", 1250},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, _ := newTestCart(t)
+			view := createCart(t, h, tt.items)
+
+			if tt.add != "" {
+				w := serve(h.AddItem, http.MethodPost, "/cart/{id}/items", "/cart/"+view.CartID.String()+"/items", tt.add)
+				if w.Code != tt.status {
+					t.Fatalf("add item = %d %s, want %d", w.Code, w.Body, tt.status)
+				}
+			}
+
+			w := serve(h.GetByID, http.MethodGet, "/cart/{id}", "/cart/"+view.CartID.String(), "")
+			if err := json.Unmarshal(w.Body.Bytes(), &view); err != nil {
+				t.Fatalf("decode cart: %v", err)
+			}
+
+			var got []string
+			for _, line := range view.Items {
+				got = append(got, fmt.Sprintf("%dx%d", line.ProductID, line.Quantity))
+			}
+			if strings.Join(got, " ") != tt.want || view.Total != tt.total {
+				t.Errorf("cart = %v totalling %d, want %s totalling %d", got, view.Total, tt.want, tt.total)
+			}
+		})
+	}
+}
+
+func TestCartSlidingExpiry(t *testing.T) {
+	h, mr := newTestCart(t)
+	view := createCart(t, h, `[{"product_id":7,"quantity":1}]`)
+	key := cart.CartIDKey(view.CartID)
+
+	for _, step := range []struct {
+		name string
+		run  func() int
+	}{
+		{"read", func() int {
+			return serve(h.GetByID, http.MethodGet, "/cart/{id}", "/cart/"+view.CartID.String(), "").Code
+		}},
+		{"add item", func() int {
+			return serve(h.AddItem, http.MethodPost, "/cart/{id}/items", "/cart/"+view.CartID.String()+"/items", `{"product_id":8,"quantity":1}`).Code
+		}},
+		{"update item", func() int {
+			return serve(h.UpdateItem, http.MethodPut, "/cart/{id}/items/{product_id}", "/cart/"+view.CartID.String()+"/items/8", `{"quantity":4}`).Code
+		}},
+	} {
+		mr.FastForward(cartTTL - time.Minute)
+		if status := step.run(); status != http.StatusOK {
+			t.Fatalf("%s = %d, want %d", step.name, status, http.StatusOK)
+		}
+		if ttl := mr.TTL(key); ttl != cartTTL {
+			t.Errorf("after %s the cart expires in %v, want %v", step.name, ttl, cartTTL)
+		}
+	}
+
+	mr.FastForward(cartTTL)
+	if status := serve(h.GetByID, http.MethodGet, "/cart/{id}", "/cart/"+view.CartID.String(), "").Code; status != http.StatusNotFound {
+		t.Errorf("abandoned cart = %d, want %d", status, http.StatusNotFound)
+	}
+}
+
+func TestCartCheckout(t *testing.T) {
+	h, _ := newTestCart(t)
+	view := createCart(t, h, `[{"product_id":7,"quantity":2},{"product_id":8,"quantity":1}]`)
+	target := "/cart/" + view.CartID.String() + "/checkout"
+
+	w := serve(h.Checkout, http.MethodPost, "/cart/{id}/checkout", target, "")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("checkout = %d %s, want %d", w.Code, w.Body, http.StatusCreated)
+	}
+
+	var o model.Order
+	if err := json.Unmarshal(w.Body.Bytes(), &o); err != nil {
+		t.Fatalf("decode order: %v", err)
+	}
+	if o.Subtotal() != 2599 || len(o.LineItems) != 2 {
+		t.Errorf("order subtotal = %d with %d line items, want 2599 with 2", o.Subtotal(), len(o.LineItems))
+	}
+
+	if w := serve(h.Checkout, http.MethodPost, "/cart/{id}/checkout", target, ""); w.Code != http.StatusNotFound {
+		t.Errorf("second checkout = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestCartCheckoutRestoresCart(t *testing.T) {
+	h, _ := newTestCart(t)
+	view := createCart(t, h, `[{"product_id":7,"quantity":2}]`)
+
+	// Orders live on a Redis that is gone, so storing the order fails
+	// after the cart was removed.
+	down := miniredis.RunT(t)
+	orders := redis.NewClient(&redis.Options{Addr: down.Addr(), MaxRetries: -1})
+	t.Cleanup(func() { orders.Close() })
+	down.Close()
+	h.Orders = &order.RedisRepo{Client: orders}
+
+	w := serve(h.Checkout, http.MethodPost, "/cart/{id}/checkout", "/cart/"+view.CartID.String()+"/checkout", "")
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("checkout = %d %s, want %d", w.Code, w.Body, http.StatusInternalServerError)
+	}
+
+	restored, err := h.Repo.FindByID(context.Background(), view.CartID)
+	if err != nil {
+		t.Fatalf("find cart after failed checkout: %v", err)
+	}
+	if len(restored.Items) != 1 || restored.Items[0].Quantity != 2 {
+		t.Errorf("restored cart items = %v, want the product 7 twice", restored.Items)
+	}
+}
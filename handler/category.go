@@ -1,20 +1,27 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
-	"fmt"
+	"log/slog"
 	"math/rand"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/umuttopalak/orders-api/logging"
 	"github.com/umuttopalak/orders-api/model"
+	"github.com/umuttopalak/orders-api/repository/batch"
 	"github.com/umuttopalak/orders-api/repository/category"
+	"github.com/umuttopalak/orders-api/repository/pagination"
 )
 
 type Category struct {
-	Repo *category.RedisRepo
+	Repo           *category.RedisRepo
+	RequireIfMatch bool
+	CacheMaxAge    time.Duration
 }
 
 func (c *Category) Create(w http.ResponseWriter, r *http.Request) {
@@ -23,25 +30,28 @@ func (c *Category) Create(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		w.WriteHeader(decodeErrorStatus(err))
 		return
 	}
 
+	now := time.Now().UTC()
 	category := model.Category{
 		CategoryID:   rand.Uint64(),
 		CategoryName: body.CategoryName,
+		Version:      1,
+		UpdatedAt:    &now,
 	}
 
 	err := c.Repo.Insert(r.Context(), category)
 	if err != nil {
-		fmt.Println("failed to insert: ", err)
+		logging.FromContext(r.Context()).Error("failed to insert", slog.Any("error", err))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
 	res, err := json.Marshal(category)
 	if err != nil {
-		fmt.Println("failed to encode category: ", err)
+		logging.FromContext(r.Context()).Error("failed to encode category", slog.Any("error", err))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -55,45 +65,45 @@ func (c *Category) Create(w http.ResponseWriter, r *http.Request) {
 }
 
 func (c *Category) List(w http.ResponseWriter, r *http.Request) {
-	cursorStr := r.URL.Query().Get("cursor")
-	if cursorStr == "" {
-		cursorStr = "0"
-	}
-
-	const decimal = 10
-	const bitSize = 64
-	cursor, err := strconv.ParseUint(cursorStr, decimal, bitSize)
+	query, err := parseListQuery(r)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	const size = 50
-	res, err := c.Repo.FindAll(r.Context(), category.FindAllPage{
-		Offset: cursor,
-		Size:   size,
-	})
+	res, err := c.Repo.FindAll(r.Context(), query)
 	if err != nil {
-		fmt.Println("failed to find all", err)
+		logging.FromContext(r.Context()).Error("failed to find all", slog.Any("error", err))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
 	var response struct {
 		Categories []model.Category `json:"categories"`
-		Next       uint64           `json:"next,omitempty"`
+		Next       string           `json:"next,omitempty"`
+		Prev       string           `json:"prev,omitempty"`
+		Total      int64            `json:"total"`
 	}
 
 	response.Categories = res.Categories
-	response.Next = res.Cursor
+	response.Next = encodeCursor(res.Next)
+	response.Prev = encodeCursor(res.Prev)
+	response.Total = res.Total
+
+	setPageLinks(w, r, res.Next, res.Prev)
 
 	data, err := json.Marshal(response)
 	if err != nil {
-		fmt.Println("failed to marshal", err)
+		logging.FromContext(r.Context()).Error("failed to marshal", slog.Any("error", err))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	w.Header().Set("Cache-Control", cacheControl(c.CacheMaxAge))
+	if checkNotModified(w, r, contentETag(data), nil) {
+		return
+	}
+
 	if _, err := w.Write(data); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		return
@@ -118,13 +128,18 @@ func (c *Category) GetByID(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	} else if err != nil {
-		fmt.Println("failed to find by id: ", err)
+		logging.FromContext(r.Context()).Error("failed to find by id", slog.Any("error", err))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	w.Header().Set("Cache-Control", cacheControl(c.CacheMaxAge))
+	if checkNotModified(w, r, etag(o.Version), o.UpdatedAt) {
+		return
+	}
+
 	if err := json.NewEncoder(w).Encode(o); err != nil {
-		fmt.Println("failed to marshal: ", err)
+		logging.FromContext(r.Context()).Error("failed to marshal", slog.Any("error", err))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -137,7 +152,7 @@ func (c *Category) UpdateByID(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		w.WriteHeader(decodeErrorStatus(err))
 		return
 	}
 
@@ -157,23 +172,37 @@ func (c *Category) UpdateByID(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	} else if err != nil {
-		fmt.Println("failed to find Category: ", err)
+		logging.FromContext(r.Context()).Error("failed to find Category", slog.Any("error", err))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	if !checkIfMatch(w, r, theCategory.Version, c.RequireIfMatch) {
+		return
+	}
+
 	theCategory.CategoryID = CategoryID
 	theCategory.CategoryName = body.CategoryName
 
-	err = c.Repo.Update(r.Context(), theCategory)
-	if err != nil {
-		fmt.Println("failed to insert: ", err)
+	now := time.Now().UTC()
+	theCategory.UpdatedAt = &now
+
+	theCategory, err = c.Repo.Update(r.Context(), theCategory)
+	if errors.Is(err, category.ErrVersionMismatch) {
+		w.WriteHeader(versionConflictStatus(r))
+		return
+	} else if errors.Is(err, category.ErrNotExist) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		logging.FromContext(r.Context()).Error("failed to insert", slog.Any("error", err))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	w.Header().Set("ETag", etag(theCategory.Version))
 	if err := json.NewEncoder(w).Encode(theCategory); err != nil {
-		fmt.Println("failed to marshal: ", err)
+		logging.FromContext(r.Context()).Error("failed to marshal", slog.Any("error", err))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -191,13 +220,238 @@ func (c *Category) DeleteByID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = c.Repo.DeleteByID(r.Context(), customerID)
+	var version uint64
+	if r.Header.Get("If-Match") != "" || c.RequireIfMatch {
+		current, err := c.Repo.FindByID(r.Context(), customerID)
+		if errors.Is(err, category.ErrNotExist) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		} else if err != nil {
+			logging.FromContext(r.Context()).Error("failed to find by id", slog.Any("error", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if !checkIfMatch(w, r, current.Version, c.RequireIfMatch) {
+			return
+		}
+		version = current.Version
+	}
+
+	err = c.Repo.DeleteByID(r.Context(), customerID, version)
 	if errors.Is(err, category.ErrNotExist) {
 		w.WriteHeader(http.StatusNotFound)
 		return
+	} else if errors.Is(err, category.ErrVersionMismatch) {
+		w.WriteHeader(versionConflictStatus(r))
+		return
 	} else if err != nil {
-		fmt.Println("failed to find by id: ", err)
+		logging.FromContext(r.Context()).Error("failed to find by id", slog.Any("error", err))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 }
+
+func (c *Category) BatchCreate(w http.ResponseWriter, r *http.Request) {
+	var body []struct {
+		CategoryName string `json:"category_name"`
+	}
+
+	atomic, ok := decodeBatch(w, r, &body)
+	if !ok {
+		return
+	}
+
+	now := time.Now().UTC()
+	results := make([]batchResult, len(body))
+	categories := make([]model.Category, 0, len(body))
+	indexes := make([]int, 0, len(body))
+
+	for i, item := range body {
+		x := model.Category{
+			CategoryID:   rand.Uint64(),
+			CategoryName: item.CategoryName,
+			Version:      1,
+			UpdatedAt:    &now,
+		}
+		if err := validateCategory(x); err != nil {
+			results[i] = batchResult{Index: i, Status: http.StatusBadRequest, Error: err.Error()}
+			continue
+		}
+		categories = append(categories, x)
+		indexes = append(indexes, i)
+	}
+
+	if abortAtomic(results, atomic) {
+		writeBatchResults(w, r, results, atomic)
+		return
+	}
+
+	errs, err := c.Repo.InsertMany(r.Context(), categories, atomic)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to insert", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	for j, x := range categories {
+		i := indexes[j]
+		if errs[j] != nil {
+			results[i] = batchErrorResult(i, errs[j])
+			continue
+		}
+		results[i] = batchResult{Index: i, Status: http.StatusCreated, ID: x.CategoryID, Version: x.Version, Item: x}
+	}
+
+	writeBatchResults(w, r, results, atomic)
+}
+
+func (c *Category) BatchUpdate(w http.ResponseWriter, r *http.Request) {
+	var body []struct {
+		CategoryID   uint64 `json:"category_id"`
+		Version      uint64 `json:"version"`
+		CategoryName string `json:"category_name"`
+	}
+
+	atomic, ok := decodeBatch(w, r, &body)
+	if !ok {
+		return
+	}
+
+	now := time.Now().UTC()
+	results := make([]batchResult, len(body))
+	categories := make([]model.Category, 0, len(body))
+	indexes := make([]int, 0, len(body))
+
+	for i, item := range body {
+		x := model.Category{
+			CategoryID:   item.CategoryID,
+			CategoryName: item.CategoryName,
+			Version:      item.Version,
+			UpdatedAt:    &now,
+		}
+		if x.Version == 0 && c.RequireIfMatch {
+			results[i] = batchResult{Index: i, Status: http.StatusBadRequest, Error: "version is required"}
+			continue
+		}
+		if err := validateCategory(x); err != nil {
+			results[i] = batchResult{Index: i, Status: http.StatusBadRequest, Error: err.Error()}
+			continue
+		}
+		categories = append(categories, x)
+		indexes = append(indexes, i)
+	}
+
+	if abortAtomic(results, atomic) {
+		writeBatchResults(w, r, results, atomic)
+		return
+	}
+
+	categories, errs, err := c.Repo.UpdateMany(r.Context(), categories, atomic)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to update", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	for j, x := range categories {
+		i := indexes[j]
+		if errs[j] != nil {
+			results[i] = batchErrorResult(i, errs[j])
+			continue
+		}
+		results[i] = batchResult{Index: i, Status: http.StatusOK, ID: x.CategoryID, Version: x.Version, Item: x}
+	}
+
+	writeBatchResults(w, r, results, atomic)
+}
+
+func (c *Category) BatchDelete(w http.ResponseWriter, r *http.Request) {
+	var body []batchTarget
+
+	atomic, ok := decodeBatch(w, r, &body)
+	if !ok {
+		return
+	}
+
+	targets := make([]batch.Target, len(body))
+	for i, t := range body {
+		targets[i] = batch.Target{ID: t.ID, Version: t.Version}
+	}
+
+	errs, err := c.Repo.DeleteMany(r.Context(), targets, atomic)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to delete", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	results := make([]batchResult, len(body))
+	for i, t := range body {
+		if errs[i] != nil {
+			results[i] = batchErrorResult(i, errs[i])
+			continue
+		}
+		results[i] = batchResult{Index: i, Status: http.StatusNoContent, ID: t.ID}
+	}
+
+	writeBatchResults(w, r, results, atomic)
+}
+
+var categoryCSVHeader = []string{"category_id", "category_name", "version", "updated_at"}
+
+func (c *Category) Export(w http.ResponseWriter, r *http.Request) {
+	exportRows(w, r, "categories", categoryCSVHeader,
+		func(x model.Category) []string {
+			return []string{
+				strconv.FormatUint(x.CategoryID, 10),
+				x.CategoryName,
+				strconv.FormatUint(x.Version, 10),
+				formatCSVTime(x.UpdatedAt),
+			}
+		},
+		func(ctx context.Context, q pagination.Query) ([]model.Category, *pagination.Cursor, error) {
+			res, err := c.Repo.FindAll(ctx, q)
+			return res.Categories, res.Next, err
+		},
+	)
+}
+
+func (c *Category) Import(w http.ResponseWriter, r *http.Request) {
+	importRows(w, r, importer[model.Category]{
+		fromCSV: func(row map[string]string) (model.Category, error) {
+			var x model.Category
+			var err error
+
+			if x.CategoryID, err = parseCSVUint(row, "category_id"); err != nil {
+				return x, err
+			}
+			if x.Version, err = parseCSVUint(row, "version"); err != nil {
+				return x, err
+			}
+			x.CategoryName = row["category_name"]
+
+			return x, nil
+		},
+		validate: validateCategory,
+		prepare: func(x *model.Category, now time.Time) (bool, error) {
+			x.UpdatedAt = &now
+			if x.CategoryID == 0 {
+				x.CategoryID = rand.Uint64()
+				x.Version = 1
+				return false, nil
+			}
+			if x.Version == 0 {
+				return false, errors.New("version is required to update an existing category")
+			}
+			return true, nil
+		},
+		insert: func(ctx context.Context, xs []model.Category) ([]error, error) {
+			return c.Repo.InsertMany(ctx, xs, false)
+		},
+		update: func(ctx context.Context, xs []model.Category) ([]error, error) {
+			_, errs, err := c.Repo.UpdateMany(ctx, xs, false)
+			return errs, err
+		},
+	})
+}
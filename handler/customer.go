@@ -1,21 +1,28 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log/slog"
+	"math/rand"
 	"net/http"
 	"net/mail"
 	"strconv"
+	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/umuttopalak/orders-api/logging"
 	"github.com/umuttopalak/orders-api/model"
+	"github.com/umuttopalak/orders-api/repository/batch"
 	"github.com/umuttopalak/orders-api/repository/customer"
-	"github.com/umuttopalak/orders-api/repository/order"
+	"github.com/umuttopalak/orders-api/repository/pagination"
 )
 
 type Customer struct {
-	Repo *customer.RedisRepo
+	Repo           *customer.RedisRepo
+	RequireIfMatch bool
 }
 
 func (c *Customer) Create(w http.ResponseWriter, r *http.Request) {
@@ -27,7 +34,7 @@ func (c *Customer) Create(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		w.WriteHeader(decodeErrorStatus(err))
 		return
 	}
 
@@ -36,18 +43,19 @@ func (c *Customer) Create(w http.ResponseWriter, r *http.Request) {
 		Surname:    body.Surname,
 		Email:      body.Email,
 		Is_deleted: false,
+		Version:    1,
 	}
 
 	err := c.Repo.Insert(r.Context(), customer)
 	if err != nil {
-		fmt.Println("failed to insert: ", err)
+		logging.FromContext(r.Context()).Error("failed to insert", slog.Any("error", err))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
 	res, err := json.Marshal(customer)
 	if err != nil {
-		fmt.Println("failed to encode customer: ", err)
+		logging.FromContext(r.Context()).Error("failed to encode customer", slog.Any("error", err))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -61,41 +69,36 @@ func (c *Customer) Create(w http.ResponseWriter, r *http.Request) {
 }
 
 func (c *Customer) List(w http.ResponseWriter, r *http.Request) {
-	cursorStr := r.URL.Query().Get("cursor")
-	if cursorStr == "" {
-		cursorStr = "0"
-	}
-
-	const decimal = 10
-	const bitSize = 64
-	cursor, err := strconv.ParseUint(cursorStr, decimal, bitSize)
+	query, err := parseListQuery(r)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	const size = 50
-	res, err := c.Repo.FindAll(r.Context(), customer.FindAllPage{
-		Offset: cursor,
-		Size:   size,
-	})
+	res, err := c.Repo.FindAll(r.Context(), query)
 	if err != nil {
-		fmt.Println("failed to find all", err)
+		logging.FromContext(r.Context()).Error("failed to find all", slog.Any("error", err))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
 	var response struct {
 		Customers []model.Customer `json:"customers"`
-		Next      uint64           `json:"next,omitempty"`
+		Next      string           `json:"next,omitempty"`
+		Prev      string           `json:"prev,omitempty"`
+		Total     int64            `json:"total"`
 	}
 
 	response.Customers = res.Customers
-	response.Next = res.Cursor
+	response.Next = encodeCursor(res.Next)
+	response.Prev = encodeCursor(res.Prev)
+	response.Total = res.Total
+
+	setPageLinks(w, r, res.Next, res.Prev)
 
 	data, err := json.Marshal(response)
 	if err != nil {
-		fmt.Println("failed to marshal", err)
+		logging.FromContext(r.Context()).Error("failed to marshal", slog.Any("error", err))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -120,17 +123,18 @@ func (c *Customer) GetByID(w http.ResponseWriter, r *http.Request) {
 	}
 
 	o, err := c.Repo.FindByID(r.Context(), customerID)
-	if errors.Is(err, order.ErrNotExist) {
+	if errors.Is(err, customer.ErrNotExist) {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	} else if err != nil {
-		fmt.Println("failed to find by id: ", err)
+		logging.FromContext(r.Context()).Error("failed to find by id", slog.Any("error", err))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	w.Header().Set("ETag", etag(o.Version))
 	if err := json.NewEncoder(w).Encode(o); err != nil {
-		fmt.Println("failed to marshal: ", err)
+		logging.FromContext(r.Context()).Error("failed to marshal", slog.Any("error", err))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -148,13 +152,252 @@ func (c *Customer) DeleteByID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = c.Repo.DeleteByID(r.Context(), customerID)
-	if errors.Is(err, order.ErrNotExist) {
+	var version uint64
+	if r.Header.Get("If-Match") != "" || c.RequireIfMatch {
+		current, err := c.Repo.FindByID(r.Context(), customerID)
+		if errors.Is(err, customer.ErrNotExist) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		} else if err != nil {
+			logging.FromContext(r.Context()).Error("failed to find by id", slog.Any("error", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if !checkIfMatch(w, r, current.Version, c.RequireIfMatch) {
+			return
+		}
+		version = current.Version
+	}
+
+	err = c.Repo.DeleteByID(r.Context(), customerID, version)
+	if errors.Is(err, customer.ErrNotExist) {
 		w.WriteHeader(http.StatusNotFound)
 		return
+	} else if errors.Is(err, customer.ErrVersionMismatch) {
+		w.WriteHeader(versionConflictStatus(r))
+		return
 	} else if err != nil {
-		fmt.Println("failed to find by id: ", err)
+		logging.FromContext(r.Context()).Error("failed to find by id", slog.Any("error", err))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 }
+
+func (c *Customer) BatchCreate(w http.ResponseWriter, r *http.Request) {
+	var body []struct {
+		Name    string       `json:"name"`
+		Surname string       `json:"surname"`
+		Email   mail.Address `json:"email"`
+	}
+
+	atomic, ok := decodeBatch(w, r, &body)
+	if !ok {
+		return
+	}
+
+	results := make([]batchResult, len(body))
+	customers := make([]model.Customer, 0, len(body))
+	indexes := make([]int, 0, len(body))
+
+	for i, item := range body {
+		x := model.Customer{
+			CustomerID: rand.Uint64(),
+			Name:       item.Name,
+			Surname:    item.Surname,
+			Email:      item.Email,
+			Version:    1,
+		}
+		if err := validateCustomer(x); err != nil {
+			results[i] = batchResult{Index: i, Status: http.StatusBadRequest, Error: err.Error()}
+			continue
+		}
+		customers = append(customers, x)
+		indexes = append(indexes, i)
+	}
+
+	if abortAtomic(results, atomic) {
+		writeBatchResults(w, r, results, atomic)
+		return
+	}
+
+	errs, err := c.Repo.InsertMany(r.Context(), customers, atomic)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to insert", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	for j, x := range customers {
+		i := indexes[j]
+		if errs[j] != nil {
+			results[i] = batchErrorResult(i, errs[j])
+			continue
+		}
+		results[i] = batchResult{Index: i, Status: http.StatusCreated, ID: x.CustomerID, Version: x.Version, Item: x}
+	}
+
+	writeBatchResults(w, r, results, atomic)
+}
+
+func (c *Customer) BatchUpdate(w http.ResponseWriter, r *http.Request) {
+	var body []struct {
+		CustomerID uint64       `json:"customer_id"`
+		Version    uint64       `json:"version"`
+		Name       string       `json:"name"`
+		Surname    string       `json:"surname"`
+		Email      mail.Address `json:"email"`
+		Is_deleted bool         `json:"is_deleted"`
+	}
+
+	atomic, ok := decodeBatch(w, r, &body)
+	if !ok {
+		return
+	}
+
+	results := make([]batchResult, len(body))
+	customers := make([]model.Customer, 0, len(body))
+	indexes := make([]int, 0, len(body))
+
+	for i, item := range body {
+		x := model.Customer{
+			CustomerID: item.CustomerID,
+			Name:       item.Name,
+			Surname:    item.Surname,
+			Email:      item.Email,
+			Is_deleted: item.Is_deleted,
+			Version:    item.Version,
+		}
+		if x.Version == 0 && c.RequireIfMatch {
+			results[i] = batchResult{Index: i, Status: http.StatusBadRequest, Error: "version is required"}
+			continue
+		}
+		if err := validateCustomer(x); err != nil {
+			results[i] = batchResult{Index: i, Status: http.StatusBadRequest, Error: err.Error()}
+			continue
+		}
+		customers = append(customers, x)
+		indexes = append(indexes, i)
+	}
+
+	if abortAtomic(results, atomic) {
+		writeBatchResults(w, r, results, atomic)
+		return
+	}
+
+	customers, errs, err := c.Repo.UpdateMany(r.Context(), customers, atomic)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to update", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	for j, x := range customers {
+		i := indexes[j]
+		if errs[j] != nil {
+			results[i] = batchErrorResult(i, errs[j])
+			continue
+		}
+		results[i] = batchResult{Index: i, Status: http.StatusOK, ID: x.CustomerID, Version: x.Version, Item: x}
+	}
+
+	writeBatchResults(w, r, results, atomic)
+}
+
+func (c *Customer) BatchDelete(w http.ResponseWriter, r *http.Request) {
+	var body []batchTarget
+
+	atomic, ok := decodeBatch(w, r, &body)
+	if !ok {
+		return
+	}
+
+	targets := make([]batch.Target, len(body))
+	for i, t := range body {
+		targets[i] = batch.Target{ID: t.ID, Version: t.Version}
+	}
+
+	errs, err := c.Repo.DeleteMany(r.Context(), targets, atomic)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to delete", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	results := make([]batchResult, len(body))
+	for i, t := range body {
+		if errs[i] != nil {
+			results[i] = batchErrorResult(i, errs[i])
+			continue
+		}
+		results[i] = batchResult{Index: i, Status: http.StatusNoContent, ID: t.ID}
+	}
+
+	writeBatchResults(w, r, results, atomic)
+}
+
+var customerCSVHeader = []string{"customer_id", "name", "surname", "email", "is_deleted", "version"}
+
+func (c *Customer) Export(w http.ResponseWriter, r *http.Request) {
+	exportRows(w, r, "customers", customerCSVHeader,
+		func(x model.Customer) []string {
+			return []string{
+				strconv.FormatUint(x.CustomerID, 10),
+				x.Name,
+				x.Surname,
+				x.Email.Address,
+				strconv.FormatBool(x.Is_deleted),
+				strconv.FormatUint(x.Version, 10),
+			}
+		},
+		func(ctx context.Context, q pagination.Query) ([]model.Customer, *pagination.Cursor, error) {
+			res, err := c.Repo.FindAll(ctx, q)
+			return res.Customers, res.Next, err
+		},
+	)
+}
+
+func (c *Customer) Import(w http.ResponseWriter, r *http.Request) {
+	importRows(w, r, importer[model.Customer]{
+		fromCSV: func(row map[string]string) (model.Customer, error) {
+			var x model.Customer
+			var err error
+
+			if x.CustomerID, err = parseCSVUint(row, "customer_id"); err != nil {
+				return x, err
+			}
+			if x.Version, err = parseCSVUint(row, "version"); err != nil {
+				return x, err
+			}
+			if v := row["is_deleted"]; v != "" {
+				if x.Is_deleted, err = strconv.ParseBool(v); err != nil {
+					return x, fmt.Errorf("is_deleted: invalid boolean %q", v)
+				}
+			}
+			x.Name = row["name"]
+			x.Surname = row["surname"]
+			x.Email = mail.Address{Address: row["email"]}
+
+			return x, nil
+		},
+		validate: validateCustomer,
+		prepare: func(x *model.Customer, now time.Time) (bool, error) {
+			if x.CustomerID == 0 {
+				x.CustomerID = rand.Uint64()
+				x.Version = 1
+				return false, nil
+			}
+			if x.Version == 0 {
+				return false, errors.New("version is required to update an existing customer")
+			}
+			return true, nil
+		},
+		insert: func(ctx context.Context, xs []model.Customer) ([]error, error) {
+			return c.Repo.InsertMany(ctx, xs, false)
+		},
+		update: func(ctx context.Context, xs []model.Customer) ([]error, error) {
+			_, errs, err := c.Repo.UpdateMany(ctx, xs, false)
+			return errs, err
+		},
+	})
+}
@@ -0,0 +1,57 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+func etag(version uint64) string {
+	return `"` + strconv.FormatUint(version, 10) + `"`
+}
+
+// matchesIfMatch reports whether an If-Match header value matches the
+// entity at version. Weak tags never match, as RFC 9110 requires strong
+// comparison for If-Match.
+func matchesIfMatch(header string, version uint64) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == etag(version) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkIfMatch enforces the If-Match precondition against the current
+// version and writes 412 or, when the header is required but missing, 428.
+// It returns false when the request must not proceed.
+func checkIfMatch(w http.ResponseWriter, r *http.Request, version uint64, required bool) bool {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		if required {
+			w.WriteHeader(http.StatusPreconditionRequired)
+			return false
+		}
+		return true
+	}
+
+	if !matchesIfMatch(header, version) {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return false
+	}
+
+	return true
+}
+
+// versionConflictStatus is the status for a write that lost a race with a
+// concurrent update: a failed precondition if the client stated one, a
+// plain conflict otherwise.
+func versionConflictStatus(r *http.Request) int {
+	if r.Header.Get("If-Match") != "" {
+		return http.StatusPreconditionFailed
+	}
+
+	return http.StatusConflict
+}
@@ -0,0 +1,68 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckIfMatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   string
+		required bool
+		ok       bool
+		status   int
+	}{
+		{"no header", "", false, true, http.StatusOK},
+		{"no header required", "", true, false, http.StatusPreconditionRequired},
+		{"current version", `"3"`, false, true, http.StatusOK},
+		{"current version required", `"3"`, true, true, http.StatusOK},
+		{"stale version", `"2"`, false, false, http.StatusPreconditionFailed},
+		{"list with current", `"1", "3"`, false, true, http.StatusOK},
+		{"wildcard", "*", true, true, http.StatusOK},
+		{"weak tag", `W/"3"`, false, false, http.StatusPreconditionFailed},
+		{"unquoted", "3", false, false, http.StatusPreconditionFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPut, "/order/1", nil)
+			if tt.header != "" {
+				r.Header.Set("If-Match", tt.header)
+			}
+			w := httptest.NewRecorder()
+
+			if ok := checkIfMatch(w, r, 3, tt.required); ok != tt.ok {
+				t.Errorf("checkIfMatch = %v, want %v", ok, tt.ok)
+			}
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestVersionConflictStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		status int
+	}{
+		{"without precondition", "", http.StatusConflict},
+		{"with precondition", `"3"`, http.StatusPreconditionFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPut, "/order/1", nil)
+			if tt.header != "" {
+				r.Header.Set("If-Match", tt.header)
+			}
+
+			if got := versionConflictStatus(r); got != tt.status {
+				t.Errorf("versionConflictStatus = %d, want %d", got, tt.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package handler
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-chi/chi/v5"
+	"github.com/redis/go-redis/v9"
+)
+
+// newTestRedis returns a client of an in-memory Redis that lives as long as
+// the test.
+func newTestRedis(t *testing.T) *redis.Client {
+	t.Helper()
+
+	client := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// serve runs one request against h mounted at pattern, so chi URL
+// parameters are filled in as in the real router.
+func serve(h http.HandlerFunc, method, pattern, target, body string) *httptest.ResponseRecorder {
+	router := chi.NewRouter()
+	router.MethodFunc(method, pattern, h)
+
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(method, target, r))
+	return w
+}
@@ -0,0 +1,113 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/umuttopalak/orders-api/logging"
+)
+
+type HealthCheck func(ctx context.Context) error
+
+type Health struct {
+	Checks  map[string]HealthCheck
+	Timeout time.Duration
+
+	draining atomic.Bool
+}
+
+type componentStatus struct {
+	Status  string `json:"status"`
+	Latency string `json:"latency,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+type healthResponse struct {
+	Status     string                     `json:"status"`
+	Components map[string]componentStatus `json:"components,omitempty"`
+}
+
+const (
+	statusUp   = "up"
+	statusDown = "down"
+)
+
+// SetDraining makes readiness fail from now on so load balancers stop
+// routing new traffic while in-flight requests finish.
+func (h *Health) SetDraining() {
+	h.draining.Store(true)
+}
+
+func (h *Health) Live(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, r, http.StatusOK, healthResponse{Status: statusUp})
+}
+
+func (h *Health) Ready(w http.ResponseWriter, r *http.Request) {
+	timeout := h.Timeout
+	if timeout == 0 {
+		timeout = 2 * time.Second
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	response := healthResponse{
+		Status:     statusUp,
+		Components: make(map[string]componentStatus, len(h.Checks)),
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range h.Checks {
+		wg.Add(1)
+		go func(name string, check HealthCheck) {
+			defer wg.Done()
+
+			start := time.Now()
+			err := check(ctx)
+			component := componentStatus{
+				Status:  statusUp,
+				Latency: time.Since(start).String(),
+			}
+			if err != nil {
+				component.Status = statusDown
+				component.Error = err.Error()
+			}
+
+			mu.Lock()
+			response.Components[name] = component
+			mu.Unlock()
+		}(name, check)
+	}
+	wg.Wait()
+
+	status := http.StatusOK
+	for _, component := range response.Components {
+		if component.Status != statusUp {
+			response.Status = statusDown
+			status = http.StatusServiceUnavailable
+		}
+	}
+
+	if h.draining.Load() {
+		response.Status = "draining"
+		status = http.StatusServiceUnavailable
+	}
+
+	writeHealth(w, r, status, response)
+}
+
+func writeHealth(w http.ResponseWriter, r *http.Request, status int, response healthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logging.FromContext(r.Context()).Error("failed to marshal", slog.Any("error", err))
+	}
+}
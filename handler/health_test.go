@@ -0,0 +1,77 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthReady(t *testing.T) {
+	up := func(context.Context) error { return nil }
+	down := func(context.Context) error { return errors.New("connection refused") }
+	slow := func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	tests := []struct {
+		name       string
+		checks     map[string]HealthCheck
+		draining   bool
+		status     int
+		body       string
+		components map[string]string
+	}{
+		{"up", map[string]HealthCheck{"redis": up}, false, http.StatusOK, statusUp, map[string]string{"redis": statusUp}},
+		{"no checks", nil, false, http.StatusOK, statusUp, map[string]string{}},
+		{"down", map[string]HealthCheck{"redis": down, "other": up}, false, http.StatusServiceUnavailable, statusDown, map[string]string{"redis": statusDown, "other": statusUp}},
+		{"timed out", map[string]HealthCheck{"redis": slow}, false, http.StatusServiceUnavailable, statusDown, map[string]string{"redis": statusDown}},
+		{"draining", map[string]HealthCheck{"redis": up}, true, http.StatusServiceUnavailable, "draining", map[string]string{"redis": statusUp}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Health{Checks: tt.checks, Timeout: 10 * time.Millisecond}
+			if tt.draining {
+				h.SetDraining()
+			}
+
+			w := httptest.NewRecorder()
+			h.Ready(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+			var res healthResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+				t.Fatalf("decode response: %v", err)
+			}
+			if w.Code != tt.status || res.Status != tt.body {
+				t.Errorf("ready = %d %q, want %d %q", w.Code, res.Status, tt.status, tt.body)
+			}
+			if len(res.Components) != len(tt.components) {
+				t.Errorf("components = %v, want %v", res.Components, tt.components)
+			}
+			for name, want := range tt.components {
+				if got := res.Components[name].Status; got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+			if got := w.Header().Get("Cache-Control"); got != "no-store" {
+				t.Errorf("Cache-Control = %q, want no-store", got)
+			}
+		})
+	}
+}
+
+func TestHealthLiveWhileDraining(t *testing.T) {
+	h := &Health{Checks: map[string]HealthCheck{"redis": func(context.Context) error { return errors.New("down") }}}
+	h.SetDraining()
+
+	w := httptest.NewRecorder()
+	h.Live(w, httptest.NewRequest(http.MethodGet, "/livez", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("live = %d, want %d", w.Code, http.StatusOK)
+	}
+}
@@ -1,53 +1,108 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log/slog"
 	"math/rand"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
+	"github.com/umuttopalak/orders-api/logging"
+	"github.com/umuttopalak/orders-api/metrics"
 	"github.com/umuttopalak/orders-api/model"
 	"github.com/umuttopalak/orders-api/repository/order"
+	"github.com/umuttopalak/orders-api/repository/pagination"
+	"github.com/umuttopalak/orders-api/repository/product"
+	"github.com/umuttopalak/orders-api/repository/promotion"
+	"github.com/umuttopalak/orders-api/tax"
 )
 
 type Order struct {
-	Repo *order.RedisRepo
+	Repo           *order.RedisRepo
+	Promotions     *promotion.RedisRepo
+	Products       *product.RedisRepo
+	Taxes          *tax.Table
+	RequireIfMatch bool
+	// Shutdown is closed when the server starts shutting down, ending
+	// open event streams so they do not hold up the shutdown.
+	Shutdown <-chan struct{}
 }
 
 func (h *Order) Create(w http.ResponseWriter, r *http.Request) {
 	var body struct {
-		CustomerID uuid.UUID        `json:"customer_id"`
-		LineItems  []model.LineItem `json:"line_items"`
+		CustomerID   uuid.UUID        `json:"customer_id"`
+		LineItems    []model.LineItem `json:"line_items"`
+		DiscountCode string           `json:"discount_code"`
+		// ShippingRegion is an ISO 3166 country or subdivision code.
+		ShippingRegion string `json:"shipping_region"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		w.WriteHeader(decodeErrorStatus(err))
 		return
 	}
 
-	now := time.Now().UTC()
-	order := model.Order{
-		OrderID:    rand.Uint64(),
-		CustomerID: body.CustomerID,
-		LineItems:  body.LineItems,
-		CreatedAt:  &now,
+	order, err := newOrder(body.CustomerID, body.LineItems)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := priceLineItems(r.Context(), h.Products, order.LineItems); err != nil {
+		var serr *statusError
+		if errors.As(err, &serr) {
+			writeError(w, serr.status, serr.msg)
+			return
+		}
+		logging.FromContext(r.Context()).Error("failed to find products", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
 
-	err := h.Repo.Insert(r.Context(), order)
+	if !setShippingRegion(w, h.Taxes, &order, body.ShippingRegion) {
+		return
+	}
+
+	release := func() {}
+	if body.DiscountCode != "" {
+		var serr *statusError
+		release, err = redeemPromotion(r.Context(), h.Promotions, h.Products, &order, body.DiscountCode)
+		if errors.As(err, &serr) {
+			writeError(w, serr.status, serr.msg)
+			return
+		} else if err != nil {
+			logging.FromContext(r.Context()).Error("failed to apply discount code", slog.Any("error", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := applyTax(r.Context(), h.Taxes, h.Products, &order); err != nil {
+		release()
+		logging.FromContext(r.Context()).Error("failed to apply tax", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	err = h.Repo.Insert(r.Context(), order)
 	if err != nil {
-		fmt.Println("failed to insert: ", err)
+		release()
+		logging.FromContext(r.Context()).Error("failed to insert", slog.Any("error", err))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	metrics.OrdersCreated.Inc()
 
 	res, err := json.Marshal(order)
 	if err != nil {
-		fmt.Println("failed to insert: ", err)
+		logging.FromContext(r.Context()).Error("failed to insert", slog.Any("error", err))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -59,42 +114,134 @@ func (h *Order) Create(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusCreated)
 }
 
-func (h *Order) List(w http.ResponseWriter, r *http.Request) {
-	cursorStr := r.URL.Query().Get("cursor")
-	if cursorStr == "" {
-		cursorStr = "0"
+// newOrder validates the line items of a new order. Orders posted directly
+// and orders checked out from a cart go through it alike.
+func newOrder(customerID uuid.UUID, items []model.LineItem) (model.Order, error) {
+	if customerID == uuid.Nil {
+		return model.Order{}, errors.New("customer_id is required")
+	}
+	if len(items) == 0 {
+		return model.Order{}, errors.New("line_items must not be empty")
+	}
+	for i, item := range items {
+		if item.Quantity == 0 {
+			return model.Order{}, fmt.Errorf("line_items[%d]: quantity must be at least 1", i)
+		}
 	}
 
-	const decimal = 10
-	const bitSize = 64
-	cursor, err := strconv.ParseUint(cursorStr, decimal, bitSize)
+	now := time.Now().UTC()
+	return model.Order{
+		OrderID:    rand.Uint64(),
+		CustomerID: customerID,
+		LineItems:  items,
+		CreatedAt:  &now,
+		Version:    1,
+	}, nil
+}
+
+// priceLineItems sets the price of each line item to its product's current
+// price, whatever the client sent, so clients cannot set what they are
+// charged. Line items without a product or with an unknown one are
+// reported as *statusError.
+func priceLineItems(ctx context.Context, products *product.RedisRepo, items []model.LineItem) error {
+	ids := make([]uint64, 0, len(items))
+	for i, item := range items {
+		if item.ProductID == 0 {
+			return &statusError{http.StatusBadRequest, fmt.Sprintf("line_items[%d]: product_id is required", i)}
+		}
+		ids = append(ids, item.ProductID)
+	}
+
+	found, err := products.FindByIDs(ctx, ids)
+	if err != nil {
+		return err
+	}
+
+	for i := range items {
+		p, ok := found[items[i].ProductID]
+		if !ok {
+			return &statusError{http.StatusBadRequest, fmt.Sprintf("line_items[%d]: product %d does not exist", i, items[i].ProductID)}
+		}
+		items[i].Price = uint(p.ProductPrice)
+	}
+	return nil
+}
+
+// setShippingRegion validates the region against the tax rates, before
+// anything is redeemed for the order, and records it on the order.
+func setShippingRegion(w http.ResponseWriter, taxes *tax.Table, o *model.Order, region string) bool {
+	if region == "" {
+		return true
+	}
+
+	if _, ok := taxes.Region(region); !ok {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("%s %s", tax.ErrUnknownRegion, region))
+		return false
+	}
+
+	o.ShippingRegion = strings.ToUpper(region)
+	return true
+}
+
+// applyTax computes the tax of an order with a shipping region. It runs
+// after discount codes are applied, as tax is charged on the discounted
+// amount.
+func applyTax(ctx context.Context, taxes *tax.Table, products *product.RedisRepo, o *model.Order) error {
+	if o.ShippingRegion == "" {
+		return nil
+	}
+
+	ids := make([]uint64, 0, len(o.LineItems))
+	for _, item := range o.LineItems {
+		if item.ProductID != 0 {
+			ids = append(ids, item.ProductID)
+		}
+	}
+
+	found, err := products.FindByIDs(ctx, ids)
+	if err != nil {
+		return err
+	}
+
+	categories := make(map[uint64]uint64, len(found))
+	for id, p := range found {
+		categories[id] = p.Category.CategoryID
+	}
+
+	return taxes.Apply(o, categories)
+}
+
+func (h *Order) List(w http.ResponseWriter, r *http.Request) {
+	query, err := parseListQuery(r)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	const size = 50
-	res, err := h.Repo.FindAll(r.Context(), order.FindAllPage{
-		Offset: cursor,
-		Size:   size,
-	})
+	res, err := h.Repo.FindAll(r.Context(), query)
 	if err != nil {
-		fmt.Println("failed to find all", err)
+		logging.FromContext(r.Context()).Error("failed to find all", slog.Any("error", err))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
 	var response struct {
 		Items []model.Order `json:"items"`
-		Next  uint64        `json:"next,omitempty"`
+		Next  string        `json:"next,omitempty"`
+		Prev  string        `json:"prev,omitempty"`
+		Total int64         `json:"total"`
 	}
 
 	response.Items = res.Orders
-	response.Next = res.Cursor
+	response.Next = encodeCursor(res.Next)
+	response.Prev = encodeCursor(res.Prev)
+	response.Total = res.Total
+
+	setPageLinks(w, r, res.Next, res.Prev)
 
 	data, err := json.Marshal(response)
 	if err != nil {
-		fmt.Println("failed to marshal", err)
+		logging.FromContext(r.Context()).Error("failed to marshal", slog.Any("error", err))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -123,25 +270,29 @@ func (h *Order) GetByID(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	} else if err != nil {
-		fmt.Println("failed to find by id: ", err)
+		logging.FromContext(r.Context()).Error("failed to find by id", slog.Any("error", err))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	w.Header().Set("ETag", etag(o.Version))
 	if err := json.NewEncoder(w).Encode(o); err != nil {
-		fmt.Println("failed to marshal: ", err)
+		logging.FromContext(r.Context()).Error("failed to marshal", slog.Any("error", err))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 }
 
+// UpdateByID completes an order. Orders are marked shipped by their
+// shipments, once every line item has been shipped in full, so setting
+// the shipped status directly is refused.
 func (h *Order) UpdateByID(w http.ResponseWriter, r *http.Request) {
 	var body struct {
 		Status string `json:"status"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		w.WriteHeader(decodeErrorStatus(err))
 		return
 	}
 
@@ -161,11 +312,15 @@ func (h *Order) UpdateByID(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	} else if err != nil {
-		fmt.Println("failed to find order: ", err)
+		logging.FromContext(r.Context()).Error("failed to find order", slog.Any("error", err))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	if !checkIfMatch(w, r, theOrder.Version, h.RequireIfMatch) {
+		return
+	}
+
 	const completedStatus = "completed"
 	const shippedStatus = "shipped"
 
@@ -173,11 +328,8 @@ func (h *Order) UpdateByID(w http.ResponseWriter, r *http.Request) {
 
 	switch body.Status {
 	case shippedStatus:
-		if theOrder.ShippedAt != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
-		theOrder.ShippedAt = &now
+		writeError(w, http.StatusConflict, fmt.Sprintf("orders are shipped by creating shipments at /order/%d/shipments", orderID))
+		return
 	case completedStatus:
 		if theOrder.CompletedAt != nil || theOrder.ShippedAt != nil {
 			w.WriteHeader(http.StatusBadRequest)
@@ -189,15 +341,24 @@ func (h *Order) UpdateByID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = h.Repo.Update(r.Context(), theOrder)
-	if err != nil {
-		fmt.Println("failed to insert: ", err)
+	theOrder, err = h.Repo.Update(r.Context(), theOrder)
+	if errors.Is(err, order.ErrVersionMismatch) {
+		w.WriteHeader(versionConflictStatus(r))
+		return
+	} else if errors.Is(err, order.ErrNotExist) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		logging.FromContext(r.Context()).Error("failed to insert", slog.Any("error", err))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	metrics.OrdersCompleted.Inc()
+
+	w.Header().Set("ETag", etag(theOrder.Version))
 	if err := json.NewEncoder(w).Encode(theOrder); err != nil {
-		fmt.Println("failed to marshal: ", err)
+		logging.FromContext(r.Context()).Error("failed to marshal", slog.Any("error", err))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -215,13 +376,65 @@ func (h *Order) DeleteByID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = h.Repo.DeleteByID(r.Context(), orderID)
+	var version uint64
+	if r.Header.Get("If-Match") != "" || h.RequireIfMatch {
+		current, err := h.Repo.FindByID(r.Context(), orderID)
+		if errors.Is(err, order.ErrNotExist) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		} else if err != nil {
+			logging.FromContext(r.Context()).Error("failed to find by id", slog.Any("error", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if !checkIfMatch(w, r, current.Version, h.RequireIfMatch) {
+			return
+		}
+		version = current.Version
+	}
+
+	err = h.Repo.DeleteByID(r.Context(), orderID, version)
 	if errors.Is(err, order.ErrNotExist) {
 		w.WriteHeader(http.StatusNotFound)
 		return
+	} else if errors.Is(err, order.ErrVersionMismatch) {
+		w.WriteHeader(versionConflictStatus(r))
+		return
 	} else if err != nil {
-		fmt.Println("failed to find by id: ", err)
+		logging.FromContext(r.Context()).Error("failed to find by id", slog.Any("error", err))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 }
+
+// Line items and discounts are nested, so the CSV export carries them as
+// JSON arrays.
+var orderCSVHeader = []string{"order_id", "customer_id", "line_items", "discounts", "shipping_region", "tax_inclusive", "created_at", "shipped_at", "completed_at", "payment_status", "paid_at", "version"}
+
+func (h *Order) Export(w http.ResponseWriter, r *http.Request) {
+	exportRows(w, r, "orders", orderCSVHeader,
+		func(o model.Order) []string {
+			lineItems, _ := json.Marshal(o.LineItems)
+			discounts, _ := json.Marshal(o.Discounts)
+			return []string{
+				strconv.FormatUint(o.OrderID, 10),
+				o.CustomerID.String(),
+				string(lineItems),
+				string(discounts),
+				o.ShippingRegion,
+				strconv.FormatBool(o.TaxInclusive),
+				formatCSVTime(o.CreatedAt),
+				formatCSVTime(o.ShippedAt),
+				formatCSVTime(o.CompletedAt),
+				o.PaymentStatus,
+				formatCSVTime(o.PaidAt),
+				strconv.FormatUint(o.Version, 10),
+			}
+		},
+		func(ctx context.Context, q pagination.Query) ([]model.Order, *pagination.Cursor, error) {
+			res, err := h.Repo.FindAll(ctx, q)
+			return res.Orders, res.Next, err
+		},
+	)
+}
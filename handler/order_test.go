@@ -0,0 +1,104 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/umuttopalak/orders-api/model"
+	"github.com/umuttopalak/orders-api/repository/order"
+	"github.com/umuttopalak/orders-api/repository/product"
+)
+
+func TestCreateOrderPricesLineItems(t *testing.T) {
+	const customer = `"customer_id":"ee4daab0-0f31-43a6-9b60-a36675f061a1"`
+
+	tests := []struct {
+		name   string
+		items  string
+		error  string
+		prices []uint
+	}{
+		{"catalog price", `[{"product_id":7,"quantity":2,"price":1}]`, "", []uint{1250}},
+		{"price omitted", `[{"product_id":7,"quantity":1},{"product_id":8,"quantity":3}]`, "", []uint{1250, 99}},
+		{"no product", `[{"product_id":7,"quantity":1},{"quantity":1,"price":1}]`, "line_items[1]: product_id is required", nil},
+		{"unknown product", `[{"product_id":9,"quantity":1,"price":1}]`, "line_items[0]: product 9 does not exist", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newTestRedis(t)
+			h := &Order{
+				Repo:     &order.RedisRepo{Client: client},
+				Products: &product.RedisRepo{Client: client},
+			}
+			for _, p := range []model.Product{
+				{ProductID: 7, ProductName: "Kettle", ProductPrice: 1250, Version: 1},
+				{ProductID: 8, ProductName: "Filter", ProductPrice: 99, Version: 1},
+			} {
+				if err := h.Products.Insert(context.Background(), p); err != nil {
+					t.Fatalf("insert product: %v", err)
+				}
+			}
+
+			w := serve(h.Create, http.MethodPost, "/order", "/order", `{`+customer+`,"line_items":`+tt.items+`}`)
+			if tt.error != "" {
+				if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), tt.error) {
+					t.Errorf("create = %d %s, want %d %q", w.Code, w.Body, http.StatusBadRequest, tt.error)
+				}
+				return
+			}
+
+			var o model.Order
+			if err := json.Unmarshal(w.Body.Bytes(), &o); err != nil {
+				t.Fatalf("decode order: %v", err)
+			}
+			stored, err := h.Repo.FindByID(context.Background(), o.OrderID)
+			if err != nil {
+				t.Fatalf("find order: %v", err)
+			}
+			for i, price := range tt.prices {
+				if got := stored.LineItems[i].Price; got != price {
+					t.Errorf("line_items[%d].price = %d, want %d", i, got, price)
+				}
+			}
+		})
+	}
+}
+
+func TestUpdateOrderStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		status string
+		want   int
+	}{
+		{"completed", "completed", http.StatusOK},
+		{"shipped", "shipped", http.StatusConflict},
+		{"unknown", "lost", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Order{Repo: &order.RedisRepo{Client: newTestRedis(t)}}
+			insertOrder(t, h.Repo, 1)
+
+			w := serve(h.UpdateByID, http.MethodPut, "/order/{id}", "/order/1", `{"status":"`+tt.status+`"}`)
+			if w.Code != tt.want {
+				t.Fatalf("update = %d %s, want %d", w.Code, w.Body, tt.want)
+			}
+
+			stored, err := h.Repo.FindByID(context.Background(), 1)
+			if err != nil {
+				t.Fatalf("find order: %v", err)
+			}
+			if stored.ShippedAt != nil {
+				t.Errorf("shipped_at = %v, want the order not shipped", stored.ShippedAt)
+			}
+			if (stored.CompletedAt != nil) != (tt.want == http.StatusOK) {
+				t.Errorf("completed_at = %v after %d", stored.CompletedAt, w.Code)
+			}
+		})
+	}
+}
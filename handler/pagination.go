@@ -0,0 +1,85 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/umuttopalak/orders-api/repository/pagination"
+)
+
+const (
+	defaultListLimit = 50
+	maxListLimit     = 200
+)
+
+// parseListQuery reads ?limit=, ?sort= and ?cursor=. Limits above the
+// maximum are clamped. A cursor remembers the sort it was issued for, so
+// asking for a different one alongside it is an error.
+func parseListQuery(r *http.Request) (pagination.Query, error) {
+	params := r.URL.Query()
+
+	query := pagination.Query{Limit: defaultListLimit}
+
+	if limit := params.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			return pagination.Query{}, fmt.Errorf("invalid limit %q", limit)
+		}
+		query.Limit = min(n, maxListLimit)
+	}
+
+	sort := params.Get("sort")
+	switch sort {
+	case "", "created_at":
+	case "-created_at":
+		query.Desc = true
+	default:
+		return pagination.Query{}, fmt.Errorf("invalid sort %q", sort)
+	}
+
+	if cursor := params.Get("cursor"); cursor != "" {
+		c, err := pagination.DecodeCursor(cursor)
+		if err != nil {
+			return pagination.Query{}, err
+		}
+		if sort != "" && c.Desc != query.Desc {
+			return pagination.Query{}, errors.New("cursor was issued for a different sort")
+		}
+		query.Desc = c.Desc
+		query.Cursor = &c
+	}
+
+	return query, nil
+}
+
+func encodeCursor(c *pagination.Cursor) string {
+	if c == nil {
+		return ""
+	}
+	return c.Encode()
+}
+
+// setPageLinks emits RFC 8288 Link headers for the neighbouring pages,
+// keeping the rest of the request's query string.
+func setPageLinks(w http.ResponseWriter, r *http.Request, next, prev *pagination.Cursor) {
+	var links []string
+	for _, link := range []struct {
+		rel    string
+		cursor *pagination.Cursor
+	}{{"next", next}, {"prev", prev}} {
+		if link.cursor == nil {
+			continue
+		}
+
+		params := r.URL.Query()
+		params.Set("cursor", link.cursor.Encode())
+		links = append(links, fmt.Sprintf(`<%s?%s>; rel="%s"`, r.URL.Path, params.Encode(), link.rel))
+	}
+
+	if len(links) > 0 {
+		w.Header().Add("Link", strings.Join(links, ", "))
+	}
+}
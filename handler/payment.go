@@ -0,0 +1,413 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/umuttopalak/orders-api/idempotency"
+	"github.com/umuttopalak/orders-api/logging"
+	"github.com/umuttopalak/orders-api/metrics"
+	"github.com/umuttopalak/orders-api/model"
+	"github.com/umuttopalak/orders-api/payments"
+	"github.com/umuttopalak/orders-api/repository/order"
+	"github.com/umuttopalak/orders-api/repository/payment"
+)
+
+// paymentLockTTL bounds how long a crashed request can block payments of
+// an order. It must outlast the provider calls of one request.
+const paymentLockTTL = 30 * time.Second
+
+// orderUpdateRetries is how often recording a payment outcome on the order
+// is retried when a concurrent write changed the order's version.
+const orderUpdateRetries = 3
+
+type Payment struct {
+	Orders   *order.RedisRepo
+	Repo     *payment.RedisRepo
+	Provider payments.Provider
+	Currency string
+}
+
+// Pay charges the order total. The authorization is captured right away,
+// and voided again if the capture fails. A declined payment is recorded and
+// answered with 402 so the client can retry with another payment method.
+//
+// The payment is recorded as pending before the provider is called, and
+// its ID is the provider's idempotency key. A retry after a failure
+// resumes that payment, or finishes recording a captured one, instead of
+// charging the order again.
+func (h *Payment) Pay(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		PaymentMethod string `json:"payment_method"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(decodeErrorStatus(err))
+		return
+	}
+	if body.PaymentMethod == "" {
+		writeError(w, http.StatusBadRequest, "payment_method is required")
+		return
+	}
+
+	orderID, unlock, ok := h.lock(w, r)
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	o, err := h.Orders.FindByID(r.Context(), orderID)
+	if errors.Is(err, order.ErrNotExist) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		logging.FromContext(r.Context()).Error("failed to find order", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if o.PaymentStatus != "" && o.PaymentStatus != model.PaymentFailed {
+		writeError(w, http.StatusConflict, "order is already paid")
+		return
+	}
+	if o.Total() == 0 {
+		writeError(w, http.StatusBadRequest, "order has nothing to pay")
+		return
+	}
+
+	list, err := h.Repo.FindByOrder(r.Context(), orderID)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to find payments", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var p model.Payment
+	if n := len(list); n > 0 && list[n-1].Status != model.PaymentFailed {
+		p = list[n-1]
+	}
+
+	switch p.Status {
+	case model.PaymentPaid:
+		// Captured by an earlier attempt that failed to update the order.
+		if err := h.setOrderPayment(r.Context(), orderID, p.Status, p.UpdatedAt); err != nil {
+			logging.FromContext(r.Context()).Error("failed to update order payment", slog.Any("error", err), slog.String("payment_id", p.PaymentID))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		writePayment(w, r, http.StatusCreated, p)
+		return
+
+	case model.PaymentPending:
+		// An earlier attempt did not learn or record the provider's answer.
+
+	default:
+		now := time.Now().UTC()
+		p = model.Payment{
+			PaymentID: uuid.NewString(),
+			OrderID:   orderID,
+			Provider:  h.Provider.Name(),
+			Amount:    o.Total(),
+			Currency:  h.Currency,
+			Status:    model.PaymentPending,
+			CreatedAt: &now,
+			UpdatedAt: &now,
+			Version:   1,
+		}
+
+		if err := h.Repo.Insert(r.Context(), p); err != nil {
+			logging.FromContext(r.Context()).Error("failed to insert payment", slog.Any("error", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	err = h.charge(r.Context(), &p, body.PaymentMethod)
+	if errors.Is(err, payments.ErrDeclined) {
+		p.Status = model.PaymentFailed
+		p.FailureReason = err.Error()
+	} else if err != nil {
+		metrics.Payments.WithLabelValues("pay", "error").Inc()
+		logging.FromContext(r.Context()).Error("payment provider failed", slog.Any("error", err), slog.String("payment_id", p.PaymentID))
+		writeError(w, http.StatusBadGateway, "payment provider unavailable")
+		return
+	} else {
+		p.Status = model.PaymentPaid
+	}
+	metrics.Payments.WithLabelValues("pay", p.Status).Inc()
+
+	now := time.Now().UTC()
+	p.UpdatedAt = &now
+
+	updated, err := h.Repo.Update(r.Context(), p)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to update payment", slog.Any("error", err), slog.String("reference", p.Reference))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	p = updated
+
+	var paidAt *time.Time
+	if p.Status == model.PaymentPaid {
+		paidAt = &now
+	}
+	if err := h.setOrderPayment(r.Context(), orderID, p.Status, paidAt); err != nil {
+		logging.FromContext(r.Context()).Error("failed to update order payment", slog.Any("error", err), slog.String("payment_id", p.PaymentID))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	status := http.StatusCreated
+	if p.Status == model.PaymentFailed {
+		status = http.StatusPaymentRequired
+	}
+	writePayment(w, r, status, p)
+}
+
+// charge authorizes and captures p.Amount, setting p.Reference.
+func (h *Payment) charge(ctx context.Context, p *model.Payment, method string) error {
+	ref, err := h.Provider.Authorize(ctx, payments.AuthorizeRequest{
+		OrderID:        p.OrderID,
+		Amount:         p.Amount,
+		Currency:       p.Currency,
+		PaymentMethod:  method,
+		IdempotencyKey: p.PaymentID,
+	})
+	if err != nil {
+		return err
+	}
+	p.Reference = ref
+
+	if err := h.Provider.Capture(ctx, ref, p.Amount); err != nil {
+		if voidErr := h.Provider.Void(ctx, ref); voidErr != nil {
+			logging.FromContext(ctx).Error("failed to void authorization", slog.Any("error", voidErr), slog.String("reference", ref))
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Refund returns the requested amount, or everything not yet refunded, of
+// the order's paid payment.
+func (h *Payment) Refund(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Amount uint64 `json:"amount"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		w.WriteHeader(decodeErrorStatus(err))
+		return
+	}
+
+	orderID, unlock, ok := h.lock(w, r)
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	if _, err := h.Orders.FindByID(r.Context(), orderID); errors.Is(err, order.ErrNotExist) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		logging.FromContext(r.Context()).Error("failed to find order", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// Retries of a request with the same Idempotency-Key reach the
+	// provider with the same key, in case an earlier attempt refunded but
+	// failed to record it.
+	key := uuid.NewString()
+	if k := r.Header.Get(idempotency.Header); k != "" {
+		key = fmt.Sprintf("order:%d:refund:%s", orderID, k)
+	}
+
+	p, err := h.refund(r.Context(), orderID, body.Amount, key)
+	var serr *statusError
+	if errors.As(err, &serr) {
+		writeError(w, serr.status, serr.msg)
+		return
+	} else if err != nil {
+		logging.FromContext(r.Context()).Error("failed to refund", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writePayment(w, r, http.StatusOK, p)
+}
+
+// refund returns amount, or everything not yet refunded if amount is 0, of
+// the order's paid payment and records it on the order. key is sent to the
+// provider and kept on the payment, so a refund already made under key is
+// only recorded, not made again. The caller holds the order's payment
+// lock. Refunds the client can fix are reported as *statusError.
+func (h *Payment) refund(ctx context.Context, orderID uint64, amount uint64, key string) (model.Payment, error) {
+	list, err := h.Repo.FindByOrder(ctx, orderID)
+	if err != nil {
+		return model.Payment{}, fmt.Errorf("failed to find payments: %w", err)
+	}
+
+	for _, p := range list {
+		for _, refund := range p.Refunds {
+			if refund.Key == key {
+				if err := h.setOrderPayment(ctx, orderID, p.Status, nil); err != nil {
+					return model.Payment{}, fmt.Errorf("failed to update order payment of %s: %w", p.PaymentID, err)
+				}
+				return p, nil
+			}
+		}
+	}
+
+	var p *model.Payment
+	for i := range list {
+		if list[i].Status == model.PaymentPaid || list[i].Status == model.PaymentPartiallyRefunded {
+			p = &list[i]
+		}
+	}
+	if p == nil {
+		return model.Payment{}, &statusError{http.StatusConflict, "order has no refundable payment"}
+	}
+
+	remaining := p.Amount - p.Refunded
+	if amount == 0 {
+		amount = remaining
+	}
+	if amount > remaining {
+		return model.Payment{}, &statusError{http.StatusBadRequest, "amount exceeds the refundable " + strconv.FormatUint(remaining, 10)}
+	}
+
+	err = h.Provider.Refund(ctx, p.Reference, amount, key)
+	if errors.Is(err, payments.ErrDeclined) {
+		metrics.Payments.WithLabelValues("refund", "declined").Inc()
+		return model.Payment{}, &statusError{http.StatusPaymentRequired, err.Error()}
+	} else if err != nil {
+		metrics.Payments.WithLabelValues("refund", "error").Inc()
+		logging.FromContext(ctx).Error("payment provider failed", slog.Any("error", err))
+		return model.Payment{}, &statusError{http.StatusBadGateway, "payment provider unavailable"}
+	}
+
+	now := time.Now().UTC()
+	p.Refunded += amount
+	p.Refunds = append(p.Refunds, model.Refund{Key: key, Amount: amount, CreatedAt: &now})
+	p.UpdatedAt = &now
+	p.Status = model.PaymentPartiallyRefunded
+	if p.Refunded == p.Amount {
+		p.Status = model.PaymentRefunded
+	}
+	metrics.Payments.WithLabelValues("refund", p.Status).Inc()
+
+	updated, err := h.Repo.Update(ctx, *p)
+	if err != nil {
+		return model.Payment{}, fmt.Errorf("failed to update payment %s: %w", p.PaymentID, err)
+	}
+
+	if err := h.setOrderPayment(ctx, orderID, updated.Status, nil); err != nil {
+		return model.Payment{}, fmt.Errorf("failed to update order payment of %s: %w", p.PaymentID, err)
+	}
+
+	return updated, nil
+}
+
+// List returns the payments of an order, oldest first.
+func (h *Payment) List(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if _, err := h.Orders.FindByID(r.Context(), orderID); errors.Is(err, order.ErrNotExist) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		logging.FromContext(r.Context()).Error("failed to find order", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	list, err := h.Repo.FindByOrder(r.Context(), orderID)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to find payments", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	response := struct {
+		Payments []model.Payment `json:"payments"`
+	}{list}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logging.FromContext(r.Context()).Error("failed to marshal", slog.Any("error", err))
+	}
+}
+
+// lock parses the order ID and takes the order's payment lock, answering
+// 409 while another payment request for the order is running.
+func (h *Payment) lock(w http.ResponseWriter, r *http.Request) (uint64, func(), bool) {
+	orderID, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return 0, nil, false
+	}
+
+	unlock, err := h.Repo.Lock(r.Context(), orderID, paymentLockTTL)
+	if errors.Is(err, payment.ErrLocked) {
+		writeError(w, http.StatusConflict, "another payment request for this order is in progress")
+		return 0, nil, false
+	} else if err != nil {
+		logging.FromContext(r.Context()).Error("failed to lock payments", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return 0, nil, false
+	}
+
+	return orderID, unlock, true
+}
+
+// setOrderPayment records a payment outcome on the order. Payment fields
+// are only written under the payment lock, so a version conflict comes
+// from an unrelated change and the update is retried on the fresh order.
+func (h *Payment) setOrderPayment(ctx context.Context, orderID uint64, status string, paidAt *time.Time) error {
+	for attempt := 1; ; attempt++ {
+		o, err := h.Orders.FindByID(ctx, orderID)
+		if err != nil {
+			return err
+		}
+
+		o.PaymentStatus = status
+		if paidAt != nil {
+			o.PaidAt = paidAt
+		}
+
+		_, err = h.Orders.Update(ctx, o)
+		if errors.Is(err, order.ErrVersionMismatch) && attempt < orderUpdateRetries {
+			continue
+		}
+		return err
+	}
+}
+
+func writePayment(w http.ResponseWriter, r *http.Request, status int, p model.Payment) {
+	res, err := json.Marshal(p)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to encode payment", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if _, err := w.Write(res); err != nil {
+		logging.FromContext(r.Context()).Error("failed to write response", slog.Any("error", err))
+	}
+}
@@ -0,0 +1,224 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/umuttopalak/orders-api/model"
+	"github.com/umuttopalak/orders-api/payments"
+	"github.com/umuttopalak/orders-api/repository/order"
+	"github.com/umuttopalak/orders-api/repository/payment"
+)
+
+func newTestPayment(t *testing.T) *Payment {
+	t.Helper()
+
+	client := newTestRedis(t)
+	return &Payment{
+		Orders:   &order.RedisRepo{Client: client},
+		Repo:     &payment.RedisRepo{Client: client},
+		Provider: &payments.Fake{},
+		Currency: "USD",
+	}
+}
+
+// insertOrder stores an order of one line item worth 1000.
+func insertOrder(t *testing.T, orders *order.RedisRepo, id uint64) {
+	t.Helper()
+
+	now := time.Now().UTC()
+	err := orders.Insert(context.Background(), model.Order{
+		OrderID:    id,
+		CustomerID: uuid.New(),
+		LineItems:  []model.LineItem{{ItemID: uuid.New(), ProductID: 1, Quantity: 2, Price: 500}},
+		CreatedAt:  &now,
+		Version:    1,
+	})
+	if err != nil {
+		t.Fatalf("insert order: %v", err)
+	}
+}
+
+type paymentResponse struct {
+	status  int
+	payment model.Payment
+	body    string
+}
+
+func decodePayment(status int, body []byte) *paymentResponse {
+	res := &paymentResponse{status: status, body: string(body)}
+	_ = json.Unmarshal(body, &res.payment)
+	return res
+}
+
+func pay(h *Payment, orderID uint64, method string) *paymentResponse {
+	w := serve(h.Pay, http.MethodPost, "/order/{id}/pay", fmt.Sprintf("/order/%d/pay", orderID), fmt.Sprintf(`{"payment_method":%q}`, method))
+	return decodePayment(w.Code, w.Body.Bytes())
+}
+
+func refund(h *Payment, orderID uint64, body string) *paymentResponse {
+	w := serve(h.Refund, http.MethodPost, "/order/{id}/refund", fmt.Sprintf("/order/%d/refund", orderID), body)
+	return decodePayment(w.Code, w.Body.Bytes())
+}
+
+func TestPay(t *testing.T) {
+	tests := []struct {
+		name          string
+		methods       []string
+		statuses      []int
+		paymentStatus string
+		payments      int
+	}{
+		{"paid", []string{"tok_visa"}, []int{http.StatusCreated}, model.PaymentPaid, 1},
+		{"declined", []string{payments.FakeDeclined}, []int{http.StatusPaymentRequired}, model.PaymentFailed, 1},
+		{"capture declined", []string{payments.FakeCaptureFailed}, []int{http.StatusPaymentRequired}, model.PaymentFailed, 1},
+		{"retried after decline", []string{payments.FakeDeclined, "tok_visa"}, []int{http.StatusPaymentRequired, http.StatusCreated}, model.PaymentPaid, 2},
+		{"paid twice", []string{"tok_visa", "tok_visa"}, []int{http.StatusCreated, http.StatusConflict}, model.PaymentPaid, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestPayment(t)
+			insertOrder(t, h.Orders, 1)
+
+			for i, method := range tt.methods {
+				if res := pay(h, 1, method); res.status != tt.statuses[i] {
+					t.Fatalf("pay #%d = %d %s, want %d", i+1, res.status, res.body, tt.statuses[i])
+				}
+			}
+
+			o, err := h.Orders.FindByID(context.Background(), 1)
+			if err != nil {
+				t.Fatalf("find order: %v", err)
+			}
+			if o.PaymentStatus != tt.paymentStatus {
+				t.Errorf("order payment_status = %q, want %q", o.PaymentStatus, tt.paymentStatus)
+			}
+			if (o.PaidAt != nil) != (tt.paymentStatus == model.PaymentPaid) {
+				t.Errorf("order paid_at = %v with payment_status %q", o.PaidAt, o.PaymentStatus)
+			}
+
+			list, err := h.Repo.FindByOrder(context.Background(), 1)
+			if err != nil {
+				t.Fatalf("find payments: %v", err)
+			}
+			if len(list) != tt.payments {
+				t.Errorf("got %d payments, want %d", len(list), tt.payments)
+			}
+			if last := list[len(list)-1]; last.Status != tt.paymentStatus || last.Amount != 1000 {
+				t.Errorf("last payment = %s of %d, want %s of 1000", last.Status, last.Amount, tt.paymentStatus)
+			}
+		})
+	}
+}
+
+func TestPayResumesPendingPayment(t *testing.T) {
+	h := newTestPayment(t)
+	ctx := context.Background()
+	insertOrder(t, h.Orders, 1)
+
+	// An earlier attempt recorded the payment but never learnt the
+	// provider's answer.
+	now := time.Now().UTC()
+	pending := model.Payment{
+		PaymentID: uuid.NewString(),
+		OrderID:   1,
+		Provider:  h.Provider.Name(),
+		Amount:    1000,
+		Currency:  "USD",
+		Status:    model.PaymentPending,
+		CreatedAt: &now,
+		UpdatedAt: &now,
+		Version:   1,
+	}
+	if err := h.Repo.Insert(ctx, pending); err != nil {
+		t.Fatalf("insert payment: %v", err)
+	}
+
+	res := pay(h, 1, "tok_visa")
+	if res.status != http.StatusCreated {
+		t.Fatalf("pay = %d %s, want %d", res.status, res.body, http.StatusCreated)
+	}
+	if res.payment.PaymentID != pending.PaymentID {
+		t.Errorf("pay charged payment %s, want the pending %s", res.payment.PaymentID, pending.PaymentID)
+	}
+
+	list, err := h.Repo.FindByOrder(ctx, 1)
+	if err != nil {
+		t.Fatalf("find payments: %v", err)
+	}
+	if len(list) != 1 || list[0].Status != model.PaymentPaid {
+		t.Errorf("payments = %+v, want the one pending payment paid", list)
+	}
+}
+
+func TestPayUnknownOrder(t *testing.T) {
+	h := newTestPayment(t)
+
+	if res := pay(h, 1, "tok_visa"); res.status != http.StatusNotFound {
+		t.Errorf("pay = %d, want %d", res.status, http.StatusNotFound)
+	}
+}
+
+func TestRefund(t *testing.T) {
+	tests := []struct {
+		name          string
+		bodies        []string
+		statuses      []int
+		refunded      uint64
+		paymentStatus string
+	}{
+		{"everything", []string{""}, []int{http.StatusOK}, 1000, model.PaymentRefunded},
+		{"partial", []string{`{"amount":400}`}, []int{http.StatusOK}, 400, model.PaymentPartiallyRefunded},
+		{"partials adding up", []string{`{"amount":400}`, `{"amount":600}`}, []int{http.StatusOK, http.StatusOK}, 1000, model.PaymentRefunded},
+		{"more than paid", []string{`{"amount":1001}`}, []int{http.StatusBadRequest}, 0, model.PaymentPaid},
+		{"more than left", []string{`{"amount":600}`, `{"amount":600}`}, []int{http.StatusOK, http.StatusBadRequest}, 600, model.PaymentPartiallyRefunded},
+		{"after full refund", []string{"", `{"amount":1}`}, []int{http.StatusOK, http.StatusConflict}, 1000, model.PaymentRefunded},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestPayment(t)
+			insertOrder(t, h.Orders, 1)
+			if res := pay(h, 1, "tok_visa"); res.status != http.StatusCreated {
+				t.Fatalf("pay = %d %s", res.status, res.body)
+			}
+
+			for i, body := range tt.bodies {
+				if res := refund(h, 1, body); res.status != tt.statuses[i] {
+					t.Fatalf("refund #%d = %d %s, want %d", i+1, res.status, res.body, tt.statuses[i])
+				}
+			}
+
+			list, err := h.Repo.FindByOrder(context.Background(), 1)
+			if err != nil {
+				t.Fatalf("find payments: %v", err)
+			}
+			if p := list[0]; p.Refunded != tt.refunded || p.Status != tt.paymentStatus {
+				t.Errorf("payment refunded %d and is %s, want %d and %s", p.Refunded, p.Status, tt.refunded, tt.paymentStatus)
+			}
+
+			o, err := h.Orders.FindByID(context.Background(), 1)
+			if err != nil {
+				t.Fatalf("find order: %v", err)
+			}
+			if o.PaymentStatus != tt.paymentStatus {
+				t.Errorf("order payment_status = %q, want %q", o.PaymentStatus, tt.paymentStatus)
+			}
+		})
+	}
+}
+
+func TestRefundUnpaidOrder(t *testing.T) {
+	h := newTestPayment(t)
+	insertOrder(t, h.Orders, 1)
+
+	if res := refund(h, 1, `{"amount":100}`); res.status != http.StatusConflict {
+		t.Errorf("refund = %d %s, want %d", res.status, res.body, http.StatusConflict)
+	}
+}
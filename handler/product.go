@@ -1,20 +1,28 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log/slog"
 	"math/rand"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/umuttopalak/orders-api/logging"
 	"github.com/umuttopalak/orders-api/model"
+	"github.com/umuttopalak/orders-api/repository/batch"
+	"github.com/umuttopalak/orders-api/repository/pagination"
 	"github.com/umuttopalak/orders-api/repository/product"
 )
 
 type Product struct {
-	Repo *product.RedisRepo
+	Repo           *product.RedisRepo
+	RequireIfMatch bool
+	CacheMaxAge    time.Duration
 }
 
 func (h *Product) Create(w http.ResponseWriter, r *http.Request) {
@@ -25,27 +33,35 @@ func (h *Product) Create(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		w.WriteHeader(decodeErrorStatus(err))
 		return
 	}
 
+	now := time.Now().UTC()
 	Product := model.Product{
 		ProductID:    rand.Uint64(),
 		ProductName:  body.ProductName,
 		ProductPrice: body.ProductPrice,
 		Category:     body.Category,
+		Version:      1,
+		UpdatedAt:    &now,
+	}
+
+	if err := validateProduct(Product); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
 	}
 
 	err := h.Repo.Insert(r.Context(), Product)
 	if err != nil {
-		fmt.Println("failed to insert: ", err)
+		logging.FromContext(r.Context()).Error("failed to insert", slog.Any("error", err))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
 	res, err := json.Marshal(Product)
 	if err != nil {
-		fmt.Println("failed to insert: ", err)
+		logging.FromContext(r.Context()).Error("failed to insert", slog.Any("error", err))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -58,45 +74,45 @@ func (h *Product) Create(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *Product) List(w http.ResponseWriter, r *http.Request) {
-	cursorStr := r.URL.Query().Get("cursor")
-	if cursorStr == "" {
-		cursorStr = "0"
-	}
-
-	const decimal = 10
-	const bitSize = 64
-	cursor, err := strconv.ParseUint(cursorStr, decimal, bitSize)
+	query, err := parseListQuery(r)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	const size = 50
-	res, err := h.Repo.FindAll(r.Context(), product.FindAllPage{
-		Offset: cursor,
-		Size:   size,
-	})
+	res, err := h.Repo.FindAll(r.Context(), query)
 	if err != nil {
-		fmt.Println("failed to find all", err)
+		logging.FromContext(r.Context()).Error("failed to find all", slog.Any("error", err))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
 	var response struct {
 		Products []model.Product `json:"products"`
-		Next     uint64          `json:"next,omitempty"`
+		Next     string          `json:"next,omitempty"`
+		Prev     string          `json:"prev,omitempty"`
+		Total    int64           `json:"total"`
 	}
 
 	response.Products = res.Products
-	response.Next = res.Cursor
+	response.Next = encodeCursor(res.Next)
+	response.Prev = encodeCursor(res.Prev)
+	response.Total = res.Total
+
+	setPageLinks(w, r, res.Next, res.Prev)
 
 	data, err := json.Marshal(response)
 	if err != nil {
-		fmt.Println("failed to marshal", err)
+		logging.FromContext(r.Context()).Error("failed to marshal", slog.Any("error", err))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	w.Header().Set("Cache-Control", cacheControl(h.CacheMaxAge))
+	if checkNotModified(w, r, contentETag(data), nil) {
+		return
+	}
+
 	if _, err := w.Write(data); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		return
@@ -121,13 +137,18 @@ func (h *Product) GetByID(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	} else if err != nil {
-		fmt.Println("failed to find by id: ", err)
+		logging.FromContext(r.Context()).Error("failed to find by id", slog.Any("error", err))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	w.Header().Set("Cache-Control", cacheControl(h.CacheMaxAge))
+	if checkNotModified(w, r, etag(o.Version), o.UpdatedAt) {
+		return
+	}
+
 	if err := json.NewEncoder(w).Encode(o); err != nil {
-		fmt.Println("failed to marshal: ", err)
+		logging.FromContext(r.Context()).Error("failed to marshal", slog.Any("error", err))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -143,7 +164,7 @@ func (h *Product) UpdateByID(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		w.WriteHeader(decodeErrorStatus(err))
 		return
 	}
 
@@ -163,24 +184,43 @@ func (h *Product) UpdateByID(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	} else if err != nil {
-		fmt.Println("failed to find Product: ", err)
+		logging.FromContext(r.Context()).Error("failed to find Product", slog.Any("error", err))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	if !checkIfMatch(w, r, theProduct.Version, h.RequireIfMatch) {
+		return
+	}
+
 	theProduct.Category = body.Category
 	theProduct.ProductPrice = body.ProductPrice
 	theProduct.ProductName = body.ProductName
 
-	err = h.Repo.Update(r.Context(), theProduct)
-	if err != nil {
-		fmt.Println("failed to insert: ", err)
+	if err := validateProduct(theProduct); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	now := time.Now().UTC()
+	theProduct.UpdatedAt = &now
+
+	theProduct, err = h.Repo.Update(r.Context(), theProduct)
+	if errors.Is(err, product.ErrVersionMismatch) {
+		w.WriteHeader(versionConflictStatus(r))
+		return
+	} else if errors.Is(err, product.ErrNotExist) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		logging.FromContext(r.Context()).Error("failed to insert", slog.Any("error", err))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	w.Header().Set("ETag", etag(theProduct.Version))
 	if err := json.NewEncoder(w).Encode(theProduct); err != nil {
-		fmt.Println("failed to marshal: ", err)
+		logging.FromContext(r.Context()).Error("failed to marshal", slog.Any("error", err))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -198,13 +238,260 @@ func (h *Product) DeleteByID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = h.Repo.DeleteByID(r.Context(), productID)
+	var version uint64
+	if r.Header.Get("If-Match") != "" || h.RequireIfMatch {
+		current, err := h.Repo.FindByID(r.Context(), productID)
+		if errors.Is(err, product.ErrNotExist) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		} else if err != nil {
+			logging.FromContext(r.Context()).Error("failed to find by id", slog.Any("error", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if !checkIfMatch(w, r, current.Version, h.RequireIfMatch) {
+			return
+		}
+		version = current.Version
+	}
+
+	err = h.Repo.DeleteByID(r.Context(), productID, version)
 	if errors.Is(err, product.ErrNotExist) {
 		w.WriteHeader(http.StatusNotFound)
 		return
+	} else if errors.Is(err, product.ErrVersionMismatch) {
+		w.WriteHeader(versionConflictStatus(r))
+		return
 	} else if err != nil {
-		fmt.Println("failed to find by id: ", err)
+		logging.FromContext(r.Context()).Error("failed to find by id", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+func (h *Product) BatchCreate(w http.ResponseWriter, r *http.Request) {
+	var body []struct {
+		Category     model.Category `json:"category"`
+		ProductPrice int64          `json:"price"`
+		ProductName  string         `json:"product_name"`
+	}
+
+	atomic, ok := decodeBatch(w, r, &body)
+	if !ok {
+		return
+	}
+
+	now := time.Now().UTC()
+	results := make([]batchResult, len(body))
+	products := make([]model.Product, 0, len(body))
+	indexes := make([]int, 0, len(body))
+
+	for i, item := range body {
+		p := model.Product{
+			ProductID:    rand.Uint64(),
+			ProductName:  item.ProductName,
+			ProductPrice: item.ProductPrice,
+			Category:     item.Category,
+			Version:      1,
+			UpdatedAt:    &now,
+		}
+		if err := validateProduct(p); err != nil {
+			results[i] = batchResult{Index: i, Status: http.StatusBadRequest, Error: err.Error()}
+			continue
+		}
+		products = append(products, p)
+		indexes = append(indexes, i)
+	}
+
+	if abortAtomic(results, atomic) {
+		writeBatchResults(w, r, results, atomic)
+		return
+	}
+
+	errs, err := h.Repo.InsertMany(r.Context(), products, atomic)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to insert", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	for j, p := range products {
+		i := indexes[j]
+		if errs[j] != nil {
+			results[i] = batchErrorResult(i, errs[j])
+			continue
+		}
+		results[i] = batchResult{Index: i, Status: http.StatusCreated, ID: p.ProductID, Version: p.Version, Item: p}
+	}
+
+	writeBatchResults(w, r, results, atomic)
+}
+
+func (h *Product) BatchUpdate(w http.ResponseWriter, r *http.Request) {
+	var body []struct {
+		ProductID    uint64         `json:"product_id"`
+		Version      uint64         `json:"version"`
+		Category     model.Category `json:"category"`
+		ProductPrice int64          `json:"price"`
+		ProductName  string         `json:"product_name"`
+	}
+
+	atomic, ok := decodeBatch(w, r, &body)
+	if !ok {
+		return
+	}
+
+	now := time.Now().UTC()
+	results := make([]batchResult, len(body))
+	products := make([]model.Product, 0, len(body))
+	indexes := make([]int, 0, len(body))
+
+	for i, item := range body {
+		p := model.Product{
+			ProductID:    item.ProductID,
+			ProductName:  item.ProductName,
+			ProductPrice: item.ProductPrice,
+			Category:     item.Category,
+			Version:      item.Version,
+			UpdatedAt:    &now,
+		}
+		// Like a PUT without If-Match, a zero version updates whatever
+		// is stored, unless If-Match is required.
+		if p.Version == 0 && h.RequireIfMatch {
+			results[i] = batchResult{Index: i, Status: http.StatusBadRequest, Error: "version is required"}
+			continue
+		}
+		if err := validateProduct(p); err != nil {
+			results[i] = batchResult{Index: i, Status: http.StatusBadRequest, Error: err.Error()}
+			continue
+		}
+		products = append(products, p)
+		indexes = append(indexes, i)
+	}
+
+	if abortAtomic(results, atomic) {
+		writeBatchResults(w, r, results, atomic)
+		return
+	}
+
+	products, errs, err := h.Repo.UpdateMany(r.Context(), products, atomic)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to update", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	for j, p := range products {
+		i := indexes[j]
+		if errs[j] != nil {
+			results[i] = batchErrorResult(i, errs[j])
+			continue
+		}
+		results[i] = batchResult{Index: i, Status: http.StatusOK, ID: p.ProductID, Version: p.Version, Item: p}
+	}
+
+	writeBatchResults(w, r, results, atomic)
+}
+
+func (h *Product) BatchDelete(w http.ResponseWriter, r *http.Request) {
+	var body []batchTarget
+
+	atomic, ok := decodeBatch(w, r, &body)
+	if !ok {
+		return
+	}
+
+	targets := make([]batch.Target, len(body))
+	for i, t := range body {
+		targets[i] = batch.Target{ID: t.ID, Version: t.Version}
+	}
+
+	errs, err := h.Repo.DeleteMany(r.Context(), targets, atomic)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to delete", slog.Any("error", err))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+
+	results := make([]batchResult, len(body))
+	for i, t := range body {
+		if errs[i] != nil {
+			results[i] = batchErrorResult(i, errs[i])
+			continue
+		}
+		results[i] = batchResult{Index: i, Status: http.StatusNoContent, ID: t.ID}
+	}
+
+	writeBatchResults(w, r, results, atomic)
+}
+
+var productCSVHeader = []string{"product_id", "product_name", "product_price", "category_id", "category_name", "version", "updated_at"}
+
+func (h *Product) Export(w http.ResponseWriter, r *http.Request) {
+	exportRows(w, r, "products", productCSVHeader,
+		func(p model.Product) []string {
+			return []string{
+				strconv.FormatUint(p.ProductID, 10),
+				p.ProductName,
+				strconv.FormatInt(p.ProductPrice, 10),
+				strconv.FormatUint(p.Category.CategoryID, 10),
+				p.Category.CategoryName,
+				strconv.FormatUint(p.Version, 10),
+				formatCSVTime(p.UpdatedAt),
+			}
+		},
+		func(ctx context.Context, q pagination.Query) ([]model.Product, *pagination.Cursor, error) {
+			res, err := h.Repo.FindAll(ctx, q)
+			return res.Products, res.Next, err
+		},
+	)
+}
+
+func (h *Product) Import(w http.ResponseWriter, r *http.Request) {
+	importRows(w, r, importer[model.Product]{
+		fromCSV: func(row map[string]string) (model.Product, error) {
+			var p model.Product
+			var err error
+
+			if p.ProductID, err = parseCSVUint(row, "product_id"); err != nil {
+				return p, err
+			}
+			if p.Version, err = parseCSVUint(row, "version"); err != nil {
+				return p, err
+			}
+			if p.Category.CategoryID, err = parseCSVUint(row, "category_id"); err != nil {
+				return p, err
+			}
+			if v := row["product_price"]; v != "" {
+				if p.ProductPrice, err = strconv.ParseInt(v, 10, 64); err != nil {
+					return p, fmt.Errorf("product_price: invalid integer %q", v)
+				}
+			}
+			p.ProductName = row["product_name"]
+			p.Category.CategoryName = row["category_name"]
+
+			return p, nil
+		},
+		validate: validateProduct,
+		prepare: func(p *model.Product, now time.Time) (bool, error) {
+			p.UpdatedAt = &now
+			if p.ProductID == 0 {
+				p.ProductID = rand.Uint64()
+				p.Version = 1
+				return false, nil
+			}
+			if p.Version == 0 {
+				return false, errors.New("version is required to update an existing product")
+			}
+			return true, nil
+		},
+		insert: func(ctx context.Context, ps []model.Product) ([]error, error) {
+			return h.Repo.InsertMany(ctx, ps, false)
+		},
+		update: func(ctx context.Context, ps []model.Product) ([]error, error) {
+			_, errs, err := h.Repo.UpdateMany(ctx, ps, false)
+			return errs, err
+		},
+	})
 }
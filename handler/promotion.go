@@ -0,0 +1,367 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/umuttopalak/orders-api/logging"
+	"github.com/umuttopalak/orders-api/metrics"
+	"github.com/umuttopalak/orders-api/model"
+	"github.com/umuttopalak/orders-api/repository/product"
+	"github.com/umuttopalak/orders-api/repository/promotion"
+)
+
+var promotionCode = regexp.MustCompile(`^[A-Z0-9][A-Z0-9_-]{2,31}$`)
+
+type Promotion struct {
+	Repo           *promotion.RedisRepo
+	RequireIfMatch bool
+}
+
+// promotionBody is the writable part of a promotion. The code is only set
+// on create.
+type promotionBody struct {
+	Code             string     `json:"code"`
+	Type             string     `json:"type"`
+	Value            uint64     `json:"value"`
+	CategoryID       uint64     `json:"category_id"`
+	MinOrderValue    uint64     `json:"min_order_value"`
+	UsageLimit       uint64     `json:"usage_limit"`
+	PerCustomerLimit uint64     `json:"per_customer_limit"`
+	StartsAt         *time.Time `json:"starts_at"`
+	EndsAt           *time.Time `json:"ends_at"`
+	Active           *bool      `json:"active"`
+}
+
+func (b promotionBody) apply(p *model.Promotion) {
+	p.Type = b.Type
+	p.Value = b.Value
+	p.CategoryID = b.CategoryID
+	p.MinOrderValue = b.MinOrderValue
+	p.UsageLimit = b.UsageLimit
+	p.PerCustomerLimit = b.PerCustomerLimit
+	p.StartsAt = b.StartsAt
+	p.EndsAt = b.EndsAt
+	if b.Active != nil {
+		p.Active = *b.Active
+	}
+}
+
+func (h *Promotion) Create(w http.ResponseWriter, r *http.Request) {
+	var body promotionBody
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(decodeErrorStatus(err))
+		return
+	}
+
+	now := time.Now().UTC()
+	p := model.Promotion{
+		Code:      normalizePromotionCode(body.Code),
+		Active:    true,
+		CreatedAt: &now,
+		Version:   1,
+	}
+	body.apply(&p)
+
+	if err := validatePromotion(p); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	err := h.Repo.Insert(r.Context(), p)
+	if errors.Is(err, promotion.ErrExists) {
+		writeError(w, http.StatusConflict, "a promotion with this code already exists")
+		return
+	} else if err != nil {
+		logging.FromContext(r.Context()).Error("failed to insert", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	res, err := json.Marshal(p)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to encode promotion", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("ETag", etag(p.Version))
+	w.WriteHeader(http.StatusCreated)
+	if _, err := w.Write(res); err != nil {
+		logging.FromContext(r.Context()).Error("failed to write response", slog.Any("error", err))
+	}
+}
+
+func (h *Promotion) List(w http.ResponseWriter, r *http.Request) {
+	query, err := parseListQuery(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	res, err := h.Repo.FindAll(r.Context(), query)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to find all", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var response struct {
+		Promotions []model.Promotion `json:"promotions"`
+		Next       string            `json:"next,omitempty"`
+		Prev       string            `json:"prev,omitempty"`
+		Total      int64             `json:"total"`
+	}
+
+	response.Promotions = res.Promotions
+	response.Next = encodeCursor(res.Next)
+	response.Prev = encodeCursor(res.Prev)
+	response.Total = res.Total
+
+	setPageLinks(w, r, res.Next, res.Prev)
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logging.FromContext(r.Context()).Error("failed to marshal", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+func (h *Promotion) GetByCode(w http.ResponseWriter, r *http.Request) {
+	p, ok := h.find(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("ETag", etag(p.Version))
+	if err := json.NewEncoder(w).Encode(p); err != nil {
+		logging.FromContext(r.Context()).Error("failed to marshal", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// UpdateByCode replaces the promotion's terms. Redemptions so far keep
+// counting against a changed usage limit.
+func (h *Promotion) UpdateByCode(w http.ResponseWriter, r *http.Request) {
+	var body promotionBody
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(decodeErrorStatus(err))
+		return
+	}
+
+	p, ok := h.find(w, r)
+	if !ok {
+		return
+	}
+
+	if !checkIfMatch(w, r, p.Version, h.RequireIfMatch) {
+		return
+	}
+
+	body.apply(&p)
+	if err := validatePromotion(p); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	redemptions := p.Redemptions
+	p, err := h.Repo.Update(r.Context(), p)
+	if errors.Is(err, promotion.ErrVersionMismatch) {
+		w.WriteHeader(versionConflictStatus(r))
+		return
+	} else if errors.Is(err, promotion.ErrNotExist) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		logging.FromContext(r.Context()).Error("failed to update", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	p.Redemptions = redemptions
+
+	w.Header().Set("ETag", etag(p.Version))
+	if err := json.NewEncoder(w).Encode(p); err != nil {
+		logging.FromContext(r.Context()).Error("failed to marshal", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// DeleteByCode removes the promotion. Orders keep the discounts it gave.
+func (h *Promotion) DeleteByCode(w http.ResponseWriter, r *http.Request) {
+	code := normalizePromotionCode(chi.URLParam(r, "code"))
+
+	var version uint64
+	if r.Header.Get("If-Match") != "" || h.RequireIfMatch {
+		p, ok := h.find(w, r)
+		if !ok {
+			return
+		}
+
+		if !checkIfMatch(w, r, p.Version, h.RequireIfMatch) {
+			return
+		}
+		version = p.Version
+	}
+
+	err := h.Repo.DeleteByCode(r.Context(), code, version)
+	if errors.Is(err, promotion.ErrNotExist) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if errors.Is(err, promotion.ErrVersionMismatch) {
+		w.WriteHeader(versionConflictStatus(r))
+		return
+	} else if err != nil {
+		logging.FromContext(r.Context()).Error("failed to delete", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+func (h *Promotion) find(w http.ResponseWriter, r *http.Request) (model.Promotion, bool) {
+	p, err := h.Repo.FindByCode(r.Context(), normalizePromotionCode(chi.URLParam(r, "code")))
+	if errors.Is(err, promotion.ErrNotExist) {
+		w.WriteHeader(http.StatusNotFound)
+		return model.Promotion{}, false
+	} else if err != nil {
+		logging.FromContext(r.Context()).Error("failed to find by code", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return model.Promotion{}, false
+	}
+
+	return p, true
+}
+
+func normalizePromotionCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+func validatePromotion(p model.Promotion) error {
+	if !promotionCode.MatchString(p.Code) {
+		return errors.New("code must be 3 to 32 letters, digits, '-' or '_'")
+	}
+
+	switch p.Type {
+	case model.PromotionPercentage:
+		if p.Value < 1 || p.Value > 100 {
+			return errors.New("value of a percentage promotion must be between 1 and 100")
+		}
+	case model.PromotionFixedAmount:
+		if p.Value == 0 {
+			return errors.New("value of a fixed_amount promotion must be positive")
+		}
+	case model.PromotionFreeShipping:
+		if p.Value != 0 {
+			return errors.New("a free_shipping promotion has no value")
+		}
+	default:
+		return fmt.Errorf("type must be %s, %s or %s", model.PromotionPercentage, model.PromotionFixedAmount, model.PromotionFreeShipping)
+	}
+
+	if p.StartsAt != nil && p.EndsAt != nil && !p.EndsAt.After(*p.StartsAt) {
+		return errors.New("ends_at must be after starts_at")
+	}
+	return nil
+}
+
+// redeemPromotion applies the discount code to o and counts the
+// redemption. The returned release gives the redemption back and must be
+// called if the order is not stored. Codes that cannot be applied are
+// reported as *statusError.
+func redeemPromotion(ctx context.Context, promotions *promotion.RedisRepo, products *product.RedisRepo, o *model.Order, code string) (func(), error) {
+	p, err := promotions.FindByCode(ctx, normalizePromotionCode(code))
+	if errors.Is(err, promotion.ErrNotExist) {
+		return nil, &statusError{http.StatusBadRequest, "unknown discount code"}
+	} else if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if !p.Active || (p.StartsAt != nil && now.Before(*p.StartsAt)) || (p.EndsAt != nil && !now.Before(*p.EndsAt)) {
+		return nil, &statusError{http.StatusBadRequest, "discount code is not active"}
+	}
+
+	subtotal := o.Subtotal()
+	if subtotal < p.MinOrderValue {
+		return nil, &statusError{http.StatusBadRequest, fmt.Sprintf("discount code requires an order value of at least %d", p.MinOrderValue)}
+	}
+
+	eligible := subtotal
+	if p.CategoryID != 0 {
+		eligible, err = categorySubtotal(ctx, products, o.LineItems, p.CategoryID)
+		if err != nil {
+			return nil, err
+		}
+		if eligible == 0 {
+			return nil, &statusError{http.StatusBadRequest, "no line item qualifies for this discount code"}
+		}
+	}
+
+	amount := discountAmount(p, eligible)
+
+	err = promotions.Redeem(ctx, p, o.CustomerID)
+	if errors.Is(err, promotion.ErrExhausted) {
+		metrics.PromotionRedemptions.WithLabelValues("exhausted").Inc()
+		return nil, &statusError{http.StatusConflict, "discount code has reached its usage limit"}
+	} else if err != nil {
+		return nil, err
+	}
+	metrics.PromotionRedemptions.WithLabelValues("redeemed").Inc()
+
+	o.Discounts = append(o.Discounts, model.Discount{Code: p.Code, Type: p.Type, Amount: amount})
+
+	release := func() {
+		metrics.PromotionRedemptions.WithLabelValues("released").Inc()
+		if err := promotions.Release(context.WithoutCancel(ctx), p.Code, o.CustomerID); err != nil {
+			logging.FromContext(ctx).Error("failed to release promotion", slog.Any("error", err), slog.String("code", p.Code))
+		}
+	}
+	return release, nil
+}
+
+// discountAmount is what p takes off eligible, the total of the line items
+// it applies to. Percentages round down.
+func discountAmount(p model.Promotion, eligible uint64) uint64 {
+	switch p.Type {
+	case model.PromotionPercentage:
+		return eligible * p.Value / 100
+	case model.PromotionFixedAmount:
+		return min(p.Value, eligible)
+	}
+	return 0
+}
+
+// categorySubtotal sums the line items whose product is in the category.
+// Line items without a product never qualify.
+func categorySubtotal(ctx context.Context, products *product.RedisRepo, items []model.LineItem, categoryID uint64) (uint64, error) {
+	ids := make([]uint64, 0, len(items))
+	for _, item := range items {
+		if item.ProductID != 0 {
+			ids = append(ids, item.ProductID)
+		}
+	}
+
+	found, err := products.FindByIDs(ctx, ids)
+	if err != nil {
+		return 0, err
+	}
+
+	var total uint64
+	for _, item := range items {
+		if p, ok := found[item.ProductID]; ok && p.Category.CategoryID == categoryID {
+			total += uint64(item.Quantity) * uint64(item.Price)
+		}
+	}
+	return total, nil
+}
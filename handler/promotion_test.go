@@ -0,0 +1,103 @@
+package handler
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/umuttopalak/orders-api/model"
+)
+
+func TestValidatePromotion(t *testing.T) {
+	start := time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(24 * time.Hour)
+
+	tests := []struct {
+		name  string
+		promo model.Promotion
+		err   string
+	}{
+		{"percentage", model.Promotion{Code: "SAVE10", Type: model.PromotionPercentage, Value: 10}, ""},
+		{"full percentage", model.Promotion{Code: "FREE", Type: model.PromotionPercentage, Value: 100}, ""},
+		{"fixed amount", model.Promotion{Code: "TAKE-500", Type: model.PromotionFixedAmount, Value: 500}, ""},
+		{"free shipping", model.Promotion{Code: "SHIP_FREE", Type: model.PromotionFreeShipping}, ""},
+		{"window", model.Promotion{Code: "WEEKEND", Type: model.PromotionPercentage, Value: 5, StartsAt: &start, EndsAt: &end}, ""},
+		{"open ended", model.Promotion{Code: "LAUNCH", Type: model.PromotionPercentage, Value: 5, StartsAt: &start}, ""},
+		{"short code", model.Promotion{Code: "AB", Type: model.PromotionPercentage, Value: 10}, "code"},
+		{"long code", model.Promotion{Code: strings.Repeat("A", 33), Type: model.PromotionPercentage, Value: 10}, "code"},
+		{"lower case code", model.Promotion{Code: "save10", Type: model.PromotionPercentage, Value: 10}, "code"},
+		{"code with space", model.Promotion{Code: "SAVE 10", Type: model.PromotionPercentage, Value: 10}, "code"},
+		{"code starting with dash", model.Promotion{Code: "-SAVE", Type: model.PromotionPercentage, Value: 10}, "code"},
+		{"zero percentage", model.Promotion{Code: "SAVE0", Type: model.PromotionPercentage}, "between 1 and 100"},
+		{"percentage above 100", model.Promotion{Code: "SAVE101", Type: model.PromotionPercentage, Value: 101}, "between 1 and 100"},
+		{"zero fixed amount", model.Promotion{Code: "TAKE0", Type: model.PromotionFixedAmount}, "must be positive"},
+		{"free shipping with value", model.Promotion{Code: "SHIP", Type: model.PromotionFreeShipping, Value: 1}, "has no value"},
+		{"unknown type", model.Promotion{Code: "BOGO", Type: "bogo", Value: 1}, "type must be"},
+		{"ends before start", model.Promotion{Code: "BACKWARDS", Type: model.PromotionPercentage, Value: 5, StartsAt: &end, EndsAt: &start}, "ends_at"},
+		{"empty window", model.Promotion{Code: "INSTANT", Type: model.PromotionPercentage, Value: 5, StartsAt: &start, EndsAt: &start}, "ends_at"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validatePromotion(tt.promo)
+			if tt.err == "" {
+				if err != nil {
+					t.Errorf("validatePromotion: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("validatePromotion error = %v, want one mentioning %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestDiscountAmount(t *testing.T) {
+	tests := []struct {
+		name     string
+		promo    model.Promotion
+		eligible uint64
+		want     uint64
+	}{
+		{"percentage", model.Promotion{Type: model.PromotionPercentage, Value: 10}, 2500, 250},
+		{"percentage rounds down", model.Promotion{Type: model.PromotionPercentage, Value: 15}, 999, 149},
+		{"full percentage", model.Promotion{Type: model.PromotionPercentage, Value: 100}, 2500, 2500},
+		{"percentage of nothing", model.Promotion{Type: model.PromotionPercentage, Value: 50}, 0, 0},
+		{"fixed amount", model.Promotion{Type: model.PromotionFixedAmount, Value: 500}, 2500, 500},
+		{"fixed amount capped", model.Promotion{Type: model.PromotionFixedAmount, Value: 500}, 300, 300},
+		{"free shipping", model.Promotion{Type: model.PromotionFreeShipping}, 2500, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := discountAmount(tt.promo, tt.eligible); got != tt.want {
+				t.Errorf("discountAmount = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOrderTotal(t *testing.T) {
+	items := []model.LineItem{{Quantity: 2, Price: 1000}, {Quantity: 1, Price: 500}}
+
+	tests := []struct {
+		name      string
+		discounts []model.Discount
+		want      uint64
+	}{
+		{"none", nil, 2500},
+		{"one", []model.Discount{{Amount: 250}}, 2250},
+		{"stacked", []model.Discount{{Amount: 250}, {Amount: 1000}}, 1250},
+		{"capped at subtotal", []model.Discount{{Amount: 2000}, {Amount: 1000}}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := model.Order{LineItems: items, Discounts: tt.discounts}
+			if got := o.Total(); got != tt.want {
+				t.Errorf("Total = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
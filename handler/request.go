@@ -0,0 +1,40 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// decodeErrorStatus maps a request body decoding error to a status code,
+// distinguishing bodies cut off by http.MaxBytesReader from malformed ones.
+func decodeErrorStatus(err error) int {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return http.StatusRequestEntityTooLarge
+	}
+
+	return http.StatusBadRequest
+}
+
+// writeError answers with a JSON error body, for failures the client can
+// only fix knowing which field was wrong.
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	_ = json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+	}{message})
+}
+
+// statusError is a failure the client can fix, returned by helpers shared
+// between handlers and answered with writeError.
+type statusError struct {
+	status int
+	msg    string
+}
+
+func (e *statusError) Error() string {
+	return e.msg
+}
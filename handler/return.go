@@ -0,0 +1,466 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/umuttopalak/orders-api/logging"
+	"github.com/umuttopalak/orders-api/model"
+	"github.com/umuttopalak/orders-api/repository/order"
+	"github.com/umuttopalak/orders-api/repository/payment"
+	"github.com/umuttopalak/orders-api/repository/returns"
+	"github.com/umuttopalak/orders-api/repository/shipment"
+)
+
+// returnLockTTL must outlast the refund a return transition can issue.
+const returnLockTTL = paymentLockTTL
+
+// returnTransitions lists the statuses each return status can move to.
+var returnTransitions = map[string][]string{
+	model.ReturnRequested: {model.ReturnApproved, model.ReturnRejected},
+	model.ReturnApproved:  {model.ReturnReceived},
+	model.ReturnReceived:  {model.ReturnRefunded},
+	model.ReturnRefunding: {model.ReturnRefunded},
+}
+
+type Return struct {
+	Orders    *order.RedisRepo
+	Shipments *shipment.RedisRepo
+	Repo      *returns.RedisRepo
+	// Payments issues the refund of a return against the order's payment.
+	Payments       *Payment
+	RequireIfMatch bool
+}
+
+// Create requests the return of shipped line items. Quantities are checked
+// against what was shipped less what other returns, unless rejected,
+// already claim.
+func (h *Return) Create(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Reason string             `json:"reason"`
+		Items  []model.ReturnItem `json:"items"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(decodeErrorStatus(err))
+		return
+	}
+	if err := validateReturnItems(body.Items); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	orderID, unlock, ok := h.lock(w, r)
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	o, err := h.Orders.FindByID(r.Context(), orderID)
+	if errors.Is(err, order.ErrNotExist) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		logging.FromContext(r.Context()).Error("failed to find order", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	shipped, err := h.shipped(r, o)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to find shipments", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	existing, err := h.Repo.FindByOrder(r.Context(), orderID)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to find returns", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	for _, ret := range existing {
+		if ret.Status == model.ReturnRejected {
+			continue
+		}
+		for _, item := range ret.Items {
+			shipped[item.ItemID] -= min(item.Quantity, shipped[item.ItemID])
+		}
+	}
+
+	items := make([]model.ReturnItem, 0, len(body.Items))
+	for _, item := range body.Items {
+		line, ok := lineItem(o, item.ItemID)
+		if !ok {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("line item %s is not in the order", item.ItemID))
+			return
+		}
+		if left := shipped[item.ItemID]; item.Quantity > left {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("line item %s has %d shipped units left to return", item.ItemID, left))
+			return
+		}
+
+		items = append(items, model.ReturnItem{ItemID: item.ItemID, ProductID: line.ProductID, Quantity: item.Quantity})
+	}
+
+	now := time.Now().UTC()
+	ret := model.Return{
+		ReturnID:  rand.Uint64(),
+		OrderID:   orderID,
+		Status:    model.ReturnRequested,
+		Reason:    body.Reason,
+		Items:     items,
+		Restock:   true,
+		CreatedAt: &now,
+		UpdatedAt: &now,
+		Version:   1,
+	}
+
+	if err := h.Repo.Insert(r.Context(), ret); err != nil {
+		logging.FromContext(r.Context()).Error("failed to insert return", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeReturn(w, r, http.StatusCreated, ret)
+}
+
+// List returns the returns of an order, oldest first.
+func (h *Return) List(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if _, err := h.Orders.FindByID(r.Context(), orderID); errors.Is(err, order.ErrNotExist) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		logging.FromContext(r.Context()).Error("failed to find order", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	list, err := h.Repo.FindByOrder(r.Context(), orderID)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to find returns", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	response := struct {
+		Returns []model.Return `json:"returns"`
+	}{list}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logging.FromContext(r.Context()).Error("failed to marshal", slog.Any("error", err))
+	}
+}
+
+func (h *Return) GetByID(w http.ResponseWriter, r *http.Request) {
+	ret, ok := h.find(w, r)
+	if !ok {
+		return
+	}
+
+	writeReturn(w, r, http.StatusOK, ret)
+}
+
+// UpdateByID moves a return to its next status. Receiving it records
+// whether the goods are restocked, which the inventory hook does from the
+// ReturnReceived event. Refunding it pays back refund_amount, by default
+// and at most the returned units' share of what the order charged,
+// against the order's payment.
+//
+// The return is stored as refunding with its amount before the provider
+// is called, and the provider refund is keyed by the return ID. If the
+// refund cannot be recorded, repeating the request finishes it without
+// refunding twice.
+func (h *Return) UpdateByID(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Status       string  `json:"status"`
+		Restock      *bool   `json:"restock"`
+		RefundAmount *uint64 `json:"refund_amount"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(decodeErrorStatus(err))
+		return
+	}
+
+	orderID, unlock, ok := h.lock(w, r)
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	ret, ok := h.find(w, r)
+	if !ok {
+		return
+	}
+
+	if !checkIfMatch(w, r, ret.Version, h.RequireIfMatch) {
+		return
+	}
+
+	if !slices.Contains(returnTransitions[ret.Status], body.Status) {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("a %s return cannot become %q", ret.Status, body.Status))
+		return
+	}
+
+	now := time.Now().UTC()
+
+	switch body.Status {
+	case model.ReturnReceived:
+		ret.Restock = body.Restock == nil || *body.Restock
+		ret.ReceivedAt = &now
+
+	case model.ReturnRefunded:
+		if ret.Status == model.ReturnReceived {
+			amount, ok := h.refundAmount(w, r, orderID, ret, body.RefundAmount)
+			if !ok {
+				return
+			}
+
+			ret.Status = model.ReturnRefunding
+			ret.RefundAmount = amount
+			ret.UpdatedAt = &now
+			if ret, ok = h.update(w, r, ret); !ok {
+				return
+			}
+		} else if body.RefundAmount != nil && *body.RefundAmount != ret.RefundAmount {
+			writeError(w, http.StatusConflict, fmt.Sprintf("return is already being refunded for %d", ret.RefundAmount))
+			return
+		}
+
+		if ret.RefundAmount > 0 {
+			paymentID, ok := h.refund(w, r, orderID, ret)
+			if !ok {
+				return
+			}
+			ret.PaymentID = paymentID
+		}
+		ret.RefundedAt = &now
+	}
+
+	ret.Status = body.Status
+	ret.UpdatedAt = &now
+
+	updated, ok := h.update(w, r, ret)
+	if !ok {
+		return
+	}
+
+	writeReturn(w, r, http.StatusOK, updated)
+}
+
+// refundAmount returns the amount to refund for a received return: the
+// requested amount, or by default the returned units' share of the
+// order's total, which the requested amount must not exceed.
+func (h *Return) refundAmount(w http.ResponseWriter, r *http.Request, orderID uint64, ret model.Return, requested *uint64) (uint64, bool) {
+	o, err := h.Orders.FindByID(r.Context(), orderID)
+	if errors.Is(err, order.ErrNotExist) {
+		w.WriteHeader(http.StatusNotFound)
+		return 0, false
+	} else if err != nil {
+		logging.FromContext(r.Context()).Error("failed to find order", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return 0, false
+	}
+
+	value := returnValue(o, ret.Items)
+	if requested == nil {
+		return value, true
+	}
+	if *requested > value {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("refund_amount exceeds the returned items' value %d", value))
+		return 0, false
+	}
+	return *requested, true
+}
+
+// update stores the return and answers the client itself if that fails.
+func (h *Return) update(w http.ResponseWriter, r *http.Request, ret model.Return) (model.Return, bool) {
+	updated, err := h.Repo.Update(r.Context(), ret)
+	if errors.Is(err, returns.ErrVersionMismatch) {
+		w.WriteHeader(versionConflictStatus(r))
+		return model.Return{}, false
+	} else if errors.Is(err, returns.ErrNotExist) {
+		w.WriteHeader(http.StatusNotFound)
+		return model.Return{}, false
+	} else if err != nil {
+		logging.FromContext(r.Context()).Error("failed to update return", slog.Any("error", err), slog.Uint64("return_id", ret.ReturnID), slog.String("payment_id", ret.PaymentID))
+		w.WriteHeader(http.StatusInternalServerError)
+		return model.Return{}, false
+	}
+
+	return updated, true
+}
+
+// refund pays the return's refund amount back against the order's payment,
+// under the payment lock, and answers the client itself if that fails.
+func (h *Return) refund(w http.ResponseWriter, r *http.Request, orderID uint64, ret model.Return) (string, bool) {
+	unlock, err := h.Payments.Repo.Lock(r.Context(), orderID, paymentLockTTL)
+	if errors.Is(err, payment.ErrLocked) {
+		writeError(w, http.StatusConflict, "another payment request for this order is in progress")
+		return "", false
+	} else if err != nil {
+		logging.FromContext(r.Context()).Error("failed to lock payments", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return "", false
+	}
+	defer unlock()
+
+	p, err := h.Payments.refund(r.Context(), orderID, ret.RefundAmount, fmt.Sprintf("return:%d", ret.ReturnID))
+	var serr *statusError
+	if errors.As(err, &serr) {
+		writeError(w, serr.status, serr.msg)
+		return "", false
+	} else if err != nil {
+		logging.FromContext(r.Context()).Error("failed to refund return", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return "", false
+	}
+
+	return p.PaymentID, true
+}
+
+// lock parses the order ID and takes the order's returns lock, answering
+// 409 while another request changes the order's returns.
+func (h *Return) lock(w http.ResponseWriter, r *http.Request) (uint64, func(), bool) {
+	orderID, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return 0, nil, false
+	}
+
+	unlock, err := h.Repo.Lock(r.Context(), orderID, returnLockTTL)
+	if errors.Is(err, returns.ErrLocked) {
+		writeError(w, http.StatusConflict, "another request for the returns of this order is in progress")
+		return 0, nil, false
+	} else if err != nil {
+		logging.FromContext(r.Context()).Error("failed to lock returns", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return 0, nil, false
+	}
+
+	return orderID, unlock, true
+}
+
+func (h *Return) find(w http.ResponseWriter, r *http.Request) (model.Return, bool) {
+	orderID, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return model.Return{}, false
+	}
+
+	returnID, err := strconv.ParseUint(chi.URLParam(r, "return_id"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return model.Return{}, false
+	}
+
+	ret, err := h.Repo.FindByID(r.Context(), returnID)
+	if errors.Is(err, returns.ErrNotExist) || (err == nil && ret.OrderID != orderID) {
+		w.WriteHeader(http.StatusNotFound)
+		return model.Return{}, false
+	} else if err != nil {
+		logging.FromContext(r.Context()).Error("failed to find return", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return model.Return{}, false
+	}
+
+	return ret, true
+}
+
+// shipped returns the shipped quantity of each line item. An order marked
+// shipped as a whole counts every line item as shipped in full.
+func (h *Return) shipped(r *http.Request, o model.Order) (map[uuid.UUID]uint, error) {
+	if o.ShippedAt != nil {
+		return unshipped(o, nil), nil
+	}
+
+	shipments, err := h.Shipments.FindByOrder(r.Context(), o.OrderID)
+	if err != nil {
+		return nil, err
+	}
+
+	shipped := make(map[uuid.UUID]uint, len(o.LineItems))
+	for _, s := range shipments {
+		for _, item := range s.Items {
+			shipped[item.ItemID] += item.Quantity
+		}
+	}
+	return shipped, nil
+}
+
+// returnValue is the returned units' share of the order's total, so
+// discounts and tax are refunded in proportion.
+func returnValue(o model.Order, items []model.ReturnItem) uint64 {
+	subtotal := o.Subtotal()
+	if subtotal == 0 {
+		return 0
+	}
+
+	var gross uint64
+	for _, item := range items {
+		if line, ok := lineItem(o, item.ItemID); ok {
+			gross += uint64(item.Quantity) * uint64(line.Price)
+		}
+	}
+	return gross * o.Total() / subtotal
+}
+
+func lineItem(o model.Order, itemID uuid.UUID) (model.LineItem, bool) {
+	for _, item := range o.LineItems {
+		if item.ItemID == itemID {
+			return item, true
+		}
+	}
+	return model.LineItem{}, false
+}
+
+func validateReturnItems(items []model.ReturnItem) error {
+	if len(items) == 0 {
+		return errors.New("items must not be empty")
+	}
+
+	seen := make(map[uuid.UUID]bool, len(items))
+	for i, item := range items {
+		if item.Quantity == 0 {
+			return fmt.Errorf("items[%d]: quantity must be at least 1", i)
+		}
+		if seen[item.ItemID] {
+			return fmt.Errorf("items[%d]: line item %s is listed twice", i, item.ItemID)
+		}
+		seen[item.ItemID] = true
+	}
+	return nil
+}
+
+func writeReturn(w http.ResponseWriter, r *http.Request, status int, ret model.Return) {
+	res, err := json.Marshal(ret)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to encode return", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", etag(ret.Version))
+	w.WriteHeader(status)
+	if _, err := w.Write(res); err != nil {
+		logging.FromContext(r.Context()).Error("failed to write response", slog.Any("error", err))
+	}
+}
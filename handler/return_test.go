@@ -0,0 +1,228 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/umuttopalak/orders-api/model"
+	"github.com/umuttopalak/orders-api/repository/returns"
+	"github.com/umuttopalak/orders-api/repository/shipment"
+)
+
+func TestReturnValue(t *testing.T) {
+	a, b := uuid.New(), uuid.New()
+	lines := []model.LineItem{
+		{ItemID: a, Quantity: 2, Price: 500, Tax: 100},
+		{ItemID: b, Quantity: 1, Price: 1000, Tax: 200},
+	}
+
+	tests := []struct {
+		name      string
+		discounts []model.Discount
+		inclusive bool
+		items     []model.ReturnItem
+		want      uint64
+	}{
+		{"one unit", nil, false, []model.ReturnItem{{ItemID: a, Quantity: 1}}, 575},
+		{"everything", nil, false, []model.ReturnItem{{ItemID: a, Quantity: 2}, {ItemID: b, Quantity: 1}}, 2300},
+		{"discounted", []model.Discount{{Code: "TENOFF", Amount: 200}}, false, []model.ReturnItem{{ItemID: b, Quantity: 1}}, 1050},
+		{"tax included", nil, true, []model.ReturnItem{{ItemID: a, Quantity: 1}}, 500},
+		{"unknown line item", nil, false, []model.ReturnItem{{ItemID: uuid.New(), Quantity: 1}}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := model.Order{LineItems: lines, Discounts: tt.discounts, TaxInclusive: tt.inclusive}
+			if got := returnValue(o, tt.items); got != tt.want {
+				t.Errorf("returnValue = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// newTestReturn returns a Return handler for a shipped order of two units
+// worth 500 each, paid in full.
+func newTestReturn(t *testing.T, orderID uint64) (*Return, model.Order) {
+	t.Helper()
+
+	payments := newTestPayment(t)
+	client := payments.Orders.Client
+	h := &Return{
+		Orders:    payments.Orders,
+		Shipments: &shipment.RedisRepo{Client: client},
+		Repo:      &returns.RedisRepo{Client: client},
+		Payments:  payments,
+	}
+
+	insertOrder(t, h.Orders, orderID)
+	if res := pay(payments, orderID, "tok_visa"); res.status != http.StatusCreated {
+		t.Fatalf("pay = %d %s", res.status, res.body)
+	}
+
+	o, err := h.Orders.FindByID(context.Background(), orderID)
+	if err != nil {
+		t.Fatalf("find order: %v", err)
+	}
+	now := time.Now().UTC()
+	o.ShippedAt = &now
+	if o, err = h.Orders.Update(context.Background(), o); err != nil {
+		t.Fatalf("ship order: %v", err)
+	}
+	return h, o
+}
+
+// insertReturn stores a return of one unit of the order in status.
+func insertReturn(t *testing.T, h *Return, o model.Order, status string) model.Return {
+	t.Helper()
+
+	now := time.Now().UTC()
+	ret := model.Return{
+		ReturnID:  uint64(time.Now().UnixNano()),
+		OrderID:   o.OrderID,
+		Status:    status,
+		Items:     []model.ReturnItem{{ItemID: o.LineItems[0].ItemID, ProductID: 1, Quantity: 1}},
+		Restock:   true,
+		CreatedAt: &now,
+		Version:   1,
+	}
+	if status == model.ReturnRefunding {
+		// Returns only become refunding by an update.
+		ret.Status = model.ReturnReceived
+	}
+	if err := h.Repo.Insert(context.Background(), ret); err != nil {
+		t.Fatalf("insert return: %v", err)
+	}
+
+	if status == model.ReturnRefunding {
+		ret.Status = status
+		ret.RefundAmount = 500
+		updated, err := h.Repo.Update(context.Background(), ret)
+		if err != nil {
+			t.Fatalf("update return: %v", err)
+		}
+		return updated
+	}
+	return ret
+}
+
+func updateReturn(h *Return, ret model.Return, body string) (int, model.Return, string) {
+	target := fmt.Sprintf("/order/%d/returns/%d", ret.OrderID, ret.ReturnID)
+	w := serve(h.UpdateByID, http.MethodPut, "/order/{id}/returns/{return_id}", target, body)
+
+	var updated model.Return
+	_ = json.Unmarshal(w.Body.Bytes(), &updated)
+	return w.Code, updated, w.Body.String()
+}
+
+func TestReturnTransitions(t *testing.T) {
+	statuses := []string{
+		model.ReturnRequested,
+		model.ReturnApproved,
+		model.ReturnRejected,
+		model.ReturnReceived,
+		model.ReturnRefunding,
+		model.ReturnRefunded,
+	}
+	allowed := map[[2]string]bool{
+		{model.ReturnRequested, model.ReturnApproved}: true,
+		{model.ReturnRequested, model.ReturnRejected}: true,
+		{model.ReturnApproved, model.ReturnReceived}:  true,
+		{model.ReturnReceived, model.ReturnRefunded}:  true,
+		{model.ReturnRefunding, model.ReturnRefunded}: true,
+	}
+
+	for i, from := range statuses {
+		for _, to := range statuses {
+			t.Run(from+" to "+to, func(t *testing.T) {
+				h, o := newTestReturn(t, uint64(i+1))
+				ret := insertReturn(t, h, o, from)
+
+				status, updated, body := updateReturn(h, ret, fmt.Sprintf(`{"status":%q}`, to))
+				if !allowed[[2]string{from, to}] {
+					if status != http.StatusBadRequest {
+						t.Errorf("status = %d %s, want %d", status, body, http.StatusBadRequest)
+					}
+					return
+				}
+
+				if status != http.StatusOK || updated.Status != to {
+					t.Fatalf("status = %d %s, want %d and %s", status, body, http.StatusOK, to)
+				}
+				if to == model.ReturnRefunded && (updated.PaymentID == "" || updated.RefundAmount != 500 || updated.RefundedAt == nil) {
+					t.Errorf("refunded return = %+v, want a refund of 500", updated)
+				}
+				if to == model.ReturnReceived && (updated.ReceivedAt == nil || !updated.Restock) {
+					t.Errorf("received return = %+v, want it received and restocked", updated)
+				}
+			})
+		}
+	}
+}
+
+func TestReturnRefundCap(t *testing.T) {
+	amount := func(n uint64) *uint64 { return &n }
+
+	tests := []struct {
+		name      string
+		requested *uint64
+		status    int
+		refunded  uint64
+	}{
+		{"default", nil, http.StatusOK, 500},
+		{"partial", amount(200), http.StatusOK, 200},
+		{"returned value", amount(500), http.StatusOK, 500},
+		{"above returned value", amount(501), http.StatusBadRequest, 0},
+		{"nothing", amount(0), http.StatusOK, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, o := newTestReturn(t, 1)
+			ret := insertReturn(t, h, o, model.ReturnReceived)
+
+			body := `{"status":"refunded"}`
+			if tt.requested != nil {
+				body = fmt.Sprintf(`{"status":"refunded","refund_amount":%d}`, *tt.requested)
+			}
+
+			status, updated, res := updateReturn(h, ret, body)
+			if status != tt.status {
+				t.Fatalf("status = %d %s, want %d", status, res, tt.status)
+			}
+			if status != http.StatusOK {
+				return
+			}
+			if updated.RefundAmount != tt.refunded {
+				t.Errorf("refund_amount = %d, want %d", updated.RefundAmount, tt.refunded)
+			}
+
+			list, err := h.Payments.Repo.FindByOrder(context.Background(), o.OrderID)
+			if err != nil {
+				t.Fatalf("find payments: %v", err)
+			}
+			if got := list[0].Refunded; got != tt.refunded {
+				t.Errorf("payment refunded %d, want %d", got, tt.refunded)
+			}
+		})
+	}
+}
+
+func TestReturnRefundRetry(t *testing.T) {
+	h, o := newTestReturn(t, 1)
+	ret := insertReturn(t, h, o, model.ReturnRefunding)
+
+	// A refund that was recorded as refunding keeps its amount.
+	if status, _, body := updateReturn(h, ret, `{"status":"refunded","refund_amount":300}`); status != http.StatusConflict {
+		t.Errorf("changed amount = %d %s, want %d", status, body, http.StatusConflict)
+	}
+
+	status, updated, body := updateReturn(h, ret, `{"status":"refunded"}`)
+	if status != http.StatusOK || updated.RefundAmount != 500 {
+		t.Fatalf("retry = %d %s, want %d refunding 500", status, body, http.StatusOK)
+	}
+}
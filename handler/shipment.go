@@ -0,0 +1,291 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/umuttopalak/orders-api/logging"
+	"github.com/umuttopalak/orders-api/metrics"
+	"github.com/umuttopalak/orders-api/model"
+	"github.com/umuttopalak/orders-api/repository/order"
+	"github.com/umuttopalak/orders-api/repository/shipment"
+)
+
+// shipmentLockTTL bounds how long a crashed request can block shipments of
+// an order.
+const shipmentLockTTL = 10 * time.Second
+
+type Shipment struct {
+	Orders *order.RedisRepo
+	Repo   *shipment.RedisRepo
+}
+
+// Create records a parcel holding some of the order's line items. Once
+// every line item has been shipped in full, the order is marked shipped.
+// If an earlier request stored the last shipment but failed to mark the
+// order, that is finished first and the request answered as for a
+// shipped order.
+func (h *Shipment) Create(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Carrier        string               `json:"carrier"`
+		TrackingNumber string               `json:"tracking_number"`
+		Items          []model.ShipmentItem `json:"items"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(decodeErrorStatus(err))
+		return
+	}
+	if err := validateShipment(body.Carrier, body.TrackingNumber, body.Items); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	orderID, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	unlock, err := h.Repo.Lock(r.Context(), orderID, shipmentLockTTL)
+	if errors.Is(err, shipment.ErrLocked) {
+		writeError(w, http.StatusConflict, "another shipment for this order is being created")
+		return
+	} else if err != nil {
+		logging.FromContext(r.Context()).Error("failed to lock shipments", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer unlock()
+
+	o, err := h.Orders.FindByID(r.Context(), orderID)
+	if errors.Is(err, order.ErrNotExist) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		logging.FromContext(r.Context()).Error("failed to find order", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	shipments, err := h.Repo.FindByOrder(r.Context(), orderID)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to find shipments", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	remaining := unshipped(o, shipments)
+	if o.ShippedAt == nil && len(shipments) > 0 && shippedInFull(remaining) {
+		last := shipments[len(shipments)-1]
+		if err := h.markShipped(r.Context(), orderID, *last.CreatedAt); err != nil {
+			logging.FromContext(r.Context()).Error("failed to mark order shipped", slog.Any("error", err), slog.String("shipment_id", last.ShipmentID))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		o.ShippedAt = last.CreatedAt
+	}
+
+	switch {
+	case o.ShippedAt != nil:
+		writeError(w, http.StatusConflict, "order is already shipped")
+		return
+	case o.CompletedAt != nil:
+		writeError(w, http.StatusConflict, "order is completed")
+		return
+	case o.PaymentStatus == model.PaymentRefunded:
+		writeError(w, http.StatusConflict, "order is refunded")
+		return
+	}
+
+	for _, item := range body.Items {
+		left, ok := remaining[item.ItemID]
+		if !ok {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("line item %s is not in the order", item.ItemID))
+			return
+		}
+		if item.Quantity > left {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("line item %s has %d left to ship", item.ItemID, left))
+			return
+		}
+		remaining[item.ItemID] -= item.Quantity
+	}
+
+	now := time.Now().UTC()
+	s := model.Shipment{
+		ShipmentID:     uuid.NewString(),
+		OrderID:        orderID,
+		Carrier:        body.Carrier,
+		TrackingNumber: body.TrackingNumber,
+		Items:          body.Items,
+		CreatedAt:      &now,
+	}
+
+	if err := h.Repo.Insert(r.Context(), s); err != nil {
+		logging.FromContext(r.Context()).Error("failed to insert shipment", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if shippedInFull(remaining) {
+		if err := h.markShipped(r.Context(), orderID, now); err != nil {
+			logging.FromContext(r.Context()).Error("failed to mark order shipped", slog.Any("error", err), slog.String("shipment_id", s.ShipmentID))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	writeShipment(w, r, http.StatusCreated, s)
+}
+
+// List returns the shipments of an order, oldest first.
+func (h *Shipment) List(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if _, err := h.Orders.FindByID(r.Context(), orderID); errors.Is(err, order.ErrNotExist) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		logging.FromContext(r.Context()).Error("failed to find order", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	list, err := h.Repo.FindByOrder(r.Context(), orderID)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to find shipments", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	response := struct {
+		Shipments []model.Shipment `json:"shipments"`
+	}{list}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logging.FromContext(r.Context()).Error("failed to marshal", slog.Any("error", err))
+	}
+}
+
+func (h *Shipment) GetByID(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s, err := h.Repo.FindByID(r.Context(), chi.URLParam(r, "shipment_id"))
+	if errors.Is(err, shipment.ErrNotExist) || (err == nil && s.OrderID != orderID) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		logging.FromContext(r.Context()).Error("failed to find shipment", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeShipment(w, r, http.StatusOK, s)
+}
+
+// markShipped sets the order's shipped time. Shipments are only created
+// under the shipment lock, so a version conflict comes from an unrelated
+// change and the update is retried on the fresh order.
+func (h *Shipment) markShipped(ctx context.Context, orderID uint64, at time.Time) error {
+	for attempt := 1; ; attempt++ {
+		o, err := h.Orders.FindByID(ctx, orderID)
+		if err != nil {
+			return err
+		}
+		if o.ShippedAt != nil {
+			return nil
+		}
+
+		o.ShippedAt = &at
+
+		_, err = h.Orders.Update(ctx, o)
+		if errors.Is(err, order.ErrVersionMismatch) && attempt < orderUpdateRetries {
+			continue
+		}
+		if err == nil {
+			metrics.OrdersShipped.Inc()
+		}
+		return err
+	}
+}
+
+// unshipped returns the quantity of each line item not yet in a shipment.
+// Line items sharing an item ID are counted together.
+func unshipped(o model.Order, shipments []model.Shipment) map[uuid.UUID]uint {
+	remaining := make(map[uuid.UUID]uint, len(o.LineItems))
+	for _, item := range o.LineItems {
+		remaining[item.ItemID] += item.Quantity
+	}
+
+	for _, s := range shipments {
+		for _, item := range s.Items {
+			remaining[item.ItemID] -= min(item.Quantity, remaining[item.ItemID])
+		}
+	}
+	return remaining
+}
+
+func shippedInFull(remaining map[uuid.UUID]uint) bool {
+	for _, left := range remaining {
+		if left > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func validateShipment(carrier, trackingNumber string, items []model.ShipmentItem) error {
+	if carrier == "" {
+		return errors.New("carrier is required")
+	}
+	if trackingNumber == "" {
+		return errors.New("tracking_number is required")
+	}
+	if len(items) == 0 {
+		return errors.New("items must not be empty")
+	}
+
+	seen := make(map[uuid.UUID]bool, len(items))
+	for i, item := range items {
+		if item.Quantity == 0 {
+			return fmt.Errorf("items[%d]: quantity must be at least 1", i)
+		}
+		if seen[item.ItemID] {
+			return fmt.Errorf("items[%d]: line item %s is listed twice", i, item.ItemID)
+		}
+		seen[item.ItemID] = true
+	}
+	return nil
+}
+
+func writeShipment(w http.ResponseWriter, r *http.Request, status int, s model.Shipment) {
+	res, err := json.Marshal(s)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to encode shipment", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if _, err := w.Write(res); err != nil {
+		logging.FromContext(r.Context()).Error("failed to write response", slog.Any("error", err))
+	}
+}
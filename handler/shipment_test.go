@@ -0,0 +1,208 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/umuttopalak/orders-api/model"
+	"github.com/umuttopalak/orders-api/repository/order"
+	"github.com/umuttopalak/orders-api/repository/shipment"
+)
+
+func TestUnshipped(t *testing.T) {
+	a, b := uuid.New(), uuid.New()
+	o := model.Order{LineItems: []model.LineItem{
+		{ItemID: a, Quantity: 2},
+		{ItemID: b, Quantity: 1},
+		{ItemID: a, Quantity: 1},
+	}}
+
+	tests := []struct {
+		name      string
+		shipments [][]model.ShipmentItem
+		want      map[uuid.UUID]uint
+		full      bool
+	}{
+		{"nothing shipped", nil, map[uuid.UUID]uint{a: 3, b: 1}, false},
+		{"partly shipped", [][]model.ShipmentItem{{{ItemID: a, Quantity: 2}}}, map[uuid.UUID]uint{a: 1, b: 1}, false},
+		{"over several shipments", [][]model.ShipmentItem{{{ItemID: a, Quantity: 2}}, {{ItemID: a, Quantity: 1}, {ItemID: b, Quantity: 1}}}, map[uuid.UUID]uint{a: 0, b: 0}, true},
+		{"shipped too much", [][]model.ShipmentItem{{{ItemID: a, Quantity: 5}, {ItemID: b, Quantity: 1}}}, map[uuid.UUID]uint{a: 0, b: 0}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var shipments []model.Shipment
+			for _, items := range tt.shipments {
+				shipments = append(shipments, model.Shipment{Items: items})
+			}
+
+			got := unshipped(o, shipments)
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("unshipped = %v, want %v", got, tt.want)
+			}
+			if shippedInFull(got) != tt.full {
+				t.Errorf("shippedInFull = %v, want %v", !tt.full, tt.full)
+			}
+		})
+	}
+}
+
+// newTestShipment returns a Shipment handler for an order of two line
+// items, three units of the first and one of the second.
+func newTestShipment(t *testing.T) (*Shipment, model.Order) {
+	t.Helper()
+
+	client := newTestRedis(t)
+	h := &Shipment{
+		Orders: &order.RedisRepo{Client: client},
+		Repo:   &shipment.RedisRepo{Client: client},
+	}
+
+	now := time.Now().UTC()
+	o := model.Order{
+		OrderID:    1,
+		CustomerID: uuid.New(),
+		LineItems: []model.LineItem{
+			{ItemID: uuid.New(), ProductID: 7, Quantity: 3, Price: 100},
+			{ItemID: uuid.New(), ProductID: 8, Quantity: 1, Price: 200},
+		},
+		CreatedAt: &now,
+		Version:   1,
+	}
+	if err := h.Orders.Insert(context.Background(), o); err != nil {
+		t.Fatalf("insert order: %v", err)
+	}
+	return h, o
+}
+
+func shipmentBody(items ...model.ShipmentItem) string {
+	var parts []string
+	for _, item := range items {
+		parts = append(parts, fmt.Sprintf(`{"item_id":%q,"quantity":%d}`, item.ItemID, item.Quantity))
+	}
+	return `{"carrier":"UPS","tracking_number":"1Z999","items":[` + strings.Join(parts, ",") + `]}`
+}
+
+func TestShipmentCreate(t *testing.T) {
+	type request struct {
+		items  func(o model.Order) []model.ShipmentItem
+		status int
+		error  string
+	}
+	part := func(line int, quantity uint) func(o model.Order) []model.ShipmentItem {
+		return func(o model.Order) []model.ShipmentItem {
+			return []model.ShipmentItem{{ItemID: o.LineItems[line].ItemID, Quantity: quantity}}
+		}
+	}
+	rest := func(o model.Order) []model.ShipmentItem {
+		return []model.ShipmentItem{{ItemID: o.LineItems[0].ItemID, Quantity: 1}, {ItemID: o.LineItems[1].ItemID, Quantity: 1}}
+	}
+
+	tests := []struct {
+		name     string
+		prepare  func(o *model.Order)
+		requests []request
+		shipped  bool
+	}{
+		{"partial", nil, []request{{part(0, 2), http.StatusCreated, ""}}, false},
+		{"in full", nil, []request{{part(0, 2), http.StatusCreated, ""}, {rest, http.StatusCreated, ""}}, true},
+		{"after shipped in full", nil, []request{{part(0, 3), http.StatusCreated, ""}, {part(1, 1), http.StatusCreated, ""}, {part(1, 1), http.StatusConflict, "order is already shipped"}}, true},
+		{"more than left", nil, []request{{part(0, 2), http.StatusCreated, ""}, {part(0, 2), http.StatusBadRequest, "has 1 left to ship"}}, false},
+		{"unknown line item", nil, []request{{func(model.Order) []model.ShipmentItem { return []model.ShipmentItem{{ItemID: uuid.New(), Quantity: 1}} }, http.StatusBadRequest, "is not in the order"}}, false},
+		{"completed order", func(o *model.Order) {
+			now := time.Now().UTC()
+			o.CompletedAt = &now
+		}, []request{{part(0, 1), http.StatusConflict, "order is completed"}}, false},
+		{"refunded order", func(o *model.Order) { o.PaymentStatus = model.PaymentRefunded }, []request{{part(0, 1), http.StatusConflict, "order is refunded"}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, o := newTestShipment(t)
+			if tt.prepare != nil {
+				tt.prepare(&o)
+				if _, err := h.Orders.Update(context.Background(), o); err != nil {
+					t.Fatalf("update order: %v", err)
+				}
+			}
+
+			target := fmt.Sprintf("/order/%d/shipments", o.OrderID)
+			for i, req := range tt.requests {
+				w := serve(h.Create, http.MethodPost, "/order/{id}/shipments", target, shipmentBody(req.items(o)...))
+				if w.Code != req.status || !strings.Contains(w.Body.String(), req.error) {
+					t.Fatalf("request %d = %d %s, want %d %q", i, w.Code, w.Body, req.status, req.error)
+				}
+			}
+
+			stored, err := h.Orders.FindByID(context.Background(), o.OrderID)
+			if err != nil {
+				t.Fatalf("find order: %v", err)
+			}
+			if (stored.ShippedAt != nil) != tt.shipped {
+				t.Errorf("shipped_at = %v, want shipped %v", stored.ShippedAt, tt.shipped)
+			}
+		})
+	}
+}
+
+func TestShipmentCreateFinishesMarkingShipped(t *testing.T) {
+	h, o := newTestShipment(t)
+
+	// An earlier request stored the last shipment but failed to mark the
+	// order.
+	at := time.Now().UTC().Add(-time.Minute).Truncate(time.Second)
+	err := h.Repo.Insert(context.Background(), model.Shipment{
+		ShipmentID:     uuid.NewString(),
+		OrderID:        o.OrderID,
+		Carrier:        "UPS",
+		TrackingNumber: "1Z999",
+		Items:          []model.ShipmentItem{{ItemID: o.LineItems[0].ItemID, Quantity: 3}, {ItemID: o.LineItems[1].ItemID, Quantity: 1}},
+		CreatedAt:      &at,
+	})
+	if err != nil {
+		t.Fatalf("insert shipment: %v", err)
+	}
+
+	w := serve(h.Create, http.MethodPost, "/order/{id}/shipments", fmt.Sprintf("/order/%d/shipments", o.OrderID), shipmentBody(model.ShipmentItem{ItemID: o.LineItems[0].ItemID, Quantity: 1}))
+	if w.Code != http.StatusConflict {
+		t.Fatalf("create = %d %s, want %d", w.Code, w.Body, http.StatusConflict)
+	}
+
+	stored, err := h.Orders.FindByID(context.Background(), o.OrderID)
+	if err != nil {
+		t.Fatalf("find order: %v", err)
+	}
+	if stored.ShippedAt == nil || !stored.ShippedAt.Equal(at) {
+		t.Errorf("shipped_at = %v, want the last shipment's %v", stored.ShippedAt, at)
+	}
+
+	list, err := h.Repo.FindByOrder(context.Background(), o.OrderID)
+	if err != nil || len(list) != 1 {
+		t.Errorf("shipments = %d, %v, want only the earlier one", len(list), err)
+	}
+}
+
+func TestShipmentCreateLocked(t *testing.T) {
+	h, o := newTestShipment(t)
+
+	unlock, err := h.Repo.Lock(context.Background(), o.OrderID, time.Minute)
+	if err != nil {
+		t.Fatalf("lock: %v", err)
+	}
+
+	target := fmt.Sprintf("/order/%d/shipments", o.OrderID)
+	body := shipmentBody(model.ShipmentItem{ItemID: o.LineItems[0].ItemID, Quantity: 1})
+	if w := serve(h.Create, http.MethodPost, "/order/{id}/shipments", target, body); w.Code != http.StatusConflict {
+		t.Errorf("create while locked = %d, want %d", w.Code, http.StatusConflict)
+	}
+
+	unlock()
+	if w := serve(h.Create, http.MethodPost, "/order/{id}/shipments", target, body); w.Code != http.StatusCreated {
+		t.Errorf("create after unlock = %d %s, want %d", w.Code, w.Body, http.StatusCreated)
+	}
+}
@@ -0,0 +1,161 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/umuttopalak/orders-api/events"
+	"github.com/umuttopalak/orders-api/logging"
+	"github.com/umuttopalak/orders-api/repository/order"
+)
+
+const (
+	// streamHeartbeat keeps idle connections from being closed by proxies
+	// and lets the server notice clients that went away.
+	streamHeartbeat = 15 * time.Second
+	streamReplay    = 500
+)
+
+// Stream sends every order event as a Server-Sent Event.
+func (h *Order) Stream(w http.ResponseWriter, r *http.Request) {
+	h.stream(w, r, 0)
+}
+
+// StreamByID sends the events of one order. Clients resuming with
+// Last-Event-ID may still receive the events of an order deleted since.
+func (h *Order) StreamByID(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if r.Header.Get("Last-Event-ID") == "" {
+		_, err := h.Repo.FindByID(r.Context(), orderID)
+		if errors.Is(err, order.ErrNotExist) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		} else if err != nil {
+			logging.FromContext(r.Context()).Error("failed to find by id", slog.Any("error", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	h.stream(w, r, orderID)
+}
+
+// stream subscribes to live events before replaying the ones after
+// Last-Event-ID from the order stream, so nothing written in between is
+// lost. Live events the replay already covered are skipped by ID. An
+// orderID of 0 streams every order.
+func (h *Order) stream(w http.ResponseWriter, r *http.Request, orderID uint64) {
+	ctx := r.Context()
+
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID != "" && !events.ValidID(lastID) {
+		writeError(w, http.StatusBadRequest, "invalid Last-Event-ID")
+		return
+	}
+
+	sub, err := h.Repo.Subscribe(ctx)
+	if err != nil {
+		logging.FromContext(ctx).Error("failed to subscribe", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer sub.Close()
+
+	// The stream outlives the server's write timeout.
+	rc := http.NewResponseController(w)
+	_ = rc.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(e events.Event) error {
+		if orderID != 0 && e.AggregateID != orderID {
+			return nil
+		}
+
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+		return err
+	}
+
+	for lastID != "" {
+		evs, err := h.Repo.EventsAfter(ctx, lastID, streamReplay)
+		if err != nil {
+			logging.FromContext(ctx).Error("failed to replay order events", slog.Any("error", err))
+			return
+		}
+
+		for _, e := range evs {
+			if err := send(e); err != nil {
+				return
+			}
+			lastID = e.ID
+		}
+		if len(evs) < streamReplay {
+			break
+		}
+	}
+
+	if _, err := fmt.Fprint(w, ": connected\n\n"); err != nil {
+		return
+	}
+	_ = rc.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+
+	live := sub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-h.Shutdown:
+			return
+
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+
+		case msg, ok := <-live:
+			if !ok {
+				return
+			}
+
+			var e events.Event
+			if err := json.Unmarshal([]byte(msg.Payload), &e); err != nil {
+				logging.FromContext(ctx).Warn("dropping malformed order event", slog.Any("error", err))
+				continue
+			}
+			if lastID != "" && events.CompareIDs(e.ID, lastID) <= 0 {
+				continue
+			}
+
+			if err := send(e); err != nil {
+				return
+			}
+			lastID = e.ID
+		}
+
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/umuttopalak/orders-api/events"
+	"github.com/umuttopalak/orders-api/repository/order"
+)
+
+func TestStreamInvalidLastEventID(t *testing.T) {
+	h := &Order{Repo: &order.RedisRepo{Client: newTestRedis(t)}}
+
+	tests := []struct {
+		name string
+		id   string
+	}{
+		{"not an ID", "abc"},
+		{"missing sequence", "1700000000000-"},
+		{"missing time", "-1"},
+		{"extra part", "1700000000000-0-1"},
+		{"negative", "-1700000000000-0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, target := range []string{"/order/stream", "/order/1/stream"} {
+				router := chi.NewRouter()
+				router.Get("/order/stream", h.Stream)
+				router.Get("/order/{id}/stream", h.StreamByID)
+
+				r := httptest.NewRequest(http.MethodGet, target, nil)
+				r.Header.Set("Last-Event-ID", tt.id)
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, r)
+
+				if w.Code != http.StatusBadRequest {
+					t.Errorf("GET %s = %d, want %d", target, w.Code, http.StatusBadRequest)
+				}
+			}
+		})
+	}
+}
+
+// TestStreamResume checks that a client resuming with Last-Event-ID gets
+// the events it missed from the stream, and that live copies of those
+// events are not sent again.
+func TestStreamResume(t *testing.T) {
+	client := newTestRedis(t)
+	h := &Order{Repo: &order.RedisRepo{Client: client}}
+	ctx := context.Background()
+
+	for id := uint64(1); id <= 3; id++ {
+		insertOrder(t, h.Repo, id)
+	}
+	written, err := events.After(ctx, client, events.AggregateOrder, "0-0", 10)
+	if err != nil || len(written) != 3 {
+		t.Fatalf("events.After = %d events, %v, want 3", len(written), err)
+	}
+
+	router := chi.NewRouter()
+	router.Get("/order/stream", h.Stream)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	reqCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	req, _ := http.NewRequestWithContext(reqCtx, http.MethodGet, server.URL+"/order/stream", nil)
+	req.Header.Set("Last-Event-ID", written[0].ID)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET /order/stream: %v", err)
+	}
+	defer res.Body.Close()
+
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q, want text/event-stream", ct)
+	}
+
+	lines := bufio.NewScanner(res.Body)
+	// readIDs returns the IDs of the events sent until a line with prefix.
+	readIDs := func(until func(line string) bool) []string {
+		var ids []string
+		for lines.Scan() {
+			line := lines.Text()
+			if id, ok := strings.CutPrefix(line, "id: "); ok {
+				ids = append(ids, id)
+			}
+			if until(line) {
+				return ids
+			}
+		}
+		t.Fatalf("stream ended: %v", lines.Err())
+		return nil
+	}
+
+	replayed := readIDs(func(line string) bool { return line == ": connected" })
+	if want := []string{written[1].ID, written[2].ID}; strings.Join(replayed, ",") != strings.Join(want, ",") {
+		t.Fatalf("replayed %v, want %v", replayed, want)
+	}
+
+	// The live copies of replayed events arrive after the replay and must
+	// be skipped.
+	for _, e := range written {
+		if err := events.Publish(ctx, client, e); err != nil {
+			t.Fatalf("publish: %v", err)
+		}
+	}
+	insertOrder(t, h.Repo, 4)
+	latest, err := events.After(ctx, client, events.AggregateOrder, written[2].ID, 10)
+	if err != nil || len(latest) != 1 {
+		t.Fatalf("events.After = %d events, %v, want 1", len(latest), err)
+	}
+
+	live := readIDs(func(line string) bool { return line == "id: "+latest[0].ID })
+	if len(live) != 1 {
+		t.Errorf("live events %v, want only %s", live, latest[0].ID)
+	}
+}
@@ -0,0 +1,409 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/umuttopalak/orders-api/logging"
+	"github.com/umuttopalak/orders-api/repository/pagination"
+)
+
+const (
+	formatCSV    = "csv"
+	formatNDJSON = "ndjson"
+)
+
+const (
+	exportPageSize = 200
+	importChunk    = 100
+
+	// maxImportErrors bounds the report of a file that fails on every line.
+	maxImportErrors = 1000
+
+	maxNDJSONLine = 1 << 20
+)
+
+// transferFormat reads ?format=, falling back to the request Content-Type
+// for imports and to CSV for exports.
+func transferFormat(r *http.Request) (string, error) {
+	format := r.URL.Query().Get("format")
+	if format == "" && r.Method != http.MethodGet {
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		switch mediaType {
+		case "text/csv":
+			format = formatCSV
+		case "application/x-ndjson":
+			format = formatNDJSON
+		}
+	}
+	if format == "" {
+		format = formatCSV
+	}
+
+	if format != formatCSV && format != formatNDJSON {
+		return "", fmt.Errorf("unsupported format %q", format)
+	}
+	return format, nil
+}
+
+// exportRows streams every entity returned by page, one page at a time and
+// oldest first, as CSV rows or NDJSON lines. Once the first page has been
+// written a failure can no longer change the status, so the connection is
+// aborted instead to keep clients from mistaking a truncated file for a
+// complete one.
+func exportRows[T any](
+	w http.ResponseWriter,
+	r *http.Request,
+	name string,
+	header []string,
+	row func(T) []string,
+	page func(ctx context.Context, q pagination.Query) ([]T, *pagination.Cursor, error),
+) {
+	format, err := transferFormat(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// Large exports outlive the server's write timeout.
+	rc := http.NewResponseController(w)
+	_ = rc.SetWriteDeadline(time.Time{})
+
+	csvw := csv.NewWriter(w)
+	enc := json.NewEncoder(w)
+
+	query := pagination.Query{Limit: exportPageSize}
+	started := false
+
+	for {
+		items, next, err := page(r.Context(), query)
+		if err != nil {
+			logging.FromContext(r.Context()).Error("failed to export", slog.Any("error", err))
+			if started {
+				panic(http.ErrAbortHandler)
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if !started {
+			started = true
+			if format == formatCSV {
+				w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+			} else {
+				w.Header().Set("Content-Type", "application/x-ndjson")
+			}
+			w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, name, format))
+			w.WriteHeader(http.StatusOK)
+
+			if format == formatCSV {
+				_ = csvw.Write(header)
+			}
+		}
+
+		for _, item := range items {
+			if format == formatCSV {
+				err = csvw.Write(row(item))
+			} else {
+				err = enc.Encode(item)
+			}
+			if err != nil {
+				break
+			}
+		}
+		if format == formatCSV {
+			csvw.Flush()
+			err = errors.Join(err, csvw.Error())
+		}
+		if err != nil {
+			logging.FromContext(r.Context()).Error("failed to write export", slog.Any("error", err))
+			panic(http.ErrAbortHandler)
+		}
+		_ = rc.Flush()
+
+		if next == nil {
+			return
+		}
+		query.Cursor = next
+	}
+}
+
+type importError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+type importReport struct {
+	Created   int           `json:"created"`
+	Updated   int           `json:"updated"`
+	Failed    int           `json:"failed"`
+	Errors    []importError `json:"errors"`
+	Truncated bool          `json:"errors_truncated,omitempty"`
+}
+
+func (rep *importReport) fail(line int, err error) {
+	rep.Failed++
+	if len(rep.Errors) == maxImportErrors {
+		rep.Truncated = true
+		return
+	}
+	rep.Errors = append(rep.Errors, importError{Line: line, Error: err.Error()})
+}
+
+// importer describes how the rows of one entity are read and stored. Rows
+// without an ID are created, rows with one replace the stored entity if it
+// is still at the row's version.
+type importer[T any] struct {
+	fromCSV  func(row map[string]string) (T, error)
+	validate func(T) error
+	// prepare fills in what the client does not send and reports whether
+	// the row is an update.
+	prepare func(x *T, now time.Time) (update bool, err error)
+	insert  func(ctx context.Context, xs []T) ([]error, error)
+	update  func(ctx context.Context, xs []T) ([]error, error)
+}
+
+type importRow[T any] struct {
+	line int
+	item T
+}
+
+// importRows reads a CSV or NDJSON body line by line and stores valid rows
+// in chunks, so neither the file nor the report of the stored rows is held
+// in memory. Every rejected row is reported with its line number. Rows
+// stored before a later failure stay stored and are counted in the report
+// sent with the 500.
+func importRows[T any](w http.ResponseWriter, r *http.Request, im importer[T]) {
+	format, err := transferFormat(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+
+	// Large files take longer to upload and store than the server's read
+	// and write timeouts allow.
+	rc := http.NewResponseController(w)
+	_ = rc.SetReadDeadline(time.Time{})
+	_ = rc.SetWriteDeadline(time.Time{})
+
+	report := importReport{Errors: []importError{}}
+	chunk := make([]importRow[T], 0, importChunk)
+	now := time.Now().UTC()
+
+	flush := func() error {
+		var creates, updates []T
+		var createLines, updateLines []int
+
+		for _, row := range chunk {
+			update, err := im.prepare(&row.item, now)
+			if err == nil {
+				err = im.validate(row.item)
+			}
+			if err != nil {
+				report.fail(row.line, err)
+				continue
+			}
+
+			if update {
+				updates = append(updates, row.item)
+				updateLines = append(updateLines, row.line)
+			} else {
+				creates = append(creates, row.item)
+				createLines = append(createLines, row.line)
+			}
+		}
+		chunk = chunk[:0]
+
+		for _, step := range []struct {
+			items []T
+			lines []int
+			store func(context.Context, []T) ([]error, error)
+			count *int
+		}{
+			{creates, createLines, im.insert, &report.Created},
+			{updates, updateLines, im.update, &report.Updated},
+		} {
+			if len(step.items) == 0 {
+				continue
+			}
+
+			errs, err := step.store(r.Context(), step.items)
+			if err != nil {
+				return err
+			}
+			for i, err := range errs {
+				if err != nil {
+					report.fail(step.lines[i], err)
+				} else {
+					*step.count++
+				}
+			}
+		}
+		return nil
+	}
+
+	add := func(line int, item T) error {
+		chunk = append(chunk, importRow[T]{line: line, item: item})
+		if len(chunk) < importChunk {
+			return nil
+		}
+		return flush()
+	}
+
+	var readErr, storeErr error
+	if format == formatCSV {
+		readErr, storeErr = readCSV(r.Body, &report, im.fromCSV, add)
+	} else {
+		readErr, storeErr = readNDJSON(r.Body, &report, add)
+	}
+	if storeErr == nil {
+		storeErr = flush()
+	}
+
+	// Rows are validated when their chunk is stored, after the parse errors
+	// of later lines have been reported.
+	sort.SliceStable(report.Errors, func(i, j int) bool {
+		return report.Errors[i].Line < report.Errors[j].Line
+	})
+
+	status := http.StatusOK
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case storeErr != nil:
+		// The rows stored before the failure stay stored, the report
+		// tells the client how many there were.
+		logging.FromContext(r.Context()).Error("failed to import", slog.Any("error", storeErr))
+		status = http.StatusInternalServerError
+	case errors.As(readErr, &maxBytesErr):
+		status = http.StatusRequestEntityTooLarge
+	case report.Failed > 0:
+		status = http.StatusMultiStatus
+	}
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to marshal", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if _, err := w.Write(data); err != nil {
+		logging.FromContext(r.Context()).Error("failed to write response", slog.Any("error", err))
+	}
+}
+
+// readCSV maps each record onto the header row. Records with the wrong
+// number of fields are reported and skipped. Any other parse error ends
+// the import, since the reader cannot tell where the next record starts.
+func readCSV[T any](body io.Reader, report *importReport, fromCSV func(map[string]string) (T, error), add func(int, T) error) (readErr, storeErr error) {
+	reader := csv.NewReader(body)
+	reader.ReuseRecord = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil
+	} else if err != nil {
+		report.fail(1, fmt.Errorf("invalid header: %w", err))
+		return err, nil
+	}
+	header = append([]string(nil), header...)
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil, nil
+		}
+
+		if err != nil {
+			line := 0
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				line = parseErr.StartLine
+			}
+			report.fail(line, err)
+			if errors.Is(err, csv.ErrFieldCount) {
+				continue
+			}
+			return err, nil
+		}
+
+		line, _ := reader.FieldPos(0)
+
+		row := make(map[string]string, len(header))
+		for i, name := range header {
+			row[name] = record[i]
+		}
+
+		item, err := fromCSV(row)
+		if err != nil {
+			report.fail(line, err)
+			continue
+		}
+
+		if err := add(line, item); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func readNDJSON[T any](body io.Reader, report *importReport, add func(int, T) error) (readErr, storeErr error) {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(nil, maxNDJSONLine)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		var item T
+		if err := json.Unmarshal(scanner.Bytes(), &item); err != nil {
+			report.fail(line, err)
+			continue
+		}
+
+		if err := add(line, item); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		report.fail(line+1, err)
+		return err, nil
+	}
+	return nil, nil
+}
+
+func parseCSVUint(row map[string]string, column string) (uint64, error) {
+	v := row[column]
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s: invalid integer %q", column, v)
+	}
+	return n, nil
+}
+
+func formatCSVTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
@@ -0,0 +1,209 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTransferFormat(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      string
+		query       string
+		contentType string
+		want        string
+		err         bool
+	}{
+		{"export default", http.MethodGet, "", "", formatCSV, false},
+		{"export ndjson", http.MethodGet, "?format=ndjson", "", formatNDJSON, false},
+		{"export ignores content type", http.MethodGet, "", "application/x-ndjson", formatCSV, false},
+		{"import csv", http.MethodPost, "", "text/csv; charset=utf-8", formatCSV, false},
+		{"import ndjson", http.MethodPost, "", "application/x-ndjson", formatNDJSON, false},
+		{"import default", http.MethodPost, "", "application/octet-stream", formatCSV, false},
+		{"query wins", http.MethodPost, "?format=csv", "application/x-ndjson", formatCSV, false},
+		{"unknown format", http.MethodGet, "?format=xml", "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/product/export"+tt.query, nil)
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+
+			got, err := transferFormat(r)
+			if (err != nil) != tt.err || got != tt.want {
+				t.Errorf("transferFormat = %q, %v, want %q, error %v", got, err, tt.want, tt.err)
+			}
+		})
+	}
+}
+
+type testRow struct {
+	ID   uint64 `json:"id"`
+	Name string `json:"name"`
+}
+
+// testImporter stores rows in memory. Rows named "fail" fail validation
+// and the store fails once failAfter rows have been stored.
+type testImporter struct {
+	stored    []testRow
+	failAfter int
+}
+
+func (ti *testImporter) importer() importer[testRow] {
+	store := func(ctx context.Context, xs []testRow) ([]error, error) {
+		if ti.failAfter > 0 && len(ti.stored)+len(xs) > ti.failAfter {
+			return nil, errors.New("redis unavailable")
+		}
+		ti.stored = append(ti.stored, xs...)
+		return make([]error, len(xs)), nil
+	}
+
+	return importer[testRow]{
+		fromCSV: func(row map[string]string) (testRow, error) {
+			id, err := parseCSVUint(row, "id")
+			return testRow{ID: id, Name: row["name"]}, err
+		},
+		validate: func(x testRow) error {
+			if x.Name == "fail" {
+				return errors.New("name must not be fail")
+			}
+			return nil
+		},
+		prepare: func(x *testRow, now time.Time) (bool, error) {
+			return x.ID != 0, nil
+		},
+		insert: store,
+		update: store,
+	}
+}
+
+func TestImportRows(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		status      int
+		report      importReport
+	}{
+		{
+			"csv",
+			"text/csv",
+			"id,name\n,kettle\n7,filter\n",
+			http.StatusOK,
+			importReport{Created: 1, Updated: 1, Errors: []importError{}},
+		},
+		{
+			"csv errors by line",
+			"text/csv",
+			"id,name\n,kettle\nx,mug\n,fail\n,too,many\n\n,cup\n",
+			http.StatusMultiStatus,
+			importReport{Created: 2, Failed: 3, Errors: []importError{
+				{3, `id: invalid integer "x"`},
+				{4, "name must not be fail"},
+				{5, "record on line 5: wrong number of fields"},
+			}},
+		},
+		{
+			"csv quoted newline",
+			"text/csv",
+			"id,name\n,\"two\nlines\"\n,fail\n",
+			http.StatusMultiStatus,
+			importReport{Created: 1, Failed: 1, Errors: []importError{{4, "name must not be fail"}}},
+		},
+		{
+			"csv header only",
+			"text/csv",
+			"id,name\n",
+			http.StatusOK,
+			importReport{Errors: []importError{}},
+		},
+		{
+			"ndjson errors by line",
+			"application/x-ndjson",
+			"{\"name\":\"kettle\"}\n\n{\"name\":\n{\"id\":7,\"name\":\"fail\"}\n{\"id\":8,\"name\":\"cup\"}\n",
+			http.StatusMultiStatus,
+			importReport{Created: 1, Updated: 1, Failed: 2, Errors: []importError{
+				{3, "unexpected end of JSON input"},
+				{4, "name must not be fail"},
+			}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ti testImporter
+			r := httptest.NewRequest(http.MethodPost, "/product/import", strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", tt.contentType)
+			w := httptest.NewRecorder()
+
+			importRows(w, r, ti.importer())
+
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			var got importReport
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatalf("decode report %s: %v", w.Body, err)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.report) {
+				t.Errorf("report = %+v, want %+v", got, tt.report)
+			}
+		})
+	}
+}
+
+func TestImportRowsStoreFailure(t *testing.T) {
+	ti := testImporter{failAfter: importChunk}
+
+	var body strings.Builder
+	body.WriteString("id,name\n")
+	for i := 0; i < importChunk+10; i++ {
+		body.WriteString(",item" + strconv.Itoa(i) + "\n")
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/product/import", strings.NewReader(body.String()))
+	r.Header.Set("Content-Type", "text/csv")
+	w := httptest.NewRecorder()
+
+	importRows(w, r, ti.importer())
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+	var got importReport
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decode report %s: %v", w.Body, err)
+	}
+	if got.Created != importChunk || len(ti.stored) != importChunk {
+		t.Errorf("report created %d and %d rows were stored, want %d", got.Created, len(ti.stored), importChunk)
+	}
+}
+
+func TestImportRowsTooLarge(t *testing.T) {
+	var ti testImporter
+	body := "id,name\n,kettle\n,filter\n"
+
+	r := httptest.NewRequest(http.MethodPost, "/product/import", strings.NewReader(body))
+	r.Header.Set("Content-Type", "text/csv")
+	w := httptest.NewRecorder()
+	r.Body = http.MaxBytesReader(w, r.Body, int64(len("id,name\n,kettle\n,fil")))
+
+	importRows(w, r, ti.importer())
+
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+	if len(ti.stored) != 1 || ti.stored[0].Name != "kettle" {
+		t.Errorf("stored %+v, want the row before the cut", ti.stored)
+	}
+}
@@ -0,0 +1,357 @@
+package handler
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	mathrand "math/rand"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/umuttopalak/orders-api/logging"
+	"github.com/umuttopalak/orders-api/model"
+	webhookrepo "github.com/umuttopalak/orders-api/repository/webhook"
+	"github.com/umuttopalak/orders-api/webhook"
+)
+
+const (
+	defaultDeliveryLimit = 50
+	maxDeliveryLimit     = 200
+)
+
+type Webhook struct {
+	Repo           *webhookrepo.RedisRepo
+	RequireIfMatch bool
+}
+
+// The secret is only returned when the webhook is created.
+func (h *Webhook) Create(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+		Active *bool    `json:"active"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(decodeErrorStatus(err))
+		return
+	}
+
+	if err := validateWebhook(body.URL, body.Events); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	secret, err := newWebhookSecret()
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to generate secret", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now().UTC()
+	hook := model.Webhook{
+		WebhookID: mathrand.Uint64(),
+		URL:       body.URL,
+		Events:    body.Events,
+		Secret:    secret,
+		Active:    body.Active == nil || *body.Active,
+		CreatedAt: &now,
+		Version:   1,
+	}
+	if hook.Events == nil {
+		hook.Events = []string{}
+	}
+
+	if err := h.Repo.Insert(r.Context(), hook); err != nil {
+		logging.FromContext(r.Context()).Error("failed to insert", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	res, err := json.Marshal(hook)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to encode webhook", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("ETag", etag(hook.Version))
+	w.WriteHeader(http.StatusCreated)
+	if _, err := w.Write(res); err != nil {
+		logging.FromContext(r.Context()).Error("failed to write response", slog.Any("error", err))
+	}
+}
+
+func (h *Webhook) List(w http.ResponseWriter, r *http.Request) {
+	query, err := parseListQuery(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	res, err := h.Repo.FindAll(r.Context(), query)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to find all", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	for i := range res.Webhooks {
+		res.Webhooks[i].Secret = ""
+	}
+
+	var response struct {
+		Webhooks []model.Webhook `json:"webhooks"`
+		Next     string          `json:"next,omitempty"`
+		Prev     string          `json:"prev,omitempty"`
+		Total    int64           `json:"total"`
+	}
+
+	response.Webhooks = res.Webhooks
+	response.Next = encodeCursor(res.Next)
+	response.Prev = encodeCursor(res.Prev)
+	response.Total = res.Total
+
+	setPageLinks(w, r, res.Next, res.Prev)
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logging.FromContext(r.Context()).Error("failed to marshal", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+func (h *Webhook) GetByID(w http.ResponseWriter, r *http.Request) {
+	hook, ok := h.find(w, r)
+	if !ok {
+		return
+	}
+
+	hook.Secret = ""
+
+	w.Header().Set("ETag", etag(hook.Version))
+	if err := json.NewEncoder(w).Encode(hook); err != nil {
+		logging.FromContext(r.Context()).Error("failed to marshal", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+func (h *Webhook) UpdateByID(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+		Active *bool    `json:"active"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(decodeErrorStatus(err))
+		return
+	}
+
+	if err := validateWebhook(body.URL, body.Events); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	hook, ok := h.find(w, r)
+	if !ok {
+		return
+	}
+
+	if !checkIfMatch(w, r, hook.Version, h.RequireIfMatch) {
+		return
+	}
+
+	hook.URL = body.URL
+	hook.Events = body.Events
+	if hook.Events == nil {
+		hook.Events = []string{}
+	}
+	if body.Active != nil {
+		hook.Active = *body.Active
+	}
+
+	hook, err := h.Repo.Update(r.Context(), hook)
+	if errors.Is(err, webhookrepo.ErrVersionMismatch) {
+		w.WriteHeader(versionConflictStatus(r))
+		return
+	} else if errors.Is(err, webhookrepo.ErrNotExist) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		logging.FromContext(r.Context()).Error("failed to update", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	hook.Secret = ""
+
+	w.Header().Set("ETag", etag(hook.Version))
+	if err := json.NewEncoder(w).Encode(hook); err != nil {
+		logging.FromContext(r.Context()).Error("failed to marshal", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+func (h *Webhook) DeleteByID(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var version uint64
+	if r.Header.Get("If-Match") != "" || h.RequireIfMatch {
+		hook, ok := h.find(w, r)
+		if !ok {
+			return
+		}
+
+		if !checkIfMatch(w, r, hook.Version, h.RequireIfMatch) {
+			return
+		}
+		version = hook.Version
+	}
+
+	err = h.Repo.DeleteByID(r.Context(), id, version)
+	if errors.Is(err, webhookrepo.ErrNotExist) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if errors.Is(err, webhookrepo.ErrVersionMismatch) {
+		w.WriteHeader(versionConflictStatus(r))
+		return
+	} else if err != nil {
+		logging.FromContext(r.Context()).Error("failed to delete", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// Deliveries lists the most recent delivery attempts, newest first.
+func (h *Webhook) Deliveries(w http.ResponseWriter, r *http.Request) {
+	hook, ok := h.find(w, r)
+	if !ok {
+		return
+	}
+
+	limit, err := parseLogLimit(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	deliveries, err := h.Repo.Deliveries(r.Context(), hook.WebhookID, limit)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to read deliveries", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var response struct {
+		Deliveries []model.WebhookDelivery `json:"deliveries"`
+	}
+	response.Deliveries = deliveries
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logging.FromContext(r.Context()).Error("failed to marshal", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// DeadLetters lists deliveries that ran out of attempts, newest first.
+func (h *Webhook) DeadLetters(w http.ResponseWriter, r *http.Request) {
+	hook, ok := h.find(w, r)
+	if !ok {
+		return
+	}
+
+	limit, err := parseLogLimit(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	letters, err := h.Repo.DeadLetters(r.Context(), hook.WebhookID, limit)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to read dead letters", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var response struct {
+		DeadLetters []model.WebhookDeadLetter `json:"dead_letters"`
+	}
+	response.DeadLetters = letters
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logging.FromContext(r.Context()).Error("failed to marshal", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+func (h *Webhook) find(w http.ResponseWriter, r *http.Request) (model.Webhook, bool) {
+	id, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return model.Webhook{}, false
+	}
+
+	hook, err := h.Repo.FindByID(r.Context(), id)
+	if errors.Is(err, webhookrepo.ErrNotExist) {
+		w.WriteHeader(http.StatusNotFound)
+		return model.Webhook{}, false
+	} else if err != nil {
+		logging.FromContext(r.Context()).Error("failed to find by id", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return model.Webhook{}, false
+	}
+
+	return hook, true
+}
+
+func parseLogLimit(r *http.Request) (int, error) {
+	v := r.URL.Query().Get("limit")
+	if v == "" {
+		return defaultDeliveryLimit, nil
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid limit %q", v)
+	}
+	return min(n, maxDeliveryLimit), nil
+}
+
+func validateWebhook(rawURL string, types []string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("url must be an absolute http or https URL")
+	}
+
+	for _, typ := range types {
+		if !slices.Contains(webhook.OrderEvents, typ) {
+			return fmt.Errorf("unknown event type %q", typ)
+		}
+	}
+	return nil
+}
+
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
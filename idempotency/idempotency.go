@@ -0,0 +1,277 @@
+package idempotency
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/umuttopalak/orders-api/logging"
+	"github.com/umuttopalak/orders-api/ratelimit"
+)
+
+const (
+	Header         = "Idempotency-Key"
+	ReplayedHeader = "Idempotent-Replayed"
+
+	maxKeyLength = 255
+)
+
+const (
+	stateInProgress = "in_progress"
+	stateCompleted  = "completed"
+)
+
+type record struct {
+	State       string `json:"state"`
+	Fingerprint string `json:"fingerprint"`
+	Status      int    `json:"status,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Body        []byte `json:"body,omitempty"`
+}
+
+// Store remembers the outcome of requests sent with an Idempotency-Key so
+// that a retry gets the original response instead of repeating the side
+// effect.
+type Store struct {
+	Client *redis.Client
+	// TTL is how long a completed response is replayed.
+	TTL time.Duration
+	// Lease is how long a key stays claimed by a request that has not
+	// completed. It should outlast the request timeout, so that a process
+	// dying mid-request blocks retries of the key only briefly. Zero uses
+	// TTL.
+	Lease time.Duration
+}
+
+// versionPrefix matches the API version segment of a path.
+var versionPrefix = regexp.MustCompile(`^/v[0-9]+/`)
+
+// resourcePath is the request path without its API version, so a request
+// retried on a deprecated unversioned alias of the route it was first sent
+// to finds the same record.
+func resourcePath(r *http.Request) string {
+	return versionPrefix.ReplaceAllString(r.URL.Path, "/")
+}
+
+func recordKey(r *http.Request, key string) string {
+	scope := resourcePath(r)
+	if apiKey := r.Header.Get(ratelimit.APIKeyHeader); apiKey != "" {
+		sum := sha256.Sum256([]byte(apiKey))
+		scope = hex.EncodeToString(sum[:8]) + ":" + scope
+	}
+
+	return "idempotency:" + scope + ":" + key
+}
+
+func fingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(r.Method))
+	h.Write([]byte{0})
+	h.Write([]byte(resourcePath(r)))
+	h.Write([]byte{0})
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Middleware claims the key before running the handler and stores the
+// response afterwards. Server errors, and handlers that gave up without
+// writing a response, release the key so the client may retry; anything
+// else is replayed for as long as the record lives.
+func (s *Store) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(Header)
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if len(key) > maxKeyLength {
+			writeError(w, http.StatusBadRequest, "idempotency key too long")
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				writeError(w, http.StatusRequestEntityTooLarge, "request body too large")
+				return
+			}
+			writeError(w, http.StatusBadRequest, "failed to read request body")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		ctx := r.Context()
+		logger := logging.FromContext(ctx)
+		redisKey := recordKey(r, key)
+		fp := fingerprint(r, body)
+
+		claimed, err := s.claim(ctx, redisKey, fp)
+		if err != nil {
+			logger.Error("failed to claim idempotency key", slog.Any("error", err))
+			writeError(w, http.StatusInternalServerError, "internal server error")
+			return
+		}
+
+		if !claimed {
+			s.replay(w, r, redisKey, fp)
+			return
+		}
+
+		rec := &recorder{ResponseWriter: w}
+		completed := false
+		defer func() {
+			if completed {
+				return
+			}
+			// The handler panicked or failed, let the client try again.
+			if err := s.Client.Del(context.WithoutCancel(ctx), redisKey).Err(); err != nil {
+				logger.Error("failed to release idempotency key", slog.Any("error", err))
+			}
+		}()
+
+		next.ServeHTTP(rec, r)
+
+		if !rec.written() || rec.status() >= http.StatusInternalServerError {
+			return
+		}
+
+		if err := s.complete(context.WithoutCancel(ctx), redisKey, fp, rec); err != nil {
+			logger.Error("failed to store idempotent response", slog.Any("error", err))
+			return
+		}
+		completed = true
+	})
+}
+
+func (s *Store) claim(ctx context.Context, key, fp string) (bool, error) {
+	data, err := json.Marshal(record{
+		State:       stateInProgress,
+		Fingerprint: fp,
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to encode idempotency record: %w", err)
+	}
+
+	lease := s.Lease
+	if lease <= 0 {
+		lease = s.TTL
+	}
+
+	ok, err := s.Client.SetNX(ctx, key, string(data), lease).Result()
+	if err != nil {
+		return false, fmt.Errorf("set idempotency key: %w", err)
+	}
+
+	return ok, nil
+}
+
+func (s *Store) complete(ctx context.Context, key, fp string, rec *recorder) error {
+	data, err := json.Marshal(record{
+		State:       stateCompleted,
+		Fingerprint: fp,
+		Status:      rec.status(),
+		ContentType: rec.Header().Get("Content-Type"),
+		Body:        rec.body.Bytes(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode idempotency record: %w", err)
+	}
+
+	if err := s.Client.Set(ctx, key, string(data), s.TTL).Err(); err != nil {
+		return fmt.Errorf("set idempotency key: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Store) replay(w http.ResponseWriter, r *http.Request, key, fp string) {
+	value, err := s.Client.Get(r.Context(), key).Result()
+	if errors.Is(err, redis.Nil) {
+		// The first attempt failed and released the key in the meantime.
+		writeError(w, http.StatusConflict, "request with this idempotency key was not completed, retry")
+		return
+	} else if err != nil {
+		logging.FromContext(r.Context()).Error("failed to get idempotency key", slog.Any("error", err))
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	var stored record
+	if err := json.Unmarshal([]byte(value), &stored); err != nil {
+		logging.FromContext(r.Context()).Error("failed to decode idempotency record", slog.Any("error", err))
+		writeError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	if stored.Fingerprint != fp {
+		writeError(w, http.StatusUnprocessableEntity, "idempotency key was already used with a different request")
+		return
+	}
+
+	if stored.State != stateCompleted {
+		writeError(w, http.StatusConflict, "request with this idempotency key is still being processed")
+		return
+	}
+
+	if stored.ContentType != "" {
+		w.Header().Set("Content-Type", stored.ContentType)
+	}
+	w.Header().Set(ReplayedHeader, "true")
+	w.Header().Set("Content-Length", strconv.Itoa(len(stored.Body)))
+	w.WriteHeader(stored.Status)
+	_, _ = w.Write(stored.Body)
+}
+
+type recorder struct {
+	http.ResponseWriter
+	code int
+	body bytes.Buffer
+}
+
+func (r *recorder) WriteHeader(code int) {
+	if r.code == 0 {
+		r.code = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	if r.code == 0 {
+		r.code = http.StatusOK
+	}
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *recorder) written() bool {
+	return r.code != 0
+}
+
+func (r *recorder) status() int {
+	if r.code == 0 {
+		return http.StatusOK
+	}
+	return r.code
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	_ = json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+	}{message})
+}
@@ -0,0 +1,185 @@
+package idempotency
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestRecordKeyIgnoresAPIVersion(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		same bool
+	}{
+		{"legacy alias", "/order/1/pay", "/v1/order/1/pay", true},
+		{"same version", "/v1/order/1/pay", "/v1/order/1/pay", true},
+		{"other order", "/v1/order/1/pay", "/v1/order/2/pay", false},
+		{"version-like resource", "/v1/order/1/pay", "/v1order/1/pay", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := httptest.NewRequest("POST", tt.a, nil)
+			b := httptest.NewRequest("POST", tt.b, nil)
+
+			if got := recordKey(a, "k") == recordKey(b, "k"); got != tt.same {
+				t.Errorf("recordKey(%s) == recordKey(%s) is %v, want %v", tt.a, tt.b, got, tt.same)
+			}
+			if got := fingerprint(a, nil) == fingerprint(b, nil); got != tt.same {
+				t.Errorf("fingerprint(%s) == fingerprint(%s) is %v, want %v", tt.a, tt.b, got, tt.same)
+			}
+		})
+	}
+}
+
+func newTestStore(t *testing.T) (*Store, *miniredis.Miniredis) {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return &Store{Client: client, TTL: 24 * time.Hour, Lease: 30 * time.Second}, mr
+}
+
+func TestMiddleware(t *testing.T) {
+	type attempt struct {
+		body     string
+		status   int
+		replayed bool
+	}
+
+	tests := []struct {
+		name     string
+		handler  func(w http.ResponseWriter, calls int)
+		attempts []attempt
+		calls    int
+	}{
+		{
+			"replayed",
+			func(w http.ResponseWriter, calls int) {
+				w.WriteHeader(http.StatusCreated)
+				fmt.Fprintf(w, `{"call":%d}`, calls)
+			},
+			[]attempt{{`{"a":1}`, http.StatusCreated, false}, {`{"a":1}`, http.StatusCreated, true}},
+			1,
+		},
+		{
+			"client error replayed",
+			func(w http.ResponseWriter, calls int) { w.WriteHeader(http.StatusBadRequest) },
+			[]attempt{{`{"a":1}`, http.StatusBadRequest, false}, {`{"a":1}`, http.StatusBadRequest, true}},
+			1,
+		},
+		{
+			"different body",
+			func(w http.ResponseWriter, calls int) { w.WriteHeader(http.StatusCreated) },
+			[]attempt{{`{"a":1}`, http.StatusCreated, false}, {`{"a":2}`, http.StatusUnprocessableEntity, false}},
+			1,
+		},
+		{
+			"server error released",
+			func(w http.ResponseWriter, calls int) {
+				if calls == 1 {
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				w.WriteHeader(http.StatusCreated)
+			},
+			[]attempt{{`{"a":1}`, http.StatusInternalServerError, false}, {`{"a":1}`, http.StatusCreated, false}},
+			2,
+		},
+		{
+			"nothing written released",
+			func(w http.ResponseWriter, calls int) {
+				if calls > 1 {
+					w.WriteHeader(http.StatusCreated)
+				}
+			},
+			[]attempt{{`{"a":1}`, http.StatusOK, false}, {`{"a":1}`, http.StatusCreated, false}},
+			2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, _ := newTestStore(t)
+
+			calls := 0
+			h := store.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				tt.handler(w, calls)
+			}))
+
+			var first string
+			for i, a := range tt.attempts {
+				r := httptest.NewRequest(http.MethodPost, "/v1/order/", strings.NewReader(a.body))
+				r.Header.Set(Header, "key-1")
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, r)
+
+				if w.Code != a.status {
+					t.Errorf("attempt %d status = %d, want %d", i+1, w.Code, a.status)
+				}
+				if replayed := w.Header().Get(ReplayedHeader) == "true"; replayed != a.replayed {
+					t.Errorf("attempt %d replayed = %v, want %v", i+1, replayed, a.replayed)
+				}
+				if i == 0 {
+					first = w.Body.String()
+				} else if a.replayed && w.Body.String() != first {
+					t.Errorf("attempt %d body = %s, want %s", i+1, w.Body, first)
+				}
+			}
+
+			if calls != tt.calls {
+				t.Errorf("handler ran %d times, want %d", calls, tt.calls)
+			}
+		})
+	}
+}
+
+func TestMiddlewareLease(t *testing.T) {
+	store, mr := newTestStore(t)
+
+	var key string
+	h := store.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key = recordKey(r, "key-1")
+
+		// A retry while the first attempt runs is told to wait.
+		retry := httptest.NewRequest(http.MethodPost, "/order/", strings.NewReader(`{}`))
+		retry.Header.Set(Header, "key-1")
+		rec := httptest.NewRecorder()
+		store.Middleware(http.NotFoundHandler()).ServeHTTP(rec, retry)
+		if rec.Code != http.StatusConflict {
+			t.Errorf("concurrent retry status = %d, want %d", rec.Code, http.StatusConflict)
+		}
+
+		if ttl := mr.TTL(key); ttl != store.Lease {
+			t.Errorf("claimed key expires in %v, want the lease %v", ttl, store.Lease)
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+
+	r := httptest.NewRequest(http.MethodPost, "/order/", strings.NewReader(`{}`))
+	r.Header.Set(Header, "key-1")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	if ttl := mr.TTL(key); ttl != store.TTL {
+		t.Errorf("completed key expires in %v, want the TTL %v", ttl, store.TTL)
+	}
+
+	// A process that died mid-request frees the key once the lease ends.
+	if ok, err := store.claim(context.Background(), "idempotency:/order/:key-2", "fp"); err != nil || !ok {
+		t.Fatalf("claim = %v, %v", ok, err)
+	}
+	mr.FastForward(store.Lease)
+	if ok, err := store.claim(context.Background(), "idempotency:/order/:key-2", "fp"); err != nil || !ok {
+		t.Errorf("claim after the lease = %v, %v, want the key free again", ok, err)
+	}
+}
@@ -0,0 +1,120 @@
+// Package inventory hands returned goods back to the inventory system.
+// Stock levels are kept there, not in this service.
+package inventory
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/umuttopalak/orders-api/events"
+	"github.com/umuttopalak/orders-api/model"
+	"github.com/umuttopalak/orders-api/worker"
+)
+
+// RestockJob is the worker job type of a single restock request.
+const RestockJob = "inventory.restock"
+
+// Restock is the body posted to the inventory system for a received
+// return.
+type Restock struct {
+	ReturnID uint64 `json:"return_id"`
+	OrderID  uint64 `json:"order_id"`
+	Items    []Item `json:"items"`
+}
+
+type Item struct {
+	ProductID uint64 `json:"product_id"`
+	Quantity  uint   `json:"quantity"`
+}
+
+// Hook restocks the goods of received returns. Every ReturnReceived event
+// of a return marked for restocking becomes a job on Queue that posts a
+// Restock to URL, retried with exponential backoff until MaxAttempts have
+// been made. The return ID is sent as the Idempotency-Key, so the
+// inventory system can tell a retry from a second return.
+type Hook struct {
+	Queue       *worker.Queue
+	Client      *http.Client
+	URL         string
+	MaxAttempts int
+	Backoff     time.Duration
+}
+
+// HandleEvent is an events.Handler for the return stream.
+func (h *Hook) HandleEvent(ctx context.Context, e events.Event) error {
+	if e.Type != events.ReturnReceived {
+		return nil
+	}
+
+	var ret model.Return
+	if err := json.Unmarshal(e.Data, &ret); err != nil {
+		return fmt.Errorf("failed to decode return: %w", err)
+	}
+	if !ret.Restock {
+		return nil
+	}
+
+	restock := Restock{ReturnID: ret.ReturnID, OrderID: ret.OrderID, Items: make([]Item, 0, len(ret.Items))}
+	for _, item := range ret.Items {
+		// Line items of orders placed before products were required carry
+		// no product to restock.
+		if item.ProductID != 0 {
+			restock.Items = append(restock.Items, Item{ProductID: item.ProductID, Quantity: item.Quantity})
+		}
+	}
+	if len(restock.Items) == 0 {
+		return nil
+	}
+
+	_, err := h.Queue.Enqueue(ctx, RestockJob, restock, worker.EnqueueOptions{
+		ID:          fmt.Sprintf("restock:%d", ret.ReturnID),
+		MaxAttempts: h.MaxAttempts,
+		Backoff:     h.Backoff,
+	})
+	if err != nil && !errors.Is(err, worker.ErrDuplicate) {
+		return err
+	}
+
+	return nil
+}
+
+// Restock is the worker.Handler for RestockJob. It makes one attempt.
+func (h *Hook) Restock(ctx context.Context, job worker.Job) error {
+	var restock Restock
+	if err := json.Unmarshal(job.Payload, &restock); err != nil {
+		return fmt.Errorf("failed to decode restock: %w", err)
+	}
+
+	body, err := json.Marshal(restock)
+	if err != nil {
+		return fmt.Errorf("failed to encode restock: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "orders-api-inventory")
+	req.Header.Set("Idempotency-Key", "return-"+strconv.FormatUint(restock.ReturnID, 10))
+
+	res, err := h.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("inventory answered %s", res.Status)
+	}
+
+	return nil
+}
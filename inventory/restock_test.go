@@ -0,0 +1,156 @@
+package inventory
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/umuttopalak/orders-api/events"
+	"github.com/umuttopalak/orders-api/model"
+	"github.com/umuttopalak/orders-api/worker"
+)
+
+func newTestQueue(t *testing.T) *worker.Queue {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	return &worker.Queue{Client: client, Name: "jobs", VisibilityTimeout: time.Minute}
+}
+
+func returnEvent(t *testing.T, typ string, ret model.Return) events.Event {
+	t.Helper()
+
+	e, err := events.New(typ, events.AggregateReturn, ret.ReturnID, ret.Version, ret)
+	if err != nil {
+		t.Fatalf("new event: %v", err)
+	}
+	return e
+}
+
+func TestHandleEvent(t *testing.T) {
+	received := model.Return{
+		ReturnID: 9,
+		OrderID:  4,
+		Status:   model.ReturnReceived,
+		Items: []model.ReturnItem{
+			{ProductID: 7, Quantity: 2},
+			{ProductID: 0, Quantity: 1},
+			{ProductID: 8, Quantity: 1},
+		},
+		Restock: true,
+	}
+	kept := received
+	kept.Restock = false
+	legacy := received
+	legacy.Items = []model.ReturnItem{{Quantity: 1}}
+
+	tests := []struct {
+		name  string
+		event events.Event
+		want  *Restock
+	}{
+		{"received", returnEvent(t, events.ReturnReceived, received), &Restock{ReturnID: 9, OrderID: 4, Items: []Item{{7, 2}, {8, 1}}}},
+		{"not restocked", returnEvent(t, events.ReturnReceived, kept), nil},
+		{"no products", returnEvent(t, events.ReturnReceived, legacy), nil},
+		{"other status", returnEvent(t, events.ReturnApproved, received), nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queue := newTestQueue(t)
+			hook := &Hook{Queue: queue}
+
+			// Redelivered events queue the restock once.
+			for i := 0; i < 2; i++ {
+				if err := hook.HandleEvent(context.Background(), tt.event); err != nil {
+					t.Fatalf("HandleEvent: %v", err)
+				}
+			}
+
+			job, ok, err := queue.Dequeue(context.Background())
+			if err != nil {
+				t.Fatalf("Dequeue: %v", err)
+			}
+			if tt.want == nil {
+				if ok {
+					t.Errorf("queued %s, want nothing", job.Payload)
+				}
+				return
+			}
+			if !ok || job.Type != RestockJob {
+				t.Fatalf("queued %v %q, want a %s job", ok, job.Type, RestockJob)
+			}
+
+			var got Restock
+			if err := json.Unmarshal(job.Payload, &got); err != nil {
+				t.Fatalf("decode payload: %v", err)
+			}
+			if gotJSON, _ := json.Marshal(got); string(gotJSON) != mustJSON(t, tt.want) {
+				t.Errorf("restock = %s, want %s", gotJSON, mustJSON(t, tt.want))
+			}
+
+			if _, ok, _ := queue.Dequeue(context.Background()); ok {
+				t.Error("restock was queued twice")
+			}
+		})
+	}
+}
+
+func TestRestock(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		wantErr bool
+	}{
+		{"accepted", http.StatusAccepted, false},
+		{"rejected", http.StatusConflict, true},
+		{"failed", http.StatusServiceUnavailable, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var key, body string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				key = r.Header.Get("Idempotency-Key")
+				data, _ := io.ReadAll(r.Body)
+				body = string(data)
+				w.WriteHeader(tt.status)
+			}))
+			defer srv.Close()
+
+			hook := &Hook{Client: srv.Client(), URL: srv.URL}
+			restock := Restock{ReturnID: 9, OrderID: 4, Items: []Item{{7, 2}}}
+			job := worker.Job{Type: RestockJob, Payload: json.RawMessage(mustJSON(t, restock))}
+
+			err := hook.Restock(context.Background(), job)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Restock error = %v, want error %v", err, tt.wantErr)
+			}
+			if key != "return-9" {
+				t.Errorf("Idempotency-Key = %q, want %q", key, "return-9")
+			}
+			if body != mustJSON(t, restock) {
+				t.Errorf("body = %s, want %s", body, mustJSON(t, restock))
+			}
+		})
+	}
+}
+
+func mustJSON(t *testing.T, v any) string {
+	t.Helper()
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	return string(data)
+}
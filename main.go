@@ -2,22 +2,42 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"log/slog"
 	"os"
 	"os/signal"
+	"syscall"
 
 	"github.com/umuttopalak/orders-api/application"
+	"github.com/umuttopalak/orders-api/logging"
 )
 
 func main() {
-	app := application.New(application.LoadConfig())
+	config, err := application.LoadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	logger := logging.New(os.Stdout, config.LogLevel)
+	slog.SetDefault(logger)
+
+	app, err := application.New(config, logger)
+	if err != nil {
+		logger.Error("failed to create app", slog.Any("error", err))
+		os.Exit(1)
+	}
 
-	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
-	err := app.Start(ctx)
+	err = app.Start(ctx)
 
 	if err != nil {
-		fmt.Println("failed to start server:", err)
+		logger.Error("failed to start server", slog.Any("error", err))
 	}
 }
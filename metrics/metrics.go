@@ -0,0 +1,91 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "orders_api"
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "Number of HTTP requests by route, method and status code.",
+	}, []string{"method", "route", "status"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "HTTP request latency by route and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	redisDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "redis",
+		Name:      "command_duration_seconds",
+		Help:      "Redis command latency by command name.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"command"})
+
+	redisErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "redis",
+		Name:      "command_errors_total",
+		Help:      "Number of failed Redis commands by command name.",
+	}, []string{"command"})
+
+	OrdersCreated = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "orders_created_total",
+		Help:      "Number of orders created.",
+	})
+
+	OrdersShipped = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "orders_shipped_total",
+		Help:      "Number of orders marked as shipped.",
+	})
+
+	OrdersCompleted = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "orders_completed_total",
+		Help:      "Number of orders marked as completed.",
+	})
+
+	Payments = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "payments_total",
+		Help:      "Number of payment operations by operation (pay or refund) and result.",
+	}, []string{"operation", "result"})
+
+	PromotionRedemptions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "promotion_redemptions_total",
+		Help:      "Number of discount code redemptions by result: redeemed, exhausted or released.",
+	}, []string{"result"})
+
+	WebhookDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "webhook",
+		Name:      "deliveries_total",
+		Help:      "Number of webhook delivery attempts by result: success, retry or dead_letter.",
+	}, []string{"result"})
+
+	WorkerJobs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "worker",
+		Name:      "jobs_total",
+		Help:      "Number of background jobs run by type and result: success, retry, dead or released.",
+	}, []string{"type", "result"})
+)
+
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
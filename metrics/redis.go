@@ -0,0 +1,57 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisHook times every command issued through the client it is added to.
+// A redis.Nil reply is a cache miss rather than a failure and is not
+// counted as an error.
+type RedisHook struct{}
+
+func (RedisHook) DialHook(next redis.DialHook) redis.DialHook {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := next(ctx, network, addr)
+		if err != nil {
+			redisErrors.WithLabelValues("dial").Inc()
+		}
+		return conn, err
+	}
+}
+
+func (RedisHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmd)
+		observe(cmd.Name(), time.Since(start), err)
+		return err
+	}
+}
+
+func (RedisHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmds)
+		elapsed := time.Since(start)
+
+		observe("pipeline", elapsed, err)
+		for _, cmd := range cmds {
+			if cmdErr := cmd.Err(); cmdErr != nil && !errors.Is(cmdErr, redis.Nil) {
+				redisErrors.WithLabelValues(cmd.Name()).Inc()
+			}
+		}
+		return err
+	}
+}
+
+func observe(command string, elapsed time.Duration, err error) {
+	redisDuration.WithLabelValues(command).Observe(elapsed.Seconds())
+	if err != nil && !errors.Is(err, redis.Nil) {
+		redisErrors.WithLabelValues(command).Inc()
+	}
+}
@@ -0,0 +1,23 @@
+package model
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type Cart struct {
+	CartID     uuid.UUID  `json:"cart_id"`
+	CustomerID uuid.UUID  `json:"customer_id"`
+	Items      []CartItem `json:"items"`
+	CreatedAt  *time.Time `json:"created_at"`
+	UpdatedAt  *time.Time `json:"updated_at"`
+	Version    uint64     `json:"version"`
+}
+
+// CartItem holds no price. Carts are priced from the current products
+// whenever they are viewed and on checkout.
+type CartItem struct {
+	ProductID uint64 `json:"product_id"`
+	Quantity  uint   `json:"quantity"`
+}
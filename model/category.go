@@ -1,6 +1,10 @@
 package model
 
+import "time"
+
 type Category struct {
-	CategoryID   uint64 `json:"category_id"`
-	CategoryName string `json:"category_name"`
+	CategoryID   uint64     `json:"category_id"`
+	CategoryName string     `json:"category_name"`
+	Version      uint64     `json:"version"`
+	UpdatedAt    *time.Time `json:"updated_at"`
 }
@@ -10,4 +10,5 @@ type Customer struct {
 	Surname    string       `json:"surname"`
 	Email      mail.Address `json:"email"`
 	Is_deleted bool         `json:"is_deleted"`
+	Version    uint64       `json:"version"`
 }
@@ -10,13 +10,68 @@ type Order struct {
 	OrderID     uint64     `json:"order_id"`
 	CustomerID  uuid.UUID  `json:"customer_id"`
 	LineItems   []LineItem `json:"line_items"`
+	Discounts   []Discount `json:"discounts,omitempty"`
 	CreatedAt   *time.Time `json:"created_at"`
 	ShippedAt   *time.Time `json:"shipped_at"`
 	CompletedAt *time.Time `json:"completed_at"`
+	// PaymentStatus is the status of the order's latest payment, empty
+	// until one has been attempted.
+	PaymentStatus string     `json:"payment_status,omitempty"`
+	PaidAt        *time.Time `json:"paid_at"`
+	// ShippingRegion selects the tax rates of the order. Orders without
+	// one are not taxed.
+	ShippingRegion string `json:"shipping_region,omitempty"`
+	// TaxInclusive reports whether the line item prices include their tax.
+	TaxInclusive bool   `json:"tax_inclusive,omitempty"`
+	Version      uint64 `json:"version"`
+}
+
+// Subtotal is the order's line item total before discounts.
+func (o Order) Subtotal() uint64 {
+	var total uint64
+	for _, item := range o.LineItems {
+		total += uint64(item.Quantity) * uint64(item.Price)
+	}
+	return total
+}
+
+// Discount is the amount taken off the subtotal by the order's discounts.
+func (o Order) Discount() uint64 {
+	var discount uint64
+	for _, d := range o.Discounts {
+		discount += d.Amount
+	}
+	return min(discount, o.Subtotal())
+}
+
+// Tax is the tax of the order's line items.
+func (o Order) Tax() uint64 {
+	var tax uint64
+	for _, item := range o.LineItems {
+		tax += item.Tax
+	}
+	return tax
+}
+
+// Total is the amount due for the order: its subtotal less discounts, plus
+// tax unless the prices already include it.
+func (o Order) Total() uint64 {
+	total := o.Subtotal() - o.Discount()
+	if !o.TaxInclusive {
+		total += o.Tax()
+	}
+	return total
 }
 
 type LineItem struct {
-	ItemID   uuid.UUID `json:"item_id"`
-	Quantity uint      `json:"quantity"`
-	Price    uint      `json:"price"`
+	ItemID uuid.UUID `json:"item_id"`
+	// ProductID is the product ordered. Orders created before products were
+	// required may have line items without one.
+	ProductID uint64 `json:"product_id,omitempty"`
+	Quantity  uint   `json:"quantity"`
+	Price     uint   `json:"price"`
+	// TaxRate is in basis points, hundredths of a percent. Tax is the
+	// line's tax on its amount after discounts.
+	TaxRate uint32 `json:"tax_rate,omitempty"`
+	Tax     uint64 `json:"tax,omitempty"`
 }
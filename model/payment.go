@@ -0,0 +1,38 @@
+package model
+
+import "time"
+
+// Statuses of a payment, also mirrored on Order.PaymentStatus. A payment
+// is pending while the provider is being asked; orders are never pending.
+const (
+	PaymentPending           = "pending"
+	PaymentPaid              = "paid"
+	PaymentFailed            = "failed"
+	PaymentPartiallyRefunded = "partially_refunded"
+	PaymentRefunded          = "refunded"
+)
+
+type Payment struct {
+	PaymentID string `json:"payment_id"`
+	OrderID   uint64 `json:"order_id"`
+	Provider  string `json:"provider"`
+	Reference string `json:"reference,omitempty"`
+	Amount    uint64 `json:"amount"`
+	Refunded  uint64 `json:"refunded"`
+	// Refunds lists the refunds summed up in Refunded.
+	Refunds       []Refund   `json:"refunds,omitempty"`
+	Currency      string     `json:"currency"`
+	Status        string     `json:"status"`
+	FailureReason string     `json:"failure_reason,omitempty"`
+	CreatedAt     *time.Time `json:"created_at"`
+	UpdatedAt     *time.Time `json:"updated_at"`
+	Version       uint64     `json:"version"`
+}
+
+// Refund is money returned of a payment. Key is the idempotency key sent
+// to the provider, so a retried refund is recognised and not counted twice.
+type Refund struct {
+	Key       string     `json:"key"`
+	Amount    uint64     `json:"amount"`
+	CreatedAt *time.Time `json:"created_at"`
+}
@@ -1,8 +1,12 @@
 package model
 
+import "time"
+
 type Product struct {
-	ProductID    uint64   `json:"product_id"`
-	ProductName  string   `json:"product_name"`
-	ProductPrice int64    `json:"product_price"`
-	Category     Category `json:"category"`
+	ProductID    uint64     `json:"product_id"`
+	ProductName  string     `json:"product_name"`
+	ProductPrice int64      `json:"product_price"`
+	Category     Category   `json:"category"`
+	Version      uint64     `json:"version"`
+	UpdatedAt    *time.Time `json:"updated_at"`
 }
@@ -0,0 +1,44 @@
+package model
+
+import "time"
+
+// Promotion types.
+const (
+	// PromotionPercentage takes Value percent off the eligible line items.
+	PromotionPercentage = "percentage"
+	// PromotionFixedAmount takes Value off the eligible line items, at most
+	// their total.
+	PromotionFixedAmount = "fixed_amount"
+	// PromotionFreeShipping waives the order's shipping. Orders carry no
+	// shipping charge yet, so the discount is recorded with amount 0.
+	PromotionFreeShipping = "free_shipping"
+)
+
+// Promotion is a discount code. Codes are stored upper case and compared
+// case-insensitively.
+type Promotion struct {
+	Code  string `json:"code"`
+	Type  string `json:"type"`
+	Value uint64 `json:"value"`
+	// CategoryID restricts the discount to line items whose product is in
+	// the category. 0 applies it to the whole order.
+	CategoryID    uint64 `json:"category_id,omitempty"`
+	MinOrderValue uint64 `json:"min_order_value,omitempty"`
+	// UsageLimit and PerCustomerLimit cap redemptions, 0 means unlimited.
+	UsageLimit       uint64     `json:"usage_limit,omitempty"`
+	PerCustomerLimit uint64     `json:"per_customer_limit,omitempty"`
+	StartsAt         *time.Time `json:"starts_at"`
+	EndsAt           *time.Time `json:"ends_at"`
+	Active           bool       `json:"active"`
+	// Redemptions is kept in its own counter and filled in on reads.
+	Redemptions uint64     `json:"redemptions"`
+	CreatedAt   *time.Time `json:"created_at"`
+	Version     uint64     `json:"version"`
+}
+
+// Discount is a promotion applied to an order.
+type Discount struct {
+	Code   string `json:"code"`
+	Type   string `json:"type"`
+	Amount uint64 `json:"amount"`
+}
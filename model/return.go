@@ -0,0 +1,44 @@
+package model
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Statuses of a return. A requested return is approved or rejected; an
+// approved one is received and then refunded. A return is refunding while
+// its refund is being issued.
+const (
+	ReturnRequested = "requested"
+	ReturnApproved  = "approved"
+	ReturnRejected  = "rejected"
+	ReturnReceived  = "received"
+	ReturnRefunding = "refunding"
+	ReturnRefunded  = "refunded"
+)
+
+// Return is a customer sending back shipped line items of an order.
+type Return struct {
+	ReturnID uint64       `json:"return_id"`
+	OrderID  uint64       `json:"order_id"`
+	Status   string       `json:"status"`
+	Reason   string       `json:"reason,omitempty"`
+	Items    []ReturnItem `json:"items"`
+	// Restock reports whether the received goods go back into inventory.
+	Restock      bool       `json:"restock"`
+	RefundAmount uint64     `json:"refund_amount"`
+	PaymentID    string     `json:"payment_id,omitempty"`
+	CreatedAt    *time.Time `json:"created_at"`
+	UpdatedAt    *time.Time `json:"updated_at"`
+	ReceivedAt   *time.Time `json:"received_at"`
+	RefundedAt   *time.Time `json:"refunded_at"`
+	Version      uint64     `json:"version"`
+}
+
+type ReturnItem struct {
+	ItemID uuid.UUID `json:"item_id"`
+	// ProductID is copied from the order's line item, for restocking.
+	ProductID uint64 `json:"product_id,omitempty"`
+	Quantity  uint   `json:"quantity"`
+}
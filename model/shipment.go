@@ -0,0 +1,23 @@
+package model
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Shipment is a parcel sent for an order, holding some or all of the
+// quantity of its line items.
+type Shipment struct {
+	ShipmentID     string         `json:"shipment_id"`
+	OrderID        uint64         `json:"order_id"`
+	Carrier        string         `json:"carrier"`
+	TrackingNumber string         `json:"tracking_number"`
+	Items          []ShipmentItem `json:"items"`
+	CreatedAt      *time.Time     `json:"created_at"`
+}
+
+type ShipmentItem struct {
+	ItemID   uuid.UUID `json:"item_id"`
+	Quantity uint      `json:"quantity"`
+}
@@ -0,0 +1,38 @@
+package model
+
+import (
+	"encoding/json"
+	"time"
+)
+
+type Webhook struct {
+	WebhookID uint64     `json:"webhook_id"`
+	URL       string     `json:"url"`
+	Events    []string   `json:"events"`
+	Secret    string     `json:"secret,omitempty"`
+	Active    bool       `json:"active"`
+	CreatedAt *time.Time `json:"created_at"`
+	Version   uint64     `json:"version"`
+}
+
+type WebhookDelivery struct {
+	DeliveryID string    `json:"delivery_id"`
+	WebhookID  uint64    `json:"webhook_id"`
+	EventID    string    `json:"event_id"`
+	EventType  string    `json:"event_type"`
+	Attempt    int       `json:"attempt"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Duration   float64   `json:"duration_ms"`
+	Success    bool      `json:"success"`
+	At         time.Time `json:"at"`
+}
+
+type WebhookDeadLetter struct {
+	DeliveryID string          `json:"delivery_id"`
+	WebhookID  uint64          `json:"webhook_id"`
+	Event      json.RawMessage `json:"event"`
+	Attempts   int             `json:"attempts"`
+	LastError  string          `json:"last_error"`
+	FailedAt   time.Time       `json:"failed_at"`
+}
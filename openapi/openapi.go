@@ -0,0 +1,82 @@
+package openapi
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+//go:embed openapi.json
+var spec []byte
+
+//go:embed docs.html
+var docs []byte
+
+func Spec(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(spec)
+}
+
+func Docs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write(docs)
+}
+
+// Verify walks the router and compares every registered method and path
+// with the operations in the document, so that a route cannot be added,
+// renamed or removed without updating the spec.
+func Verify(routes chi.Routes) error {
+	var doc struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(spec, &doc); err != nil {
+		return fmt.Errorf("failed to decode openapi spec: %w", err)
+	}
+
+	documented := make(map[string]bool)
+	for path, item := range doc.Paths {
+		for method := range item {
+			switch method {
+			case "get", "put", "post", "delete", "patch", "head", "options":
+				documented[strings.ToUpper(method)+" "+path] = true
+			}
+		}
+	}
+
+	registered := make(map[string]bool)
+	err := chi.Walk(routes, func(method, route string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+		if len(route) > 1 {
+			route = strings.TrimSuffix(route, "/")
+		}
+		registered[method+" "+route] = true
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to walk routes: %w", err)
+	}
+
+	var problems []string
+	for op := range registered {
+		if !documented[op] {
+			problems = append(problems, op+" is routed but missing from openapi.json")
+		}
+	}
+	for op := range documented {
+		if !registered[op] {
+			problems = append(problems, op+" is documented but not routed")
+		}
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return errors.New("openapi spec drift:\n  " + strings.Join(problems, "\n  "))
+	}
+
+	return nil
+}
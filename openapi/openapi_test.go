@@ -0,0 +1,31 @@
+package openapi
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestVerifyReportsDrift(t *testing.T) {
+	noop := func(http.ResponseWriter, *http.Request) {}
+
+	router := chi.NewRouter()
+	router.Get("/openapi.json", noop)
+	router.Get("/v1/undocumented", noop)
+
+	err := Verify(router)
+	if err == nil {
+		t.Fatal("Verify accepted a router that differs from the spec")
+	}
+
+	for _, want := range []string{
+		"GET /v1/undocumented is routed but missing from openapi.json",
+		"GET /v1/order/{id} is documented but not routed",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error does not mention %q:\n%s", want, err)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package payments
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// Test payment methods understood by Fake. Any other non-empty token is
+// approved.
+const (
+	FakeDeclined      = "tok_declined"
+	FakeCaptureFailed = "tok_capture_declined"
+)
+
+// Fake is an in-process Provider for tests and local development. It keeps
+// authorizations in memory, so they are lost on restart and not shared
+// between instances.
+type Fake struct {
+	mu         sync.Mutex
+	auths      map[string]*fakeAuth
+	keys       map[string]string
+	refundKeys map[string]bool
+}
+
+type fakeAuth struct {
+	method   string
+	amount   uint64
+	captured uint64
+	refunded uint64
+	voided   bool
+}
+
+func (f *Fake) Name() string {
+	return "fake"
+}
+
+func (f *Fake) Authorize(ctx context.Context, req AuthorizeRequest) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.auths == nil {
+		f.auths = make(map[string]*fakeAuth)
+		f.keys = make(map[string]string)
+	}
+
+	if ref, ok := f.keys[req.IdempotencyKey]; ok && req.IdempotencyKey != "" {
+		return ref, nil
+	}
+
+	switch {
+	case req.PaymentMethod == "":
+		return "", fmt.Errorf("%w: missing payment method", ErrDeclined)
+	case req.PaymentMethod == FakeDeclined:
+		return "", fmt.Errorf("%w: card declined", ErrDeclined)
+	case req.Amount == 0:
+		return "", fmt.Errorf("%w: amount must be positive", ErrDeclined)
+	}
+
+	ref := "fake_" + uuid.NewString()
+	f.auths[ref] = &fakeAuth{method: req.PaymentMethod, amount: req.Amount}
+	if req.IdempotencyKey != "" {
+		f.keys[req.IdempotencyKey] = ref
+	}
+
+	return ref, nil
+}
+
+func (f *Fake) Capture(ctx context.Context, reference string, amount uint64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	auth, err := f.find(reference)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case auth.captured > 0 && auth.captured == amount:
+		return nil
+	case auth.voided:
+		return fmt.Errorf("%w: authorization was voided", ErrDeclined)
+	case auth.method == FakeCaptureFailed:
+		return fmt.Errorf("%w: capture declined", ErrDeclined)
+	case auth.captured+amount > auth.amount:
+		return fmt.Errorf("%w: capture exceeds authorized amount", ErrDeclined)
+	}
+
+	auth.captured += amount
+	return nil
+}
+
+func (f *Fake) Refund(ctx context.Context, reference string, amount uint64, idempotencyKey string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	auth, err := f.find(reference)
+	if err != nil {
+		return err
+	}
+
+	if f.refundKeys[idempotencyKey] && idempotencyKey != "" {
+		return nil
+	}
+
+	if auth.refunded+amount > auth.captured {
+		return fmt.Errorf("%w: refund exceeds captured amount", ErrDeclined)
+	}
+
+	auth.refunded += amount
+	if idempotencyKey != "" {
+		if f.refundKeys == nil {
+			f.refundKeys = make(map[string]bool)
+		}
+		f.refundKeys[idempotencyKey] = true
+	}
+	return nil
+}
+
+func (f *Fake) Void(ctx context.Context, reference string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	auth, err := f.find(reference)
+	if err != nil {
+		return err
+	}
+
+	if auth.captured > 0 {
+		return fmt.Errorf("%w: authorization was captured", ErrDeclined)
+	}
+
+	auth.voided = true
+	return nil
+}
+
+func (f *Fake) find(reference string) (*fakeAuth, error) {
+	auth, ok := f.auths[reference]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown reference %q", ErrDeclined, reference)
+	}
+	return auth, nil
+}
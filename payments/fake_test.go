@@ -0,0 +1,173 @@
+package payments
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestFakeAuthorize(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		amount   uint64
+		declined bool
+	}{
+		{"approved", "tok_visa", 1000, false},
+		{"capture declined later", FakeCaptureFailed, 1000, false},
+		{"declined", FakeDeclined, 1000, true},
+		{"missing method", "", 1000, true},
+		{"zero amount", "tok_visa", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var f Fake
+			ref, err := f.Authorize(context.Background(), AuthorizeRequest{Amount: tt.amount, PaymentMethod: tt.method})
+			if tt.declined {
+				if !errors.Is(err, ErrDeclined) {
+					t.Errorf("Authorize error = %v, want %v", err, ErrDeclined)
+				}
+				return
+			}
+			if err != nil || ref == "" {
+				t.Errorf("Authorize = %q, %v, want a reference", ref, err)
+			}
+		})
+	}
+}
+
+func TestFakeAuthorizeIdempotent(t *testing.T) {
+	var f Fake
+	ctx := context.Background()
+	req := AuthorizeRequest{Amount: 1000, PaymentMethod: "tok_visa", IdempotencyKey: "payment-1"}
+
+	first, err := f.Authorize(ctx, req)
+	if err != nil {
+		t.Fatalf("Authorize: %v", err)
+	}
+	second, err := f.Authorize(ctx, req)
+	if err != nil {
+		t.Fatalf("Authorize again: %v", err)
+	}
+	if first != second {
+		t.Errorf("retried Authorize = %q, want %q", second, first)
+	}
+
+	req.IdempotencyKey = "payment-2"
+	if other, _ := f.Authorize(ctx, req); other == first {
+		t.Errorf("Authorize with another key reused reference %q", first)
+	}
+}
+
+func TestFakeCapture(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		captures []uint64
+		void     bool
+		declined bool
+	}{
+		{"full", "tok_visa", []uint64{1000}, false, false},
+		{"repeated", "tok_visa", []uint64{1000, 1000}, false, false},
+		{"partial then rest", "tok_visa", []uint64{400, 600}, false, false},
+		{"above authorized", "tok_visa", []uint64{1001}, false, true},
+		{"partials above authorized", "tok_visa", []uint64{600, 500}, false, true},
+		{"declined", FakeCaptureFailed, []uint64{1000}, false, true},
+		{"voided", "tok_visa", []uint64{1000}, true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var f Fake
+			ctx := context.Background()
+			ref, err := f.Authorize(ctx, AuthorizeRequest{Amount: 1000, PaymentMethod: tt.method})
+			if err != nil {
+				t.Fatalf("Authorize: %v", err)
+			}
+			if tt.void {
+				if err := f.Void(ctx, ref); err != nil {
+					t.Fatalf("Void: %v", err)
+				}
+			}
+
+			for _, amount := range tt.captures {
+				err = f.Capture(ctx, ref, amount)
+				if err != nil {
+					break
+				}
+			}
+
+			if tt.declined && !errors.Is(err, ErrDeclined) {
+				t.Errorf("Capture error = %v, want %v", err, ErrDeclined)
+			}
+			if !tt.declined && err != nil {
+				t.Errorf("Capture: %v", err)
+			}
+		})
+	}
+}
+
+func TestFakeRefund(t *testing.T) {
+	type refund struct {
+		amount uint64
+		key    string
+	}
+
+	tests := []struct {
+		name     string
+		refunds  []refund
+		declined bool
+	}{
+		{"full", []refund{{1000, "a"}}, false},
+		{"partials", []refund{{400, "a"}, {600, "b"}}, false},
+		{"retried key", []refund{{1000, "a"}, {1000, "a"}}, false},
+		{"above captured", []refund{{1001, "a"}}, true},
+		{"partials above captured", []refund{{600, "a"}, {600, "b"}}, true},
+		{"twice without key", []refund{{1000, ""}, {1000, ""}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var f Fake
+			ctx := context.Background()
+			ref, err := f.Authorize(ctx, AuthorizeRequest{Amount: 1000, PaymentMethod: "tok_visa"})
+			if err != nil {
+				t.Fatalf("Authorize: %v", err)
+			}
+			if err := f.Capture(ctx, ref, 1000); err != nil {
+				t.Fatalf("Capture: %v", err)
+			}
+
+			for _, r := range tt.refunds {
+				err = f.Refund(ctx, ref, r.amount, r.key)
+				if err != nil {
+					break
+				}
+			}
+
+			if tt.declined && !errors.Is(err, ErrDeclined) {
+				t.Errorf("Refund error = %v, want %v", err, ErrDeclined)
+			}
+			if !tt.declined && err != nil {
+				t.Errorf("Refund: %v", err)
+			}
+		})
+	}
+}
+
+func TestFakeRefundUncaptured(t *testing.T) {
+	var f Fake
+	ctx := context.Background()
+	ref, err := f.Authorize(ctx, AuthorizeRequest{Amount: 1000, PaymentMethod: "tok_visa"})
+	if err != nil {
+		t.Fatalf("Authorize: %v", err)
+	}
+
+	if err := f.Refund(ctx, ref, 1, "a"); !errors.Is(err, ErrDeclined) {
+		t.Errorf("Refund error = %v, want %v", err, ErrDeclined)
+	}
+	if err := f.Refund(ctx, "fake_unknown", 1, "b"); !errors.Is(err, ErrDeclined) {
+		t.Errorf("Refund of unknown reference error = %v, want %v", err, ErrDeclined)
+	}
+}
@@ -0,0 +1,46 @@
+// Package payments talks to payment service providers. Handlers depend on
+// the Provider interface only, so a real gateway can replace Fake without
+// touching the order flow.
+package payments
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrDeclined is wrapped by provider errors that reject the request itself,
+// such as a declined card or a refund above the captured amount. Any other
+// error means the provider could not be reached or failed, and the request
+// may be retried.
+var ErrDeclined = errors.New("payment declined")
+
+// Provider moves money for orders. Amounts are in the minor unit of the
+// currency, like line item prices.
+type Provider interface {
+	// Name identifies the provider on payment records.
+	Name() string
+
+	// Authorize reserves req.Amount on the payment method and returns the
+	// provider's reference for the authorization. Retrying with the same
+	// IdempotencyKey returns the same reference.
+	Authorize(ctx context.Context, req AuthorizeRequest) (string, error)
+	// Capture collects amount, at most the authorized amount. Capturing an
+	// authorization again for the amount already captured succeeds without
+	// collecting twice.
+	Capture(ctx context.Context, reference string, amount uint64) error
+	// Refund returns amount of a captured payment, at most what has been
+	// captured and not yet refunded. Retrying with the same idempotencyKey
+	// does not refund again.
+	Refund(ctx context.Context, reference string, amount uint64, idempotencyKey string) error
+	// Void releases an authorization that has not been captured.
+	Void(ctx context.Context, reference string) error
+}
+
+type AuthorizeRequest struct {
+	OrderID  uint64
+	Amount   uint64
+	Currency string
+	// PaymentMethod is the provider token of the card or account to charge.
+	PaymentMethod  string
+	IdempotencyKey string
+}
@@ -0,0 +1,75 @@
+package ratelimit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/umuttopalak/orders-api/logging"
+)
+
+const APIKeyHeader = "X-API-Key"
+
+// Middleware limits requests to the route group per client. Clients are
+// identified by their API key when they send a known one and by IP
+// otherwise. If Redis cannot be reached the request is let through rather
+// than failing the API along with the limiter.
+func (l *Limiter) Middleware(group string, limit Limit) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if !limit.Enabled() {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := "ratelimit:" + group + ":" + l.clientKey(r)
+
+			res, err := l.Allow(r.Context(), key, limit)
+			if err != nil {
+				logging.FromContext(r.Context()).Warn("rate limiter unavailable", slog.Any("error", err))
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Set("RateLimit-Limit", strconv.Itoa(limit.Burst))
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+			w.Header().Set("RateLimit-Reset", strconv.Itoa(seconds(res.Reset)))
+
+			if !res.Allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(seconds(res.RetryAfter)))
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusTooManyRequests)
+
+				_ = json.NewEncoder(w).Encode(struct {
+					Error string `json:"error"`
+				}{"rate limit exceeded"})
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func (l *Limiter) clientKey(r *http.Request) string {
+	if apiKey := r.Header.Get(APIKeyHeader); l.APIKeys[apiKey] {
+		sum := sha256.Sum256([]byte(apiKey))
+		return "key:" + hex.EncodeToString(sum[:8])
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	return "ip:" + host
+}
+
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
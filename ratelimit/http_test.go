@@ -0,0 +1,39 @@
+package ratelimit
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestClientKey(t *testing.T) {
+	l := &Limiter{APIKeys: map[string]bool{"known": true}}
+
+	tests := []struct {
+		name   string
+		apiKey string
+		prefix string
+	}{
+		{"no key", "", "ip:"},
+		{"known key", "known", "key:"},
+		{"unknown key", "made-up", "ip:"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/v1/order", nil)
+			r.RemoteAddr = "192.0.2.1:1234"
+			if tt.apiKey != "" {
+				r.Header.Set(APIKeyHeader, tt.apiKey)
+			}
+
+			got := l.clientKey(r)
+			if !strings.HasPrefix(got, tt.prefix) {
+				t.Errorf("clientKey = %q, want prefix %q", got, tt.prefix)
+			}
+			if tt.prefix == "ip:" && got != "ip:192.0.2.1" {
+				t.Errorf("clientKey = %q, want ip:192.0.2.1", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Limit is a token bucket refilled at Rate tokens per second holding at
+// most Burst tokens. The zero Limit disables limiting.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+func (l Limit) Enabled() bool {
+	return l.Rate > 0 && l.Burst > 0
+}
+
+// ParseLimit reads limits written as "<requests>/<period>", for example
+// "100/1m". The bucket holds one period's worth of requests. An empty
+// string or "0" yields the zero Limit.
+func ParseLimit(s string) (Limit, error) {
+	if s == "" || s == "0" {
+		return Limit{}, nil
+	}
+
+	count, period, ok := strings.Cut(s, "/")
+	if !ok {
+		return Limit{}, fmt.Errorf("invalid rate limit %q, expected <requests>/<period>", s)
+	}
+
+	n, err := strconv.Atoi(count)
+	if err != nil || n <= 0 {
+		return Limit{}, fmt.Errorf("invalid request count in rate limit %q", s)
+	}
+
+	d, err := time.ParseDuration(period)
+	if err != nil || d <= 0 {
+		return Limit{}, fmt.Errorf("invalid period in rate limit %q", s)
+	}
+
+	return Limit{
+		Rate:  float64(n) / d.Seconds(),
+		Burst: n,
+	}, nil
+}
+
+type Result struct {
+	Allowed    bool
+	Remaining  int
+	RetryAfter time.Duration
+	// Reset is how long until the bucket is full again.
+	Reset time.Duration
+}
+
+// The bucket state lives in a hash so that the refill and the take happen
+// in one atomic step, shared by every replica talking to the same Redis.
+// Redis TIME is used as the clock to avoid skew between replicas.
+var tokenBucket = redis.NewScript(`
+local key = KEYS[1]
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+
+local state = redis.call('HMGET', key, 'tokens', 'ts')
+local tokens = tonumber(state[1])
+local ts = tonumber(state[2])
+if tokens == nil or ts == nil then
+	tokens = burst
+	ts = now
+end
+
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate / 1000000)
+
+local allowed = 0
+local retry_after = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	retry_after = math.ceil((1 - tokens) * 1000000 / rate)
+end
+
+redis.call('HSET', key, 'tokens', tostring(tokens), 'ts', tostring(now))
+redis.call('PEXPIRE', key, math.ceil(burst / rate * 1000) + 1000)
+
+local reset = math.ceil((burst - tokens) * 1000000 / rate)
+return {allowed, math.floor(tokens), retry_after, reset}
+`)
+
+type Limiter struct {
+	Client *redis.Client
+	// APIKeys are the API keys clients are limited by. Requests with any
+	// other key are limited by IP, so made-up keys cannot open new buckets.
+	APIKeys map[string]bool
+}
+
+func (l *Limiter) Allow(ctx context.Context, key string, limit Limit) (Result, error) {
+	res, err := tokenBucket.Run(ctx, l.Client, []string{key}, limit.Rate, limit.Burst).Int64Slice()
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to run token bucket: %w", err)
+	}
+
+	if len(res) != 4 {
+		return Result{}, fmt.Errorf("unexpected token bucket reply: %v", res)
+	}
+
+	return Result{
+		Allowed:    res[0] == 1,
+		Remaining:  int(res[1]),
+		RetryAfter: time.Duration(res[2]) * time.Microsecond,
+		Reset:      time.Duration(res[3]) * time.Microsecond,
+	}, nil
+}
@@ -0,0 +1,245 @@
+package batch
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/umuttopalak/orders-api/events"
+)
+
+var (
+	ErrExists          = errors.New("already exists")
+	ErrNotExist        = errors.New("does not exist")
+	ErrVersionMismatch = errors.New("version mismatch")
+	ErrDuplicate       = errors.New("key appears more than once in the batch")
+	ErrAborted         = errors.New("not applied because another item in the batch failed")
+	ErrContention      = errors.New("batch kept conflicting with concurrent writes")
+)
+
+type Op int
+
+const (
+	Create Op = iota
+	Update
+	Delete
+)
+
+type Write struct {
+	Op   Op
+	Key  string
+	Data string
+	// Version is the version the stored entity must be at for an update or
+	// delete. Deletes skip the check when it is zero; updates fill it in
+	// with FillVersions first.
+	Version uint64
+	// Events, if set, returns the domain events of the write given the
+	// stored value it replaces, empty for a create. They are appended in the
+	// same transaction as the write.
+	Events func(previous string) ([]events.Event, error)
+}
+
+type Target struct {
+	ID      uint64
+	Version uint64
+}
+
+const maxAttempts = 3
+
+// FillVersions sets every zero version to the version stored under the
+// key at the same index. Updates without a version then replace whatever
+// is stored, as a PUT without If-Match does, and still fail with
+// ErrVersionMismatch if the entity changes before the batch commits.
+// Versions of missing keys stay zero and their updates fail with
+// ErrNotExist.
+func FillVersions(ctx context.Context, client *redis.Client, keys []string, versions []uint64) error {
+	var missing []string
+	var indexes []int
+	for i, v := range versions {
+		if v == 0 {
+			missing = append(missing, keys[i])
+			indexes = append(indexes, i)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	values, err := client.MGet(ctx, missing...).Result()
+	if err != nil {
+		return fmt.Errorf("failed to get batch versions: %w", err)
+	}
+
+	for j, value := range values {
+		if value == nil {
+			continue
+		}
+
+		var stored struct {
+			Version uint64 `json:"version"`
+		}
+		if err := json.Unmarshal([]byte(value.(string)), &stored); err != nil {
+			return fmt.Errorf("failed to decode %s: %w", missing[j], err)
+		}
+		versions[indexes[j]] = stored.Version
+	}
+
+	return nil
+}
+
+// Apply checks every write against the stored entities and commits the
+// ones that pass in a single MULTI/EXEC, keeping index in step. The keys
+// are WATCHed, so a concurrent write between the check and the commit
+// makes the whole batch start over. It returns one error per write, nil
+// for the writes that were applied. In atomic mode a single failure
+// prevents every write and the others report ErrAborted.
+func Apply(ctx context.Context, client *redis.Client, index string, writes []Write, atomic bool) ([]error, error) {
+	keys := make([]string, len(writes))
+	for i, w := range writes {
+		keys[i] = w.Key
+	}
+
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		var errs []error
+
+		err := client.Watch(ctx, func(tx *redis.Tx) error {
+			var previous []string
+			var err error
+			errs, previous, err = check(ctx, tx, writes)
+			if err != nil {
+				return err
+			}
+
+			if atomic && failed(errs) {
+				for i := range errs {
+					if errs[i] == nil {
+						errs[i] = ErrAborted
+					}
+				}
+				return nil
+			}
+
+			evs := make([][]events.Event, len(writes))
+			for i, w := range writes {
+				if errs[i] != nil || w.Events == nil {
+					continue
+				}
+				if evs[i], err = w.Events(previous[i]); err != nil {
+					return err
+				}
+			}
+
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				score := float64(time.Now().UnixMilli())
+				for i, w := range writes {
+					if errs[i] != nil {
+						continue
+					}
+
+					for _, e := range evs[i] {
+						events.Append(ctx, pipe, e)
+					}
+
+					switch w.Op {
+					case Create:
+						pipe.Set(ctx, w.Key, w.Data, 0)
+						pipe.ZAdd(ctx, index, redis.Z{Score: score, Member: w.Key})
+					case Update:
+						pipe.Set(ctx, w.Key, w.Data, 0)
+					case Delete:
+						pipe.Del(ctx, w.Key)
+						pipe.ZRem(ctx, index, w.Key)
+					}
+				}
+				return nil
+			})
+			return err
+		}, keys...)
+		if errors.Is(err, redis.TxFailedErr) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		return errs, nil
+	}
+
+	return nil, ErrContention
+}
+
+// check returns the error of every write that cannot be applied, and the
+// values stored under the keys.
+func check(ctx context.Context, tx *redis.Tx, writes []Write) ([]error, []string, error) {
+	cmds := make([]*redis.StringCmd, len(writes))
+	_, err := tx.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, w := range writes {
+			cmds[i] = pipe.Get(ctx, w.Key)
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, nil, fmt.Errorf("failed to get batch keys: %w", err)
+	}
+
+	errs := make([]error, len(writes))
+	values := make([]string, len(writes))
+	seen := make(map[string]bool, len(writes))
+
+	for i, w := range writes {
+		if seen[w.Key] {
+			errs[i] = ErrDuplicate
+			continue
+		}
+		seen[w.Key] = true
+
+		value, err := cmds[i].Result()
+		exists := true
+		if errors.Is(err, redis.Nil) {
+			exists = false
+		} else if err != nil {
+			return nil, nil, fmt.Errorf("failed to get %s: %w", w.Key, err)
+		}
+		values[i] = value
+
+		if w.Op == Create {
+			if exists {
+				errs[i] = ErrExists
+			}
+			continue
+		}
+
+		if !exists {
+			errs[i] = ErrNotExist
+			continue
+		}
+
+		if w.Op == Delete && w.Version == 0 {
+			continue
+		}
+
+		var stored struct {
+			Version uint64 `json:"version"`
+		}
+		if err := json.Unmarshal([]byte(value), &stored); err != nil {
+			return nil, nil, fmt.Errorf("failed to decode %s: %w", w.Key, err)
+		}
+
+		if stored.Version != w.Version {
+			errs[i] = ErrVersionMismatch
+		}
+	}
+
+	return errs, values, nil
+}
+
+func failed(errs []error) bool {
+	for _, err := range errs {
+		if err != nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,219 @@
+package batch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+const testIndex = "things"
+
+func newTestClient(t *testing.T) (*redis.Client, *miniredis.Miniredis) {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return client, mr
+}
+
+func thing(version uint64) string {
+	return fmt.Sprintf(`{"version":%d}`, version)
+}
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []Write
+		atomic bool
+		want   []error
+		// stored lists the value of every key after the batch, empty for
+		// missing keys.
+		stored map[string]string
+	}{
+		{
+			name: "all applied",
+			writes: []Write{
+				{Op: Create, Key: "thing:3", Data: thing(1)},
+				{Op: Update, Key: "thing:1", Data: thing(2), Version: 1},
+				{Op: Delete, Key: "thing:2", Version: 1},
+			},
+			atomic: true,
+			want:   []error{nil, nil, nil},
+			stored: map[string]string{"thing:1": thing(2), "thing:2": "", "thing:3": thing(1)},
+		},
+		{
+			name: "partial",
+			writes: []Write{
+				{Op: Create, Key: "thing:1", Data: thing(1)},
+				{Op: Update, Key: "thing:2", Data: thing(2), Version: 1},
+				{Op: Update, Key: "thing:4", Data: thing(6), Version: 5},
+				{Op: Update, Key: "thing:9", Data: thing(2), Version: 1},
+				{Op: Create, Key: "thing:3", Data: thing(1)},
+				{Op: Delete, Key: "thing:3"},
+			},
+			want:   []error{ErrExists, nil, ErrVersionMismatch, ErrNotExist, nil, ErrDuplicate},
+			stored: map[string]string{"thing:1": thing(1), "thing:2": thing(2), "thing:3": thing(1), "thing:4": thing(1), "thing:9": ""},
+		},
+		{
+			name: "all or nothing",
+			writes: []Write{
+				{Op: Create, Key: "thing:3", Data: thing(1)},
+				{Op: Update, Key: "thing:1", Data: thing(2), Version: 1},
+				{Op: Delete, Key: "thing:2", Version: 4},
+			},
+			atomic: true,
+			want:   []error{ErrAborted, ErrAborted, ErrVersionMismatch},
+			stored: map[string]string{"thing:1": thing(1), "thing:2": thing(1), "thing:3": ""},
+		},
+		{
+			name: "unversioned delete",
+			writes: []Write{
+				{Op: Delete, Key: "thing:1"},
+				{Op: Delete, Key: "thing:9"},
+			},
+			want:   []error{nil, ErrNotExist},
+			stored: map[string]string{"thing:1": "", "thing:2": thing(1)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, mr := newTestClient(t)
+			ctx := context.Background()
+			for _, key := range []string{"thing:1", "thing:2", "thing:4"} {
+				client.Set(ctx, key, thing(1), 0)
+				client.ZAdd(ctx, testIndex, redis.Z{Member: key})
+			}
+
+			errs, err := Apply(ctx, client, testIndex, tt.writes, tt.atomic)
+			if err != nil {
+				t.Fatalf("Apply: %v", err)
+			}
+			for i := range tt.want {
+				if !errors.Is(errs[i], tt.want[i]) {
+					t.Errorf("write %d: error = %v, want %v", i, errs[i], tt.want[i])
+				}
+			}
+
+			for key, want := range tt.stored {
+				got, _ := mr.Get(key)
+				if got != want {
+					t.Errorf("%s = %q, want %q", key, got, want)
+				}
+				if indexed := mr.Exists(key) && isMember(t, mr, key); indexed != (want != "") {
+					t.Errorf("%s indexed = %v, want %v", key, indexed, want != "")
+				}
+			}
+		})
+	}
+}
+
+func isMember(t *testing.T, mr *miniredis.Miniredis, key string) bool {
+	t.Helper()
+
+	members, err := mr.ZMembers(testIndex)
+	if err != nil {
+		t.Fatalf("index: %v", err)
+	}
+	for _, m := range members {
+		if m == key {
+			return true
+		}
+	}
+	return false
+}
+
+// interfere writes to key from another connection whenever the batch has
+// read its keys, so every attempt's transaction is discarded.
+type interfere struct {
+	other *redis.Client
+	key   string
+	times int
+}
+
+func (h *interfere) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (h *interfere) ProcessHook(next redis.ProcessHook) redis.ProcessHook { return next }
+
+func (h *interfere) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		err := next(ctx, cmds)
+		if h.times > 0 && len(cmds) > 0 && cmds[0].Name() == "get" {
+			h.times--
+			h.other.Set(ctx, h.key, thing(7), 0)
+		}
+		return err
+	}
+}
+
+func TestApplyContention(t *testing.T) {
+	tests := []struct {
+		name  string
+		times int
+		want  error
+	}{
+		{"retried", maxAttempts - 1, nil},
+		{"gave up", maxAttempts, ErrContention},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, mr := newTestClient(t)
+			client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+			other := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+			t.Cleanup(func() {
+				client.Close()
+				other.Close()
+			})
+			client.AddHook(&interfere{other: other, key: "thing:2", times: tt.times})
+
+			writes := []Write{
+				{Op: Create, Key: "thing:1", Data: thing(1)},
+				{Op: Delete, Key: "thing:2"},
+			}
+			mr.Set("thing:2", thing(1))
+
+			errs, err := Apply(context.Background(), client, testIndex, writes, true)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("Apply error = %v, want %v", err, tt.want)
+			}
+			if tt.want != nil {
+				if mr.Exists("thing:1") {
+					t.Error("thing:1 was created by a batch that gave up")
+				}
+				return
+			}
+			if errs[0] != nil || errs[1] != nil || !mr.Exists("thing:1") || mr.Exists("thing:2") {
+				t.Errorf("errs = %v, want the batch applied on the last attempt", errs)
+			}
+		})
+	}
+}
+
+func TestFillVersions(t *testing.T) {
+	client, mr := newTestClient(t)
+	mr.Set("thing:1", thing(4))
+	mr.Set("thing:2", thing(0))
+	mr.Set("thing:3", `{}`)
+
+	keys := []string{"thing:1", "thing:1", "thing:2", "thing:3", "thing:9"}
+	versions := []uint64{0, 2, 0, 0, 0}
+
+	if err := FillVersions(context.Background(), client, keys, versions); err != nil {
+		t.Fatalf("FillVersions: %v", err)
+	}
+	if want := []uint64{4, 2, 0, 0, 0}; fmt.Sprint(versions) != fmt.Sprint(want) {
+		t.Errorf("versions = %v, want %v", versions, want)
+	}
+
+	// Versioned writes do not touch Redis.
+	mr.Close()
+	if err := FillVersions(context.Background(), client, keys[1:2], versions[1:2]); err != nil {
+		t.Errorf("FillVersions without unversioned writes: %v", err)
+	}
+}
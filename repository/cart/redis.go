@@ -0,0 +1,167 @@
+package cart
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"github.com/umuttopalak/orders-api/logging"
+	"github.com/umuttopalak/orders-api/model"
+	"go.opentelemetry.io/otel"
+)
+
+var tracer = otel.Tracer("github.com/umuttopalak/orders-api/repository/cart")
+
+// RedisRepo stores carts with a sliding expiry: every read and write keeps
+// the cart for another TTL, so only abandoned carts expire.
+type RedisRepo struct {
+	Client *redis.Client
+	TTL    time.Duration
+}
+
+var ErrNotExist = errors.New("cart does not exist")
+
+var ErrVersionMismatch = errors.New("cart version mismatch")
+
+func CartIDKey(id uuid.UUID) string {
+	return fmt.Sprintf("cart:%s", id)
+}
+
+func (r *RedisRepo) Insert(ctx context.Context, cart model.Cart) error {
+	ctx, span := tracer.Start(ctx, "cart.RedisRepo.Insert")
+	defer span.End()
+
+	data, err := json.Marshal(cart)
+	if err != nil {
+		return fmt.Errorf("failed to encode cart: %w", err)
+	}
+
+	key := CartIDKey(cart.CartID)
+
+	if err := r.Client.SetNX(ctx, key, string(data), r.TTL).Err(); err != nil {
+		return fmt.Errorf("failed to set: %w", err)
+	}
+
+	logging.FromContext(ctx).Debug("cart inserted", slog.String("key", key))
+
+	return nil
+}
+
+// FindByID returns the cart and extends its expiry.
+func (r *RedisRepo) FindByID(ctx context.Context, id uuid.UUID) (model.Cart, error) {
+	ctx, span := tracer.Start(ctx, "cart.RedisRepo.FindByID")
+	defer span.End()
+
+	value, err := r.Client.GetEx(ctx, CartIDKey(id), r.TTL).Result()
+	if errors.Is(err, redis.Nil) {
+		return model.Cart{}, ErrNotExist
+	} else if err != nil {
+		return model.Cart{}, fmt.Errorf("get cart: %w", err)
+	}
+
+	var cart model.Cart
+	if err := json.Unmarshal([]byte(value), &cart); err != nil {
+		return model.Cart{}, fmt.Errorf("failed to decode cart json: %w", err)
+	}
+
+	return cart, nil
+}
+
+// Update stores cart if the stored cart is still at cart.Version and
+// returns it with the version incremented.
+func (r *RedisRepo) Update(ctx context.Context, cart model.Cart) (model.Cart, error) {
+	ctx, span := tracer.Start(ctx, "cart.RedisRepo.Update")
+	defer span.End()
+
+	expected := cart.Version
+	cart.Version++
+
+	data, err := json.Marshal(cart)
+	if err != nil {
+		return model.Cart{}, fmt.Errorf("failed to encode cart: %w", err)
+	}
+
+	key := CartIDKey(cart.CartID)
+
+	err = r.Client.Watch(ctx, func(tx *redis.Tx) error {
+		current, err := currentVersion(ctx, tx, key)
+		if err != nil {
+			return err
+		}
+
+		if current != expected {
+			return ErrVersionMismatch
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			return pipe.Set(ctx, key, string(data), r.TTL).Err()
+		})
+		return err
+	}, key)
+	if errors.Is(err, redis.TxFailedErr) {
+		return model.Cart{}, ErrVersionMismatch
+	} else if err != nil {
+		return model.Cart{}, err
+	}
+
+	logging.FromContext(ctx).Debug("cart updated", slog.String("key", key))
+
+	return cart, nil
+}
+
+// DeleteByID removes the cart. A non-zero version makes the delete
+// conditional on the stored cart still being at that version.
+func (r *RedisRepo) DeleteByID(ctx context.Context, id uuid.UUID, version uint64) error {
+	ctx, span := tracer.Start(ctx, "cart.RedisRepo.DeleteByID")
+	defer span.End()
+
+	key := CartIDKey(id)
+
+	err := r.Client.Watch(ctx, func(tx *redis.Tx) error {
+		current, err := currentVersion(ctx, tx, key)
+		if err != nil {
+			return err
+		}
+
+		if version != 0 && current != version {
+			return ErrVersionMismatch
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			return pipe.Del(ctx, key).Err()
+		})
+		return err
+	}, key)
+	if errors.Is(err, redis.TxFailedErr) {
+		return ErrVersionMismatch
+	} else if err != nil {
+		return err
+	}
+
+	logging.FromContext(ctx).Debug("cart deleted", slog.String("key", key))
+
+	return nil
+}
+
+func currentVersion(ctx context.Context, tx *redis.Tx, key string) (uint64, error) {
+	value, err := tx.Get(ctx, key).Result()
+	if errors.Is(err, redis.Nil) {
+		return 0, ErrNotExist
+	} else if err != nil {
+		return 0, fmt.Errorf("get cart: %w", err)
+	}
+
+	var stored struct {
+		Version uint64 `json:"version"`
+	}
+	if err := json.Unmarshal([]byte(value), &stored); err != nil {
+		return 0, fmt.Errorf("failed to decode cart json: %w", err)
+	}
+
+	return stored.Version, nil
+}
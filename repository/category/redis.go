@@ -5,32 +5,46 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log/slog"
+	"time"
 
 	"github.com/redis/go-redis/v9"
+	"github.com/umuttopalak/orders-api/logging"
 	"github.com/umuttopalak/orders-api/model"
+	"github.com/umuttopalak/orders-api/repository/batch"
+	"github.com/umuttopalak/orders-api/repository/pagination"
+	"go.opentelemetry.io/otel"
 )
 
+var tracer = otel.Tracer("github.com/umuttopalak/orders-api/repository/category")
+
+// categoriesIndex lists every category key scored by its creation time in
+// milliseconds.
+const categoriesIndex = "categories:by_created"
+
 type RedisRepo struct {
 	Client *redis.Client
 }
 
-type FindAllPage struct {
-	Size   uint64
-	Offset uint64
-}
-
 type FindResult struct {
 	Categories []model.Category
-	Cursor     uint64
+	Next       *pagination.Cursor
+	Prev       *pagination.Cursor
+	Total      int64
 }
 
 var ErrNotExist = errors.New("category does not exist")
 
+var ErrVersionMismatch = errors.New("category version mismatch")
+
 func CategoryIDKey(id uint64) string {
 	return fmt.Sprintf("category:%d", id)
 }
 
 func (r *RedisRepo) Insert(ctx context.Context, category model.Category) error {
+	ctx, span := tracer.Start(ctx, "category.RedisRepo.Insert")
+	defer span.End()
+
 	data, err := json.Marshal(category)
 	if err != nil {
 		return fmt.Errorf("failed to encode category: %w", err)
@@ -46,7 +60,8 @@ func (r *RedisRepo) Insert(ctx context.Context, category model.Category) error {
 		return fmt.Errorf("failed to set: %w", err)
 	}
 
-	if err := txn.SAdd(ctx, "categories", key).Err(); err != nil {
+	score := float64(time.Now().UnixMilli())
+	if err := txn.ZAdd(ctx, categoriesIndex, redis.Z{Score: score, Member: key}).Err(); err != nil {
 		txn.Discard()
 		return fmt.Errorf("failed to add category to categories: %w", err)
 	}
@@ -55,10 +70,15 @@ func (r *RedisRepo) Insert(ctx context.Context, category model.Category) error {
 		return fmt.Errorf("failed to exec: %w", err)
 	}
 
+	logging.FromContext(ctx).Debug("category inserted", slog.String("key", key))
+
 	return nil
 }
 
 func (r *RedisRepo) FindByID(ctx context.Context, id uint64) (model.Category, error) {
+	ctx, span := tracer.Start(ctx, "category.RedisRepo.FindByID")
+	defer span.End()
+
 	key := CategoryIDKey(id)
 
 	value, err := r.Client.Get(ctx, key).Result()
@@ -77,81 +97,243 @@ func (r *RedisRepo) FindByID(ctx context.Context, id uint64) (model.Category, er
 	return category, nil
 }
 
-func (r *RedisRepo) DeleteByID(ctx context.Context, id uint64) error {
+// DeleteByID removes the category. A non-zero version makes the delete
+// conditional on the stored category still being at that version.
+func (r *RedisRepo) DeleteByID(ctx context.Context, id uint64, version uint64) error {
+	ctx, span := tracer.Start(ctx, "category.RedisRepo.DeleteByID")
+	defer span.End()
+
 	key := CategoryIDKey(id)
 
-	txn := r.Client.TxPipeline()
+	err := r.Client.Watch(ctx, func(tx *redis.Tx) error {
+		current, err := currentVersion(ctx, tx, key)
+		if err != nil {
+			return err
+		}
 
-	err := txn.Del(ctx, key).Err()
-	if errors.Is(err, redis.Nil) {
-		txn.Discard()
-		return ErrNotExist
+		if version != 0 && current != version {
+			return ErrVersionMismatch
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, key)
+			pipe.ZRem(ctx, categoriesIndex, key)
+			return nil
+		})
+		return err
+	}, key)
+	if errors.Is(err, redis.TxFailedErr) {
+		return ErrVersionMismatch
 	} else if err != nil {
-		txn.Discard()
-		return fmt.Errorf("get category: %w", err)
+		return err
 	}
 
-	if _, err := txn.Exec(ctx); err != nil {
-		return fmt.Errorf("failed to exec: %w", err)
-	}
+	logging.FromContext(ctx).Debug("category deleted", slog.String("key", key))
 
 	return nil
 }
 
-func (r *RedisRepo) Update(ctx context.Context, category model.Category) error {
+// Update stores category if the stored category is still at category.Version
+// and returns it with the version incremented. Concurrent writers are
+// detected with WATCH and reported as ErrVersionMismatch.
+func (r *RedisRepo) Update(ctx context.Context, category model.Category) (model.Category, error) {
+	ctx, span := tracer.Start(ctx, "category.RedisRepo.Update")
+	defer span.End()
+
+	expected := category.Version
+	category.Version++
+
 	data, err := json.Marshal(category)
 	if err != nil {
-		return fmt.Errorf("failed to encode category: %w", err)
+		return model.Category{}, fmt.Errorf("failed to encode category: %w", err)
 	}
 
 	key := CategoryIDKey(category.CategoryID)
 
-	err = r.Client.SetXX(ctx, key, string(data), 0).Err()
+	err = r.Client.Watch(ctx, func(tx *redis.Tx) error {
+		current, err := currentVersion(ctx, tx, key)
+		if err != nil {
+			return err
+		}
+
+		if current != expected {
+			return ErrVersionMismatch
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			return pipe.Set(ctx, key, string(data), 0).Err()
+		})
+		return err
+	}, key)
+	if errors.Is(err, redis.TxFailedErr) {
+		return model.Category{}, ErrVersionMismatch
+	} else if err != nil {
+		return model.Category{}, err
+	}
+
+	logging.FromContext(ctx).Debug("category updated", slog.String("key", key))
+
+	return category, nil
+}
+
+func currentVersion(ctx context.Context, tx *redis.Tx, key string) (uint64, error) {
+	value, err := tx.Get(ctx, key).Result()
 	if errors.Is(err, redis.Nil) {
-		return ErrNotExist
+		return 0, ErrNotExist
 	} else if err != nil {
-		return fmt.Errorf("set category: %w", err)
+		return 0, fmt.Errorf("get category: %w", err)
 	}
 
-	return nil
+	var stored struct {
+		Version uint64 `json:"version"`
+	}
+	if err := json.Unmarshal([]byte(value), &stored); err != nil {
+		return 0, fmt.Errorf("failed to decode category json: %w", err)
+	}
+
+	return stored.Version, nil
 }
 
-func (r *RedisRepo) FindAll(ctx context.Context, page FindAllPage) (FindResult, error) {
-	res := r.Client.SScan(ctx, "categories", page.Offset, "*", int64(page.Size))
+func (r *RedisRepo) FindAll(ctx context.Context, page pagination.Query) (FindResult, error) {
+	ctx, span := tracer.Start(ctx, "category.RedisRepo.FindAll")
+	defer span.End()
 
-	keys, cursor, err := res.Result()
+	res, err := pagination.Find(ctx, r.Client, categoriesIndex, page)
 	if err != nil {
 		return FindResult{}, fmt.Errorf("failed to get category id's: %w", err)
 	}
 
-	if len(keys) == 0 {
+	if len(res.Keys) == 0 {
 		return FindResult{
 			Categories: []model.Category{},
+			Next:       res.Next,
+			Prev:       res.Prev,
+			Total:      res.Total,
 		}, nil
 	}
 
-	xs, err := r.Client.MGet(ctx, keys...).Result()
+	xs, err := r.Client.MGet(ctx, res.Keys...).Result()
 	if err != nil {
 		return FindResult{}, fmt.Errorf("failed to get categories: %w", err)
 	}
 
-	categories := make([]model.Category, len(xs))
+	categories := make([]model.Category, 0, len(xs))
 
-	for i, x := range xs {
-		x := x.(string)
+	for _, x := range xs {
+		// The key was deleted after the index was read.
+		if x == nil {
+			continue
+		}
 
 		var category model.Category
 
-		err := json.Unmarshal([]byte(x), &category)
+		err := json.Unmarshal([]byte(x.(string)), &category)
 		if err != nil {
-			return FindResult{}, fmt.Errorf("failed to decode categories: %w", err)
+			return FindResult{}, fmt.Errorf("failed to decode category json: %w", err)
 		}
 
-		categories[i] = category
+		categories = append(categories, category)
 	}
 
+	logging.FromContext(ctx).Debug("categories listed", slog.Int("count", len(categories)), slog.Int64("total", res.Total))
+
 	return FindResult{
 		Categories: categories,
-		Cursor:     cursor,
+		Next:       res.Next,
+		Prev:       res.Prev,
+		Total:      res.Total,
 	}, nil
 }
+
+// MigrateIndex moves categories from the unordered set used before listings
+// were sorted by creation time into the sorted index.
+func (r *RedisRepo) MigrateIndex(ctx context.Context) error {
+	return pagination.MigrateSet(ctx, r.Client, "categories", categoriesIndex)
+}
+
+// InsertMany stores categories in one transaction. See batch.Apply for how
+// per-item failures and atomic mode are reported.
+func (r *RedisRepo) InsertMany(ctx context.Context, categories []model.Category, atomic bool) ([]error, error) {
+	ctx, span := tracer.Start(ctx, "category.RedisRepo.InsertMany")
+	defer span.End()
+
+	writes := make([]batch.Write, len(categories))
+	for i, x := range categories {
+		data, err := json.Marshal(x)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode category: %w", err)
+		}
+		writes[i] = batch.Write{Op: batch.Create, Key: CategoryIDKey(x.CategoryID), Data: string(data)}
+	}
+
+	errs, err := batch.Apply(ctx, r.Client, categoriesIndex, writes, atomic)
+	if err != nil {
+		return nil, err
+	}
+
+	logging.FromContext(ctx).Debug("categories inserted", slog.Int("count", len(writes)))
+
+	return errs, nil
+}
+
+// UpdateMany stores categories whose stored versions still match their
+// Version fields and returns them with the versions incremented. A zero
+// Version updates whatever version is stored.
+func (r *RedisRepo) UpdateMany(ctx context.Context, categories []model.Category, atomic bool) ([]model.Category, []error, error) {
+	ctx, span := tracer.Start(ctx, "category.RedisRepo.UpdateMany")
+	defer span.End()
+
+	keys := make([]string, len(categories))
+	versions := make([]uint64, len(categories))
+	for i, x := range categories {
+		keys[i] = CategoryIDKey(x.CategoryID)
+		versions[i] = x.Version
+	}
+	if err := batch.FillVersions(ctx, r.Client, keys, versions); err != nil {
+		return nil, nil, err
+	}
+
+	updated := make([]model.Category, len(categories))
+	writes := make([]batch.Write, len(categories))
+	for i, x := range categories {
+		expected := versions[i]
+		x.Version = expected + 1
+
+		data, err := json.Marshal(x)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to encode category: %w", err)
+		}
+		updated[i] = x
+		writes[i] = batch.Write{Op: batch.Update, Key: keys[i], Data: string(data), Version: expected}
+	}
+
+	errs, err := batch.Apply(ctx, r.Client, categoriesIndex, writes, atomic)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	logging.FromContext(ctx).Debug("categories updated", slog.Int("count", len(writes)))
+
+	return updated, errs, nil
+}
+
+// DeleteMany removes the targeted categories. Targets with a zero version
+// are deleted unconditionally.
+func (r *RedisRepo) DeleteMany(ctx context.Context, targets []batch.Target, atomic bool) ([]error, error) {
+	ctx, span := tracer.Start(ctx, "category.RedisRepo.DeleteMany")
+	defer span.End()
+
+	writes := make([]batch.Write, len(targets))
+	for i, t := range targets {
+		writes[i] = batch.Write{Op: batch.Delete, Key: CategoryIDKey(t.ID), Version: t.Version}
+	}
+
+	errs, err := batch.Apply(ctx, r.Client, categoriesIndex, writes, atomic)
+	if err != nil {
+		return nil, err
+	}
+
+	logging.FromContext(ctx).Debug("categories deleted", slog.Int("count", len(writes)))
+
+	return errs, nil
+}
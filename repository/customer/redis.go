@@ -5,32 +5,47 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log/slog"
+	"time"
 
 	"github.com/redis/go-redis/v9"
+	"github.com/umuttopalak/orders-api/events"
+	"github.com/umuttopalak/orders-api/logging"
 	"github.com/umuttopalak/orders-api/model"
+	"github.com/umuttopalak/orders-api/repository/batch"
+	"github.com/umuttopalak/orders-api/repository/pagination"
+	"go.opentelemetry.io/otel"
 )
 
+var tracer = otel.Tracer("github.com/umuttopalak/orders-api/repository/customer")
+
+// customersIndex lists every customer key scored by its creation time in
+// milliseconds.
+const customersIndex = "customers:by_created"
+
 type RedisRepo struct {
 	Client *redis.Client
 }
 
-type FindAllPage struct {
-	Size   uint64
-	Offset uint64
-}
-
 type FindResult struct {
 	Customers []model.Customer
-	Cursor    uint64
+	Next      *pagination.Cursor
+	Prev      *pagination.Cursor
+	Total     int64
 }
 
 var ErrNotExist = errors.New("customer does not exist")
 
+var ErrVersionMismatch = errors.New("customer version mismatch")
+
 func CustomerIDKey(id uint64) string {
 	return fmt.Sprintf("customer:%d", id)
 }
 
 func (r *RedisRepo) Insert(ctx context.Context, customer model.Customer) error {
+	ctx, span := tracer.Start(ctx, "customer.RedisRepo.Insert")
+	defer span.End()
+
 	data, err := json.Marshal(customer)
 	if err != nil {
 		return fmt.Errorf("failed to encode customer: %w", err)
@@ -38,6 +53,11 @@ func (r *RedisRepo) Insert(ctx context.Context, customer model.Customer) error {
 
 	key := CustomerIDKey(customer.CustomerID)
 
+	evs, err := changeEvents(nil, &customer)
+	if err != nil {
+		return err
+	}
+
 	txn := r.Client.TxPipeline()
 
 	res := txn.SetNX(ctx, key, string(data), 0)
@@ -46,19 +66,29 @@ func (r *RedisRepo) Insert(ctx context.Context, customer model.Customer) error {
 		return fmt.Errorf("failed to set: %w", err)
 	}
 
-	if err := txn.SAdd(ctx, "customers", key).Err(); err != nil {
+	score := float64(time.Now().UnixMilli())
+	if err := txn.ZAdd(ctx, customersIndex, redis.Z{Score: score, Member: key}).Err(); err != nil {
 		txn.Discard()
 		return fmt.Errorf("failed to add customer to customers: %w", err)
 	}
 
+	for _, e := range evs {
+		events.Append(ctx, txn, e)
+	}
+
 	if _, err := txn.Exec(ctx); err != nil {
 		return fmt.Errorf("failed to exec: %w", err)
 	}
 
+	logging.FromContext(ctx).Debug("customer inserted", slog.String("key", key))
+
 	return nil
 }
 
 func (r *RedisRepo) FindByID(ctx context.Context, id uint64) (model.Customer, error) {
+	ctx, span := tracer.Start(ctx, "customer.RedisRepo.FindByID")
+	defer span.End()
+
 	key := CustomerIDKey(id)
 
 	value, err := r.Client.Get(ctx, key).Result()
@@ -77,80 +107,295 @@ func (r *RedisRepo) FindByID(ctx context.Context, id uint64) (model.Customer, er
 	return customer, nil
 }
 
-func (r *RedisRepo) DeleteByID(ctx context.Context, id uint64) error {
+// DeleteByID removes the customer. A non-zero version makes the delete
+// conditional on the stored customer still being at that version.
+func (r *RedisRepo) DeleteByID(ctx context.Context, id uint64, version uint64) error {
+	ctx, span := tracer.Start(ctx, "customer.RedisRepo.DeleteByID")
+	defer span.End()
+
 	key := CustomerIDKey(id)
 
-	txn := r.Client.TxPipeline()
+	err := r.Client.Watch(ctx, func(tx *redis.Tx) error {
+		current, err := stored(ctx, tx, key)
+		if err != nil {
+			return err
+		}
 
-	err := txn.Del(ctx, key).Err()
-	if errors.Is(err, redis.Nil) {
-		txn.Discard()
-		return ErrNotExist
+		if version != 0 && current.Version != version {
+			return ErrVersionMismatch
+		}
+
+		evs, err := changeEvents(&current, nil)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, key)
+			pipe.ZRem(ctx, customersIndex, key)
+			for _, e := range evs {
+				events.Append(ctx, pipe, e)
+			}
+			return nil
+		})
+		return err
+	}, key)
+	if errors.Is(err, redis.TxFailedErr) {
+		return ErrVersionMismatch
 	} else if err != nil {
-		txn.Discard()
-		return fmt.Errorf("get customer: %w", err)
+		return err
 	}
 
-	if _, err := txn.Exec(ctx); err != nil {
-		return fmt.Errorf("failed to exec: %w", err)
-	}
+	logging.FromContext(ctx).Debug("customer deleted", slog.String("key", key))
 
 	return nil
 }
 
-func (r *RedisRepo) Update(ctx context.Context, customer model.Customer) error {
+// Update stores customer if the stored customer is still at customer.Version
+// and returns it with the version incremented. Concurrent writers are
+// detected with WATCH and reported as ErrVersionMismatch.
+func (r *RedisRepo) Update(ctx context.Context, customer model.Customer) (model.Customer, error) {
+	ctx, span := tracer.Start(ctx, "customer.RedisRepo.Update")
+	defer span.End()
+
+	expected := customer.Version
+	customer.Version++
+
 	data, err := json.Marshal(customer)
 	if err != nil {
-		return fmt.Errorf("failed to encode customer: %w", err)
+		return model.Customer{}, fmt.Errorf("failed to encode customer: %w", err)
 	}
 
 	key := CustomerIDKey(customer.CustomerID)
 
-	err = r.Client.SetXX(ctx, key, string(data), 0).Err()
+	err = r.Client.Watch(ctx, func(tx *redis.Tx) error {
+		current, err := stored(ctx, tx, key)
+		if err != nil {
+			return err
+		}
+
+		if current.Version != expected {
+			return ErrVersionMismatch
+		}
+
+		evs, err := changeEvents(&current, &customer)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, string(data), 0)
+			for _, e := range evs {
+				events.Append(ctx, pipe, e)
+			}
+			return nil
+		})
+		return err
+	}, key)
+	if errors.Is(err, redis.TxFailedErr) {
+		return model.Customer{}, ErrVersionMismatch
+	} else if err != nil {
+		return model.Customer{}, err
+	}
+
+	logging.FromContext(ctx).Debug("customer updated", slog.String("key", key))
+
+	return customer, nil
+}
+
+func stored(ctx context.Context, tx *redis.Tx, key string) (model.Customer, error) {
+	value, err := tx.Get(ctx, key).Result()
 	if errors.Is(err, redis.Nil) {
-		return ErrNotExist
+		return model.Customer{}, ErrNotExist
 	} else if err != nil {
-		return fmt.Errorf("set customer: %w", err)
+		return model.Customer{}, fmt.Errorf("get customer: %w", err)
 	}
 
-	return nil
+	var x model.Customer
+	if err := json.Unmarshal([]byte(value), &x); err != nil {
+		return model.Customer{}, fmt.Errorf("failed to decode customer json: %w", err)
+	}
+
+	return x, nil
 }
 
-func (r *RedisRepo) FindAll(ctx context.Context, page FindAllPage) (FindResult, error) {
-	res := r.Client.SScan(ctx, "customers", page.Offset, "*", int64(page.Size))
+// changeEvents describes a write of a customer, before being nil for an
+// insert and after for a delete.
+func changeEvents(before, after *model.Customer) ([]events.Event, error) {
+	var e events.Event
+	var err error
+	switch {
+	case before == nil:
+		e, err = events.New(events.CustomerCreated, events.AggregateCustomer, after.CustomerID, after.Version, after)
+	case after == nil:
+		e, err = events.New(events.CustomerDeleted, events.AggregateCustomer, before.CustomerID, 0, before)
+	default:
+		e, err = events.New(events.CustomerUpdated, events.AggregateCustomer, after.CustomerID, after.Version, after)
+	}
+	if err != nil {
+		return nil, err
+	}
 
-	keys, cursor, err := res.Result()
+	return []events.Event{e}, nil
+}
+
+func (r *RedisRepo) FindAll(ctx context.Context, page pagination.Query) (FindResult, error) {
+	ctx, span := tracer.Start(ctx, "customer.RedisRepo.FindAll")
+	defer span.End()
+
+	res, err := pagination.Find(ctx, r.Client, customersIndex, page)
 	if err != nil {
-		return FindResult{}, fmt.Errorf("failed to get order id's: %w", err)
+		return FindResult{}, fmt.Errorf("failed to get customer id's: %w", err)
 	}
 
-	if len(keys) == 0 {
+	if len(res.Keys) == 0 {
 		return FindResult{
 			Customers: []model.Customer{},
+			Next:      res.Next,
+			Prev:      res.Prev,
+			Total:     res.Total,
 		}, nil
 	}
 
-	xs, err := r.Client.MGet(ctx, keys...).Result()
+	xs, err := r.Client.MGet(ctx, res.Keys...).Result()
 	if err != nil {
 		return FindResult{}, fmt.Errorf("failed to get customers: %w", err)
 	}
 
-	customers := make([]model.Customer, len(xs))
+	customers := make([]model.Customer, 0, len(xs))
+
+	for _, x := range xs {
+		// The key was deleted after the index was read.
+		if x == nil {
+			continue
+		}
 
-	for i, x := range xs {
-		x := x.(string)
 		var customer model.Customer
 
-		err := json.Unmarshal([]byte(x), &customer)
+		err := json.Unmarshal([]byte(x.(string)), &customer)
 		if err != nil {
-			return FindResult{}, fmt.Errorf("failed to decode customer: %w", err)
+			return FindResult{}, fmt.Errorf("failed to decode customer json: %w", err)
 		}
 
-		customers[i] = customer
+		customers = append(customers, customer)
 	}
 
+	logging.FromContext(ctx).Debug("customers listed", slog.Int("count", len(customers)), slog.Int64("total", res.Total))
+
 	return FindResult{
 		Customers: customers,
-		Cursor:    cursor,
+		Next:      res.Next,
+		Prev:      res.Prev,
+		Total:     res.Total,
 	}, nil
 }
+
+// MigrateIndex moves customers from the unordered set used before listings
+// were sorted by creation time into the sorted index.
+func (r *RedisRepo) MigrateIndex(ctx context.Context) error {
+	return pagination.MigrateSet(ctx, r.Client, "customers", customersIndex)
+}
+
+// InsertMany stores customers in one transaction. See batch.Apply for how
+// per-item failures and atomic mode are reported.
+func (r *RedisRepo) InsertMany(ctx context.Context, customers []model.Customer, atomic bool) ([]error, error) {
+	ctx, span := tracer.Start(ctx, "customer.RedisRepo.InsertMany")
+	defer span.End()
+
+	writes := make([]batch.Write, len(customers))
+	for i, x := range customers {
+		x := x
+		data, err := json.Marshal(x)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode customer: %w", err)
+		}
+		writes[i] = batch.Write{Op: batch.Create, Key: CustomerIDKey(x.CustomerID), Data: string(data), Events: batchEvents(&x)}
+	}
+
+	errs, err := batch.Apply(ctx, r.Client, customersIndex, writes, atomic)
+	if err != nil {
+		return nil, err
+	}
+
+	logging.FromContext(ctx).Debug("customers inserted", slog.Int("count", len(writes)))
+
+	return errs, nil
+}
+
+// UpdateMany stores customers whose stored versions still match their
+// Version fields and returns them with the versions incremented. A zero
+// Version updates whatever version is stored.
+func (r *RedisRepo) UpdateMany(ctx context.Context, customers []model.Customer, atomic bool) ([]model.Customer, []error, error) {
+	ctx, span := tracer.Start(ctx, "customer.RedisRepo.UpdateMany")
+	defer span.End()
+
+	keys := make([]string, len(customers))
+	versions := make([]uint64, len(customers))
+	for i, x := range customers {
+		keys[i] = CustomerIDKey(x.CustomerID)
+		versions[i] = x.Version
+	}
+	if err := batch.FillVersions(ctx, r.Client, keys, versions); err != nil {
+		return nil, nil, err
+	}
+
+	updated := make([]model.Customer, len(customers))
+	writes := make([]batch.Write, len(customers))
+	for i, x := range customers {
+		expected := versions[i]
+		x.Version = expected + 1
+
+		data, err := json.Marshal(x)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to encode customer: %w", err)
+		}
+		updated[i] = x
+		writes[i] = batch.Write{Op: batch.Update, Key: keys[i], Data: string(data), Version: expected, Events: batchEvents(&updated[i])}
+	}
+
+	errs, err := batch.Apply(ctx, r.Client, customersIndex, writes, atomic)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	logging.FromContext(ctx).Debug("customers updated", slog.Int("count", len(writes)))
+
+	return updated, errs, nil
+}
+
+// DeleteMany removes the targeted customers. Targets with a zero version
+// are deleted unconditionally.
+func (r *RedisRepo) DeleteMany(ctx context.Context, targets []batch.Target, atomic bool) ([]error, error) {
+	ctx, span := tracer.Start(ctx, "customer.RedisRepo.DeleteMany")
+	defer span.End()
+
+	writes := make([]batch.Write, len(targets))
+	for i, t := range targets {
+		writes[i] = batch.Write{Op: batch.Delete, Key: CustomerIDKey(t.ID), Version: t.Version, Events: batchEvents(nil)}
+	}
+
+	errs, err := batch.Apply(ctx, r.Client, customersIndex, writes, atomic)
+	if err != nil {
+		return nil, err
+	}
+
+	logging.FromContext(ctx).Debug("customers deleted", slog.Int("count", len(writes)))
+
+	return errs, nil
+}
+
+// batchEvents adapts changeEvents to batch.Write, decoding the value the
+// write replaces.
+func batchEvents(after *model.Customer) func(previous string) ([]events.Event, error) {
+	return func(previous string) ([]events.Event, error) {
+		if previous == "" {
+			return changeEvents(nil, after)
+		}
+
+		var before model.Customer
+		if err := json.Unmarshal([]byte(previous), &before); err != nil {
+			return nil, fmt.Errorf("failed to decode customer json: %w", err)
+		}
+		return changeEvents(&before, after)
+	}
+}
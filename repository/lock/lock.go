@@ -0,0 +1,47 @@
+// Package lock provides the Redis locks repositories use to serialize
+// requests on an order.
+package lock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"github.com/umuttopalak/orders-api/logging"
+)
+
+// ErrLocked is returned by Acquire while another holder has the lock.
+var ErrLocked = errors.New("locked")
+
+var releaseScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// Acquire takes the lock at key. The lock expires after ttl in case its
+// holder dies; release only frees it while it is still held, so a holder
+// that outlived ttl cannot release a lock someone else has taken since.
+func Acquire(ctx context.Context, client *redis.Client, key string, ttl time.Duration) (release func(), err error) {
+	token := uuid.NewString()
+
+	ok, err := client.SetNX(ctx, key, token, ttl).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to acquire lock %s: %w", key, err)
+	}
+	if !ok {
+		return nil, ErrLocked
+	}
+
+	return func() {
+		ctx := context.WithoutCancel(ctx)
+		if err := releaseScript.Run(ctx, client, []string{key}, token).Err(); err != nil {
+			logging.FromContext(ctx).Error("failed to release lock", slog.Any("error", err), slog.String("key", key))
+		}
+	}, nil
+}
@@ -5,11 +5,23 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log/slog"
+	"time"
 
 	"github.com/redis/go-redis/v9"
+	"github.com/umuttopalak/orders-api/events"
+	"github.com/umuttopalak/orders-api/logging"
 	"github.com/umuttopalak/orders-api/model"
+	"github.com/umuttopalak/orders-api/repository/pagination"
+	"go.opentelemetry.io/otel"
 )
 
+var tracer = otel.Tracer("github.com/umuttopalak/orders-api/repository/order")
+
+// ordersIndex lists every order key scored by its creation time in
+// milliseconds.
+const ordersIndex = "orders:by_created"
+
 type RedisRepo struct {
 	Client *redis.Client
 }
@@ -19,6 +31,9 @@ func OrderIDKey(id uint64) string {
 }
 
 func (r *RedisRepo) Insert(ctx context.Context, order model.Order) error {
+	ctx, span := tracer.Start(ctx, "order.RedisRepo.Insert")
+	defer span.End()
+
 	data, err := json.Marshal(order)
 	if err != nil {
 		return fmt.Errorf("failed to encode order: %w", err)
@@ -26,6 +41,11 @@ func (r *RedisRepo) Insert(ctx context.Context, order model.Order) error {
 
 	key := OrderIDKey(order.OrderID)
 
+	evs, err := changeEvents(nil, &order)
+	if err != nil {
+		return err
+	}
+
 	txn := r.Client.TxPipeline()
 
 	res := txn.SetNX(ctx, key, string(data), 0)
@@ -34,21 +54,36 @@ func (r *RedisRepo) Insert(ctx context.Context, order model.Order) error {
 		return fmt.Errorf("failed to set: %w", err)
 	}
 
-	if err := txn.SAdd(ctx, "orders", key).Err(); err != nil {
+	score := float64(time.Now().UnixMilli())
+	if err := txn.ZAdd(ctx, ordersIndex, redis.Z{Score: score, Member: key}).Err(); err != nil {
 		txn.Discard()
 		return fmt.Errorf("failed to add order to orders: %w", err)
 	}
 
+	ids := make([]*redis.StringCmd, len(evs))
+	for i, e := range evs {
+		ids[i] = events.Append(ctx, txn, e)
+	}
+
 	if _, err := txn.Exec(ctx); err != nil {
 		return fmt.Errorf("failed to exec: %w", err)
 	}
 
+	logging.FromContext(ctx).Debug("order inserted", slog.String("key", key))
+
+	r.publish(ctx, evs, ids)
+
 	return nil
 }
 
 var ErrNotExist = errors.New("order does not exist")
 
+var ErrVersionMismatch = errors.New("order version mismatch")
+
 func (r *RedisRepo) FindByID(ctx context.Context, id uint64) (model.Order, error) {
+	ctx, span := tracer.Start(ctx, "order.RedisRepo.FindByID")
+	defer span.End()
+
 	key := OrderIDKey(id)
 
 	value, err := r.Client.Get(ctx, key).Result()
@@ -67,95 +102,259 @@ func (r *RedisRepo) FindByID(ctx context.Context, id uint64) (model.Order, error
 	return order, nil
 }
 
-func (r *RedisRepo) DeleteByID(ctx context.Context, id uint64) error {
+// DeleteByID removes the order. A non-zero version makes the delete
+// conditional on the stored order still being at that version.
+func (r *RedisRepo) DeleteByID(ctx context.Context, id uint64, version uint64) error {
+	ctx, span := tracer.Start(ctx, "order.RedisRepo.DeleteByID")
+	defer span.End()
+
 	key := OrderIDKey(id)
 
-	txn := r.Client.TxPipeline()
+	var evs []events.Event
+	var ids []*redis.StringCmd
 
-	err := txn.Del(ctx, key).Err()
-	if errors.Is(err, redis.Nil) {
-		txn.Discard()
-		return ErrNotExist
+	err := r.Client.Watch(ctx, func(tx *redis.Tx) error {
+		current, err := stored(ctx, tx, key)
+		if err != nil {
+			return err
+		}
+
+		if version != 0 && current.Version != version {
+			return ErrVersionMismatch
+		}
+
+		evs, err = changeEvents(&current, nil)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, key)
+			pipe.ZRem(ctx, ordersIndex, key)
+			ids = make([]*redis.StringCmd, len(evs))
+			for i, e := range evs {
+				ids[i] = events.Append(ctx, pipe, e)
+			}
+			return nil
+		})
+		return err
+	}, key)
+	if errors.Is(err, redis.TxFailedErr) {
+		return ErrVersionMismatch
 	} else if err != nil {
-		txn.Discard()
-		return fmt.Errorf("get order: %w", err)
+		return err
 	}
 
-	if err := txn.SRem(ctx, "orders", key).Err(); err != nil {
-		txn.Discard()
-		return fmt.Errorf("failed to remove order from orders: %w", err)
-	}
+	logging.FromContext(ctx).Debug("order deleted", slog.String("key", key))
 
-	if _, err := txn.Exec(ctx); err != nil {
-		return fmt.Errorf("failed to exec: %w", err)
-	}
+	r.publish(ctx, evs, ids)
 
 	return nil
 }
 
-func (r *RedisRepo) Update(ctx context.Context, order model.Order) error {
+// Update stores order if the stored order is still at order.Version and
+// returns it with the version incremented. Concurrent writers are detected
+// with WATCH and reported as ErrVersionMismatch.
+func (r *RedisRepo) Update(ctx context.Context, order model.Order) (model.Order, error) {
+	ctx, span := tracer.Start(ctx, "order.RedisRepo.Update")
+	defer span.End()
+
+	expected := order.Version
+	order.Version++
+
 	data, err := json.Marshal(order)
 	if err != nil {
-		return fmt.Errorf("Failed to encode order: %w", err)
+		return model.Order{}, fmt.Errorf("failed to encode order: %w", err)
 	}
 
 	key := OrderIDKey(order.OrderID)
 
-	err = r.Client.SetXX(ctx, key, string(data), 0).Err()
+	var evs []events.Event
+	var ids []*redis.StringCmd
+
+	err = r.Client.Watch(ctx, func(tx *redis.Tx) error {
+		current, err := stored(ctx, tx, key)
+		if err != nil {
+			return err
+		}
+
+		if current.Version != expected {
+			return ErrVersionMismatch
+		}
+
+		evs, err = changeEvents(&current, &order)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, string(data), 0)
+			ids = make([]*redis.StringCmd, len(evs))
+			for i, e := range evs {
+				ids[i] = events.Append(ctx, pipe, e)
+			}
+			return nil
+		})
+		return err
+	}, key)
+	if errors.Is(err, redis.TxFailedErr) {
+		return model.Order{}, ErrVersionMismatch
+	} else if err != nil {
+		return model.Order{}, err
+	}
+
+	logging.FromContext(ctx).Debug("order updated", slog.String("key", key))
+
+	r.publish(ctx, evs, ids)
+
+	return order, nil
+}
+
+func stored(ctx context.Context, tx *redis.Tx, key string) (model.Order, error) {
+	value, err := tx.Get(ctx, key).Result()
 	if errors.Is(err, redis.Nil) {
-		return ErrNotExist
+		return model.Order{}, ErrNotExist
 	} else if err != nil {
-		return fmt.Errorf("set order: %w", err)
+		return model.Order{}, fmt.Errorf("get order: %w", err)
 	}
 
-	return nil
+	var order model.Order
+	if err := json.Unmarshal([]byte(value), &order); err != nil {
+		return model.Order{}, fmt.Errorf("failed to decode order json: %w", err)
+	}
+
+	return order, nil
+}
+
+// changeEvents describes a write of an order, before being nil for an
+// insert and after for a delete. Status transitions replace OrderUpdated.
+func changeEvents(before, after *model.Order) ([]events.Event, error) {
+	var typ string
+	switch {
+	case before == nil:
+		typ = events.OrderCreated
+	case after == nil:
+		e, err := events.New(events.OrderDeleted, events.AggregateOrder, before.OrderID, 0, before)
+		return []events.Event{e}, err
+	case before.ShippedAt == nil && after.ShippedAt != nil:
+		typ = events.OrderShipped
+	case before.CompletedAt == nil && after.CompletedAt != nil:
+		typ = events.OrderCompleted
+	case before.PaymentStatus != after.PaymentStatus:
+		typ = paymentEvent(after.PaymentStatus)
+	default:
+		typ = events.OrderUpdated
+	}
+
+	e, err := events.New(typ, events.AggregateOrder, after.OrderID, after.Version, after)
+	return []events.Event{e}, err
 }
 
-type FindAllPage struct {
-	Size   uint64
-	Offset uint64
+func paymentEvent(status string) string {
+	switch status {
+	case model.PaymentPaid:
+		return events.OrderPaid
+	case model.PaymentFailed:
+		return events.OrderPaymentFailed
+	case model.PaymentRefunded, model.PaymentPartiallyRefunded:
+		return events.OrderRefunded
+	}
+	return events.OrderUpdated
 }
 
 type FindResult struct {
 	Orders []model.Order
-	Cursor uint64
+	Next   *pagination.Cursor
+	Prev   *pagination.Cursor
+	Total  int64
+}
+
+// publish announces committed events to live listeners. The write has
+// already succeeded, so failures are only logged; listeners that missed
+// the message recover it from the stream on their next reconnect.
+func (r *RedisRepo) publish(ctx context.Context, evs []events.Event, ids []*redis.StringCmd) {
+	for i, e := range evs {
+		e.ID = ids[i].Val()
+		if err := events.Publish(ctx, r.Client, e); err != nil {
+			logging.FromContext(ctx).Warn("failed to publish order event", slog.Any("error", err))
+		}
+	}
 }
 
-func (r *RedisRepo) FindAll(ctx context.Context, page FindAllPage) (FindResult, error) {
-	res := r.Client.SScan(ctx, "orders", page.Offset, "*", int64(page.Size))
+// Subscribe listens to order events as they are committed. The
+// subscription is confirmed when it is returned, so events written
+// afterwards are not missed.
+func (r *RedisRepo) Subscribe(ctx context.Context) (*redis.PubSub, error) {
+	sub := r.Client.Subscribe(ctx, events.LiveChannel(events.AggregateOrder))
+	if _, err := sub.Receive(ctx); err != nil {
+		sub.Close()
+		return nil, fmt.Errorf("failed to subscribe to order events: %w", err)
+	}
+	return sub, nil
+}
 
-	keys, cursor, err := res.Result()
+// EventsAfter returns up to count order events recorded after the event
+// with ID id.
+func (r *RedisRepo) EventsAfter(ctx context.Context, id string, count int64) ([]events.Event, error) {
+	ctx, span := tracer.Start(ctx, "order.RedisRepo.EventsAfter")
+	defer span.End()
+
+	return events.After(ctx, r.Client, events.AggregateOrder, id, count)
+}
+
+func (r *RedisRepo) FindAll(ctx context.Context, page pagination.Query) (FindResult, error) {
+	ctx, span := tracer.Start(ctx, "order.RedisRepo.FindAll")
+	defer span.End()
+
+	res, err := pagination.Find(ctx, r.Client, ordersIndex, page)
 	if err != nil {
 		return FindResult{}, fmt.Errorf("failed to get order id's: %w", err)
 	}
 
-	if len(keys) == 0 {
+	if len(res.Keys) == 0 {
 		return FindResult{
 			Orders: []model.Order{},
+			Next:   res.Next,
+			Prev:   res.Prev,
+			Total:  res.Total,
 		}, nil
 	}
 
-	xs, err := r.Client.MGet(ctx, keys...).Result()
+	xs, err := r.Client.MGet(ctx, res.Keys...).Result()
 	if err != nil {
 		return FindResult{}, fmt.Errorf("failed to get orders: %w", err)
 	}
 
-	orders := make([]model.Order, len(xs))
+	orders := make([]model.Order, 0, len(xs))
+
+	for _, x := range xs {
+		// The key was deleted after the index was read.
+		if x == nil {
+			continue
+		}
 
-	for i, x := range xs {
-		x := x.(string)
 		var order model.Order
 
-		err := json.Unmarshal([]byte(x), &order)
+		err := json.Unmarshal([]byte(x.(string)), &order)
 		if err != nil {
 			return FindResult{}, fmt.Errorf("failed to decode order json: %w", err)
 		}
 
-		orders[i] = order
+		orders = append(orders, order)
 	}
 
+	logging.FromContext(ctx).Debug("orders listed", slog.Int("count", len(orders)), slog.Int64("total", res.Total))
+
 	return FindResult{
 		Orders: orders,
-		Cursor: cursor,
+		Next:   res.Next,
+		Prev:   res.Prev,
+		Total:  res.Total,
 	}, nil
 }
+
+// MigrateIndex moves orders from the unordered set used before listings
+// were sorted by creation time into the sorted index.
+func (r *RedisRepo) MigrateIndex(ctx context.Context) error {
+	return pagination.MigrateSet(ctx, r.Client, "orders", ordersIndex)
+}
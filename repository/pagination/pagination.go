@@ -0,0 +1,256 @@
+package pagination
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Cursor marks a position in a sorted set index by the score and member of
+// the item next to it. It is handed to clients as an opaque string. A
+// Backward cursor pages towards the start of the listing.
+type Cursor struct {
+	Score    float64 `json:"s"`
+	Member   string  `json:"m"`
+	Backward bool    `json:"b,omitempty"`
+	Desc     bool    `json:"d,omitempty"`
+}
+
+func (c Cursor) Encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func DecodeCursor(s string) (Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return Cursor{}, ErrInvalidCursor
+	}
+
+	var c Cursor
+	if err := json.Unmarshal(data, &c); err != nil || c.Member == "" {
+		return Cursor{}, ErrInvalidCursor
+	}
+
+	return c, nil
+}
+
+type Query struct {
+	Limit  int
+	Cursor *Cursor
+	// Desc lists the newest items first.
+	Desc bool
+}
+
+type Result struct {
+	Keys  []string
+	Next  *Cursor
+	Prev  *Cursor
+	Total int64
+}
+
+// Find reads one page of members from index, a sorted set scored by
+// creation time in milliseconds. Members with equal scores are ordered by
+// Redis lexicographically, which keeps the order stable across pages.
+func Find(ctx context.Context, client redis.Cmdable, index string, q Query) (Result, error) {
+	backward := q.Cursor != nil && q.Cursor.Backward
+	// Walking backwards through a descending listing means walking the
+	// index in ascending order and vice versa.
+	ascending := q.Desc == backward
+
+	// One extra item tells whether there is another page.
+	items, err := fetch(ctx, client, index, ascending, q.Cursor, q.Limit+1)
+	if err != nil {
+		return Result{}, err
+	}
+
+	hasMore := len(items) > q.Limit
+	if hasMore {
+		items = items[:q.Limit]
+	}
+
+	if backward {
+		for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+			items[i], items[j] = items[j], items[i]
+		}
+	}
+
+	total, err := client.ZCard(ctx, index).Result()
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to count %s: %w", index, err)
+	}
+
+	res := Result{
+		Keys:  make([]string, len(items)),
+		Total: total,
+	}
+	for i, item := range items {
+		res.Keys[i] = item.Member
+	}
+
+	cursorAt := func(z redis.Z, backward bool) *Cursor {
+		return &Cursor{
+			Score:    z.Score,
+			Member:   z.Member,
+			Backward: backward,
+			Desc:     q.Desc,
+		}
+	}
+
+	if len(items) == 0 {
+		if q.Cursor != nil {
+			// Nothing beyond the cursor, offer the way back.
+			reverse := *q.Cursor
+			reverse.Backward = !backward
+			if backward {
+				res.Next = &reverse
+			} else {
+				res.Prev = &reverse
+			}
+		}
+		return res, nil
+	}
+
+	first, last := items[0], items[len(items)-1]
+	if backward {
+		res.Next = cursorAt(last, false)
+		if hasMore {
+			res.Prev = cursorAt(first, true)
+		}
+	} else {
+		if hasMore {
+			res.Next = cursorAt(last, false)
+		}
+		if q.Cursor != nil {
+			res.Prev = cursorAt(first, true)
+		}
+	}
+
+	return res, nil
+}
+
+func fetch(ctx context.Context, client redis.Cmdable, index string, ascending bool, after *Cursor, n int) ([]redis.Z, error) {
+	if after == nil {
+		return zrange(ctx, client, index, ascending, 0, n)
+	}
+
+	rankCmd := client.ZRank
+	if !ascending {
+		rankCmd = client.ZRevRank
+	}
+
+	rank, err := rankCmd(ctx, index, after.Member).Result()
+	if err == nil {
+		return zrange(ctx, client, index, ascending, rank+1, n)
+	} else if !errors.Is(err, redis.Nil) {
+		return nil, fmt.Errorf("failed to find cursor in %s: %w", index, err)
+	}
+
+	// The cursor item was deleted since the previous page was served, so
+	// continue from its score instead: first its remaining ties, then
+	// everything strictly beyond it.
+	return fetchByScore(ctx, client, index, ascending, after, n)
+}
+
+func zrange(ctx context.Context, client redis.Cmdable, index string, ascending bool, start int64, n int) ([]redis.Z, error) {
+	stop := start + int64(n) - 1
+
+	var items []redis.Z
+	var err error
+	if ascending {
+		items, err = client.ZRangeWithScores(ctx, index, start, stop).Result()
+	} else {
+		items, err = client.ZRevRangeWithScores(ctx, index, start, stop).Result()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to range %s: %w", index, err)
+	}
+
+	return items, nil
+}
+
+func fetchByScore(ctx context.Context, client redis.Cmdable, index string, ascending bool, after *Cursor, n int) ([]redis.Z, error) {
+	score := strconv.FormatFloat(after.Score, 'f', -1, 64)
+
+	var ties, rest []redis.Z
+	var err error
+	if ascending {
+		ties, err = client.ZRangeByScoreWithScores(ctx, index, &redis.ZRangeBy{Min: score, Max: score}).Result()
+	} else {
+		ties, err = client.ZRevRangeByScoreWithScores(ctx, index, &redis.ZRangeBy{Min: score, Max: score}).Result()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to range %s: %w", index, err)
+	}
+
+	items := make([]redis.Z, 0, n)
+	for _, z := range ties {
+		if (ascending && z.Member > after.Member) || (!ascending && z.Member < after.Member) {
+			items = append(items, z)
+		}
+	}
+	if len(items) >= n {
+		return items[:n], nil
+	}
+
+	remaining := int64(n - len(items))
+	if ascending {
+		rest, err = client.ZRangeByScoreWithScores(ctx, index, &redis.ZRangeBy{Min: "(" + score, Max: "+inf", Count: remaining}).Result()
+	} else {
+		rest, err = client.ZRevRangeByScoreWithScores(ctx, index, &redis.ZRangeBy{Min: "-inf", Max: "(" + score, Count: remaining}).Result()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to range %s: %w", index, err)
+	}
+
+	return append(items, rest...), nil
+}
+
+// MigrateSet moves the members of a legacy unordered set into index. The
+// creation time of legacy members is unknown, so they sort first with a
+// score of zero.
+func MigrateSet(ctx context.Context, client *redis.Client, set, index string) error {
+	typ, err := client.Type(ctx, set).Result()
+	if err != nil {
+		return fmt.Errorf("failed to get type of %s: %w", set, err)
+	}
+	if typ != "set" {
+		return nil
+	}
+
+	var cursor uint64
+	for {
+		keys, next, err := client.SScan(ctx, set, cursor, "*", 500).Result()
+		if err != nil {
+			return fmt.Errorf("failed to scan %s: %w", set, err)
+		}
+
+		if len(keys) > 0 {
+			members := make([]redis.Z, len(keys))
+			for i, key := range keys {
+				members[i] = redis.Z{Score: 0, Member: key}
+			}
+			if err := client.ZAddNX(ctx, index, members...).Err(); err != nil {
+				return fmt.Errorf("failed to add to %s: %w", index, err)
+			}
+		}
+
+		cursor = next
+		if cursor == 0 {
+			break
+		}
+	}
+
+	if err := client.Del(ctx, set).Err(); err != nil {
+		return fmt.Errorf("failed to delete %s: %w", set, err)
+	}
+
+	return nil
+}
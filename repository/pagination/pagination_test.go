@@ -0,0 +1,55 @@
+package pagination
+
+import (
+	"encoding/base64"
+	"errors"
+	"testing"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		cursor Cursor
+	}{
+		{"forward", Cursor{Score: 1700000000000, Member: "order:1"}},
+		{"backward", Cursor{Score: 1700000000000, Member: "order:1", Backward: true}},
+		{"descending", Cursor{Score: 1700000000123, Member: "customer:abc", Desc: true}},
+		{"backward descending", Cursor{Score: 0, Member: "product:7", Backward: true, Desc: true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodeCursor(tt.cursor.Encode())
+			if err != nil {
+				t.Fatalf("DecodeCursor: %v", err)
+			}
+			if got != tt.cursor {
+				t.Errorf("DecodeCursor = %+v, want %+v", got, tt.cursor)
+			}
+		})
+	}
+}
+
+func TestDecodeCursorInvalid(t *testing.T) {
+	encode := func(s string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(s))
+	}
+
+	tests := []struct {
+		name   string
+		cursor string
+	}{
+		{"not base64", "not a cursor!"},
+		{"not json", encode("order:1")},
+		{"missing member", encode(`{"s":1}`)},
+		{"wrong type", encode(`{"s":"1","m":"order:1"}`)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := DecodeCursor(tt.cursor); !errors.Is(err, ErrInvalidCursor) {
+				t.Errorf("DecodeCursor(%q) error = %v, want %v", tt.cursor, err, ErrInvalidCursor)
+			}
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package payment
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/umuttopalak/orders-api/logging"
+	"github.com/umuttopalak/orders-api/model"
+	"github.com/umuttopalak/orders-api/repository/lock"
+	"go.opentelemetry.io/otel"
+)
+
+var tracer = otel.Tracer("github.com/umuttopalak/orders-api/repository/payment")
+
+type RedisRepo struct {
+	Client *redis.Client
+}
+
+var ErrNotExist = errors.New("payment does not exist")
+
+var ErrVersionMismatch = errors.New("payment version mismatch")
+
+// ErrLocked is returned by Lock while another request holds the order's
+// payment lock.
+var ErrLocked = errors.New("order payment is locked")
+
+func PaymentIDKey(id string) string {
+	return fmt.Sprintf("payment:%s", id)
+}
+
+// orderPaymentsKey lists the payment keys of an order scored by creation
+// time in milliseconds.
+func orderPaymentsKey(orderID uint64) string {
+	return fmt.Sprintf("order:%d:payments", orderID)
+}
+
+func lockKey(orderID uint64) string {
+	return fmt.Sprintf("order:%d:payment_lock", orderID)
+}
+
+func (r *RedisRepo) Insert(ctx context.Context, payment model.Payment) error {
+	ctx, span := tracer.Start(ctx, "payment.RedisRepo.Insert")
+	defer span.End()
+
+	data, err := json.Marshal(payment)
+	if err != nil {
+		return fmt.Errorf("failed to encode payment: %w", err)
+	}
+
+	key := PaymentIDKey(payment.PaymentID)
+
+	_, err = r.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SetNX(ctx, key, string(data), 0)
+		pipe.ZAdd(ctx, orderPaymentsKey(payment.OrderID), redis.Z{Score: float64(time.Now().UnixMilli()), Member: key})
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to exec: %w", err)
+	}
+
+	logging.FromContext(ctx).Debug("payment inserted", slog.String("key", key))
+
+	return nil
+}
+
+// Update stores payment if the stored payment is still at payment.Version
+// and returns it with the version incremented.
+func (r *RedisRepo) Update(ctx context.Context, payment model.Payment) (model.Payment, error) {
+	ctx, span := tracer.Start(ctx, "payment.RedisRepo.Update")
+	defer span.End()
+
+	expected := payment.Version
+	payment.Version++
+
+	data, err := json.Marshal(payment)
+	if err != nil {
+		return model.Payment{}, fmt.Errorf("failed to encode payment: %w", err)
+	}
+
+	key := PaymentIDKey(payment.PaymentID)
+
+	err = r.Client.Watch(ctx, func(tx *redis.Tx) error {
+		value, err := tx.Get(ctx, key).Result()
+		if errors.Is(err, redis.Nil) {
+			return ErrNotExist
+		} else if err != nil {
+			return fmt.Errorf("get payment: %w", err)
+		}
+
+		var current model.Payment
+		if err := json.Unmarshal([]byte(value), &current); err != nil {
+			return fmt.Errorf("failed to decode payment json: %w", err)
+		}
+		if current.Version != expected {
+			return ErrVersionMismatch
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			return pipe.Set(ctx, key, string(data), 0).Err()
+		})
+		return err
+	}, key)
+	if errors.Is(err, redis.TxFailedErr) {
+		return model.Payment{}, ErrVersionMismatch
+	} else if err != nil {
+		return model.Payment{}, err
+	}
+
+	logging.FromContext(ctx).Debug("payment updated", slog.String("key", key))
+
+	return payment, nil
+}
+
+// FindByOrder returns the payments of an order, oldest first.
+func (r *RedisRepo) FindByOrder(ctx context.Context, orderID uint64) ([]model.Payment, error) {
+	ctx, span := tracer.Start(ctx, "payment.RedisRepo.FindByOrder")
+	defer span.End()
+
+	keys, err := r.Client.ZRange(ctx, orderPaymentsKey(orderID), 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get payment keys: %w", err)
+	}
+
+	payments := make([]model.Payment, 0, len(keys))
+	if len(keys) == 0 {
+		return payments, nil
+	}
+
+	xs, err := r.Client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get payments: %w", err)
+	}
+
+	for _, x := range xs {
+		if x == nil {
+			continue
+		}
+
+		var payment model.Payment
+		if err := json.Unmarshal([]byte(x.(string)), &payment); err != nil {
+			return nil, fmt.Errorf("failed to decode payment json: %w", err)
+		}
+		payments = append(payments, payment)
+	}
+
+	// Payments created in the same millisecond share a score and come back
+	// in key order.
+	sort.SliceStable(payments, func(i, j int) bool {
+		return payments[i].CreatedAt.Before(*payments[j].CreatedAt)
+	})
+
+	return payments, nil
+}
+
+// Lock serializes payment operations on an order, so two requests cannot
+// charge or refund it at the same time. The lock expires after ttl.
+func (r *RedisRepo) Lock(ctx context.Context, orderID uint64, ttl time.Duration) (unlock func(), err error) {
+	unlock, err = lock.Acquire(ctx, r.Client, lockKey(orderID), ttl)
+	if errors.Is(err, lock.ErrLocked) {
+		return nil, ErrLocked
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to lock order payments: %w", err)
+	}
+
+	return unlock, nil
+}
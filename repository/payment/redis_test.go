@@ -0,0 +1,112 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/umuttopalak/orders-api/model"
+)
+
+func newTestRepo(t *testing.T) *RedisRepo {
+	t.Helper()
+
+	client := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	t.Cleanup(func() { client.Close() })
+	return &RedisRepo{Client: client}
+}
+
+func TestFindByOrderOldestFirst(t *testing.T) {
+	repo := newTestRepo(t)
+	ctx := context.Background()
+
+	// Inserted within the same millisecond, in an order that differs from
+	// the order of their keys.
+	base := time.Now().UTC()
+	ids := []string{"c", "a", "b"}
+	for i, id := range ids {
+		created := base.Add(time.Duration(i) * time.Microsecond)
+		p := model.Payment{PaymentID: id, OrderID: 1, Status: model.PaymentPending, CreatedAt: &created, Version: 1}
+		if err := repo.Insert(ctx, p); err != nil {
+			t.Fatalf("insert: %v", err)
+		}
+	}
+	other := model.Payment{PaymentID: "d", OrderID: 2, CreatedAt: &base, Version: 1}
+	if err := repo.Insert(ctx, other); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+
+	list, err := repo.FindByOrder(ctx, 1)
+	if err != nil {
+		t.Fatalf("FindByOrder: %v", err)
+	}
+	if len(list) != len(ids) {
+		t.Fatalf("got %d payments, want %d", len(list), len(ids))
+	}
+	for i, id := range ids {
+		if list[i].PaymentID != id {
+			t.Errorf("payments[%d] = %s, want %s", i, list[i].PaymentID, id)
+		}
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	tests := []struct {
+		name    string
+		id      string
+		version uint64
+		err     error
+	}{
+		{"current version", "p", 1, nil},
+		{"stale version", "p", 2, ErrVersionMismatch},
+		{"missing", "q", 1, ErrNotExist},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := newTestRepo(t)
+			ctx := context.Background()
+			now := time.Now().UTC()
+
+			if err := repo.Insert(ctx, model.Payment{PaymentID: "p", OrderID: 1, Status: model.PaymentPending, CreatedAt: &now, Version: 1}); err != nil {
+				t.Fatalf("insert: %v", err)
+			}
+
+			updated, err := repo.Update(ctx, model.Payment{PaymentID: tt.id, OrderID: 1, Status: model.PaymentPaid, CreatedAt: &now, Version: tt.version})
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Update error = %v, want %v", err, tt.err)
+			}
+			if err == nil && updated.Version != tt.version+1 {
+				t.Errorf("Update version = %d, want %d", updated.Version, tt.version+1)
+			}
+		})
+	}
+}
+
+func TestLock(t *testing.T) {
+	repo := newTestRepo(t)
+	ctx := context.Background()
+
+	unlock, err := repo.Lock(ctx, 1, time.Minute)
+	if err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+	if _, err := repo.Lock(ctx, 1, time.Minute); !errors.Is(err, ErrLocked) {
+		t.Errorf("second Lock error = %v, want %v", err, ErrLocked)
+	}
+	if other, err := repo.Lock(ctx, 2, time.Minute); err != nil {
+		t.Errorf("Lock of another order: %v", err)
+	} else {
+		other()
+	}
+
+	unlock()
+	again, err := repo.Lock(ctx, 1, time.Minute)
+	if err != nil {
+		t.Fatalf("Lock after unlock: %v", err)
+	}
+	again()
+}
@@ -5,11 +5,24 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log/slog"
+	"time"
 
 	"github.com/redis/go-redis/v9"
+	"github.com/umuttopalak/orders-api/events"
+	"github.com/umuttopalak/orders-api/logging"
 	"github.com/umuttopalak/orders-api/model"
+	"github.com/umuttopalak/orders-api/repository/batch"
+	"github.com/umuttopalak/orders-api/repository/pagination"
+	"go.opentelemetry.io/otel"
 )
 
+var tracer = otel.Tracer("github.com/umuttopalak/orders-api/repository/product")
+
+// productsIndex lists every product key scored by its creation time in
+// milliseconds.
+const productsIndex = "products:by_created"
+
 type RedisRepo struct {
 	Client *redis.Client
 }
@@ -18,19 +31,21 @@ func ProductIDKey(id uint64) string {
 	return fmt.Sprintf("product:%d", id)
 }
 
-type FindAllPage struct {
-	Size   uint64
-	Offset uint64
-}
-
 type FindResult struct {
 	Products []model.Product
-	Cursor   uint64
+	Next     *pagination.Cursor
+	Prev     *pagination.Cursor
+	Total    int64
 }
 
 var ErrNotExist = errors.New("product does not exist")
 
+var ErrVersionMismatch = errors.New("product version mismatch")
+
 func (r *RedisRepo) Insert(ctx context.Context, Product model.Product) error {
+	ctx, span := tracer.Start(ctx, "product.RedisRepo.Insert")
+	defer span.End()
+
 	data, err := json.Marshal(Product)
 	if err != nil {
 		return fmt.Errorf("failed to encode product: %w", err)
@@ -38,28 +53,43 @@ func (r *RedisRepo) Insert(ctx context.Context, Product model.Product) error {
 
 	key := ProductIDKey(Product.ProductID)
 
+	evs, err := changeEvents(nil, &Product)
+	if err != nil {
+		return err
+	}
+
 	txn := r.Client.TxPipeline()
 
-	res := r.Client.SetNX(ctx, key, string(data), 0)
+	res := txn.SetNX(ctx, key, string(data), 0)
 
 	if err := res.Err(); err != nil {
 		txn.Discard()
 		return fmt.Errorf("failed to set: %w", err)
 	}
 
-	if err := txn.SAdd(ctx, "products", key).Err(); err != nil {
+	score := float64(time.Now().UnixMilli())
+	if err := txn.ZAdd(ctx, productsIndex, redis.Z{Score: score, Member: key}).Err(); err != nil {
 		txn.Discard()
-		return fmt.Errorf("failed to add Product to products: %w", err)
+		return fmt.Errorf("failed to add product to products: %w", err)
+	}
+
+	for _, e := range evs {
+		events.Append(ctx, txn, e)
 	}
 
 	if _, err := txn.Exec(ctx); err != nil {
 		return fmt.Errorf("failed to exec: %w", err)
 	}
 
+	logging.FromContext(ctx).Debug("product inserted", slog.String("key", key))
+
 	return nil
 }
 
 func (r *RedisRepo) FindByID(ctx context.Context, id uint64) (model.Product, error) {
+	ctx, span := tracer.Start(ctx, "product.RedisRepo.FindByID")
+	defer span.End()
+
 	key := ProductIDKey(id)
 
 	value, err := r.Client.Get(ctx, key).Result()
@@ -78,85 +108,344 @@ func (r *RedisRepo) FindByID(ctx context.Context, id uint64) (model.Product, err
 	return Product, nil
 }
 
-func (r *RedisRepo) DeleteByID(ctx context.Context, id uint64) error {
-	key := ProductIDKey(id)
+// FindByIDs returns the products that exist among ids, keyed by ID.
+func (r *RedisRepo) FindByIDs(ctx context.Context, ids []uint64) (map[uint64]model.Product, error) {
+	ctx, span := tracer.Start(ctx, "product.RedisRepo.FindByIDs")
+	defer span.End()
 
-	txn := r.Client.TxPipeline()
+	products := make(map[uint64]model.Product, len(ids))
+	if len(ids) == 0 {
+		return products, nil
+	}
 
-	err := txn.Del(ctx, key).Err()
-	if errors.Is(err, redis.Nil) {
-		txn.Discard()
-		return ErrNotExist
-	} else if err != nil {
-		txn.Discard()
-		return fmt.Errorf("get product: %w", err)
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = ProductIDKey(id)
 	}
 
-	if err := txn.SRem(ctx, "products", key).Err(); err != nil {
-		txn.Discard()
-		return fmt.Errorf("failed to remove product from products: %w", err)
+	xs, err := r.Client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get products: %w", err)
 	}
 
-	if _, err := txn.Exec(ctx); err != nil {
-		return fmt.Errorf("failed to exec: %w", err)
+	for _, x := range xs {
+		if x == nil {
+			continue
+		}
+
+		var Product model.Product
+		if err := json.Unmarshal([]byte(x.(string)), &Product); err != nil {
+			return nil, fmt.Errorf("failed to decode product json: %w", err)
+		}
+		products[Product.ProductID] = Product
 	}
 
+	return products, nil
+}
+
+// DeleteByID removes the product. A non-zero version makes the delete
+// conditional on the stored product still being at that version.
+func (r *RedisRepo) DeleteByID(ctx context.Context, id uint64, version uint64) error {
+	ctx, span := tracer.Start(ctx, "product.RedisRepo.DeleteByID")
+	defer span.End()
+
+	key := ProductIDKey(id)
+
+	err := r.Client.Watch(ctx, func(tx *redis.Tx) error {
+		current, err := stored(ctx, tx, key)
+		if err != nil {
+			return err
+		}
+
+		if version != 0 && current.Version != version {
+			return ErrVersionMismatch
+		}
+
+		evs, err := changeEvents(&current, nil)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, key)
+			pipe.ZRem(ctx, productsIndex, key)
+			for _, e := range evs {
+				events.Append(ctx, pipe, e)
+			}
+			return nil
+		})
+		return err
+	}, key)
+	if errors.Is(err, redis.TxFailedErr) {
+		return ErrVersionMismatch
+	} else if err != nil {
+		return err
+	}
+
+	logging.FromContext(ctx).Debug("product deleted", slog.String("key", key))
+
 	return nil
 }
 
-func (r *RedisRepo) Update(ctx context.Context, Product model.Product) error {
+// Update stores Product if the stored product is still at Product.Version and
+// returns it with the version incremented. Concurrent writers are detected
+// with WATCH and reported as ErrVersionMismatch.
+func (r *RedisRepo) Update(ctx context.Context, Product model.Product) (model.Product, error) {
+	ctx, span := tracer.Start(ctx, "product.RedisRepo.Update")
+	defer span.End()
+
+	expected := Product.Version
+	Product.Version++
+
 	data, err := json.Marshal(Product)
 	if err != nil {
-		return fmt.Errorf("Failed to encode product: %w", err)
+		return model.Product{}, fmt.Errorf("failed to encode product: %w", err)
 	}
 
 	key := ProductIDKey(Product.ProductID)
 
-	err = r.Client.SetXX(ctx, key, string(data), 0).Err()
+	err = r.Client.Watch(ctx, func(tx *redis.Tx) error {
+		current, err := stored(ctx, tx, key)
+		if err != nil {
+			return err
+		}
+
+		if current.Version != expected {
+			return ErrVersionMismatch
+		}
+
+		evs, err := changeEvents(&current, &Product)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, string(data), 0)
+			for _, e := range evs {
+				events.Append(ctx, pipe, e)
+			}
+			return nil
+		})
+		return err
+	}, key)
+	if errors.Is(err, redis.TxFailedErr) {
+		return model.Product{}, ErrVersionMismatch
+	} else if err != nil {
+		return model.Product{}, err
+	}
+
+	logging.FromContext(ctx).Debug("product updated", slog.String("key", key))
+
+	return Product, nil
+}
+
+func stored(ctx context.Context, tx *redis.Tx, key string) (model.Product, error) {
+	value, err := tx.Get(ctx, key).Result()
 	if errors.Is(err, redis.Nil) {
-		return ErrNotExist
+		return model.Product{}, ErrNotExist
 	} else if err != nil {
-		return fmt.Errorf("set product: %w", err)
+		return model.Product{}, fmt.Errorf("get product: %w", err)
 	}
 
-	return nil
+	var x model.Product
+	if err := json.Unmarshal([]byte(value), &x); err != nil {
+		return model.Product{}, fmt.Errorf("failed to decode product json: %w", err)
+	}
+
+	return x, nil
+}
+
+// changeEvents describes a write of a product, before being nil for an
+// insert and after for a delete. A changed price adds ProductPriceChanged
+// next to ProductUpdated.
+func changeEvents(before, after *model.Product) ([]events.Event, error) {
+	switch {
+	case before == nil:
+		e, err := events.New(events.ProductCreated, events.AggregateProduct, after.ProductID, after.Version, after)
+		return []events.Event{e}, err
+	case after == nil:
+		e, err := events.New(events.ProductDeleted, events.AggregateProduct, before.ProductID, 0, before)
+		return []events.Event{e}, err
+	}
+
+	e, err := events.New(events.ProductUpdated, events.AggregateProduct, after.ProductID, after.Version, after)
+	if err != nil {
+		return nil, err
+	}
+	evs := []events.Event{e}
+
+	if before.ProductPrice != after.ProductPrice {
+		e, err := events.New(events.ProductPriceChanged, events.AggregateProduct, after.ProductID, after.Version, events.PriceChange{
+			ProductID: after.ProductID,
+			OldPrice:  before.ProductPrice,
+			NewPrice:  after.ProductPrice,
+		})
+		if err != nil {
+			return nil, err
+		}
+		evs = append(evs, e)
+	}
+
+	return evs, nil
 }
 
-func (r *RedisRepo) FindAll(ctx context.Context, page FindAllPage) (FindResult, error) {
-	res := r.Client.SScan(ctx, "products", page.Offset, "*", int64(page.Size))
+func (r *RedisRepo) FindAll(ctx context.Context, page pagination.Query) (FindResult, error) {
+	ctx, span := tracer.Start(ctx, "product.RedisRepo.FindAll")
+	defer span.End()
 
-	keys, cursor, err := res.Result()
+	res, err := pagination.Find(ctx, r.Client, productsIndex, page)
 	if err != nil {
-		return FindResult{}, fmt.Errorf("failed to get Product id's: %w", err)
+		return FindResult{}, fmt.Errorf("failed to get product id's: %w", err)
 	}
 
-	if len(keys) == 0 {
+	if len(res.Keys) == 0 {
 		return FindResult{
 			Products: []model.Product{},
+			Next:     res.Next,
+			Prev:     res.Prev,
+			Total:    res.Total,
 		}, nil
 	}
 
-	xs, err := r.Client.MGet(ctx, keys...).Result()
+	xs, err := r.Client.MGet(ctx, res.Keys...).Result()
 	if err != nil {
 		return FindResult{}, fmt.Errorf("failed to get products: %w", err)
 	}
 
-	products := make([]model.Product, len(xs))
+	products := make([]model.Product, 0, len(xs))
+
+	for _, x := range xs {
+		// The key was deleted after the index was read.
+		if x == nil {
+			continue
+		}
 
-	for i, x := range xs {
-		x := x.(string)
 		var Product model.Product
 
-		err := json.Unmarshal([]byte(x), &Product)
+		err := json.Unmarshal([]byte(x.(string)), &Product)
 		if err != nil {
-			return FindResult{}, fmt.Errorf("failed to decode products json: %w", err)
+			return FindResult{}, fmt.Errorf("failed to decode product json: %w", err)
 		}
 
-		products[i] = Product
+		products = append(products, Product)
 	}
 
+	logging.FromContext(ctx).Debug("products listed", slog.Int("count", len(products)), slog.Int64("total", res.Total))
+
 	return FindResult{
 		Products: products,
-		Cursor:   cursor,
+		Next:     res.Next,
+		Prev:     res.Prev,
+		Total:    res.Total,
 	}, nil
 }
+
+// MigrateIndex moves products from the unordered set used before listings
+// were sorted by creation time into the sorted index.
+func (r *RedisRepo) MigrateIndex(ctx context.Context) error {
+	return pagination.MigrateSet(ctx, r.Client, "products", productsIndex)
+}
+
+// InsertMany stores products in one transaction. See batch.Apply for how
+// per-item failures and atomic mode are reported.
+func (r *RedisRepo) InsertMany(ctx context.Context, products []model.Product, atomic bool) ([]error, error) {
+	ctx, span := tracer.Start(ctx, "product.RedisRepo.InsertMany")
+	defer span.End()
+
+	writes := make([]batch.Write, len(products))
+	for i, x := range products {
+		x := x
+		data, err := json.Marshal(x)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode product: %w", err)
+		}
+		writes[i] = batch.Write{Op: batch.Create, Key: ProductIDKey(x.ProductID), Data: string(data), Events: batchEvents(&x)}
+	}
+
+	errs, err := batch.Apply(ctx, r.Client, productsIndex, writes, atomic)
+	if err != nil {
+		return nil, err
+	}
+
+	logging.FromContext(ctx).Debug("products inserted", slog.Int("count", len(writes)))
+
+	return errs, nil
+}
+
+// UpdateMany stores products whose stored versions still match their
+// Version fields and returns them with the versions incremented. A zero
+// Version updates whatever version is stored.
+func (r *RedisRepo) UpdateMany(ctx context.Context, products []model.Product, atomic bool) ([]model.Product, []error, error) {
+	ctx, span := tracer.Start(ctx, "product.RedisRepo.UpdateMany")
+	defer span.End()
+
+	keys := make([]string, len(products))
+	versions := make([]uint64, len(products))
+	for i, x := range products {
+		keys[i] = ProductIDKey(x.ProductID)
+		versions[i] = x.Version
+	}
+	if err := batch.FillVersions(ctx, r.Client, keys, versions); err != nil {
+		return nil, nil, err
+	}
+
+	updated := make([]model.Product, len(products))
+	writes := make([]batch.Write, len(products))
+	for i, x := range products {
+		expected := versions[i]
+		x.Version = expected + 1
+
+		data, err := json.Marshal(x)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to encode product: %w", err)
+		}
+		updated[i] = x
+		writes[i] = batch.Write{Op: batch.Update, Key: keys[i], Data: string(data), Version: expected, Events: batchEvents(&updated[i])}
+	}
+
+	errs, err := batch.Apply(ctx, r.Client, productsIndex, writes, atomic)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	logging.FromContext(ctx).Debug("products updated", slog.Int("count", len(writes)))
+
+	return updated, errs, nil
+}
+
+// DeleteMany removes the targeted products. Targets with a zero version
+// are deleted unconditionally.
+func (r *RedisRepo) DeleteMany(ctx context.Context, targets []batch.Target, atomic bool) ([]error, error) {
+	ctx, span := tracer.Start(ctx, "product.RedisRepo.DeleteMany")
+	defer span.End()
+
+	writes := make([]batch.Write, len(targets))
+	for i, t := range targets {
+		writes[i] = batch.Write{Op: batch.Delete, Key: ProductIDKey(t.ID), Version: t.Version, Events: batchEvents(nil)}
+	}
+
+	errs, err := batch.Apply(ctx, r.Client, productsIndex, writes, atomic)
+	if err != nil {
+		return nil, err
+	}
+
+	logging.FromContext(ctx).Debug("products deleted", slog.Int("count", len(writes)))
+
+	return errs, nil
+}
+
+// batchEvents adapts changeEvents to batch.Write, decoding the value the
+// write replaces.
+func batchEvents(after *model.Product) func(previous string) ([]events.Event, error) {
+	return func(previous string) ([]events.Event, error) {
+		if previous == "" {
+			return changeEvents(nil, after)
+		}
+
+		var before model.Product
+		if err := json.Unmarshal([]byte(previous), &before); err != nil {
+			return nil, fmt.Errorf("failed to decode product json: %w", err)
+		}
+		return changeEvents(&before, after)
+	}
+}
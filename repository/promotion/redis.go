@@ -0,0 +1,346 @@
+package promotion
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"github.com/umuttopalak/orders-api/logging"
+	"github.com/umuttopalak/orders-api/model"
+	"github.com/umuttopalak/orders-api/repository/pagination"
+	"go.opentelemetry.io/otel"
+)
+
+var tracer = otel.Tracer("github.com/umuttopalak/orders-api/repository/promotion")
+
+// promotionsIndex lists every promotion key scored by its creation time in
+// milliseconds.
+const promotionsIndex = "promotions:by_created"
+
+type RedisRepo struct {
+	Client *redis.Client
+}
+
+type FindResult struct {
+	Promotions []model.Promotion
+	Next       *pagination.Cursor
+	Prev       *pagination.Cursor
+	Total      int64
+}
+
+var ErrNotExist = errors.New("promotion does not exist")
+
+var ErrExists = errors.New("promotion already exists")
+
+var ErrVersionMismatch = errors.New("promotion version mismatch")
+
+// ErrExhausted is returned by Redeem when the promotion, or the customer's
+// share of it, has been used up.
+var ErrExhausted = errors.New("promotion usage limit reached")
+
+func PromotionCodeKey(code string) string {
+	return fmt.Sprintf("promotion:%s", code)
+}
+
+// redemptionsKey counts the redemptions of a promotion, and
+// customersKey counts them per customer.
+func redemptionsKey(code string) string {
+	return fmt.Sprintf("promotion:%s:redemptions", code)
+}
+
+func customersKey(code string) string {
+	return fmt.Sprintf("promotion:%s:customers", code)
+}
+
+func (r *RedisRepo) Insert(ctx context.Context, promotion model.Promotion) error {
+	ctx, span := tracer.Start(ctx, "promotion.RedisRepo.Insert")
+	defer span.End()
+
+	data, err := json.Marshal(promotion)
+	if err != nil {
+		return fmt.Errorf("failed to encode promotion: %w", err)
+	}
+
+	key := PromotionCodeKey(promotion.Code)
+
+	err = r.Client.Watch(ctx, func(tx *redis.Tx) error {
+		n, err := tx.Exists(ctx, key).Result()
+		if err != nil {
+			return fmt.Errorf("failed to check promotion: %w", err)
+		}
+		if n > 0 {
+			return ErrExists
+		}
+
+		// A deleted promotion's code can be reused, starting over.
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, string(data), 0)
+			pipe.Del(ctx, redemptionsKey(promotion.Code), customersKey(promotion.Code))
+			pipe.ZAdd(ctx, promotionsIndex, redis.Z{Score: float64(time.Now().UnixMilli()), Member: key})
+			return nil
+		})
+		return err
+	}, key)
+	if errors.Is(err, redis.TxFailedErr) {
+		return ErrExists
+	} else if err != nil {
+		return err
+	}
+
+	logging.FromContext(ctx).Debug("promotion inserted", slog.String("key", key))
+
+	return nil
+}
+
+func (r *RedisRepo) FindByCode(ctx context.Context, code string) (model.Promotion, error) {
+	ctx, span := tracer.Start(ctx, "promotion.RedisRepo.FindByCode")
+	defer span.End()
+
+	promotions, err := r.get(ctx, []string{PromotionCodeKey(code)})
+	if err != nil {
+		return model.Promotion{}, err
+	}
+	if len(promotions) == 0 {
+		return model.Promotion{}, ErrNotExist
+	}
+
+	return promotions[0], nil
+}
+
+// DeleteByCode removes the promotion and its redemption counters. A
+// non-zero version makes the delete conditional on the stored promotion
+// still being at that version.
+func (r *RedisRepo) DeleteByCode(ctx context.Context, code string, version uint64) error {
+	ctx, span := tracer.Start(ctx, "promotion.RedisRepo.DeleteByCode")
+	defer span.End()
+
+	key := PromotionCodeKey(code)
+
+	err := r.Client.Watch(ctx, func(tx *redis.Tx) error {
+		current, err := currentVersion(ctx, tx, key)
+		if err != nil {
+			return err
+		}
+
+		if version != 0 && current != version {
+			return ErrVersionMismatch
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, key, redemptionsKey(code), customersKey(code))
+			pipe.ZRem(ctx, promotionsIndex, key)
+			return nil
+		})
+		return err
+	}, key)
+	if errors.Is(err, redis.TxFailedErr) {
+		return ErrVersionMismatch
+	} else if err != nil {
+		return err
+	}
+
+	logging.FromContext(ctx).Debug("promotion deleted", slog.String("key", key))
+
+	return nil
+}
+
+// Update stores promotion if the stored promotion is still at
+// promotion.Version and returns it with the version incremented.
+// Concurrent writers are detected with WATCH and reported as
+// ErrVersionMismatch.
+func (r *RedisRepo) Update(ctx context.Context, promotion model.Promotion) (model.Promotion, error) {
+	ctx, span := tracer.Start(ctx, "promotion.RedisRepo.Update")
+	defer span.End()
+
+	expected := promotion.Version
+	promotion.Version++
+
+	data, err := json.Marshal(promotion)
+	if err != nil {
+		return model.Promotion{}, fmt.Errorf("failed to encode promotion: %w", err)
+	}
+
+	key := PromotionCodeKey(promotion.Code)
+
+	err = r.Client.Watch(ctx, func(tx *redis.Tx) error {
+		current, err := currentVersion(ctx, tx, key)
+		if err != nil {
+			return err
+		}
+
+		if current != expected {
+			return ErrVersionMismatch
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			return pipe.Set(ctx, key, string(data), 0).Err()
+		})
+		return err
+	}, key)
+	if errors.Is(err, redis.TxFailedErr) {
+		return model.Promotion{}, ErrVersionMismatch
+	} else if err != nil {
+		return model.Promotion{}, err
+	}
+
+	logging.FromContext(ctx).Debug("promotion updated", slog.String("key", key))
+
+	return promotion, nil
+}
+
+func currentVersion(ctx context.Context, tx *redis.Tx, key string) (uint64, error) {
+	value, err := tx.Get(ctx, key).Result()
+	if errors.Is(err, redis.Nil) {
+		return 0, ErrNotExist
+	} else if err != nil {
+		return 0, fmt.Errorf("get promotion: %w", err)
+	}
+
+	var stored struct {
+		Version uint64 `json:"version"`
+	}
+	if err := json.Unmarshal([]byte(value), &stored); err != nil {
+		return 0, fmt.Errorf("failed to decode promotion json: %w", err)
+	}
+
+	return stored.Version, nil
+}
+
+func (r *RedisRepo) FindAll(ctx context.Context, page pagination.Query) (FindResult, error) {
+	ctx, span := tracer.Start(ctx, "promotion.RedisRepo.FindAll")
+	defer span.End()
+
+	res, err := pagination.Find(ctx, r.Client, promotionsIndex, page)
+	if err != nil {
+		return FindResult{}, fmt.Errorf("failed to get promotion codes: %w", err)
+	}
+
+	promotions, err := r.get(ctx, res.Keys)
+	if err != nil {
+		return FindResult{}, err
+	}
+
+	return FindResult{
+		Promotions: promotions,
+		Next:       res.Next,
+		Prev:       res.Prev,
+		Total:      res.Total,
+	}, nil
+}
+
+// get reads the promotions with their redemption counts.
+func (r *RedisRepo) get(ctx context.Context, keys []string) ([]model.Promotion, error) {
+	if len(keys) == 0 {
+		return []model.Promotion{}, nil
+	}
+
+	pipe := r.Client.Pipeline()
+	values := make([]*redis.StringCmd, len(keys))
+	counts := make([]*redis.StringCmd, len(keys))
+	for i, key := range keys {
+		values[i] = pipe.Get(ctx, key)
+		counts[i] = pipe.Get(ctx, key+":redemptions")
+	}
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return nil, fmt.Errorf("failed to get promotions: %w", err)
+	}
+
+	promotions := make([]model.Promotion, 0, len(keys))
+
+	for i := range keys {
+		value, err := values[i].Result()
+		// The key was deleted after the index was read.
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+
+		var promotion model.Promotion
+		if err := json.Unmarshal([]byte(value), &promotion); err != nil {
+			return nil, fmt.Errorf("failed to decode promotion json: %w", err)
+		}
+
+		promotion.Redemptions = 0
+		if count, err := counts[i].Uint64(); err == nil {
+			promotion.Redemptions = count
+		}
+
+		promotions = append(promotions, promotion)
+	}
+
+	return promotions, nil
+}
+
+// redeemScript counts a redemption unless it would exceed the overall or
+// the per-customer limit, both checked and incremented in one step so
+// concurrent orders cannot over-redeem. A limit of 0 is unlimited.
+//
+// KEYS[1] redemptions counter, KEYS[2] per-customer hash
+// ARGV[1] usage limit, ARGV[2] per-customer limit, ARGV[3] customer ID
+var redeemScript = redis.NewScript(`
+local limit = tonumber(ARGV[1])
+local perCustomer = tonumber(ARGV[2])
+if limit > 0 and tonumber(redis.call("GET", KEYS[1]) or "0") >= limit then
+	return 0
+end
+if perCustomer > 0 and tonumber(redis.call("HGET", KEYS[2], ARGV[3]) or "0") >= perCustomer then
+	return 0
+end
+redis.call("INCR", KEYS[1])
+redis.call("HINCRBY", KEYS[2], ARGV[3], 1)
+return 1
+`)
+
+// Redeem counts one use of the promotion by the customer, or returns
+// ErrExhausted if a limit has been reached.
+func (r *RedisRepo) Redeem(ctx context.Context, promotion model.Promotion, customerID uuid.UUID) error {
+	ctx, span := tracer.Start(ctx, "promotion.RedisRepo.Redeem")
+	defer span.End()
+
+	ok, err := redeemScript.Run(ctx, r.Client,
+		[]string{redemptionsKey(promotion.Code), customersKey(promotion.Code)},
+		strconv.FormatUint(promotion.UsageLimit, 10),
+		strconv.FormatUint(promotion.PerCustomerLimit, 10),
+		customerID.String(),
+	).Int()
+	if err != nil {
+		return fmt.Errorf("failed to redeem promotion: %w", err)
+	}
+	if ok == 0 {
+		return ErrExhausted
+	}
+
+	return nil
+}
+
+// releaseScript takes back a redemption, never going below zero.
+var releaseScript = redis.NewScript(`
+if tonumber(redis.call("GET", KEYS[1]) or "0") > 0 then
+	redis.call("DECR", KEYS[1])
+end
+if tonumber(redis.call("HGET", KEYS[2], ARGV[1]) or "0") > 0 then
+	redis.call("HINCRBY", KEYS[2], ARGV[1], -1)
+end
+return 1
+`)
+
+// Release takes back a redemption whose order could not be stored.
+func (r *RedisRepo) Release(ctx context.Context, code string, customerID uuid.UUID) error {
+	ctx, span := tracer.Start(ctx, "promotion.RedisRepo.Release")
+	defer span.End()
+
+	err := releaseScript.Run(ctx, r.Client,
+		[]string{redemptionsKey(code), customersKey(code)},
+		customerID.String(),
+	).Err()
+	if err != nil {
+		return fmt.Errorf("failed to release promotion: %w", err)
+	}
+
+	return nil
+}
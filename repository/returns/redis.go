@@ -0,0 +1,224 @@
+package returns
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/umuttopalak/orders-api/events"
+	"github.com/umuttopalak/orders-api/logging"
+	"github.com/umuttopalak/orders-api/model"
+	"github.com/umuttopalak/orders-api/repository/lock"
+	"go.opentelemetry.io/otel"
+)
+
+var tracer = otel.Tracer("github.com/umuttopalak/orders-api/repository/returns")
+
+type RedisRepo struct {
+	Client *redis.Client
+}
+
+var ErrNotExist = errors.New("return does not exist")
+
+var ErrVersionMismatch = errors.New("return version mismatch")
+
+// ErrLocked is returned by Lock while another request holds the order's
+// returns lock.
+var ErrLocked = errors.New("order returns are locked")
+
+func ReturnIDKey(id uint64) string {
+	return fmt.Sprintf("return:%d", id)
+}
+
+// orderReturnsKey lists the return keys of an order scored by creation
+// time in milliseconds.
+func orderReturnsKey(orderID uint64) string {
+	return fmt.Sprintf("order:%d:returns", orderID)
+}
+
+func lockKey(orderID uint64) string {
+	return fmt.Sprintf("order:%d:return_lock", orderID)
+}
+
+func (r *RedisRepo) Insert(ctx context.Context, ret model.Return) error {
+	ctx, span := tracer.Start(ctx, "returns.RedisRepo.Insert")
+	defer span.End()
+
+	data, err := json.Marshal(ret)
+	if err != nil {
+		return fmt.Errorf("failed to encode return: %w", err)
+	}
+
+	e, err := statusEvent(ret)
+	if err != nil {
+		return err
+	}
+
+	key := ReturnIDKey(ret.ReturnID)
+
+	_, err = r.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SetNX(ctx, key, string(data), 0)
+		pipe.ZAdd(ctx, orderReturnsKey(ret.OrderID), redis.Z{Score: float64(time.Now().UnixMilli()), Member: key})
+		events.Append(ctx, pipe, e)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to exec: %w", err)
+	}
+
+	logging.FromContext(ctx).Debug("return inserted", slog.String("key", key))
+
+	return nil
+}
+
+func (r *RedisRepo) FindByID(ctx context.Context, id uint64) (model.Return, error) {
+	ctx, span := tracer.Start(ctx, "returns.RedisRepo.FindByID")
+	defer span.End()
+
+	value, err := r.Client.Get(ctx, ReturnIDKey(id)).Result()
+	if errors.Is(err, redis.Nil) {
+		return model.Return{}, ErrNotExist
+	} else if err != nil {
+		return model.Return{}, fmt.Errorf("get return: %w", err)
+	}
+
+	var ret model.Return
+	if err := json.Unmarshal([]byte(value), &ret); err != nil {
+		return model.Return{}, fmt.Errorf("failed to decode return json: %w", err)
+	}
+
+	return ret, nil
+}
+
+// Update stores ret if the stored return is still at ret.Version and
+// returns it with the version incremented. A change of status appends the
+// matching event in the same transaction. Refunding is a step of the
+// refund, which is reported once, as ReturnRefunded.
+func (r *RedisRepo) Update(ctx context.Context, ret model.Return) (model.Return, error) {
+	ctx, span := tracer.Start(ctx, "returns.RedisRepo.Update")
+	defer span.End()
+
+	expected := ret.Version
+	ret.Version++
+
+	data, err := json.Marshal(ret)
+	if err != nil {
+		return model.Return{}, fmt.Errorf("failed to encode return: %w", err)
+	}
+
+	key := ReturnIDKey(ret.ReturnID)
+
+	err = r.Client.Watch(ctx, func(tx *redis.Tx) error {
+		value, err := tx.Get(ctx, key).Result()
+		if errors.Is(err, redis.Nil) {
+			return ErrNotExist
+		} else if err != nil {
+			return fmt.Errorf("get return: %w", err)
+		}
+
+		var current model.Return
+		if err := json.Unmarshal([]byte(value), &current); err != nil {
+			return fmt.Errorf("failed to decode return json: %w", err)
+		}
+		if current.Version != expected {
+			return ErrVersionMismatch
+		}
+
+		var evs []events.Event
+		if current.Status != ret.Status && ret.Status != model.ReturnRefunding {
+			e, err := statusEvent(ret)
+			if err != nil {
+				return err
+			}
+			evs = append(evs, e)
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, string(data), 0)
+			for _, e := range evs {
+				events.Append(ctx, pipe, e)
+			}
+			return nil
+		})
+		return err
+	}, key)
+	if errors.Is(err, redis.TxFailedErr) {
+		return model.Return{}, ErrVersionMismatch
+	} else if err != nil {
+		return model.Return{}, err
+	}
+
+	logging.FromContext(ctx).Debug("return updated", slog.String("key", key))
+
+	return ret, nil
+}
+
+// FindByOrder returns the returns of an order, oldest first.
+func (r *RedisRepo) FindByOrder(ctx context.Context, orderID uint64) ([]model.Return, error) {
+	ctx, span := tracer.Start(ctx, "returns.RedisRepo.FindByOrder")
+	defer span.End()
+
+	keys, err := r.Client.ZRange(ctx, orderReturnsKey(orderID), 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get return keys: %w", err)
+	}
+
+	list := make([]model.Return, 0, len(keys))
+	if len(keys) == 0 {
+		return list, nil
+	}
+
+	xs, err := r.Client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get returns: %w", err)
+	}
+
+	for _, x := range xs {
+		if x == nil {
+			continue
+		}
+
+		var ret model.Return
+		if err := json.Unmarshal([]byte(x.(string)), &ret); err != nil {
+			return nil, fmt.Errorf("failed to decode return json: %w", err)
+		}
+		list = append(list, ret)
+	}
+
+	return list, nil
+}
+
+// statusEvent describes a return that was created or moved to a new
+// status. The payload is the return after the change.
+func statusEvent(ret model.Return) (events.Event, error) {
+	typ := map[string]string{
+		model.ReturnRequested: events.ReturnRequested,
+		model.ReturnApproved:  events.ReturnApproved,
+		model.ReturnRejected:  events.ReturnRejected,
+		model.ReturnReceived:  events.ReturnReceived,
+		model.ReturnRefunded:  events.ReturnRefunded,
+	}[ret.Status]
+	if typ == "" {
+		return events.Event{}, fmt.Errorf("unknown return status %q", ret.Status)
+	}
+
+	return events.New(typ, events.AggregateReturn, ret.ReturnID, ret.Version, ret)
+}
+
+// Lock serializes changes to the returns of an order, so two returns
+// cannot both claim the same shipped units and a refund is only issued
+// once. The lock expires after ttl.
+func (r *RedisRepo) Lock(ctx context.Context, orderID uint64, ttl time.Duration) (unlock func(), err error) {
+	unlock, err = lock.Acquire(ctx, r.Client, lockKey(orderID), ttl)
+	if errors.Is(err, lock.ErrLocked) {
+		return nil, ErrLocked
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to lock order returns: %w", err)
+	}
+
+	return unlock, nil
+}
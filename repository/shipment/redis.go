@@ -0,0 +1,134 @@
+package shipment
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/umuttopalak/orders-api/logging"
+	"github.com/umuttopalak/orders-api/model"
+	"github.com/umuttopalak/orders-api/repository/lock"
+	"go.opentelemetry.io/otel"
+)
+
+var tracer = otel.Tracer("github.com/umuttopalak/orders-api/repository/shipment")
+
+type RedisRepo struct {
+	Client *redis.Client
+}
+
+var ErrNotExist = errors.New("shipment does not exist")
+
+// ErrLocked is returned by Lock while another request holds the order's
+// shipment lock.
+var ErrLocked = errors.New("order shipments are locked")
+
+func ShipmentIDKey(id string) string {
+	return fmt.Sprintf("shipment:%s", id)
+}
+
+// orderShipmentsKey lists the shipment keys of an order scored by creation
+// time in milliseconds.
+func orderShipmentsKey(orderID uint64) string {
+	return fmt.Sprintf("order:%d:shipments", orderID)
+}
+
+func lockKey(orderID uint64) string {
+	return fmt.Sprintf("order:%d:shipment_lock", orderID)
+}
+
+func (r *RedisRepo) Insert(ctx context.Context, shipment model.Shipment) error {
+	ctx, span := tracer.Start(ctx, "shipment.RedisRepo.Insert")
+	defer span.End()
+
+	data, err := json.Marshal(shipment)
+	if err != nil {
+		return fmt.Errorf("failed to encode shipment: %w", err)
+	}
+
+	key := ShipmentIDKey(shipment.ShipmentID)
+
+	_, err = r.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SetNX(ctx, key, string(data), 0)
+		pipe.ZAdd(ctx, orderShipmentsKey(shipment.OrderID), redis.Z{Score: float64(time.Now().UnixMilli()), Member: key})
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to exec: %w", err)
+	}
+
+	logging.FromContext(ctx).Debug("shipment inserted", slog.String("key", key))
+
+	return nil
+}
+
+func (r *RedisRepo) FindByID(ctx context.Context, id string) (model.Shipment, error) {
+	ctx, span := tracer.Start(ctx, "shipment.RedisRepo.FindByID")
+	defer span.End()
+
+	value, err := r.Client.Get(ctx, ShipmentIDKey(id)).Result()
+	if errors.Is(err, redis.Nil) {
+		return model.Shipment{}, ErrNotExist
+	} else if err != nil {
+		return model.Shipment{}, fmt.Errorf("get shipment: %w", err)
+	}
+
+	var shipment model.Shipment
+	if err := json.Unmarshal([]byte(value), &shipment); err != nil {
+		return model.Shipment{}, fmt.Errorf("failed to decode shipment json: %w", err)
+	}
+
+	return shipment, nil
+}
+
+// FindByOrder returns the shipments of an order, oldest first.
+func (r *RedisRepo) FindByOrder(ctx context.Context, orderID uint64) ([]model.Shipment, error) {
+	ctx, span := tracer.Start(ctx, "shipment.RedisRepo.FindByOrder")
+	defer span.End()
+
+	keys, err := r.Client.ZRange(ctx, orderShipmentsKey(orderID), 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get shipment keys: %w", err)
+	}
+
+	shipments := make([]model.Shipment, 0, len(keys))
+	if len(keys) == 0 {
+		return shipments, nil
+	}
+
+	xs, err := r.Client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get shipments: %w", err)
+	}
+
+	for _, x := range xs {
+		if x == nil {
+			continue
+		}
+
+		var shipment model.Shipment
+		if err := json.Unmarshal([]byte(x.(string)), &shipment); err != nil {
+			return nil, fmt.Errorf("failed to decode shipment json: %w", err)
+		}
+		shipments = append(shipments, shipment)
+	}
+
+	return shipments, nil
+}
+
+// Lock serializes shipment creation on an order, so two parcels cannot
+// both take the last units of a line item. The lock expires after ttl.
+func (r *RedisRepo) Lock(ctx context.Context, orderID uint64, ttl time.Duration) (unlock func(), err error) {
+	unlock, err = lock.Acquire(ctx, r.Client, lockKey(orderID), ttl)
+	if errors.Is(err, lock.ErrLocked) {
+		return nil, ErrLocked
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to lock order shipments: %w", err)
+	}
+
+	return unlock, nil
+}
@@ -0,0 +1,355 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/umuttopalak/orders-api/logging"
+	"github.com/umuttopalak/orders-api/model"
+	"github.com/umuttopalak/orders-api/repository/pagination"
+	"go.opentelemetry.io/otel"
+)
+
+var tracer = otel.Tracer("github.com/umuttopalak/orders-api/repository/webhook")
+
+// webhooksIndex lists every webhook key scored by its creation time in
+// milliseconds.
+const webhooksIndex = "webhooks:by_created"
+
+const (
+	maxDeliveryLog = 200
+	maxDeadLetters = 1000
+)
+
+type RedisRepo struct {
+	Client *redis.Client
+}
+
+type FindResult struct {
+	Webhooks []model.Webhook
+	Next     *pagination.Cursor
+	Prev     *pagination.Cursor
+	Total    int64
+}
+
+var ErrNotExist = errors.New("webhook does not exist")
+
+var ErrVersionMismatch = errors.New("webhook version mismatch")
+
+func WebhookIDKey(id uint64) string {
+	return fmt.Sprintf("webhook:%d", id)
+}
+
+func deliveriesKey(id uint64) string {
+	return fmt.Sprintf("webhook:%d:deliveries", id)
+}
+
+func deadLettersKey(id uint64) string {
+	return fmt.Sprintf("webhook:%d:dead_letters", id)
+}
+
+func (r *RedisRepo) Insert(ctx context.Context, webhook model.Webhook) error {
+	ctx, span := tracer.Start(ctx, "webhook.RedisRepo.Insert")
+	defer span.End()
+
+	data, err := json.Marshal(webhook)
+	if err != nil {
+		return fmt.Errorf("failed to encode webhook: %w", err)
+	}
+
+	key := WebhookIDKey(webhook.WebhookID)
+
+	txn := r.Client.TxPipeline()
+
+	res := txn.SetNX(ctx, key, string(data), 0)
+	if err := res.Err(); err != nil {
+		txn.Discard()
+		return fmt.Errorf("failed to set: %w", err)
+	}
+
+	score := float64(time.Now().UnixMilli())
+	if err := txn.ZAdd(ctx, webhooksIndex, redis.Z{Score: score, Member: key}).Err(); err != nil {
+		txn.Discard()
+		return fmt.Errorf("failed to add webhook to webhooks: %w", err)
+	}
+
+	if _, err := txn.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to exec: %w", err)
+	}
+
+	logging.FromContext(ctx).Debug("webhook inserted", slog.String("key", key))
+
+	return nil
+}
+
+func (r *RedisRepo) FindByID(ctx context.Context, id uint64) (model.Webhook, error) {
+	ctx, span := tracer.Start(ctx, "webhook.RedisRepo.FindByID")
+	defer span.End()
+
+	key := WebhookIDKey(id)
+
+	value, err := r.Client.Get(ctx, key).Result()
+	if errors.Is(err, redis.Nil) {
+		return model.Webhook{}, ErrNotExist
+	} else if err != nil {
+		return model.Webhook{}, fmt.Errorf("get webhook: %w", err)
+	}
+
+	var webhook model.Webhook
+	err = json.Unmarshal([]byte(value), &webhook)
+	if err != nil {
+		return model.Webhook{}, fmt.Errorf("failed to decode webhook json: %w", err)
+	}
+
+	return webhook, nil
+}
+
+// DeleteByID removes the webhook with its delivery log and dead letters. A
+// non-zero version makes the delete conditional on the stored webhook still
+// being at that version.
+func (r *RedisRepo) DeleteByID(ctx context.Context, id uint64, version uint64) error {
+	ctx, span := tracer.Start(ctx, "webhook.RedisRepo.DeleteByID")
+	defer span.End()
+
+	key := WebhookIDKey(id)
+
+	err := r.Client.Watch(ctx, func(tx *redis.Tx) error {
+		current, err := currentVersion(ctx, tx, key)
+		if err != nil {
+			return err
+		}
+
+		if version != 0 && current != version {
+			return ErrVersionMismatch
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, key, deliveriesKey(id), deadLettersKey(id))
+			pipe.ZRem(ctx, webhooksIndex, key)
+			return nil
+		})
+		return err
+	}, key)
+	if errors.Is(err, redis.TxFailedErr) {
+		return ErrVersionMismatch
+	} else if err != nil {
+		return err
+	}
+
+	logging.FromContext(ctx).Debug("webhook deleted", slog.String("key", key))
+
+	return nil
+}
+
+// Update stores webhook if the stored webhook is still at webhook.Version
+// and returns it with the version incremented. Concurrent writers are
+// detected with WATCH and reported as ErrVersionMismatch.
+func (r *RedisRepo) Update(ctx context.Context, webhook model.Webhook) (model.Webhook, error) {
+	ctx, span := tracer.Start(ctx, "webhook.RedisRepo.Update")
+	defer span.End()
+
+	expected := webhook.Version
+	webhook.Version++
+
+	data, err := json.Marshal(webhook)
+	if err != nil {
+		return model.Webhook{}, fmt.Errorf("failed to encode webhook: %w", err)
+	}
+
+	key := WebhookIDKey(webhook.WebhookID)
+
+	err = r.Client.Watch(ctx, func(tx *redis.Tx) error {
+		current, err := currentVersion(ctx, tx, key)
+		if err != nil {
+			return err
+		}
+
+		if current != expected {
+			return ErrVersionMismatch
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			return pipe.Set(ctx, key, string(data), 0).Err()
+		})
+		return err
+	}, key)
+	if errors.Is(err, redis.TxFailedErr) {
+		return model.Webhook{}, ErrVersionMismatch
+	} else if err != nil {
+		return model.Webhook{}, err
+	}
+
+	logging.FromContext(ctx).Debug("webhook updated", slog.String("key", key))
+
+	return webhook, nil
+}
+
+func currentVersion(ctx context.Context, tx *redis.Tx, key string) (uint64, error) {
+	value, err := tx.Get(ctx, key).Result()
+	if errors.Is(err, redis.Nil) {
+		return 0, ErrNotExist
+	} else if err != nil {
+		return 0, fmt.Errorf("get webhook: %w", err)
+	}
+
+	var stored struct {
+		Version uint64 `json:"version"`
+	}
+	if err := json.Unmarshal([]byte(value), &stored); err != nil {
+		return 0, fmt.Errorf("failed to decode webhook json: %w", err)
+	}
+
+	return stored.Version, nil
+}
+
+func (r *RedisRepo) FindAll(ctx context.Context, page pagination.Query) (FindResult, error) {
+	ctx, span := tracer.Start(ctx, "webhook.RedisRepo.FindAll")
+	defer span.End()
+
+	res, err := pagination.Find(ctx, r.Client, webhooksIndex, page)
+	if err != nil {
+		return FindResult{}, fmt.Errorf("failed to get webhook id's: %w", err)
+	}
+
+	webhooks, err := r.get(ctx, res.Keys)
+	if err != nil {
+		return FindResult{}, err
+	}
+
+	return FindResult{
+		Webhooks: webhooks,
+		Next:     res.Next,
+		Prev:     res.Prev,
+		Total:    res.Total,
+	}, nil
+}
+
+// FindActive returns every active webhook, for the dispatcher. The number
+// of subscriptions is expected to stay small.
+func (r *RedisRepo) FindActive(ctx context.Context) ([]model.Webhook, error) {
+	ctx, span := tracer.Start(ctx, "webhook.RedisRepo.FindActive")
+	defer span.End()
+
+	keys, err := r.Client.ZRange(ctx, webhooksIndex, 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get webhook id's: %w", err)
+	}
+
+	webhooks, err := r.get(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	active := webhooks[:0]
+	for _, webhook := range webhooks {
+		if webhook.Active {
+			active = append(active, webhook)
+		}
+	}
+
+	return active, nil
+}
+
+func (r *RedisRepo) get(ctx context.Context, keys []string) ([]model.Webhook, error) {
+	if len(keys) == 0 {
+		return []model.Webhook{}, nil
+	}
+
+	xs, err := r.Client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get webhooks: %w", err)
+	}
+
+	webhooks := make([]model.Webhook, 0, len(xs))
+
+	for _, x := range xs {
+		// The key was deleted after the index was read.
+		if x == nil {
+			continue
+		}
+
+		var webhook model.Webhook
+
+		err := json.Unmarshal([]byte(x.(string)), &webhook)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode webhook json: %w", err)
+		}
+
+		webhooks = append(webhooks, webhook)
+	}
+
+	return webhooks, nil
+}
+
+// LogDelivery records a delivery attempt, keeping the most recent ones.
+func (r *RedisRepo) LogDelivery(ctx context.Context, delivery model.WebhookDelivery) error {
+	ctx, span := tracer.Start(ctx, "webhook.RedisRepo.LogDelivery")
+	defer span.End()
+
+	return pushCapped(ctx, r.Client, deliveriesKey(delivery.WebhookID), delivery, maxDeliveryLog)
+}
+
+// Deliveries returns the most recent delivery attempts, newest first.
+func (r *RedisRepo) Deliveries(ctx context.Context, id uint64, limit int) ([]model.WebhookDelivery, error) {
+	ctx, span := tracer.Start(ctx, "webhook.RedisRepo.Deliveries")
+	defer span.End()
+
+	return readList[model.WebhookDelivery](ctx, r.Client, deliveriesKey(id), limit)
+}
+
+// DeadLetter stores a delivery that ran out of attempts.
+func (r *RedisRepo) DeadLetter(ctx context.Context, letter model.WebhookDeadLetter) error {
+	ctx, span := tracer.Start(ctx, "webhook.RedisRepo.DeadLetter")
+	defer span.End()
+
+	return pushCapped(ctx, r.Client, deadLettersKey(letter.WebhookID), letter, maxDeadLetters)
+}
+
+// DeadLetters returns the most recent dead letters, newest first.
+func (r *RedisRepo) DeadLetters(ctx context.Context, id uint64, limit int) ([]model.WebhookDeadLetter, error) {
+	ctx, span := tracer.Start(ctx, "webhook.RedisRepo.DeadLetters")
+	defer span.End()
+
+	return readList[model.WebhookDeadLetter](ctx, r.Client, deadLettersKey(id), limit)
+}
+
+func pushCapped(ctx context.Context, client *redis.Client, key string, v any, max int64) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s entry: %w", key, err)
+	}
+
+	_, err = client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.LPush(ctx, key, string(data))
+		pipe.LTrim(ctx, key, 0, max-1)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to push to %s: %w", key, err)
+	}
+
+	return nil
+}
+
+func readList[T any](ctx context.Context, client *redis.Client, key string, limit int) ([]T, error) {
+	values, err := client.LRange(ctx, key, 0, int64(limit)-1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", key, err)
+	}
+
+	items := make([]T, 0, len(values))
+	for _, value := range values {
+		var item T
+		if err := json.Unmarshal([]byte(value), &item); err != nil {
+			return nil, fmt.Errorf("failed to decode %s entry: %w", key, err)
+		}
+		items = append(items, item)
+	}
+
+	return items, nil
+}
@@ -0,0 +1,169 @@
+// Package tax computes the tax of order line items from a rate table keyed
+// by shipping region and product category.
+//
+// The table is read from a YAML file:
+//
+//	inclusive: false     # whether prices include tax, unless a region says otherwise
+//	regions:
+//	  US-CA:
+//	    rate: 7.25       # percent, at most two decimals
+//	    categories:
+//	      12: 0          # category ID: rate
+//	  DE:
+//	    rate: 19
+//	    inclusive: true
+//	    categories:
+//	      3: 7
+//
+// Region codes are matched case-insensitively, first in full and then by
+// the part before the first '-', so US-NY falls back to US if only that is
+// listed.
+package tax
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+
+	"github.com/umuttopalak/orders-api/model"
+	"gopkg.in/yaml.v3"
+)
+
+// ErrUnknownRegion is returned for a shipping region the table has no
+// rates for.
+var ErrUnknownRegion = errors.New("no tax rates for shipping region")
+
+// Rate is a tax rate in basis points, hundredths of a percent.
+type Rate uint32
+
+const maxRate Rate = 10000
+
+func (r *Rate) UnmarshalYAML(node *yaml.Node) error {
+	var percent float64
+	if err := node.Decode(&percent); err != nil {
+		return fmt.Errorf("line %d: rate must be a percentage", node.Line)
+	}
+
+	bps := math.Round(percent * 100)
+	if bps < 0 || bps > float64(maxRate) || math.Abs(bps-percent*100) > 1e-6 {
+		return fmt.Errorf("line %d: rate must be between 0 and 100 with at most two decimals", node.Line)
+	}
+
+	*r = Rate(bps)
+	return nil
+}
+
+type Region struct {
+	Rate       Rate            `yaml:"rate"`
+	Inclusive  *bool           `yaml:"inclusive"`
+	Categories map[uint64]Rate `yaml:"categories"`
+}
+
+// Table holds the tax rates of every region orders are shipped to. The
+// zero Table has none.
+type Table struct {
+	Inclusive bool              `yaml:"inclusive"`
+	Regions   map[string]Region `yaml:"regions"`
+}
+
+// Load reads a rate table from path. An empty path gives an empty table.
+func Load(path string) (*Table, error) {
+	t := &Table{}
+	if path == "" {
+		return t, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(t); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	regions := make(map[string]Region, len(t.Regions))
+	for code, region := range t.Regions {
+		regions[strings.ToUpper(code)] = region
+	}
+	t.Regions = regions
+
+	return t, nil
+}
+
+// Region returns the rates for a shipping region.
+func (t *Table) Region(code string) (Region, bool) {
+	code = strings.ToUpper(code)
+	if region, ok := t.Regions[code]; ok {
+		return region, true
+	}
+
+	country, _, found := strings.Cut(code, "-")
+	if !found {
+		return Region{}, false
+	}
+	region, ok := t.Regions[country]
+	return region, ok
+}
+
+// Apply sets the tax of every line item of o from the rates of
+// o.ShippingRegion. categories maps the line items' product IDs to their
+// category; line items without a known category are taxed at the region's
+// rate.
+//
+// Tax is charged on what the customer pays, so the order's discounts are
+// spread over the line items in proportion to their amount first.
+func (t *Table) Apply(o *model.Order, categories map[uint64]uint64) error {
+	region, ok := t.Region(o.ShippingRegion)
+	if !ok {
+		return fmt.Errorf("%w %s", ErrUnknownRegion, o.ShippingRegion)
+	}
+
+	o.TaxInclusive = t.Inclusive
+	if region.Inclusive != nil {
+		o.TaxInclusive = *region.Inclusive
+	}
+
+	subtotal := o.Subtotal()
+	discount := o.Discount()
+
+	var allocated uint64
+	for i := range o.LineItems {
+		item := &o.LineItems[i]
+
+		amount := uint64(item.Quantity) * uint64(item.Price)
+		share := discount - allocated
+		if i < len(o.LineItems)-1 && subtotal > 0 {
+			share = discount * amount / subtotal
+		}
+		share = min(share, amount)
+		allocated += share
+
+		rate := region.Rate
+		if categoryID, ok := categories[item.ProductID]; ok {
+			if r, ok := region.Categories[categoryID]; ok {
+				rate = r
+			}
+		}
+
+		item.TaxRate = uint32(rate)
+		item.Tax = rate.of(amount-share, o.TaxInclusive)
+	}
+
+	return nil
+}
+
+// of returns the tax in amount, rounded half up. An inclusive amount
+// already contains the tax.
+func (r Rate) of(amount uint64, inclusive bool) uint64 {
+	rate := uint64(r)
+	if inclusive {
+		return (amount*rate + (uint64(maxRate)+rate)/2) / (uint64(maxRate) + rate)
+	}
+	return (amount*rate + uint64(maxRate)/2) / uint64(maxRate)
+}
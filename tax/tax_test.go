@@ -0,0 +1,163 @@
+package tax
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/umuttopalak/orders-api/model"
+)
+
+const testRates = `
+inclusive: false
+regions:
+  us-ca:
+    rate: 7.25
+    categories:
+      12: 0
+  US:
+    rate: 5
+  DE:
+    rate: 19
+    inclusive: true
+    categories:
+      3: 7
+`
+
+func newTestTable(t *testing.T) *Table {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "tax.yaml")
+	if err := os.WriteFile(path, []byte(testRates), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	table, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	return table
+}
+
+func TestApply(t *testing.T) {
+	// Product 1 is in category 3, product 2 in category 12.
+	categories := map[uint64]uint64{1: 3, 2: 12}
+
+	tests := []struct {
+		name      string
+		region    string
+		items     []model.LineItem
+		discount  uint64
+		inclusive bool
+		rates     []uint32
+		taxes     []uint64
+	}{
+		{
+			name:   "exclusive rounds half up",
+			region: "US-CA",
+			items:  []model.LineItem{{Quantity: 1, Price: 1000}, {Quantity: 1, Price: 999}},
+			rates:  []uint32{725, 725},
+			taxes:  []uint64{73, 72},
+		},
+		{
+			name:      "inclusive",
+			region:    "DE",
+			items:     []model.LineItem{{Quantity: 1, Price: 1190}, {ProductID: 1, Quantity: 1, Price: 100}},
+			inclusive: true,
+			rates:     []uint32{1900, 700},
+			// 100 includes 6.54 of tax at 7%.
+			taxes: []uint64{190, 7},
+		},
+		{
+			name:   "category rate",
+			region: "US-CA",
+			items:  []model.LineItem{{ProductID: 2, Quantity: 3, Price: 500}, {ProductID: 9, Quantity: 1, Price: 1000}},
+			rates:  []uint32{0, 725},
+			taxes:  []uint64{0, 73},
+		},
+		{
+			name:     "discount spread by amount",
+			region:   "US",
+			items:    []model.LineItem{{Quantity: 2, Price: 300}, {Quantity: 1, Price: 400}},
+			discount: 100,
+			rates:    []uint32{500, 500},
+			// 5% of 600-60 and of 400-40.
+			taxes: []uint64{27, 18},
+		},
+		{
+			name:     "discount remainder on the last line item",
+			region:   "US",
+			items:    []model.LineItem{{Quantity: 1, Price: 100}, {Quantity: 1, Price: 100}, {Quantity: 1, Price: 100}},
+			discount: 32,
+			rates:    []uint32{500, 500, 500},
+			// 5% of 100-10, 100-10 and 100-12.
+			taxes: []uint64{5, 5, 4},
+		},
+		{
+			name:     "discount above subtotal",
+			region:   "US",
+			items:    []model.LineItem{{Quantity: 1, Price: 100}, {Quantity: 2, Price: 50}},
+			discount: 500,
+			rates:    []uint32{500, 500},
+			taxes:    []uint64{0, 0},
+		},
+		{
+			name:   "subdivision falls back to country",
+			region: "us-ny",
+			items:  []model.LineItem{{Quantity: 1, Price: 1000}},
+			rates:  []uint32{500},
+			taxes:  []uint64{50},
+		},
+	}
+
+	table := newTestTable(t)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := &model.Order{ShippingRegion: tt.region, LineItems: tt.items}
+			if tt.discount > 0 {
+				o.Discounts = []model.Discount{{Code: "SALE", Type: "fixed", Amount: tt.discount}}
+			}
+
+			if err := table.Apply(o, categories); err != nil {
+				t.Fatalf("Apply: %v", err)
+			}
+
+			if o.TaxInclusive != tt.inclusive {
+				t.Errorf("TaxInclusive = %v, want %v", o.TaxInclusive, tt.inclusive)
+			}
+			for i, item := range o.LineItems {
+				if item.TaxRate != tt.rates[i] || item.Tax != tt.taxes[i] {
+					t.Errorf("line item %d: rate %d, tax %d, want rate %d, tax %d",
+						i, item.TaxRate, item.Tax, tt.rates[i], tt.taxes[i])
+				}
+			}
+		})
+	}
+}
+
+func TestApplyUnknownRegion(t *testing.T) {
+	table := newTestTable(t)
+
+	for _, region := range []string{"FR", "FR-75", "CA-US", ""} {
+		o := &model.Order{ShippingRegion: region, LineItems: []model.LineItem{{Quantity: 1, Price: 100}}}
+		if err := table.Apply(o, nil); !errors.Is(err, ErrUnknownRegion) {
+			t.Errorf("Apply(%q) = %v, want %v", region, err, ErrUnknownRegion)
+		}
+	}
+}
+
+func TestLoadRejectsInvalidRates(t *testing.T) {
+	for _, rate := range []string{"-1", "100.5", "7.255", "seven"} {
+		path := filepath.Join(t.TempDir(), "tax.yaml")
+		data := "regions:\n  US:\n    rate: " + rate + "\n"
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := Load(path); err == nil {
+			t.Errorf("Load accepted rate %s", rate)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/umuttopalak/orders-api/events"
+	"github.com/umuttopalak/orders-api/logging"
+	"github.com/umuttopalak/orders-api/metrics"
+	"github.com/umuttopalak/orders-api/model"
+	webhookrepo "github.com/umuttopalak/orders-api/repository/webhook"
+	"github.com/umuttopalak/orders-api/worker"
+)
+
+// OrderEvents are the event types a webhook can subscribe to.
+var OrderEvents = []string{
+	events.OrderCreated,
+	events.OrderUpdated,
+	events.OrderShipped,
+	events.OrderCompleted,
+	events.OrderDeleted,
+	events.OrderPaid,
+	events.OrderPaymentFailed,
+	events.OrderRefunded,
+}
+
+// DeliverJob is the worker job type of a single webhook delivery.
+const DeliverJob = "webhook.deliver"
+
+// Dispatcher delivers order events to the subscribed webhooks. Every
+// delivery is a job on Queue, retried with exponential backoff until
+// MaxAttempts have been made and then moved to the webhook's dead letters.
+type Dispatcher struct {
+	Repo        *webhookrepo.RedisRepo
+	Queue       *worker.Queue
+	Client      *http.Client
+	MaxAttempts int
+	Backoff     time.Duration
+}
+
+type delivery struct {
+	DeliveryID string       `json:"delivery_id"`
+	WebhookID  uint64       `json:"webhook_id"`
+	Event      events.Event `json:"event"`
+}
+
+// HandleEvent is an events.Handler. It queues a delivery for every matching
+// webhook, so a slow receiver does not hold up the stream.
+func (d *Dispatcher) HandleEvent(ctx context.Context, e events.Event) error {
+	hooks, err := d.Repo.FindActive(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, hook := range hooks {
+		if len(hook.Events) > 0 && !slices.Contains(hook.Events, e.Type) {
+			continue
+		}
+
+		// The job ID keeps an event redelivered by the stream from being
+		// queued twice for the same webhook.
+		_, err := d.Queue.Enqueue(ctx, DeliverJob, delivery{
+			DeliveryID: uuid.NewString(),
+			WebhookID:  hook.WebhookID,
+			Event:      e,
+		}, worker.EnqueueOptions{
+			ID:          fmt.Sprintf("webhook:%d:%s", hook.WebhookID, e.ID),
+			MaxAttempts: d.MaxAttempts,
+			Backoff:     d.Backoff,
+		})
+		if err != nil && !errors.Is(err, worker.ErrDuplicate) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Deliver is the worker.Handler for DeliverJob. It makes one attempt and
+// records it in the webhook's delivery log.
+func (d *Dispatcher) Deliver(ctx context.Context, job worker.Job) error {
+	var dl delivery
+	if err := json.Unmarshal(job.Payload, &dl); err != nil {
+		return fmt.Errorf("failed to decode delivery: %w", err)
+	}
+
+	hook, err := d.Repo.FindByID(ctx, dl.WebhookID)
+	if errors.Is(err, webhookrepo.ErrNotExist) {
+		// Deleted webhooks take their pending deliveries with them.
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !hook.Active {
+		return nil
+	}
+
+	logger := logging.FromContext(ctx).With(
+		slog.Uint64("webhook_id", hook.WebhookID),
+		slog.String("delivery_id", dl.DeliveryID),
+	)
+
+	start := time.Now()
+	status, sendErr := d.send(ctx, hook, dl)
+
+	entry := model.WebhookDelivery{
+		DeliveryID: dl.DeliveryID,
+		WebhookID:  hook.WebhookID,
+		EventID:    dl.Event.ID,
+		EventType:  dl.Event.Type,
+		Attempt:    job.Attempt,
+		StatusCode: status,
+		Duration:   float64(time.Since(start).Microseconds()) / 1000,
+		Success:    sendErr == nil,
+		At:         start.UTC(),
+	}
+	if sendErr != nil {
+		entry.Error = sendErr.Error()
+	}
+
+	if err := d.Repo.LogDelivery(ctx, entry); err != nil {
+		logger.Error("failed to log webhook delivery", slog.Any("error", err))
+	}
+
+	switch {
+	case sendErr == nil:
+		metrics.WebhookDeliveries.WithLabelValues("success").Inc()
+		return nil
+
+	case job.Attempt < job.MaxAttempts:
+		metrics.WebhookDeliveries.WithLabelValues("retry").Inc()
+		return sendErr
+
+	default:
+		metrics.WebhookDeliveries.WithLabelValues("dead_letter").Inc()
+
+		payload, _ := json.Marshal(dl.Event)
+		letter := model.WebhookDeadLetter{
+			DeliveryID: dl.DeliveryID,
+			WebhookID:  hook.WebhookID,
+			Event:      payload,
+			Attempts:   job.Attempt,
+			LastError:  sendErr.Error(),
+			FailedAt:   time.Now().UTC(),
+		}
+		if err := d.Repo.DeadLetter(ctx, letter); err != nil {
+			logger.Error("failed to store webhook dead letter", slog.Any("error", err))
+		}
+		return sendErr
+	}
+}
+
+func (d *Dispatcher) send(ctx context.Context, hook model.Webhook, dl delivery) (int, error) {
+	body, err := json.Marshal(dl.Event)
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode event: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "orders-api-webhooks")
+	req.Header.Set("Webhook-Id", dl.DeliveryID)
+	req.Header.Set("Webhook-Event", dl.Event.Type)
+	req.Header.Set(SignatureHeader, Sign(hook.Secret, time.Now(), body))
+
+	res, err := d.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("receiver answered %s", res.Status)
+	}
+
+	return res.StatusCode, nil
+}
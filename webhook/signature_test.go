@@ -0,0 +1,56 @@
+package webhook
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSign(t *testing.T) {
+	body := []byte(`{"event":"order.created"}`)
+	got := Sign("whsec_test", time.Unix(1700000000, 0), body)
+	want := "t=1700000000,v1=44ccdd37cc0cde29381624e0495514ce79007393020fddb05c89075cd26cc6bd"
+	if got != want {
+		t.Errorf("Sign = %q, want %q", got, want)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	const secret = "whsec_test"
+	body := []byte(`{"event":"order.created"}`)
+	now := time.Now()
+	ts := strconv.FormatInt(now.Unix(), 10)
+
+	tests := []struct {
+		name   string
+		secret string
+		header string
+		body   []byte
+		ok     bool
+	}{
+		{"valid", secret, Sign(secret, now, body), body, true},
+		{"within tolerance", secret, Sign(secret, now.Add(-4*time.Minute), body), body, true},
+		{"fields reordered", secret, "v1=" + mac(secret, ts, body) + ",t=" + ts, body, true},
+		{"wrong secret", "other", Sign(secret, now, body), body, false},
+		{"tampered body", secret, Sign(secret, now, body), []byte(`{"event":"order.deleted"}`), false},
+		{"replayed with new timestamp", secret, "t=" + ts + ",v1=" + mac(secret, "1700000000", body), body, false},
+		{"too old", secret, Sign(secret, now.Add(-6*time.Minute), body), body, false},
+		{"too far ahead", secret, Sign(secret, now.Add(6*time.Minute), body), body, false},
+		{"missing signature", secret, "t=" + ts, body, false},
+		{"missing timestamp", secret, "v1=" + mac(secret, ts, body), body, false},
+		{"empty", secret, "", body, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Verify(tt.secret, tt.header, tt.body, 5*time.Minute)
+			if tt.ok && err != nil {
+				t.Errorf("Verify: %v", err)
+			}
+			if !tt.ok && !errors.Is(err, ErrInvalidSignature) {
+				t.Errorf("Verify error = %v, want %v", err, ErrInvalidSignature)
+			}
+		})
+	}
+}
@@ -0,0 +1,304 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// Job is a unit of work in the queue. The payload is opaque to the queue
+// and decoded by the handler registered for Type.
+type Job struct {
+	ID          string          `json:"id"`
+	Type        string          `json:"type"`
+	Payload     json.RawMessage `json:"payload"`
+	MaxAttempts int             `json:"max_attempts"`
+	// Backoff is the delay before the first retry. It doubles with every
+	// further one.
+	Backoff    time.Duration `json:"backoff"`
+	EnqueuedAt time.Time     `json:"enqueued_at"`
+
+	// Attempt counts deliveries of the job, including the current one.
+	Attempt int `json:"-"`
+}
+
+type EnqueueOptions struct {
+	// ID deduplicates jobs: a job is not enqueued while another with the
+	// same ID is queued or running. Empty generates a random ID.
+	ID          string
+	Delay       time.Duration
+	MaxAttempts int
+	Backoff     time.Duration
+}
+
+const (
+	defaultMaxAttempts = 5
+	defaultBackoff     = 5 * time.Second
+	maxBackoff         = time.Hour
+
+	maxDeadJobs = 1000
+)
+
+var ErrDuplicate = errors.New("job with this ID is already queued")
+
+// Queue is a Redis job queue with at-least-once delivery. A dequeued job is
+// invisible to other workers for VisibilityTimeout. If it is neither acked
+// nor retried by then, because the worker died, it is handed out again.
+//
+// Keys, all prefixed with queue:<name>:
+//
+//	jobs       hash of job ID to job JSON
+//	attempts   hash of job ID to delivery count
+//	scheduled  sorted set of job IDs by the time they are due
+//	inflight   sorted set of job IDs by the time their visibility ends
+//	dead       list of jobs that ran out of attempts, newest first
+type Queue struct {
+	Client            *redis.Client
+	Name              string
+	VisibilityTimeout time.Duration
+}
+
+func (q *Queue) key(part string) string {
+	return fmt.Sprintf("queue:%s:%s", q.Name, part)
+}
+
+// All scripts use Redis TIME so that workers with skewed clocks agree on
+// when jobs are due.
+var enqueueScript = redis.NewScript(`
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+
+if redis.call('HSETNX', KEYS[1], ARGV[1], ARGV[2]) == 0 then
+	return 0
+end
+redis.call('ZADD', KEYS[2], now + tonumber(ARGV[3]), ARGV[1])
+return 1
+`)
+
+var dequeueScript = redis.NewScript(`
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+
+local expired = redis.call('ZRANGEBYSCORE', KEYS[2], '-inf', now, 'LIMIT', 0, 100)
+for _, id in ipairs(expired) do
+	redis.call('ZREM', KEYS[2], id)
+	redis.call('ZADD', KEYS[1], now, id)
+end
+
+while true do
+	local ids = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', now, 'LIMIT', 0, 1)
+	if #ids == 0 then
+		return false
+	end
+
+	local id = ids[1]
+	redis.call('ZREM', KEYS[1], id)
+
+	local data = redis.call('HGET', KEYS[3], id)
+	if data then
+		local attempt = redis.call('HINCRBY', KEYS[4], id, 1)
+		redis.call('ZADD', KEYS[2], now + tonumber(ARGV[1]), id)
+		return {data, attempt}
+	end
+end
+`)
+
+// retryScript moves an in-flight job back to the scheduled set. It does
+// nothing if the job is no longer in flight, which happens when its
+// visibility ran out and another worker has taken it over.
+var retryScript = redis.NewScript(`
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+
+if redis.call('ZREM', KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+if ARGV[3] == '1' then
+	redis.call('HINCRBY', KEYS[3], ARGV[1], -1)
+end
+redis.call('ZADD', KEYS[2], now + tonumber(ARGV[2]), ARGV[1])
+return 1
+`)
+
+var touchScript = redis.NewScript(`
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+
+return redis.call('ZADD', KEYS[1], 'XX', 'CH', now + tonumber(ARGV[2]), ARGV[1])
+`)
+
+func (q *Queue) Enqueue(ctx context.Context, jobType string, payload any, opts EnqueueOptions) (Job, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return Job{}, fmt.Errorf("failed to encode %s payload: %w", jobType, err)
+	}
+
+	job := Job{
+		ID:          opts.ID,
+		Type:        jobType,
+		Payload:     data,
+		MaxAttempts: opts.MaxAttempts,
+		Backoff:     opts.Backoff,
+		EnqueuedAt:  time.Now().UTC(),
+	}
+	if job.ID == "" {
+		job.ID = uuid.NewString()
+	}
+	if job.MaxAttempts <= 0 {
+		job.MaxAttempts = defaultMaxAttempts
+	}
+	if job.Backoff <= 0 {
+		job.Backoff = defaultBackoff
+	}
+
+	encoded, err := json.Marshal(job)
+	if err != nil {
+		return Job{}, fmt.Errorf("failed to encode job: %w", err)
+	}
+
+	added, err := enqueueScript.Run(ctx, q.Client,
+		[]string{q.key("jobs"), q.key("scheduled")},
+		job.ID, string(encoded), opts.Delay.Milliseconds(),
+	).Int()
+	if err != nil {
+		return Job{}, fmt.Errorf("failed to enqueue %s: %w", jobType, err)
+	}
+	if added == 0 {
+		return Job{}, ErrDuplicate
+	}
+
+	return job, nil
+}
+
+// Dequeue takes the next due job, reporting false when there is none.
+func (q *Queue) Dequeue(ctx context.Context) (Job, bool, error) {
+	res, err := dequeueScript.Run(ctx, q.Client,
+		[]string{q.key("scheduled"), q.key("inflight"), q.key("jobs"), q.key("attempts")},
+		q.VisibilityTimeout.Milliseconds(),
+	).Slice()
+	if errors.Is(err, redis.Nil) {
+		return Job{}, false, nil
+	} else if err != nil {
+		return Job{}, false, fmt.Errorf("failed to dequeue: %w", err)
+	}
+
+	data, _ := res[0].(string)
+	attempt, _ := res[1].(int64)
+
+	var job Job
+	if err := json.Unmarshal([]byte(data), &job); err != nil {
+		return Job{}, false, fmt.Errorf("failed to decode job: %w", err)
+	}
+	job.Attempt = int(attempt)
+
+	return job, true, nil
+}
+
+// Ack removes a finished job.
+func (q *Queue) Ack(ctx context.Context, job Job) error {
+	_, err := q.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRem(ctx, q.key("inflight"), job.ID)
+		pipe.HDel(ctx, q.key("jobs"), job.ID)
+		pipe.HDel(ctx, q.key("attempts"), job.ID)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to ack job %s: %w", job.ID, err)
+	}
+	return nil
+}
+
+// Retry schedules a failed job again after its backoff.
+func (q *Queue) Retry(ctx context.Context, job Job) error {
+	return q.reschedule(ctx, job, backoff(job.Backoff, job.Attempt), false)
+}
+
+// Release puts a job that was interrupted by shutdown back without
+// counting the attempt.
+func (q *Queue) Release(ctx context.Context, job Job) error {
+	return q.reschedule(ctx, job, 0, true)
+}
+
+func (q *Queue) reschedule(ctx context.Context, job Job, delay time.Duration, uncount bool) error {
+	flag := "0"
+	if uncount {
+		flag = "1"
+	}
+
+	err := retryScript.Run(ctx, q.Client,
+		[]string{q.key("inflight"), q.key("scheduled"), q.key("attempts")},
+		job.ID, delay.Milliseconds(), flag,
+	).Err()
+	if err != nil {
+		return fmt.Errorf("failed to reschedule job %s: %w", job.ID, err)
+	}
+	return nil
+}
+
+// Touch extends the visibility of a job that is still running.
+func (q *Queue) Touch(ctx context.Context, job Job) error {
+	err := touchScript.Run(ctx, q.Client,
+		[]string{q.key("inflight")},
+		job.ID, q.VisibilityTimeout.Milliseconds(),
+	).Err()
+	if err != nil {
+		return fmt.Errorf("failed to extend job %s: %w", job.ID, err)
+	}
+	return nil
+}
+
+type DeadJob struct {
+	Job      Job       `json:"job"`
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+// Bury moves a job that ran out of attempts to the dead list.
+func (q *Queue) Bury(ctx context.Context, job Job, cause error) error {
+	data, err := json.Marshal(DeadJob{
+		Job:      job,
+		Attempts: job.Attempt,
+		Error:    cause.Error(),
+		FailedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode dead job: %w", err)
+	}
+
+	_, err = q.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRem(ctx, q.key("inflight"), job.ID)
+		pipe.HDel(ctx, q.key("jobs"), job.ID)
+		pipe.HDel(ctx, q.key("attempts"), job.ID)
+		pipe.LPush(ctx, q.key("dead"), string(data))
+		pipe.LTrim(ctx, q.key("dead"), 0, maxDeadJobs-1)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to bury job %s: %w", job.ID, err)
+	}
+	return nil
+}
+
+// backoff doubles base with every attempt, up to maxBackoff, and spreads
+// retries by up to a fifth either way so a recovering dependency is not hit
+// by every retry at once.
+func backoff(base time.Duration, attempt int) time.Duration {
+	delay := base
+	for i := 1; i < attempt && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	delay = min(delay, maxBackoff)
+
+	jitter := time.Duration(rand.Int63n(int64(delay)/5 + 1))
+	if rand.Intn(2) == 0 {
+		return delay - jitter
+	}
+	return delay + jitter
+}
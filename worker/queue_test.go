@@ -0,0 +1,277 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		name    string
+		base    time.Duration
+		attempt int
+		want    time.Duration
+	}{
+		{"first retry", 5 * time.Second, 1, 5 * time.Second},
+		{"second retry", 5 * time.Second, 2, 10 * time.Second},
+		{"fifth retry", 5 * time.Second, 5, 80 * time.Second},
+		{"capped", 5 * time.Second, 20, maxBackoff},
+		{"many attempts", time.Second, 1000, maxBackoff},
+		{"base above cap", 2 * time.Hour, 1, maxBackoff},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The jitter spreads retries by up to a fifth either way.
+			lo, hi := tt.want-tt.want/5, tt.want+tt.want/5
+			for i := 0; i < 100; i++ {
+				if got := backoff(tt.base, tt.attempt); got < lo || got > hi {
+					t.Fatalf("backoff(%v, %d) = %v, want within [%v, %v]", tt.base, tt.attempt, got, lo, hi)
+				}
+			}
+		})
+	}
+}
+
+func TestBackoffJitters(t *testing.T) {
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		seen[backoff(5*time.Second, 3)] = true
+	}
+
+	if len(seen) < 2 {
+		t.Errorf("backoff returned the same delay 100 times, want jitter")
+	}
+}
+
+// testRedis is a miniredis whose clock, which the scripts read with TIME,
+// only moves when advanced.
+type testRedis struct {
+	*miniredis.Miniredis
+	now time.Time
+}
+
+func (r *testRedis) advance(d time.Duration) {
+	r.now = r.now.Add(d)
+	r.SetTime(r.now)
+}
+
+func newTestQueue(t *testing.T) (*Queue, *testRedis) {
+	t.Helper()
+
+	mr := &testRedis{Miniredis: miniredis.RunT(t), now: time.Date(2026, time.October, 19, 12, 0, 0, 0, time.UTC)}
+	mr.SetTime(mr.now)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	return &Queue{Client: client, Name: "test", VisibilityTimeout: time.Minute}, mr
+}
+
+func dequeue(t *testing.T, q *Queue) (Job, bool) {
+	t.Helper()
+
+	job, ok, err := q.Dequeue(context.Background())
+	if err != nil {
+		t.Fatalf("Dequeue: %v", err)
+	}
+	return job, ok
+}
+
+func TestEnqueue(t *testing.T) {
+	q, _ := newTestQueue(t)
+	ctx := context.Background()
+
+	job, err := q.Enqueue(ctx, "test.job", map[string]int{"n": 1}, EnqueueOptions{})
+	if err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	if job.ID == "" || job.MaxAttempts != defaultMaxAttempts || job.Backoff != defaultBackoff {
+		t.Errorf("job = %+v, want a generated ID and the default attempts and backoff", job)
+	}
+
+	got, ok := dequeue(t, q)
+	if !ok || got.ID != job.ID || got.Type != "test.job" || string(got.Payload) != `{"n":1}` || got.Attempt != 1 {
+		t.Errorf("dequeued %+v, %v, want the job on its first attempt", got, ok)
+	}
+	if _, ok := dequeue(t, q); ok {
+		t.Error("dequeued a job twice")
+	}
+}
+
+func TestEnqueueDuplicate(t *testing.T) {
+	q, _ := newTestQueue(t)
+	ctx := context.Background()
+	opts := EnqueueOptions{ID: "job-1"}
+
+	if _, err := q.Enqueue(ctx, "test.job", 1, opts); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	if _, err := q.Enqueue(ctx, "test.job", 2, opts); !errors.Is(err, ErrDuplicate) {
+		t.Errorf("Enqueue while queued = %v, want %v", err, ErrDuplicate)
+	}
+
+	job, _ := dequeue(t, q)
+	if _, err := q.Enqueue(ctx, "test.job", 2, opts); !errors.Is(err, ErrDuplicate) {
+		t.Errorf("Enqueue while running = %v, want %v", err, ErrDuplicate)
+	}
+
+	if err := q.Ack(ctx, job); err != nil {
+		t.Fatalf("Ack: %v", err)
+	}
+	if _, err := q.Enqueue(ctx, "test.job", 2, opts); err != nil {
+		t.Errorf("Enqueue after ack = %v, want nil", err)
+	}
+}
+
+func TestEnqueueDelay(t *testing.T) {
+	q, mr := newTestQueue(t)
+
+	if _, err := q.Enqueue(context.Background(), "test.job", 1, EnqueueOptions{Delay: time.Minute}); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+
+	mr.advance(59 * time.Second)
+	if _, ok := dequeue(t, q); ok {
+		t.Error("dequeued a job before its delay")
+	}
+
+	mr.advance(time.Second)
+	if _, ok := dequeue(t, q); !ok {
+		t.Error("job not dequeued once due")
+	}
+}
+
+func TestDequeueVisibility(t *testing.T) {
+	q, mr := newTestQueue(t)
+	ctx := context.Background()
+
+	if _, err := q.Enqueue(ctx, "test.job", 1, EnqueueOptions{}); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	job, _ := dequeue(t, q)
+
+	// The worker keeps the job alive for a while, then dies.
+	mr.advance(50 * time.Second)
+	if err := q.Touch(ctx, job); err != nil {
+		t.Fatalf("Touch: %v", err)
+	}
+	mr.advance(50 * time.Second)
+	if _, ok := dequeue(t, q); ok {
+		t.Fatal("touched job handed out again")
+	}
+
+	mr.advance(10 * time.Second)
+	again, ok := dequeue(t, q)
+	if !ok || again.ID != job.ID || again.Attempt != 2 {
+		t.Fatalf("dequeued %+v, %v after the visibility ran out, want the job on its second attempt", again, ok)
+	}
+
+	// A late retry by the first worker, after the second finished the job,
+	// must not bring it back.
+	if err := q.Ack(ctx, again); err != nil {
+		t.Fatalf("Ack: %v", err)
+	}
+	if err := q.Retry(ctx, job); err != nil {
+		t.Fatalf("Retry: %v", err)
+	}
+	mr.advance(time.Hour)
+	if _, ok := dequeue(t, q); ok {
+		t.Error("acked job handed out again after a late retry")
+	}
+}
+
+func TestRetryAndRelease(t *testing.T) {
+	tests := []struct {
+		name    string
+		release bool
+		early   time.Duration
+		due     time.Duration
+		attempt int
+	}{
+		// The first retry waits the backoff, give or take a fifth.
+		{"retry", false, 7 * time.Second, 13 * time.Second, 2},
+		{"release", true, 0, 0, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, mr := newTestQueue(t)
+			ctx := context.Background()
+
+			if _, err := q.Enqueue(ctx, "test.job", 1, EnqueueOptions{Backoff: 10 * time.Second}); err != nil {
+				t.Fatalf("Enqueue: %v", err)
+			}
+			job, _ := dequeue(t, q)
+
+			var err error
+			if tt.release {
+				err = q.Release(ctx, job)
+			} else {
+				err = q.Retry(ctx, job)
+			}
+			if err != nil {
+				t.Fatalf("reschedule: %v", err)
+			}
+
+			if tt.early > 0 {
+				mr.advance(tt.early)
+				if _, ok := dequeue(t, q); ok {
+					t.Fatal("dequeued before the backoff")
+				}
+			}
+			mr.advance(tt.due - tt.early)
+
+			again, ok := dequeue(t, q)
+			if !ok || again.Attempt != tt.attempt {
+				t.Errorf("dequeued %+v, %v, want attempt %d", again, ok, tt.attempt)
+			}
+		})
+	}
+}
+
+func TestBury(t *testing.T) {
+	q, mr := newTestQueue(t)
+	ctx := context.Background()
+
+	if _, err := q.Enqueue(ctx, "test.job", 1, EnqueueOptions{ID: "job-1", MaxAttempts: 1}); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	job, _ := dequeue(t, q)
+
+	if err := q.Bury(ctx, job, errors.New("receiver answered 500")); err != nil {
+		t.Fatalf("Bury: %v", err)
+	}
+
+	mr.advance(2 * q.VisibilityTimeout)
+	if _, ok := dequeue(t, q); ok {
+		t.Error("buried job handed out again")
+	}
+	for _, part := range []string{"jobs", "attempts", "inflight", "scheduled"} {
+		if mr.Exists(q.key(part)) {
+			t.Errorf("%s still holds the buried job", q.key(part))
+		}
+	}
+
+	dead, err := mr.List(q.key("dead"))
+	if err != nil || len(dead) != 1 {
+		t.Fatalf("dead = %v, %v, want one job", dead, err)
+	}
+	var got DeadJob
+	if err := json.Unmarshal([]byte(dead[0]), &got); err != nil {
+		t.Fatalf("decode dead job: %v", err)
+	}
+	if got.Job.ID != "job-1" || got.Attempts != 1 || got.Error != "receiver answered 500" {
+		t.Errorf("dead job = %+v", got)
+	}
+
+	// The ID is free again.
+	if _, err := q.Enqueue(ctx, "test.job", 1, EnqueueOptions{ID: "job-1"}); err != nil {
+		t.Errorf("Enqueue after bury = %v, want nil", err)
+	}
+}
@@ -0,0 +1,201 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/umuttopalak/orders-api/logging"
+	"github.com/umuttopalak/orders-api/metrics"
+)
+
+// Handler runs one job. A returned error retries the job after its backoff
+// until MaxAttempts deliveries have been made, after which the job is moved
+// to the dead list. Since a job is delivered at least once, handlers must
+// tolerate running the same job again.
+type Handler interface {
+	Handle(ctx context.Context, job Job) error
+}
+
+type HandlerFunc func(ctx context.Context, job Job) error
+
+func (f HandlerFunc) Handle(ctx context.Context, job Job) error {
+	return f(ctx, job)
+}
+
+var errNoHandler = errors.New("no handler for job type")
+
+// Runner pulls jobs from Queue and runs them on up to Concurrency
+// goroutines. When the context passed to Run is cancelled it stops taking
+// jobs and gives the running ones DrainTimeout to finish. Jobs still running
+// after that are cancelled and put back on the queue without counting the
+// attempt, so the next instance picks them up.
+type Runner struct {
+	Queue        *Queue
+	Concurrency  int
+	PollInterval time.Duration
+	DrainTimeout time.Duration
+
+	handlers map[string]Handler
+}
+
+// Handle registers h for jobs of jobType. It must be called before Run.
+func (r *Runner) Handle(jobType string, h Handler) {
+	if r.handlers == nil {
+		r.handlers = make(map[string]Handler)
+	}
+	r.handlers[jobType] = h
+}
+
+// Run blocks until ctx is cancelled and the running jobs have drained.
+func (r *Runner) Run(ctx context.Context) {
+	// Jobs outlive ctx by up to DrainTimeout, so they get a context that
+	// keeps its values but is only cancelled when the drain runs out.
+	jobCtx, cancelJobs := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelJobs()
+
+	var wg sync.WaitGroup
+	for i := 0; i < max(r.Concurrency, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.work(ctx, jobCtx)
+		}()
+	}
+
+	<-ctx.Done()
+
+	drained := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(drained)
+	}()
+
+	timer := time.NewTimer(r.DrainTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-drained:
+	case <-timer.C:
+		logging.FromContext(ctx).Warn("jobs did not finish in time, cancelling")
+		cancelJobs()
+		<-drained
+	}
+}
+
+func (r *Runner) work(ctx, jobCtx context.Context) {
+	for {
+		if ctx.Err() != nil {
+			return
+		}
+
+		job, ok, err := r.Queue.Dequeue(ctx)
+		if err != nil && ctx.Err() == nil {
+			logging.FromContext(ctx).Error("failed to dequeue job", slog.Any("error", err))
+		}
+		if !ok {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(r.PollInterval):
+			}
+			continue
+		}
+
+		r.run(jobCtx, job)
+	}
+}
+
+func (r *Runner) run(ctx context.Context, job Job) {
+	logger := logging.FromContext(ctx).With(
+		slog.String("job_id", job.ID),
+		slog.String("job_type", job.Type),
+		slog.Int("attempt", job.Attempt),
+	)
+	ctx = logging.WithLogger(ctx, logger)
+
+	stopHeartbeat := r.heartbeat(ctx, job)
+	err := r.call(ctx, job)
+	stopHeartbeat()
+
+	// Queue bookkeeping must happen even for jobs cancelled by shutdown.
+	store := context.WithoutCancel(ctx)
+
+	var result string
+	switch {
+	case err == nil:
+		result = "success"
+		err = r.Queue.Ack(store, job)
+
+	case ctx.Err() != nil:
+		result = "released"
+		logger.Warn("job interrupted by shutdown", slog.Any("error", err))
+		err = r.Queue.Release(store, job)
+
+	case job.Attempt < job.MaxAttempts:
+		result = "retry"
+		logger.Warn("job failed, retrying", slog.Any("error", err))
+		err = r.Queue.Retry(store, job)
+
+	default:
+		result = "dead"
+		logger.Error("job failed, giving up", slog.Any("error", err))
+		err = r.Queue.Bury(store, job, err)
+	}
+
+	metrics.WorkerJobs.WithLabelValues(job.Type, result).Inc()
+	if err != nil {
+		logger.Error("failed to update job", slog.Any("error", err))
+	}
+}
+
+func (r *Runner) call(ctx context.Context, job Job) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = fmt.Errorf("panic: %v", v)
+			logging.FromContext(ctx).Error("job panicked",
+				slog.Any("panic", v),
+				slog.String("stack", string(debug.Stack())),
+			)
+		}
+	}()
+
+	h, ok := r.handlers[job.Type]
+	if !ok {
+		return fmt.Errorf("%w %q", errNoHandler, job.Type)
+	}
+	return h.Handle(ctx, job)
+}
+
+// heartbeat keeps a long job invisible to other workers while it runs.
+func (r *Runner) heartbeat(ctx context.Context, job Job) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(r.Queue.VisibilityTimeout / 2)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := r.Queue.Touch(ctx, job); err != nil && ctx.Err() == nil {
+					logging.FromContext(ctx).Error("failed to extend job visibility", slog.Any("error", err))
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}